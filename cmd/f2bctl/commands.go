@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/archive"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/client"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errUsage = errors.New("invalid usage")
+
+// legacyExport is the format of exports before the versioned archive
+type legacyExport struct {
+	Policy    blocker.Policy           `json:"policy"`
+	Blocks    []storage.BlockEntry     `json:"blocks"`
+	Modules   []storage.ExternalModule `json:"modules"`
+	Allowlist []storage.AllowEntry     `json:"allowlist"`
+}
+
+func (cmd *command) run(name string, args []string) error {
+	switch name {
+	case "status":
+		return cmd.status()
+	case "block":
+		return cmd.block(args)
+	case "unblock":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return cmd.unblock(args[0])
+	case "list":
+		return cmd.list(args)
+	case "policy":
+		return cmd.policy(args)
+	case "module":
+		return cmd.module(args)
+	case "allowlist":
+		return cmd.allowlist(args)
+	case "key":
+		return cmd.key(args)
+	case "audit":
+		return cmd.audit(args)
+	case "export":
+		return cmd.export(args)
+	case "import":
+		return cmd.importData(args)
+	default:
+		return errUsage
+	}
+}
+
+func (cmd *command) status() error {
+	policy, err := cmd.c.Policy(cmd.ctx)
+	if err != nil {
+		return err
+	}
+
+	blocks, err := cmd.c.Blocks(cmd.ctx)
+	if err != nil {
+		return err
+	}
+
+	sources, err := cmd.c.Sources(cmd.ctx)
+	if err != nil {
+		return err
+	}
+
+	modules, err := cmd.c.Modules(cmd.ctx)
+	if err != nil {
+		return err
+	}
+
+	if cmd.output == "json" {
+		return printJSON(struct {
+			Policy       blocker.Policy `json:"policy"`
+			ActiveBlocks int            `json:"active_blocks"`
+			Sources      int            `json:"sources"`
+			Modules      int            `json:"modules"`
+		}{policy, len(blocks), len(sources), len(modules)})
+	}
+
+	return printTable([]string{"KEY", "VALUE"}, [][]string{
+		{"policy attempts", strconv.Itoa(policy.Attempts)},
+		{"policy period", policy.Period.String()},
+		{"policy block time", policy.BlockTime.String()},
+		{"active blocks", strconv.Itoa(len(blocks))},
+		{"sources", strconv.Itoa(len(sources))},
+		{"modules", strconv.Itoa(len(modules))},
+	})
+}
+
+func (cmd *command) block(args []string) error {
+	flags := flag.NewFlagSet("block", flag.ContinueOnError)
+	duration := flags.Duration("duration", 0, "duration of the block, the active policy is used when omitted")
+	permanent := flags.Bool("permanent", false, "block permanently")
+	reason := flags.String("reason", "", "reason of the block")
+	tags := flags.String("tags", "", "comma separated tags of the block")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	req := client.BlockRequest{
+		Duration:  *duration,
+		Permanent: *permanent,
+		Reason:    *reason,
+	}
+	if *tags != "" {
+		req.Tags = strings.Split(*tags, ",")
+	}
+
+	entry, err := cmd.c.Block(cmd.ctx, flags.Arg(0), req)
+	if err != nil {
+		return err
+	}
+
+	return cmd.printBlocks([]storage.BlockEntry{entry})
+}
+
+func (cmd *command) unblock(ip string) error {
+	if err := cmd.c.Unblock(cmd.ctx, ip); err != nil {
+		return err
+	}
+
+	return cmd.printResult(fmt.Sprintf("%v was unblocked", ip))
+}
+
+func (cmd *command) list(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch {
+	case args[0] == "blocks" && len(args) == 1:
+		blocks, err := cmd.c.Blocks(cmd.ctx)
+		if err != nil {
+			return err
+		}
+
+		return cmd.printBlocks(blocks)
+	case args[0] == "entries" && len(args) == 1:
+		sources, err := cmd.c.Sources(cmd.ctx)
+		if err != nil {
+			return err
+		}
+
+		if cmd.output == "json" {
+			return printJSON(sources)
+		}
+
+		rows := make([][]string, 0, len(sources))
+		for source, count := range sources {
+			rows = append(rows, []string{source, strconv.Itoa(count)})
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			return rows[i][0] < rows[j][0]
+		})
+
+		return printTable([]string{"SOURCE", "ATTEMPTS"}, rows)
+	case args[0] == "entries" && len(args) == 2:
+		entries, err := cmd.c.Entries(cmd.ctx, args[1])
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Timestamp.Time().Before(entries[j].Timestamp.Time())
+		})
+
+		if cmd.output == "json" {
+			return printJSON(entries)
+		}
+
+		rows := make([][]string, 0, len(entries))
+		for _, e := range entries {
+			rows = append(rows, []string{e.Source, e.Service, formatTime(e.Timestamp.Time())})
+		}
+
+		return printTable([]string{"SOURCE", "SERVICE", "TIMESTAMP"}, rows)
+	default:
+		return errUsage
+	}
+}
+
+func (cmd *command) policy(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	policy, err := cmd.c.Policy(cmd.ctx)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "get":
+		if len(args) != 1 {
+			return errUsage
+		}
+	case "set":
+		flags := flag.NewFlagSet("policy set", flag.ContinueOnError)
+		flags.IntVar(&policy.Attempts, "attempts", policy.Attempts, "amount of attempts before a source is blocked")
+		flags.DurationVar(&policy.Period, "period", policy.Period, "period in which attempts are counted")
+		flags.DurationVar(&policy.BlockTime, "blocktime", policy.BlockTime, "duration of a block")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+			return errUsage
+		}
+
+		if err := cmd.c.UpdatePolicy(cmd.ctx, policy); err != nil {
+			return err
+		}
+	default:
+		return errUsage
+	}
+
+	if cmd.output == "json" {
+		return printJSON(policy)
+	}
+
+	return printTable([]string{"ATTEMPTS", "PERIOD", "BLOCKTIME"}, [][]string{
+		{strconv.Itoa(policy.Attempts), policy.Period.String(), policy.BlockTime.String()},
+	})
+}
+
+func (cmd *command) module(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("module add", flag.ContinueOnError)
+		method := flags.String("method", http.MethodPost, "HTTP method used to notify the module")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+			return errUsage
+		}
+
+		module, err := cmd.c.AddModule(cmd.ctx, flags.Arg(0), *method)
+		if err != nil {
+			return err
+		}
+
+		return cmd.printModules([]storage.ExternalModule{module})
+	case "list":
+		modules, err := cmd.c.Modules(cmd.ctx)
+		if err != nil {
+			return err
+		}
+
+		return cmd.printModules(modules)
+	case "remove":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		id, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return errors.Wrapf(err, "%v is not a valid module id", args[1])
+		}
+
+		if err := cmd.c.RemoveModule(cmd.ctx, uint32(id)); err != nil {
+			return err
+		}
+
+		return cmd.printResult(fmt.Sprintf("module %v was removed", id))
+	default:
+		return errUsage
+	}
+}
+
+func (cmd *command) allowlist(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("allowlist add", flag.ContinueOnError)
+		description := flags.String("description", "", "description of the entry")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+			return errUsage
+		}
+
+		entry := storage.AllowEntry{
+			Source:      flags.Arg(0),
+			Description: *description,
+		}
+		if err := cmd.c.AddAllowEntry(cmd.ctx, entry); err != nil {
+			return err
+		}
+
+		return cmd.printAllowlist([]storage.AllowEntry{entry})
+	case "list":
+		entries, err := cmd.c.Allowlist(cmd.ctx)
+		if err != nil {
+			return err
+		}
+
+		return cmd.printAllowlist(entries)
+	case "remove":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		if err := cmd.c.RemoveAllowEntry(cmd.ctx, args[1]); err != nil {
+			return err
+		}
+
+		return cmd.printResult(fmt.Sprintf("%v was removed from the allowlist", args[1]))
+	default:
+		return errUsage
+	}
+}
+
+func (cmd *command) key(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("key add", flag.ContinueOnError)
+		scopes := flags.String("scopes", "read", "comma separated scopes of the key: read, report-entries, block or admin")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+			return errUsage
+		}
+
+		key, err := cmd.c.CreateApiKey(cmd.ctx, flags.Arg(0), strings.Split(*scopes, ","))
+		if err != nil {
+			return err
+		}
+
+		if cmd.output == "json" {
+			return printJSON(key)
+		}
+
+		return printTable([]string{"NAME", "SCOPES", "KEY"}, [][]string{
+			{key.Name, strings.Join(key.Scopes, ","), key.Key},
+		})
+	case "list":
+		keys, err := cmd.c.ApiKeys(cmd.ctx)
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].Name < keys[j].Name
+		})
+
+		if cmd.output == "json" {
+			return printJSON(keys)
+		}
+
+		rows := make([][]string, 0, len(keys))
+		for _, k := range keys {
+			rows = append(rows, []string{k.Name, strings.Join(k.Scopes, ","), formatTime(k.Created.Time())})
+		}
+
+		return printTable([]string{"NAME", "SCOPES", "CREATED"}, rows)
+	case "remove":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		if err := cmd.c.RemoveApiKey(cmd.ctx, args[1]); err != nil {
+			return err
+		}
+
+		return cmd.printResult(fmt.Sprintf("API key %v was removed", args[1]))
+	default:
+		return errUsage
+	}
+}
+
+func (cmd *command) audit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	since := flags.Duration("since", 24*time.Hour, "only show entries of this period")
+	source := flags.String("source", "", "only show entries of this source")
+	action := flags.String("action", "", "only show entries of this action, for example block or policy_update")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	entries, err := cmd.c.AuditLog(cmd.ctx, storage.AuditQuery{
+		From:   time.Now().Add(-*since),
+		Source: *source,
+		Action: *action,
+	})
+	if err != nil {
+		return err
+	}
+
+	if cmd.output == "json" {
+		return printJSON(entries)
+	}
+
+	rows := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, []string{formatTime(e.Timestamp.Time()), e.Action, e.Trigger, e.Actor, e.Source, e.Details})
+	}
+
+	return printTable([]string{"TIME", "ACTION", "TRIGGER", "ACTOR", "SOURCE", "DETAILS"}, rows)
+}
+
+func (cmd *command) export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	file := flags.String("file", "", "file to write the archive to, stdout is used when omitted")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	a, err := cmd.c.Export(cmd.ctx)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal archive")
+	}
+
+	if *file == "" {
+		_, err := fmt.Println(string(buf))
+		return err
+	}
+
+	return errors.Wrap(ioutil.WriteFile(*file, buf, 0600), "failed to write archive")
+}
+
+func (cmd *command) importData(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := flags.String("file", "", "file to read the archive from, stdin is used when omitted")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	var buf []byte
+	var err error
+	if *file == "" {
+		buf, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		buf, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read archive")
+	}
+
+	// Exports of older versions have no version, and are imported using the regular API
+	var a archive.Archive
+	if err := json.Unmarshal(buf, &a); err != nil {
+		return errors.Wrap(err, "failed to decode archive")
+	}
+	if a.Version == 0 {
+		return cmd.importLegacy(buf)
+	}
+
+	summary, err := cmd.c.Import(cmd.ctx, a)
+	if err != nil {
+		return err
+	}
+
+	if cmd.output == "json" {
+		return printJSON(summary)
+	}
+	return cmd.printResult(fmt.Sprintf("imported %v entries, %v blocks, %v modules, %v allowlist entries, "+
+		"%v API keys and %v audit entries, skipped %v blocks on the allowlist", summary.Entries, summary.Blocks,
+		summary.Modules, summary.Allowlist, summary.ApiKeys, summary.Audit, summary.AllowedBlocks))
+}
+
+// importLegacy imports an export of an older version, which contains the policy, blocks, modules and allowlist
+func (cmd *command) importLegacy(buf []byte) error {
+	var d legacyExport
+	if err := json.Unmarshal(buf, &d); err != nil {
+		return errors.Wrap(err, "failed to decode export")
+	}
+
+	if err := cmd.c.UpdatePolicy(cmd.ctx, d.Policy); err != nil {
+		return errors.Wrap(err, "failed to import policy")
+	}
+
+	for _, e := range d.Allowlist {
+		if err := cmd.c.AddAllowEntry(cmd.ctx, e); err != nil {
+			return errors.Wrapf(err, "failed to import allowlist entry %v", e.Source)
+		}
+	}
+
+	for _, m := range d.Modules {
+		if _, err := cmd.c.AddModule(cmd.ctx, m.Address, m.Method); err != nil {
+			return errors.Wrapf(err, "failed to import module %v", m.Address)
+		}
+	}
+
+	// Blocks are recreated with their remaining duration, expired blocks are skipped
+	imported := 0
+	for _, e := range d.Blocks {
+		req := client.BlockRequest{
+			Permanent: e.Permanent,
+			Reason:    e.Reason,
+			Tags:      e.Tags,
+		}
+		if !e.Permanent {
+			req.Duration = time.Until(e.Timestamp.Time().Add(e.Duration))
+			if req.Duration <= 0 {
+				continue
+			}
+		}
+
+		if _, err := cmd.c.Block(cmd.ctx, e.Source, req); err != nil {
+			return errors.Wrapf(err, "failed to import block of %v", e.Source)
+		}
+		imported++
+	}
+
+	return cmd.printResult(fmt.Sprintf("imported policy, %v allowlist entries, %v modules and %v blocks",
+		len(d.Allowlist), len(d.Modules), imported))
+}
@@ -0,0 +1,137 @@
+// Command f2bctl is a command-line tool to administer a running fail2ban service
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/client"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const usage = `usage: f2bctl [flags] <command> [arguments]
+
+commands:
+  status                                 show policy, active blocks and modules
+  block [-duration d | -permanent] [-reason r] [-tags t] <ip>
+                                         block an IP, the active policy is used by default
+  unblock <ip>                           unblock an IP
+  list blocks                            list all active blocks
+  list entries [ip]                      list all sources, or all attempts of the given IP
+  policy get                             show the active policy
+  policy set [-attempts n] [-period d] [-blocktime d]
+                                         update the active policy, omitted values are kept
+  module add [-method m] <address>       add an external module
+  module list                            list all external modules
+  module remove <id>                     remove an external module
+  allowlist add [-description d] <source>
+                                         add an IP or CIDR range to the allowlist
+  allowlist list                         list the allowlist
+  allowlist remove <source>              remove an IP or CIDR range from the allowlist
+  key add [-scopes s] <name>             create an API key, the key is only shown once
+  key list                               list all API keys
+  key remove <name>                      remove an API key
+  audit [-since d] [-source s] [-action a]
+                                         show the audit log
+  export [-file f]                       export the full state as a versioned JSON archive
+  import [-file f]                       import an archive, or an export of an older version
+
+flags:
+`
+
+type command struct {
+	c      *client.Client
+	ctx    context.Context
+	output string
+}
+
+func main() {
+	flags := flag.NewFlagSet("f2bctl", flag.ExitOnError)
+	address := flags.String("address", envOr("FAIL2BAN_ADDRESS", "http://localhost:8080"), "address of the server (env FAIL2BAN_ADDRESS)")
+	key := flags.String("key", os.Getenv("FAIL2BAN_API_KEY"), "API key to use (env FAIL2BAN_API_KEY)")
+	output := flags.String("output", "table", "output format, table or json")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout of the entire command")
+	caFile := flags.String("tls-ca", os.Getenv("FAIL2BAN_TLS_CA"), "CA bundle used to verify the server (env FAIL2BAN_TLS_CA)")
+	certFile := flags.String("tls-cert", os.Getenv("FAIL2BAN_TLS_CERT"), "client certificate for mutual TLS (env FAIL2BAN_TLS_CERT)")
+	keyFile := flags.String("tls-key", os.Getenv("FAIL2BAN_TLS_KEY"), "client certificate key for mutual TLS (env FAIL2BAN_TLS_KEY)")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 || (*output != "table" && *output != "json") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	opts := []client.Option{client.WithApiKey(*key)}
+	if *caFile != "" || *certFile != "" {
+		tlsConfig, err := loadTLSConfig(*caFile, *certFile, *keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+
+		opts = append(opts, client.WithTLSConfig(tlsConfig))
+	}
+
+	cmd := &command{
+		c:      client.New(*address, opts...),
+		ctx:    ctx,
+		output: *output,
+	}
+
+	if err := cmd.run(flags.Arg(0), flags.Args()[1:]); err != nil {
+		if err == errUsage {
+			flags.Usage()
+			os.Exit(2)
+		}
+
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func loadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		buf, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read CA bundle")
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, errors.Errorf("no certificates found in CA bundle %v", caFile)
+		}
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+
+	return fallback
+}
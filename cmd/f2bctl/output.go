@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(time.RFC3339)
+}
+
+func (cmd *command) printResult(msg string) error {
+	if cmd.output == "json" {
+		return printJSON(struct {
+			Success bool   `json:"success"`
+			Message string `json:"message"`
+		}{true, msg})
+	}
+
+	_, err := fmt.Println(msg)
+	return err
+}
+
+func (cmd *command) printBlocks(blocks []storage.BlockEntry) error {
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Timestamp.Time().Before(blocks[j].Timestamp.Time())
+	})
+
+	if cmd.output == "json" {
+		return printJSON(blocks)
+	}
+
+	rows := make([][]string, 0, len(blocks))
+	for _, b := range blocks {
+		duration, remaining := "permanent", "permanent"
+		if !b.Permanent {
+			r := time.Until(b.Timestamp.Time().Add(b.Duration)).Round(time.Second)
+			if r < 0 {
+				r = 0
+			}
+
+			duration, remaining = b.Duration.String(), r.String()
+		}
+
+		rows = append(rows, []string{b.Source, formatTime(b.Timestamp.Time()), duration, remaining, strings.Join(b.Tags, ","), b.Reason})
+	}
+
+	return printTable([]string{"SOURCE", "BLOCKED AT", "DURATION", "REMAINING", "TAGS", "REASON"}, rows)
+}
+
+func (cmd *command) printModules(modules []storage.ExternalModule) error {
+	sort.Slice(modules, func(i, j int) bool {
+		return modules[i].Address < modules[j].Address
+	})
+
+	if cmd.output == "json" {
+		return printJSON(modules)
+	}
+
+	rows := make([][]string, 0, len(modules))
+	for _, m := range modules {
+		rows = append(rows, []string{strconv.FormatUint(uint64(m.Id), 10), m.Method, m.Address})
+	}
+
+	return printTable([]string{"ID", "METHOD", "ADDRESS"}, rows)
+}
+
+func (cmd *command) printAllowlist(entries []storage.AllowEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Source < entries[j].Source
+	})
+
+	if cmd.output == "json" {
+		return printJSON(entries)
+	}
+
+	rows := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, []string{e.Source, e.Description})
+	}
+
+	return printTable([]string{"SOURCE", "DESCRIPTION"}, rows)
+}
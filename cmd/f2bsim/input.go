@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/internal/config"
+	"github.com/timanema/fail2ban-service/pkg/archive"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"github.com/timanema/fail2ban-service/pkg/watcher"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// File formats, auto uses the extension of the file
+const (
+	formatAuto    = "auto"
+	formatArchive = "archive"
+	formatNDJSON  = "ndjson"
+	formatLog     = "log"
+)
+
+// maxLineSize limits the length of lines of NDJSON and log files
+const maxLineSize = 1 << 20
+
+// defaultTimeLayouts are tried when no layout is given, in this order
+var defaultTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", time.Stamp}
+
+// filter is a compiled watcher, matching lines are failed attempts of its service
+type filter struct {
+	service string
+	pattern *regexp.Regexp
+}
+
+// reader reads authentication entries from files
+type reader struct {
+	format  string
+	filters []filter
+	times   timeParser
+
+	// skipped counts the matching log lines without a timestamp
+	skipped int
+}
+
+func newReader(format string, watchers []config.Watcher, times timeParser) (*reader, error) {
+	switch format {
+	case formatAuto, formatArchive, formatNDJSON, formatLog:
+	default:
+		return nil, errors.Errorf("invalid format %v", format)
+	}
+
+	r := &reader{format: format, times: times}
+	for _, w := range watchers {
+		pattern, err := watcher.CompilePattern(w.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid filter for %v", w.Service)
+		}
+		r.filters = append(r.filters, filter{service: w.Service, pattern: pattern})
+	}
+
+	return r, nil
+}
+
+// formatOf returns the format of the file, based on its extension when the format is auto
+func (r *reader) formatOf(path string) string {
+	if r.format != formatAuto {
+		return r.format
+	}
+
+	switch filepath.Ext(path) {
+	case ".json":
+		return formatArchive
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	default:
+		return formatLog
+	}
+}
+
+func (r *reader) read(path string) ([]storage.AuthenticationEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+
+	var entries []storage.AuthenticationEntry
+	switch r.formatOf(path) {
+	case formatArchive:
+		var a archive.Archive
+		if err := json.NewDecoder(f).Decode(&a); err != nil {
+			return nil, errors.Wrapf(err, "invalid archive %v", path)
+		}
+		if err := a.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid archive %v", path)
+		}
+		return a.Entries, nil
+	case formatNDJSON:
+		err = scanLines(f, func(n int, line string) error {
+			var e storage.AuthenticationEntry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				return errors.Wrapf(err, "invalid entry on line %v", n)
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	case formatLog:
+		if len(r.filters) == 0 {
+			return nil, errors.Errorf("log file %v needs a watcher in the current configuration file or -pattern", path)
+		}
+		err = scanLines(f, func(_ int, line string) error {
+			if e, ok := r.parseLine(line); ok {
+				entries = append(entries, e)
+			}
+			return nil
+		})
+	}
+
+	return entries, errors.Wrapf(err, "failed to read %v", path)
+}
+
+// parseLine returns the entry of the first filter matching the line. Matching lines without a timestamp are skipped
+func (r *reader) parseLine(line string) (storage.AuthenticationEntry, bool) {
+	for _, f := range r.filters {
+		source, ok := watcher.ParseLine(f.pattern, line)
+		if !ok {
+			continue
+		}
+
+		t, ok := r.times.parse(line)
+		if !ok {
+			r.skipped++
+			return storage.AuthenticationEntry{}, false
+		}
+
+		return storage.AuthenticationEntry{Source: source, Service: f.service, Timestamp: unix_time.Time(t)}, true
+	}
+
+	return storage.AuthenticationEntry{}, false
+}
+
+// scanLines calls fn for every line that is not empty, with its line number
+func scanLines(f *os.File, fn func(n int, line string) error) error {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if err := fn(n, line); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// timeParser parses the timestamp at the start of log lines, in the local time zone
+type timeParser struct {
+	layouts []string
+	// year is used for timestamps without a year
+	year int
+}
+
+func newTimeParser(layout string, year int) timeParser {
+	if layout == "" {
+		return timeParser{layouts: defaultTimeLayouts, year: year}
+	}
+
+	return timeParser{layouts: []string{layout}, year: year}
+}
+
+func (p timeParser) parse(line string) (time.Time, bool) {
+	fields := strings.Fields(line)
+	for _, layout := range p.layouts {
+		// Timestamps take as many fields as their layout, padding such as in syslog timestamps is ignored
+		n := len(strings.Fields(layout))
+		if len(fields) < n {
+			continue
+		}
+
+		t, err := time.ParseInLocation(layout, strings.Join(fields[:n], " "), time.Local)
+		if err != nil {
+			continue
+		}
+
+		if t.Year() == 0 {
+			t = t.AddDate(p.year, 0, 0)
+		}
+		return t, true
+	}
+
+	return time.Time{}, false
+}
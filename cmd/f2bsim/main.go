@@ -0,0 +1,161 @@
+// Command f2bsim replays recorded failed attempts through the current and a candidate policy, to show which sources a
+// policy change would affect before it is made
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/internal/config"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/simulation"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"os"
+	"time"
+)
+
+const usage = `usage: f2bsim [flags] <file>...
+
+Replays the failed attempts in the files through the current and a candidate policy using a simulated clock, and
+reports the blocks of both policies and the sources that are blocked differently. Nothing is blocked.
+
+Files are JSON archives of f2bctl export, newline delimited JSON authentication entries, or log files. Lines of log
+files are matched against the watchers of the current configuration file, or the -pattern flag, and need a timestamp
+at the start of the line.
+
+The current policy is the policy of the -current configuration file, or the default policy. The candidate policy is
+the policy of the -candidate configuration file, and the -attempts, -period and -blocktime flags override it. Settings
+that are missing for the candidate are the same as the current ones.
+
+flags:
+`
+
+// settings are the parts of a configuration file used for the simulation
+type settings struct {
+	policies  simulation.Policies
+	allowlist []storage.AllowEntry
+	watchers  []config.Watcher
+}
+
+func main() {
+	flags := flag.NewFlagSet("f2bsim", flag.ExitOnError)
+	currentFile := flags.String("current", "", "configuration file with the current policy, allowlist and watchers")
+	candidateFile := flags.String("candidate", "", "configuration file with the candidate policy")
+	attempts := flags.Int("attempts", 0, "attempts of the candidate policy")
+	period := flags.Duration("period", 0, "period of the candidate policy")
+	blockTime := flags.Duration("blocktime", 0, "block time of the candidate policy")
+	format := flags.String("format", formatAuto, "format of the files, auto, archive, ndjson or log")
+	service := flags.String("service", "", "service of the attempts matched by -pattern")
+	pattern := flags.String("pattern", "", "pattern matching failed attempts in log files, used instead of the watchers")
+	timeLayout := flags.String("time-layout", "", "Go time layout of the timestamps in log files, common layouts are tried by default")
+	year := flags.Int("year", time.Now().Year(), "year of log timestamps without one, such as syslog timestamps")
+	output := flags.String("output", "table", "output format, table or json")
+	limit := flags.Int("limit", 50, "maximum amount of sources listed per difference in table output, 0 lists all")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 || (*output != "table" && *output != "json") || (*pattern != "") != (*service != "") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	current, err := loadSettings(*currentFile, nil)
+	if err != nil {
+		fail(err)
+	}
+	candidate, err := loadSettings(*candidateFile, &current)
+	if err != nil {
+		fail(err)
+	}
+	if *attempts > 0 {
+		candidate.policies.Policy.Attempts = *attempts
+	}
+	if *period > 0 {
+		candidate.policies.Policy.Period = *period
+	}
+	if *blockTime > 0 {
+		candidate.policies.Policy.BlockTime = *blockTime
+	}
+
+	filters := current.watchers
+	if *pattern != "" {
+		filters = []config.Watcher{{Service: *service, Pattern: *pattern}}
+	}
+	r, err := newReader(*format, filters, newTimeParser(*timeLayout, *year))
+	if err != nil {
+		fail(err)
+	}
+
+	var entries []storage.AuthenticationEntry
+	for _, path := range flags.Args() {
+		read, err := r.read(path)
+		if err != nil {
+			fail(err)
+		}
+		entries = append(entries, read...)
+	}
+
+	ctx := context.Background()
+	currentResult, err := simulation.Run(ctx, entries, current.policies, current.allowlist)
+	if err != nil {
+		fail(errors.Wrap(err, "failed to simulate the current policy"))
+	}
+	candidateResult, err := simulation.Run(ctx, entries, candidate.policies, candidate.allowlist)
+	if err != nil {
+		fail(errors.Wrap(err, "failed to simulate the candidate policy"))
+	}
+
+	rep := newReport(r.skipped, currentResult, candidateResult)
+	if *output == "json" {
+		err = printJSON(rep)
+	} else {
+		err = rep.print(*limit)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// loadSettings reads the configuration file, settings that are missing are taken from base. Without a base the
+// default policy is used
+func loadSettings(path string, base *settings) (settings, error) {
+	s := settings{policies: simulation.Policies{Policy: blocker.DefaultPolicy}}
+	if base != nil {
+		s = *base
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	file, err := config.Load(path)
+	if err != nil {
+		return settings{}, err
+	}
+
+	if file.Policy != nil {
+		s.policies.Policy = file.Policy.Blocker()
+	}
+	if file.Services != nil {
+		s.policies.Services = make(map[string]blocker.Policy, len(file.Services))
+		for service, p := range file.Services {
+			s.policies.Services[service] = p.Blocker()
+		}
+	}
+	if file.Allowlist != nil {
+		s.allowlist = file.Allowlist
+	}
+	if file.Watchers != nil {
+		s.watchers = file.Watchers
+	}
+
+	return s, nil
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	os.Exit(1)
+}
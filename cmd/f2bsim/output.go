@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/simulation"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// summary is the outcome of a simulation of a single policy
+type summary struct {
+	Policies simulation.Policies `json:"policies"`
+	Entries  int                 `json:"entries"`
+	Invalid  int                 `json:"invalid"`
+	Blocks   int                 `json:"blocks"`
+	Sources  int                 `json:"sources"`
+	Duration time.Duration       `json:"duration"`
+	Longest  time.Duration       `json:"longest"`
+}
+
+type report struct {
+	// Skipped counts the matching log lines without a timestamp
+	Skipped   int             `json:"skipped_lines"`
+	Current   summary         `json:"current"`
+	Candidate summary         `json:"candidate"`
+	Diff      simulation.Diff `json:"diff"`
+}
+
+func newReport(skipped int, current, candidate simulation.Result) report {
+	return report{
+		Skipped:   skipped,
+		Current:   summarize(current),
+		Candidate: summarize(candidate),
+		Diff:      simulation.Compare(current, candidate),
+	}
+}
+
+func summarize(r simulation.Result) summary {
+	s := summary{
+		Policies: r.Policies,
+		Entries:  r.Entries,
+		Invalid:  r.Invalid,
+		Blocks:   len(r.Blocks),
+		Sources:  len(r.Sources()),
+		Duration: r.Duration(),
+	}
+	for _, e := range r.Blocks {
+		if e.Duration > s.Longest {
+			s.Longest = e.Duration
+		}
+	}
+
+	return s
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(time.RFC3339)
+}
+
+func formatPolicy(p blocker.Policy) string {
+	return fmt.Sprintf("%v attempts within %v, blocked for %v", p.Attempts, p.Period, p.BlockTime)
+}
+
+// print shows the summaries side by side, followed by at most limit sources of every difference
+func (r report) print(limit int) error {
+	rows := [][]string{
+		{"POLICY", formatPolicy(r.Current.Policies.Policy), formatPolicy(r.Candidate.Policies.Policy)},
+	}
+	for _, service := range services(r.Current.Policies, r.Candidate.Policies) {
+		current, candidate := "-", "-"
+		if p, ok := r.Current.Policies.Services[service]; ok {
+			current = formatPolicy(p)
+		}
+		if p, ok := r.Candidate.Policies.Services[service]; ok {
+			candidate = formatPolicy(p)
+		}
+		rows = append(rows, []string{"POLICY " + service, current, candidate})
+	}
+	rows = append(rows,
+		[]string{"ENTRIES", strconv.Itoa(r.Current.Entries), strconv.Itoa(r.Candidate.Entries)},
+		[]string{"BLOCKS", strconv.Itoa(r.Current.Blocks), strconv.Itoa(r.Candidate.Blocks)},
+		[]string{"BLOCKED SOURCES", strconv.Itoa(r.Current.Sources), strconv.Itoa(r.Candidate.Sources)},
+		[]string{"TOTAL BLOCK TIME", r.Current.Duration.String(), r.Candidate.Duration.String()},
+		[]string{"LONGEST BLOCK", r.Current.Longest.String(), r.Candidate.Longest.String()},
+	)
+	if err := printTable([]string{"", "CURRENT", "CANDIDATE"}, rows); err != nil {
+		return err
+	}
+	if r.Skipped > 0 || r.Current.Invalid > 0 {
+		fmt.Printf("\nskipped %v log lines without a timestamp and %v invalid entries\n", r.Skipped, r.Current.Invalid)
+	}
+
+	fmt.Printf("\nOnly blocked by the candidate policy (%v):\n", len(r.Diff.Added))
+	if err := printSources(r.Diff.Added, limit); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nOnly blocked by the current policy (%v):\n", len(r.Diff.Removed))
+	if err := printSources(r.Diff.Removed, limit); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nBlocked differently (%v):\n", len(r.Diff.Changed))
+	if len(r.Diff.Changed) == 0 {
+		return nil
+	}
+	changed := r.Diff.Changed
+	if limit > 0 && len(changed) > limit {
+		changed = changed[:limit]
+	}
+	rows = make([][]string, 0, len(changed))
+	for _, c := range changed {
+		rows = append(rows, []string{c.Source, strconv.Itoa(c.Current.Blocks), c.Current.Duration.String(),
+			strconv.Itoa(c.Candidate.Blocks), c.Candidate.Duration.String()})
+	}
+	if err := printTable([]string{"SOURCE", "CURRENT BLOCKS", "CURRENT DURATION", "CANDIDATE BLOCKS", "CANDIDATE DURATION"}, rows); err != nil {
+		return err
+	}
+	printRemaining(len(r.Diff.Changed), len(changed))
+
+	return nil
+}
+
+func printSources(sources []simulation.SourceSummary, limit int) error {
+	if len(sources) == 0 {
+		return nil
+	}
+
+	shown := sources
+	if limit > 0 && len(shown) > limit {
+		shown = shown[:limit]
+	}
+
+	rows := make([][]string, 0, len(shown))
+	for _, s := range shown {
+		rows = append(rows, []string{s.Source, strconv.Itoa(s.Blocks), s.Duration.String(), formatTime(s.First.Time())})
+	}
+	if err := printTable([]string{"SOURCE", "BLOCKS", "DURATION", "FIRST BLOCKED AT"}, rows); err != nil {
+		return err
+	}
+	printRemaining(len(sources), len(shown))
+
+	return nil
+}
+
+func printRemaining(total, shown int) {
+	if total > shown {
+		fmt.Printf("... and %v more\n", total-shown)
+	}
+}
+
+// services returns the services that have their own policy in either of the policies, sorted
+func services(policies ...simulation.Policies) []string {
+	seen := make(map[string]struct{})
+	var res []string
+	for _, p := range policies {
+		for service := range p.Services {
+			if _, ok := seen[service]; !ok {
+				seen[service] = struct{}{}
+				res = append(res, service)
+			}
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
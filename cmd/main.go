@@ -1,60 +1,320 @@
 package main
 
 import (
+	"context"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/internal/config"
 	"github.com/timanema/fail2ban-service/internal/server"
+	"github.com/timanema/fail2ban-service/pkg/archive"
 	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/federation"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/replication"
 	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/tracing"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
 type Config struct {
 	server.Config
 	StorageType string `default:"memory" split_words:"true"`
+	// ConfigFile is an optional YAML file, which is reloaded on SIGHUP. Its settings take precedence
+	ConfigFile string `split_words:"true"`
+
+	LogFormat string `default:"text" split_words:"true"`
+	LogLevel  string `default:"info" split_words:"true"`
+
+	// TracingExporter is none, otlp or stdout, the OTLP endpoint falls back to the OTEL_EXPORTER_OTLP_* variables
+	TracingExporter string `default:"none" split_words:"true"`
+	TracingEndpoint string `split_words:"true"`
+
+	// Replication is enabled when peers are given, using the FAIL2BAN_REPLICATION_* variables
+	Replication replication.Config
+	// Federation mirrors the blocks of upstream servers when they are given, using the FAIL2BAN_FEDERATION_* variables
+	Federation federation.Config
+	// Persistent configures the persistent storage type, using the FAIL2BAN_PERSISTENT_* variables
+	Persistent storage.PersistentConfig
+	// Raft configures the raft storage type, using the FAIL2BAN_RAFT_* variables
+	Raft storage.RaftConfig
+
+	// MigrateFrom copies all data of the given storage type to the configured storage type and exits, instead of
+	// starting the server
+	MigrateFrom string `split_words:"true"`
 }
 
 func main() {
-	log.Println("starting server")
-
 	var c Config
 	if err := envconfig.Process("fail2ban", &c); err != nil {
 		log.Fatalf("unable to load fail2ban server config: %v\n", err)
 	}
-	log.Printf("active configuration: %+v\n", c)
 
-	var store storage.Storage
-	switch c.StorageType {
-	case "memory":
-		store = storage.NewMemoryStore()
-	case "persistent":
-		store = storage.NewPersistentStore()
-	default:
-		log.Printf("invalid storage type: %v, using 'memory' type as fallback\n", c.StorageType)
-		store = storage.NewMemoryStore()
+	logger, err := logging.New(os.Stderr, c.LogFormat, c.LogLevel)
+	if err != nil {
+		log.Fatalf("unable to create logger: %v\n", err)
+	}
+
+	// Dependencies using the log package end up in the same output
+	slog.SetDefault(logger)
+	logger.Info("starting server")
+
+	policy := blocker.DefaultPolicy
+
+	var file *config.File
+	if c.ConfigFile != "" {
+		if file, err = config.Load(c.ConfigFile); err != nil {
+			fatal(logger, "unable to load config file", err)
+		}
+
+		if file.ListenAddress != "" {
+			c.ListenAddress = file.ListenAddress
+		}
+		if file.Storage != "" {
+			c.StorageType = file.Storage
+		}
+		if file.Enforcement != "" {
+			c.IptablesBlockerEnabled = file.Enforcement == config.EnforcementIptables
+		}
+		if file.Policy != nil {
+			policy = file.Policy.Blocker()
+		}
+	}
+	logged := c
+	if logged.Config.ApiKey != "" {
+		logged.Config.ApiKey = "<redacted>"
+	}
+	if logged.Replication.Secret != "" {
+		logged.Replication.Secret = "<redacted>"
+	}
+	if logged.Federation.ApiKey != "" {
+		logged.Federation.ApiKey = "<redacted>"
+	}
+	if logged.Raft.Secret != "" {
+		logged.Raft.Secret = "<redacted>"
+	}
+	if logged.Persistent.Key != "" {
+		logged.Persistent.Key = "<redacted>"
+	}
+	if logged.Persistent.PreviousKey != "" {
+		logged.Persistent.PreviousKey = "<redacted>"
+	}
+	logger.Info("active configuration", "config", logged)
+
+	if c.MigrateFrom != "" {
+		if err := migrate(c, logger); err != nil {
+			fatal(logger, "unable to migrate storage", err)
+		}
+		return
+	}
+
+	stopTracing, err := tracing.Setup(context.Background(), c.TracingExporter, c.TracingEndpoint)
+	if err != nil {
+		fatal(logger, "unable to set up tracing", err)
+	}
+
+	store, raftStore, err := openStorage(c.StorageType, c, logger)
+	if err == errInvalidStorageType {
+		logger.Warn("invalid storage type, using 'memory' type as fallback", "storage_type", c.StorageType)
+		store = storage.NewMemoryStore(clock.Real, logger)
+	} else if err != nil {
+		fatal(logger, "unable to open storage", err)
+	}
+
+	var replicator *replication.Replicator
+	if c.Replication.Enabled() {
+		if replicator, err = replication.New(store, c.Replication, clock.Real, logger); err != nil {
+			fatal(logger, "unable to set up replication", err)
+		}
+		store = replicator
+	}
+
+	var federator *federation.Federation
+	if c.Federation.Enabled() {
+		if federator, err = federation.New(store, c.Federation, clock.Real, logger); err != nil {
+			fatal(logger, "unable to set up federation", err)
+		}
+		store = federator
+	}
+
+	store = storage.NewInstrumentedStore(store)
+	if tracing.Enabled(c.TracingExporter) {
+		store = storage.NewTracedStore(store)
 	}
 
 	p := store
-	s := server.New(p, blocker.Policy{
-		Attempts:  3,
-		Period:    time.Second * 5,
-		BlockTime: time.Minute,
-	}, c.Config)
+	s := server.New(p, policy, c.Config, clock.Real, logger)
+
+	if raftStore != nil {
+		s.HandlePeer(storage.RaftApplyPath, raftStore.Handler())
+	}
+	if replicator != nil {
+		replicator.SetEnforcer(s.Blocker().Enforce)
+		s.HandlePeer(replication.OpsPath, replicator.Handler())
+		replicator.Start()
+	}
+	if federator != nil {
+		federator.SetBlocker(s.Blocker())
+		federator.Start()
+	}
+
+	manager := config.NewManager(c.ConfigFile, p, s.Blocker(), clock.Real, logger)
+	if c.ConfigFile != "" {
+		if err := manager.Apply(context.Background(), file); err != nil {
+			fatal(logger, "unable to apply config file", err)
+		}
+	}
 
 	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	go s.ListenAndServe()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
-	<-stop
-	log.Println("stopping server")
+	failed := make(chan error, 1)
+	go func() {
+		if err := s.ListenAndServe(); err != http.ErrServerClosed {
+			failed <- err
+		}
+	}()
 
-	if err := p.Close(); err != nil {
-		log.Printf("failed to close storage: %v\n", err)
+wait:
+	for {
+		select {
+		case <-reload:
+			if c.ConfigFile == "" {
+				logger.Warn("received SIGHUP, but no config file is used")
+				continue
+			}
+
+			logger.Info("reloading config file", "config_file", c.ConfigFile)
+			if err := manager.Reload(context.Background()); err != nil {
+				logger.Error("unable to reload config file, keeping current config", "error", err)
+			}
+		case sig := <-stop:
+			logger.Info("stopping server", "signal", sig.String())
+			break wait
+		case err := <-failed:
+			logger.Error("server failed", "error", err)
+			shutdown(logger, s, manager, p, stopTracing)
+			os.Exit(1)
+		}
+	}
+
+	if !shutdown(logger, s, manager, p, stopTracing) {
+		os.Exit(1)
 	}
+	logger.Info("server stopped")
+}
+
+// shutdown stops everything in order: log watchers and the server first so nothing causes new blocks, and storage last
+// so everything that happened before is persisted. Remaining spans are flushed at the very end. It reports whether
+// everything was stopped cleanly
+func shutdown(logger *slog.Logger, s *server.Server, manager *config.Manager, store storage.Storage,
+	stopTracing func(context.Context) error) bool {
+	ok := true
+
+	manager.Close()
 	if err := s.Shutdown(); err != nil {
-		log.Fatalf("failed to stop server: %v\n", err)
+		logger.Error("failed to stop server", "error", err)
+		ok = false
+	}
+
+	// Closing storage also stops replication and federation, when they are enabled. Blocks they stored after the
+	// blocker was drained are enforced by the next start
+	if err := store.Close(); err != nil {
+		logger.Error("failed to close storage", "error", err)
+		ok = false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := stopTracing(ctx); err != nil {
+		logger.Error("failed to flush traces", "error", err)
+		ok = false
 	}
+
+	return ok
+}
+
+var errInvalidStorageType = errors.New("invalid storage type")
+
+// openStorage creates the storage of the given type. The raft storage is returned separately as well, as its handler
+// has to be served
+func openStorage(storageType string, c Config, logger *slog.Logger) (storage.Storage, *storage.RaftStorage, error) {
+	switch storageType {
+	case "memory":
+		return storage.NewMemoryStore(clock.Real, logger), nil, nil
+	case "persistent":
+		persistentStore, err := storage.NewPersistentStore(c.Persistent, clock.Real, logger)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "unable to open persistent storage")
+		}
+		return persistentStore, nil, nil
+	case "raft":
+		raftStore, err := storage.NewRaftStore(c.Raft, clock.Real, logger)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "unable to start raft storage")
+		}
+		return raftStore, raftStore, nil
+	}
+
+	return nil, nil, errInvalidStorageType
+}
+
+// migrate copies all data of the storage type to migrate from to the configured storage type. Policies are not kept
+// in storage, so they are not migrated
+func migrate(c Config, logger *slog.Logger) error {
+	if c.MigrateFrom == c.StorageType {
+		return errors.Errorf("cannot migrate %v storage to itself", c.StorageType)
+	}
+	if c.MigrateFrom == "memory" || c.StorageType == "memory" {
+		return errors.New("memory storage does not keep data, so it cannot be migrated from or to")
+	}
+
+	logger.Info("migrating storage", "from", c.MigrateFrom, "to", c.StorageType)
+	source, _, err := openStorage(c.MigrateFrom, c, logger)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %v storage", c.MigrateFrom)
+	}
+	defer source.Close()
+
+	target, _, err := openStorage(c.StorageType, c, logger)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %v storage", c.StorageType)
+	}
+
+	ctx := context.Background()
+	a, err := archive.Export(ctx, source, clock.Real)
+	if err != nil {
+		target.Close()
+		return err
+	}
+
+	summary, err := archive.Import(ctx, target, a)
+	if err != nil {
+		target.Close()
+		return err
+	}
+
+	// The target is closed explicitly, as closing persists its data
+	if err := target.Close(); err != nil {
+		return errors.Wrapf(err, "unable to close %v storage", c.StorageType)
+	}
+
+	logger.Info("migrated storage", "entries", summary.Entries, "blocks", summary.Blocks, "modules", summary.Modules,
+		"allowlist", summary.Allowlist, "api_keys", summary.ApiKeys, "audit", summary.Audit,
+		"allowed_blocks", summary.AllowedBlocks)
+	return nil
+}
+
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,202 @@
+// Package config loads the configuration file of the service, and applies changes to it while the service is running
+package config
+
+import (
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/importer"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/watcher"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// Enforcement backends
+const (
+	EnforcementIptables = "iptables"
+	EnforcementNone     = "none"
+)
+
+// Storage types
+const (
+	StorageMemory     = "memory"
+	StoragePersistent = "persistent"
+	StorageRaft       = "raft"
+)
+
+var listNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// File is the configuration file, all settings are optional and fall back to the environment configuration
+type File struct {
+	ListenAddress string `yaml:"listen_address"`
+	Storage       string `yaml:"storage"`
+	Enforcement   string `yaml:"enforcement"`
+
+	Policy *Policy `yaml:"policy"`
+	// Services overrides the policy for entries of a single service
+	Services map[string]Policy `yaml:"services"`
+
+	Allowlist []storage.AllowEntry `yaml:"allowlist"`
+	Modules   []Module             `yaml:"modules"`
+	Watchers  []Watcher            `yaml:"watchers"`
+	Lists     []List               `yaml:"lists"`
+}
+
+type Policy struct {
+	Attempts  int           `yaml:"attempts"`
+	Period    time.Duration `yaml:"period"`
+	BlockTime time.Duration `yaml:"blocktime"`
+}
+
+func (p Policy) Blocker() blocker.Policy {
+	return blocker.Policy{
+		Attempts:  p.Attempts,
+		Period:    p.Period,
+		BlockTime: p.BlockTime,
+	}
+}
+
+func (p Policy) validate() error {
+	if p.Attempts <= 0 {
+		return errors.New("attempts must be positive")
+	}
+	if p.Period <= 0 {
+		return errors.New("period must be positive")
+	}
+	if p.BlockTime <= 0 {
+		return errors.New("blocktime must be positive")
+	}
+
+	return nil
+}
+
+type Module struct {
+	Address string `yaml:"address"`
+	Method  string `yaml:"method"`
+}
+
+// Watcher tails a log file, lines matching the pattern are reported as failed attempts of the service
+type Watcher struct {
+	Path    string `yaml:"path"`
+	Service string `yaml:"service"`
+	// Pattern is a regular expression with a capture group named source containing the IP
+	Pattern string `yaml:"pattern"`
+}
+
+// List is a third-party blocklist, loaded from either a URL or a local file. Its sources are blocked until they
+// disappear from the list
+type List struct {
+	Name     string        `yaml:"name"`
+	URL      string        `yaml:"url"`
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (l List) Importer() importer.List {
+	return importer.List{
+		Name:     l.Name,
+		URL:      l.URL,
+		Path:     l.Path,
+		Interval: l.Interval,
+	}
+}
+
+// Load reads and validates the given configuration file
+func Load(path string) (*File, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file")
+	}
+
+	var f File
+	if err := yaml.Unmarshal(buf, &f); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config file %v", path)
+	}
+
+	if err := f.validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid config file %v", path)
+	}
+
+	return &f, nil
+}
+
+func (f *File) validate() error {
+	switch f.Storage {
+	case "", StorageMemory, StoragePersistent, StorageRaft:
+	default:
+		return errors.Errorf("invalid storage type %v", f.Storage)
+	}
+
+	switch f.Enforcement {
+	case "", EnforcementIptables, EnforcementNone:
+	default:
+		return errors.Errorf("invalid enforcement backend %v", f.Enforcement)
+	}
+
+	if f.Policy != nil {
+		if err := f.Policy.validate(); err != nil {
+			return errors.Wrap(err, "invalid policy")
+		}
+	}
+
+	for service, p := range f.Services {
+		if err := p.validate(); err != nil {
+			return errors.Wrapf(err, "invalid policy for service %v", service)
+		}
+	}
+
+	for _, e := range f.Allowlist {
+		if !e.Valid() {
+			return errors.Errorf("invalid allowlist entry %v, must be an IP or CIDR range", e.Source)
+		}
+	}
+
+	for _, m := range f.Modules {
+		if u, err := url.Parse(m.Address); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.Errorf("invalid module address %v", m.Address)
+		}
+
+		switch m.Method {
+		case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			return errors.Errorf("invalid method %v for module %v", m.Method, m.Address)
+		}
+	}
+
+	for _, w := range f.Watchers {
+		if w.Path == "" || w.Service == "" {
+			return errors.New("watchers need both a path and a service")
+		}
+
+		if _, err := watcher.CompilePattern(w.Pattern); err != nil {
+			return errors.Wrapf(err, "invalid watcher for %v", w.Path)
+		}
+	}
+
+	names := make(map[string]struct{}, len(f.Lists))
+	for _, l := range f.Lists {
+		if !listNamePattern.MatchString(l.Name) {
+			return errors.Errorf("invalid list name %v, must only contain letters, digits, - and _", l.Name)
+		}
+		if _, ok := names[l.Name]; ok {
+			return errors.Errorf("list %v is configured more than once", l.Name)
+		}
+		names[l.Name] = struct{}{}
+
+		if (l.URL == "") == (l.Path == "") {
+			return errors.Errorf("list %v needs either a url or a path", l.Name)
+		}
+		if u, err := url.Parse(l.URL); l.URL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			return errors.Errorf("invalid url %v for list %v", l.URL, l.Name)
+		}
+		if l.Interval < 0 {
+			return errors.Errorf("interval of list %v must be positive", l.Name)
+		}
+	}
+
+	return nil
+}
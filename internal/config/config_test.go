@@ -0,0 +1,92 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, `
+storage: persistent
+policy:
+  attempts: 3
+  period: 1m
+  blocktime: 1h
+services:
+  ssh:
+    attempts: 5
+    period: 10m
+    blocktime: 24h
+allowlist:
+  - source: 10.0.0.0/8
+    description: internal
+modules:
+  - address: http://localhost:9000/block
+    method: POST
+watchers:
+  - path: /var/log/auth.log
+    service: ssh
+    pattern: 'Failed password for .* from (?P<source>\S+)'
+lists:
+  - name: spamhaus
+    url: https://www.spamhaus.org/drop/drop.txt
+`)
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.Storage != StoragePersistent || f.Policy.Blocker().BlockTime != time.Hour || f.Services["ssh"].Attempts != 5 {
+		t.Fatalf("expected the settings of the file, got %+v", f)
+	}
+	if len(f.Allowlist) != 1 || f.Allowlist[0].Description != "internal" || len(f.Modules) != 1 ||
+		len(f.Watchers) != 1 || len(f.Lists) != 1 {
+		t.Fatalf("expected all entries of the file, got %+v", f)
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatalf("expected an error for a missing file")
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := map[string]string{
+		"syntax":          "policy: [",
+		"storage":         "storage: disk",
+		"enforcement":     "enforcement: nftables",
+		"policy":          "policy: {attempts: 0, period: 1m, blocktime: 1h}",
+		"service policy":  "services: {ssh: {attempts: 3, period: 1m}}",
+		"allowlist":       "allowlist: [{source: not-an-ip}]",
+		"module address":  "modules: [{address: localhost, method: POST}]",
+		"module method":   "modules: [{address: 'http://localhost', method: DELETE}]",
+		"watcher path":    "watchers: [{service: ssh, pattern: '(?P<source>.*)'}]",
+		"watcher pattern": "watchers: [{path: /var/log/auth.log, service: ssh, pattern: '(.*)'}]",
+		"list name":       "lists: [{name: 'a list', path: /tmp/list}]",
+		"list duplicate":  "lists: [{name: a, path: /tmp/a}, {name: a, path: /tmp/b}]",
+		"list source":     "lists: [{name: a, path: /tmp/a, url: 'https://example.com'}]",
+		"list url":        "lists: [{name: a, url: 'ftp://example.com'}]",
+		"list interval":   "lists: [{name: a, path: /tmp/a, interval: -1m}]",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			writeFile(t, path, content)
+
+			if _, err := Load(path); err == nil {
+				t.Fatalf("expected %q to be rejected", content)
+			}
+		})
+	}
+}
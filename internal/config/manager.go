@@ -0,0 +1,360 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/importer"
+	"github.com/timanema/fail2ban-service/pkg/metrics"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"github.com/timanema/fail2ban-service/pkg/watcher"
+	"log/slog"
+	"math/rand"
+	"reflect"
+	"sync"
+)
+
+// actor is recorded in the audit log for changes made by the configuration file
+const actor = "config"
+
+// Manager applies the configuration file to a running service. Only the differences with the previously applied file
+// are applied, so changes made using the API to settings that did not change in the file are kept, and active blocks
+// are never touched
+type Manager struct {
+	lock    sync.Mutex
+	logger  *slog.Logger
+	path    string
+	store   storage.Storage
+	blocker *blocker.Blocker
+	// clock is passed on to the watchers and importers, and sets the timestamps of audit entries
+	clock clock.Clock
+
+	current   *File
+	watchers  map[Watcher]*watcher.Watcher
+	importers map[List]*importer.Importer
+}
+
+func NewManager(path string, store storage.Storage, b *blocker.Blocker, clock clock.Clock, logger *slog.Logger) *Manager {
+	return &Manager{
+		logger:    logger.With("config_file", path),
+		path:      path,
+		store:     store,
+		blocker:   b,
+		clock:     clock,
+		current:   &File{},
+		watchers:  make(map[Watcher]*watcher.Watcher),
+		importers: make(map[List]*importer.Importer),
+	}
+}
+
+// Reload reads the configuration file again and applies it. If the file is invalid, the error is returned and the
+// current configuration is kept
+func (m *Manager) Reload(ctx context.Context) error {
+	f, err := Load(m.path)
+	if err != nil {
+		return err
+	}
+
+	return m.Apply(ctx, f)
+}
+
+// change is a single change to the storage made by applying a file, with the change that reverts it
+type change struct {
+	apply   func(ctx context.Context) error
+	revert  func(ctx context.Context) error
+	action  string
+	source  string
+	details string
+}
+
+// Apply applies the differences between the given file and the previously applied file. All changes to the storage
+// are computed before any of them is made, and the changes that were already made are reverted when one fails, so a
+// failed apply keeps the current configuration
+func (m *Manager) Apply(ctx context.Context, f *File) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	prev := m.current
+	if prev.ListenAddress != "" && f.ListenAddress != prev.ListenAddress {
+		m.logger.Warn("listen address changed, restart to apply", "old", prev.ListenAddress, "new", f.ListenAddress)
+	}
+	if prev.Storage != "" && f.Storage != prev.Storage {
+		m.logger.Warn("storage changed, restart to apply", "old", prev.Storage, "new", f.Storage)
+	}
+	if prev.Enforcement != "" && f.Enforcement != prev.Enforcement {
+		m.logger.Warn("enforcement changed, restart to apply", "old", prev.Enforcement, "new", f.Enforcement)
+	}
+
+	allowlist, err := m.allowlistChanges(ctx, prev, f)
+	if err != nil {
+		return errors.Wrap(err, "failed to apply allowlist")
+	}
+
+	modules, err := m.moduleChanges(ctx, prev, f)
+	if err != nil {
+		return errors.Wrap(err, "failed to apply modules")
+	}
+
+	changes := append(allowlist, modules...)
+	for i, c := range changes {
+		if err := c.apply(ctx); err != nil {
+			m.revert(ctx, changes[:i])
+			return errors.Wrap(err, "failed to apply config file")
+		}
+	}
+	for _, c := range changes {
+		m.audit(ctx, c.action, c.source, c.details)
+	}
+
+	if f.Policy != nil && !reflect.DeepEqual(f.Policy, prev.Policy) {
+		if old := m.blocker.Policy(); old != f.Policy.Blocker() {
+			m.blocker.UpdatePolicy(f.Policy.Blocker())
+			m.audit(ctx, storage.AuditPolicyUpdate, "", fmt.Sprintf("policy changed from %+v to %+v", old, f.Policy.Blocker()))
+		}
+	}
+
+	if !reflect.DeepEqual(f.Services, prev.Services) {
+		policies := make(map[string]blocker.Policy, len(f.Services))
+		for service, p := range f.Services {
+			policies[service] = p.Blocker()
+		}
+
+		m.blocker.UpdateServicePolicies(policies)
+		m.audit(ctx, storage.AuditPolicyUpdate, "", fmt.Sprintf("service policies changed to %+v", policies))
+	}
+
+	m.applyWatchers(f)
+	m.applyLists(ctx, f)
+
+	m.current = f
+	m.logger.Info("applied config file")
+	return nil
+}
+
+// revert reverts the given changes in reverse order, errors are logged as the original error is returned instead
+func (m *Manager) revert(ctx context.Context, changes []change) {
+	for i := len(changes) - 1; i >= 0; i-- {
+		if err := changes[i].revert(ctx); err != nil {
+			m.logger.Error("failed to revert change of config file", "action", changes[i].action,
+				"source", changes[i].source, "error", err)
+		}
+	}
+}
+
+func (m *Manager) allowlistChanges(ctx context.Context, prev, next *File) ([]change, error) {
+	entries, err := m.store.GetAllowEntries(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get allowlist")
+	}
+
+	existing := make(map[string]storage.AllowEntry, len(entries))
+	for _, e := range entries {
+		existing[e.Source] = e
+	}
+
+	wanted := make(map[string]storage.AllowEntry, len(next.Allowlist))
+	for _, e := range next.Allowlist {
+		wanted[e.Source] = e
+	}
+
+	var changes []change
+	for _, e := range prev.Allowlist {
+		old, ok := existing[e.Source]
+		if _, keep := wanted[e.Source]; keep || !ok {
+			continue
+		}
+
+		changes = append(changes, change{
+			apply: func(ctx context.Context) error {
+				if err := m.store.RemoveAllowEntry(ctx, old.Source); err != nil && err != storage.NotFoundErr {
+					return errors.Wrapf(err, "failed to remove allowlist entry %v", old.Source)
+				}
+				return nil
+			},
+			revert: func(ctx context.Context) error { return m.store.AddAllowEntry(ctx, old) },
+			action: storage.AuditAllowlistRemove,
+			source: e.Source,
+		})
+	}
+
+	for _, e := range wanted {
+		e := e
+		old, ok := existing[e.Source]
+		if ok && old == e {
+			continue
+		}
+
+		revert := func(ctx context.Context) error { return m.store.RemoveAllowEntry(ctx, e.Source) }
+		if ok {
+			revert = func(ctx context.Context) error { return m.store.AddAllowEntry(ctx, old) }
+		}
+
+		changes = append(changes, change{
+			apply: func(ctx context.Context) error {
+				return errors.Wrapf(m.store.AddAllowEntry(ctx, e), "failed to add allowlist entry %v", e.Source)
+			},
+			revert:  revert,
+			action:  storage.AuditAllowlistAdd,
+			source:  e.Source,
+			details: e.Description,
+		})
+	}
+
+	return changes, nil
+}
+
+func (m *Manager) moduleChanges(ctx context.Context, prev, next *File) ([]change, error) {
+	wanted := make(map[string]Module, len(next.Modules))
+	for _, mod := range next.Modules {
+		wanted[mod.Address] = mod
+	}
+
+	var changes []change
+	for _, mod := range prev.Modules {
+		if _, ok := wanted[mod.Address]; ok {
+			continue
+		}
+
+		existing, err := m.store.GetExternalModuleByAddress(ctx, mod.Address)
+		if err == storage.NotFoundErr {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find module %v", mod.Address)
+		}
+
+		changes = append(changes, change{
+			apply: func(ctx context.Context) error {
+				return errors.Wrapf(m.store.RemoveExternalModule(ctx, existing.Id), "failed to remove module %v", existing.Address)
+			},
+			revert:  func(ctx context.Context) error { return m.store.AddExternalModule(ctx, existing) },
+			action:  storage.AuditModuleRemove,
+			details: fmt.Sprintf("module %v: %v %v", existing.Id, existing.Method, existing.Address),
+		})
+	}
+
+	for _, mod := range wanted {
+		module := storage.ExternalModule{Id: rand.Uint32(), Address: mod.Address, Method: mod.Method}
+
+		existing, err := m.store.GetExternalModuleByAddress(ctx, mod.Address)
+		if err != nil && err != storage.NotFoundErr {
+			return nil, errors.Wrapf(err, "failed to find module %v", mod.Address)
+		}
+
+		revert := func(ctx context.Context) error { return m.store.RemoveExternalModule(ctx, module.Id) }
+		if err == nil {
+			if existing.Method == mod.Method {
+				continue
+			}
+			module.Id = existing.Id
+			revert = func(ctx context.Context) error { return m.store.AddExternalModule(ctx, existing) }
+		}
+
+		changes = append(changes, change{
+			apply: func(ctx context.Context) error {
+				return errors.Wrapf(m.store.AddExternalModule(ctx, module), "failed to add module %v", module.Address)
+			},
+			revert:  revert,
+			action:  storage.AuditModuleAdd,
+			details: fmt.Sprintf("module %v: %v %v", module.Id, module.Method, module.Address),
+		})
+	}
+
+	return changes, nil
+}
+
+// applyWatchers stops watchers that were removed from the file and starts new ones, unchanged watchers keep running
+func (m *Manager) applyWatchers(next *File) {
+	wanted := make(map[Watcher]struct{}, len(next.Watchers))
+	for _, w := range next.Watchers {
+		wanted[w] = struct{}{}
+	}
+
+	for w, running := range m.watchers {
+		if _, ok := wanted[w]; !ok {
+			running.Stop()
+			delete(m.watchers, w)
+		}
+	}
+
+	for w := range wanted {
+		if _, ok := m.watchers[w]; ok {
+			continue
+		}
+
+		// The pattern was checked when the file was loaded
+		pattern, _ := watcher.CompilePattern(w.Pattern)
+		running := watcher.New(w.Path, w.Service, pattern, m.blocker.AddEntry, m.clock, m.logger)
+		running.Start()
+		m.watchers[w] = running
+	}
+}
+
+// applyLists stops importing lists that were removed from the file and starts importing new ones. The blocks of lists
+// that are no longer in the file are lifted, lists that only changed keep their blocks
+func (m *Manager) applyLists(ctx context.Context, next *File) {
+	wanted := make(map[List]struct{}, len(next.Lists))
+	names := make(map[string]struct{}, len(next.Lists))
+	for _, l := range next.Lists {
+		wanted[l] = struct{}{}
+		names[l.Name] = struct{}{}
+	}
+
+	for l, running := range m.importers {
+		if _, ok := wanted[l]; ok {
+			continue
+		}
+
+		running.Stop()
+		delete(m.importers, l)
+		if _, ok := names[l.Name]; !ok {
+			if err := running.Remove(ctx); err != nil {
+				m.logger.Error("failed to remove blocks of list", "list", l.Name, "error", err)
+			}
+		}
+	}
+
+	for l := range wanted {
+		if _, ok := m.importers[l]; ok {
+			continue
+		}
+
+		running := importer.New(l.Importer(), m.store, m.blocker, m.clock, m.logger)
+		running.Start()
+		m.importers[l] = running
+	}
+}
+
+// Close stops all watchers and importers
+func (m *Manager) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for w, running := range m.watchers {
+		running.Stop()
+		delete(m.watchers, w)
+	}
+
+	for l, running := range m.importers {
+		running.Stop()
+		delete(m.importers, l)
+	}
+}
+
+func (m *Manager) audit(ctx context.Context, action, source, details string) {
+	entry := storage.AuditEntry{
+		Timestamp: unix_time.Time(m.clock.Now()),
+		Action:    action,
+		Trigger:   metrics.ReasonManual,
+		Actor:     actor,
+		Source:    source,
+		Details:   details,
+	}
+
+	if err := m.store.AddAuditEntry(ctx, entry); err != nil {
+		m.logger.Error("failed to add audit entry", "action", entry.Action, "source", entry.Source, "error", err)
+	}
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+policy:
+  attempts: 3
+  period: 1m
+  blocktime: 1h
+allowlist:
+  - source: 10.0.0.0/8
+modules:
+  - address: http://localhost:9000/block
+    method: POST
+`
+
+// failingStore fails to add the external module with the given address
+type failingStore struct {
+	storage.Storage
+	fail string
+}
+
+func (s *failingStore) AddExternalModule(ctx context.Context, module storage.ExternalModule) error {
+	if module.Address == s.fail {
+		return errors.New("storage unavailable")
+	}
+	return s.Storage.AddExternalModule(ctx, module)
+}
+
+func newTestManager(t *testing.T, path string) (*Manager, *failingStore, *blocker.Blocker) {
+	t.Helper()
+
+	store := &failingStore{Storage: storage.NewMemoryStore(clock.Real, logging.Discard())}
+	b := blocker.New(store, blocker.DefaultPolicy, blocker.NoopFirewall{}, clock.Real, logging.Discard())
+	m := NewManager(path, store, b, clock.Real, logging.Discard())
+	t.Cleanup(m.Close)
+
+	return m, store, b
+}
+
+func allowlist(t *testing.T, store storage.Storage) []storage.AllowEntry {
+	t.Helper()
+
+	entries, err := store.GetAllowEntries(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return entries
+}
+
+func TestReload(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, testConfig)
+
+	m, store, b := newTestManager(t, path)
+	if err := m.Reload(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.Policy().BlockTime != time.Hour {
+		t.Fatalf("expected the policy of the file, got %+v", b.Policy())
+	}
+	if entries := allowlist(t, store); len(entries) != 1 || entries[0].Source != "10.0.0.0/8" {
+		t.Fatalf("expected the allowlist of the file, got %+v", entries)
+	}
+
+	// Entries removed from the file are removed, entries added using the API are kept
+	if err := store.AddAllowEntry(ctx, storage.AllowEntry{Source: "192.168.0.1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	writeFile(t, path, "allowlist: [{source: 172.16.0.0/12}]")
+	if err := m.Reload(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries := allowlist(t, store); len(entries) != 2 {
+		t.Fatalf("expected the new entry and the entry added using the API, got %+v", entries)
+	}
+	if modules, _ := store.GetExternalModules(ctx); len(modules) != 0 {
+		t.Fatalf("expected the module removed from the file to be removed, got %+v", modules)
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, testConfig)
+
+	m, store, b := newTestManager(t, path)
+	if err := m.Reload(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Invalid files are rejected without changing anything
+	writeFile(t, path, "policy: {attempts: 0, period: 1m, blocktime: 1h}\nallowlist: []")
+	if err := m.Reload(ctx); err == nil {
+		t.Fatalf("expected the invalid file to be rejected")
+	}
+	if b.Policy().BlockTime != time.Hour || len(allowlist(t, store)) != 1 {
+		t.Fatalf("expected the previous configuration to be kept")
+	}
+}
+
+func TestApplyRollback(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, testConfig)
+
+	m, store, b := newTestManager(t, path)
+	if err := m.Reload(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A storage error halfway reverts the changes that were already made
+	store.fail = "http://localhost:9001/block"
+	writeFile(t, path, `
+policy: {attempts: 5, period: 1m, blocktime: 2h}
+allowlist: [{source: 172.16.0.0/12}]
+modules: [{address: 'http://localhost:9001/block', method: PUT}]
+`)
+	if err := m.Reload(ctx); err == nil {
+		t.Fatalf("expected the storage error to be returned")
+	}
+	if entries := allowlist(t, store); len(entries) != 1 || entries[0].Source != "10.0.0.0/8" {
+		t.Fatalf("expected the allowlist to be reverted, got %+v", entries)
+	}
+	if modules, _ := store.GetExternalModules(ctx); len(modules) != 1 || modules[0].Address != "http://localhost:9000/block" {
+		t.Fatalf("expected the removed module to be restored, got %+v", modules)
+	}
+	if b.Policy().BlockTime != time.Hour {
+		t.Fatalf("expected the policy to be kept, got %+v", b.Policy())
+	}
+
+	// The file is applied in full once the storage recovered
+	store.fail = ""
+	if err := m.Reload(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries := allowlist(t, store); len(entries) != 1 || entries[0].Source != "172.16.0.0/12" || b.Policy().BlockTime != 2*time.Hour {
+		t.Fatalf("expected the new file to be applied, got %+v and %+v", entries, b.Policy())
+	}
+}
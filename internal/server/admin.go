@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/archive"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"net/http"
+)
+
+// maxArchiveSize limits the size of imported archives
+const maxArchiveSize = 256 << 20
+
+// exportState serves an archive of all data, including the active policies
+func (s *Server) exportState(w http.ResponseWriter, r *http.Request) {
+	a, err := archive.Export(r.Context(), s.store, s.clock)
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	policy := s.blocker.Policy()
+	a.Policy = &policy
+	a.ServicePolicies = s.blocker.ServicePolicies()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+	}
+}
+
+// importState adds the data of an archive, and enforces the active blocks in it. Blocks of sources on the allowlist are
+// skipped and audited. The policies of the archive replace the active policies
+func (s *Server) importState(w http.ResponseWriter, r *http.Request) {
+	var a archive.Archive
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxArchiveSize)).Decode(&a); err != nil {
+		s.writeBadRequest(w, errors.Wrap(err, "invalid archive"))
+		return
+	}
+	if err := a.Validate(); err != nil {
+		s.writeBadRequest(w, err)
+		return
+	}
+
+	summary, err := archive.Import(r.Context(), s.store, a)
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	now := s.clock.Now()
+	for _, e := range a.Blocks {
+		allowed, err := s.blocker.IsAllowed(r.Context(), e.Source)
+		if err != nil {
+			s.logger.Error("failed to check allowlist for imported block", "source", e.Source, "error", err)
+			continue
+		}
+		if allowed {
+			s.audit(r, storage.AuditImport, e.Source, "block not imported, the source is on the allowlist")
+			continue
+		}
+		if !e.ActiveAt(now) {
+			continue
+		}
+
+		if err := s.blocker.Enforce(r.Context(), e); err != nil {
+			s.logger.Error("failed to enforce imported block", "source", e.Source, "error", err)
+		}
+	}
+
+	if a.Policy != nil {
+		s.blocker.UpdatePolicy(*a.Policy)
+	}
+	if a.ServicePolicies != nil {
+		s.blocker.UpdateServicePolicies(a.ServicePolicies)
+	}
+
+	s.audit(r, storage.AuditImport, "", fmt.Sprintf("imported archive of version %v: %v entries, %v blocks, %v modules, "+
+		"%v allowlist entries, %v API keys and %v audit entries, skipped %v blocks on the allowlist", a.Version,
+		summary.Entries, summary.Blocks, summary.Modules, summary.Allowlist, summary.ApiKeys, summary.Audit,
+		summary.AllowedBlocks))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+	}
+}
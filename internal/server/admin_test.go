@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/timanema/fail2ban-service/pkg/archive"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// exportArchive exports the state of the server using the admin key
+func exportArchive(t *testing.T, ts *httptest.Server) archive.Archive {
+	t.Helper()
+
+	resp, buf := request(t, ts, http.MethodGet, "/api/admin/export", adminKey, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the export to succeed, got %v: %s", resp.StatusCode, buf)
+	}
+
+	var a archive.Archive
+	if err := json.Unmarshal(buf, &a); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return a
+}
+
+// importArchive imports the archive using the admin key, and returns the response status and summary
+func importArchive(t *testing.T, ts *httptest.Server, a archive.Archive) (int, archive.Summary) {
+	t.Helper()
+
+	body, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resp, buf := request(t, ts, http.MethodPost, "/api/admin/import", adminKey, string(body))
+	var summary archive.Summary
+	if resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal(buf, &summary); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return resp.StatusCode, summary
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	source, sourceTs, _ := newTestServer(t)
+
+	policy := blocker.Policy{Attempts: 5, Period: 2 * time.Minute, BlockTime: time.Hour}
+	source.blocker.UpdatePolicy(policy)
+	source.blocker.UpdateServicePolicies(map[string]blocker.Policy{"ssh": testPolicy})
+	if _, err := source.blocker.BlockIP(ctx, "10.0.0.1", blocker.BlockOptions{Reason: "scanner", Tags: []string{"scan"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := source.blocker.BlockIP(ctx, "2001:db8::1", blocker.BlockOptions{Permanent: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a := exportArchive(t, sourceTs)
+
+	// The archive contains a block of a source on the allowlist of the target, and of a source on its own allowlist
+	a.Allowlist = append(a.Allowlist, storage.AllowEntry{Source: "172.16.0.0/12"})
+	a.Blocks = append(a.Blocks,
+		storage.BlockEntry{Source: "192.168.1.1", Timestamp: a.Created, Duration: time.Hour},
+		storage.BlockEntry{Source: "172.16.0.1", Timestamp: a.Created, Permanent: true})
+
+	target, targetTs, _ := newTestServer(t)
+	status, summary := importArchive(t, targetTs, a)
+	if status != http.StatusOK {
+		t.Fatalf("expected the import to succeed, got %v", status)
+	}
+	if summary.Blocks != 2 || summary.AllowedBlocks != 2 || summary.Allowlist != 2 || summary.ApiKeys != 1 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	if p := target.blocker.Policy(); p != policy {
+		t.Fatalf("expected the policy of the archive to be used, got %+v", p)
+	}
+	if p := target.blocker.ServicePolicies(); !reflect.DeepEqual(p, map[string]blocker.Policy{"ssh": testPolicy}) {
+		t.Fatalf("expected the service policies of the archive to be used, got %+v", p)
+	}
+	for _, ip := range []string{"10.0.0.1", "2001:db8::1"} {
+		if blocked, _, err := target.blocker.IsBlocked(ctx, ip); err != nil || !blocked {
+			t.Fatalf("expected %v to be blocked after the import, got %v (%v)", ip, blocked, err)
+		}
+	}
+
+	// Allowlisted sources are neither stored nor enforced, but are audited
+	audit, err := target.store.FindAuditEntries(ctx, storage.AuditQuery{Action: storage.AuditImport})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	skipped := make(map[string]bool)
+	for _, e := range audit {
+		skipped[e.Source] = true
+	}
+	for _, ip := range []string{"192.168.1.1", "172.16.0.1"} {
+		if _, err := target.store.FindBlockEntry(ctx, ip); err != storage.NotFoundErr {
+			t.Fatalf("expected the block of allowlisted %v to be skipped, got %v", ip, err)
+		}
+		if !skipped[ip] {
+			t.Fatalf("expected the skipped block of %v to be audited, got %+v", ip, audit)
+		}
+	}
+
+	// Exporting the target again results in the same blocks
+	again := exportArchive(t, targetTs)
+	if len(again.Blocks) != 2 || again.Blocks[0].Source != "10.0.0.1" || again.Blocks[0].Reason != "scanner" ||
+		!again.Blocks[1].Permanent {
+		t.Fatalf("expected the imported blocks to be exported, got %+v", again.Blocks)
+	}
+}
+
+func TestImportRejected(t *testing.T) {
+	ctx := context.Background()
+	s, ts, c := newTestServer(t)
+
+	block := storage.BlockEntry{Source: "10.0.0.1", Timestamp: unix_time.Time(c.Now()), Duration: time.Hour}
+	tests := map[string]archive.Archive{
+		"missing version": {},
+		"newer version":   {Version: archive.Version + 1},
+		"policy without attempts": {Version: archive.Version,
+			Policy: &blocker.Policy{Period: time.Minute, BlockTime: time.Hour}},
+		"policy without block time": {Version: archive.Version,
+			Policy: &blocker.Policy{Attempts: 1, Period: time.Minute}},
+		"service policy without period": {Version: archive.Version,
+			ServicePolicies: map[string]blocker.Policy{"ssh": {Attempts: 3, BlockTime: time.Hour}}},
+	}
+
+	for name, a := range tests {
+		a.Blocks = []storage.BlockEntry{block}
+		if status, _ := importArchive(t, ts, a); status != http.StatusBadRequest {
+			t.Fatalf("expected an archive with %v to be rejected, got %v", name, status)
+		}
+
+		// Nothing of a rejected archive is imported
+		if _, err := s.store.FindBlockEntry(ctx, block.Source); err != storage.NotFoundErr {
+			t.Fatalf("expected nothing of an archive with %v to be imported, got %v", name, err)
+		}
+		if p := s.blocker.Policy(); p != testPolicy {
+			t.Fatalf("expected the policy to be kept after rejecting an archive with %v, got %+v", name, p)
+		}
+		if p := s.blocker.ServicePolicies(); len(p) != 0 {
+			t.Fatalf("expected no service policies after rejecting an archive with %v, got %+v", name, p)
+		}
+	}
+
+	if resp, _ := request(t, ts, http.MethodPost, "/api/admin/import", adminKey, "{"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected an invalid archive to be rejected, got %v", resp.StatusCode)
+	}
+	if resp, _ := request(t, ts, http.MethodPost, "/api/admin/import", readKey, `{"version": 1}`); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the import to require the admin scope, got %v", resp.StatusCode)
+	}
+}
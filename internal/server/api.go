@@ -1,25 +1,30 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/timanema/fail2ban-service/pkg/blocker"
 	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
 	"strconv"
+	"time"
 )
 
-func writeError(err error, w http.ResponseWriter, code int) {
+func (s *Server) writeError(err error, w http.ResponseWriter, code int) {
 	w.WriteHeader(code)
 	fmt.Fprintf(w, "%v, %v", code, http.StatusText(code))
-	log.Printf("error: %v\n", err)
+	s.logger.Error("request failed", "status", code, "error", err)
 }
 
-func writeSuccess(w http.ResponseWriter) {
+func (s *Server) writeSuccess(w http.ResponseWriter) {
 	res := struct {
 		Success bool `json:"success"`
 	}{
@@ -27,49 +32,94 @@ func writeSuccess(w http.ResponseWriter) {
 	}
 
 	if err := json.NewEncoder(w).Encode(res); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 	}
 }
 
-func (s *Server) listSources(w http.ResponseWriter, _ *http.Request) {
-	sources, err := s.store.FindSources()
+// writeBadRequest responds to requests with an invalid body or invalid parameters
+func (s *Server) writeBadRequest(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, "%v bad request, %v", http.StatusBadRequest, err)
+}
+
+// listSources responds with an object of sources and their amounts of attempts. Objects have no order, so the order
+// parameter is only supported by the v2 endpoint
+func (s *Server) listSources(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("order") != "" {
+		s.writeBadRequest(w, errors.New("order is not supported by /api/entries, use /api/v2/entries instead"))
+		return
+	}
+
+	params, err := parseListParams(r, 0)
+	if err != nil {
+		s.writeBadRequest(w, err)
+		return
+	}
+
+	page, err := s.store.ListSources(r.Context(), params.sourceQuery())
+	if err == storage.InvalidCursorErr {
+		s.writeBadRequest(w, err)
+		return
+	}
 	if err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 		return
 	}
 
+	sources := make(map[string]int, len(page.Sources))
+	for _, source := range page.Sources {
+		sources[source.Source] = source.Attempts
+	}
+
+	setNextCursor(w, page.NextCursor)
 	if err := json.NewEncoder(w).Encode(sources); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 	}
 }
 
-func (s *Server) listBlocks(w http.ResponseWriter, _ *http.Request) {
-	activeBlocks, err := s.store.AllBlockEntries(true)
+func (s *Server) listBlocks(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r, 0)
+	if err != nil {
+		s.writeBadRequest(w, err)
+		return
+	}
+
+	page, err := s.store.ListBlockEntries(r.Context(), params.blockQuery())
+	if err == storage.InvalidCursorErr {
+		s.writeBadRequest(w, err)
+		return
+	}
 	if err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(activeBlocks); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+	setNextCursor(w, page.NextCursor)
+	if err := json.NewEncoder(w).Encode(page.Entries); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
 	}
 }
 
 func (s *Server) listEntries(w http.ResponseWriter, r *http.Request) {
-	ip := mux.Vars(r)["ip"]
-	entries, err := s.store.FindAuthenticationEntries(ip)
-	if err != nil && err != storage.NotFoundErr {
-		writeError(err, w, http.StatusInternalServerError)
+	params, err := parseListParams(r, 0)
+	if err != nil {
+		s.writeBadRequest(w, err)
 		return
 	}
 
-	res := make([]storage.AuthenticationEntry, 0, len(entries))
-	for e := range entries {
-		res = append(res, e)
+	page, err := s.store.ListAuthenticationEntries(r.Context(), params.entryQuery(mux.Vars(r)["ip"]))
+	if err == storage.InvalidCursorErr {
+		s.writeBadRequest(w, err)
+		return
+	}
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
 	}
 
-	if err := json.NewEncoder(w).Encode(res); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+	setNextCursor(w, page.NextCursor)
+	if err := json.NewEncoder(w).Encode(page.Entries); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
 	}
 }
 
@@ -77,34 +127,34 @@ func (s *Server) addEntry(w http.ResponseWriter, r *http.Request) {
 	ip := mux.Vars(r)["ip"]
 	buf, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		writeError(err, w, http.StatusBadRequest)
+		s.writeError(err, w, http.StatusBadRequest)
 		return
 	}
 
 	var entry storage.AuthenticationEntry
 	if err := json.Unmarshal(buf, &entry); err != nil {
-		writeError(err, w, http.StatusBadRequest)
+		s.writeError(err, w, http.StatusBadRequest)
 		return
 	}
 
-	if !entry.Valid() || entry.Source != ip {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%v bad request, invalid entry data", http.StatusBadRequest)
+	if err := validateEntry(entry, ip); err != nil {
+		s.writeBadRequest(w, err)
 		return
 	}
 
-	if err := s.blocker.AddEntry(entry); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+	if err := s.blocker.AddEntry(r.Context(), entry); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
 	}
-	writeSuccess(w)
+	s.writeSuccess(w)
 }
 
 func (s *Server) blockedQuery(w http.ResponseWriter, r *http.Request) {
 	ip := mux.Vars(r)["ip"]
 
-	blocked, entry, err := s.blocker.IsBlocked(ip)
+	blocked, entry, err := s.blocker.IsBlocked(r.Context(), ip)
 	if err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 		return
 	}
 
@@ -120,122 +170,436 @@ func (s *Server) blockedQuery(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewEncoder(w).Encode(res); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 	}
 }
 
+type blockRequest struct {
+	Duration  time.Duration `json:"duration"`
+	Permanent bool          `json:"permanent"`
+	Reason    string        `json:"reason"`
+	Tags      []string      `json:"tags"`
+}
+
 func (s *Server) block(w http.ResponseWriter, r *http.Request) {
 	ip := mux.Vars(r)["ip"]
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(err, w, http.StatusBadRequest)
+		return
+	}
+
+	// The body is optional, without it the active policy is used
+	var req blockRequest
+	if len(bytes.TrimSpace(buf)) > 0 {
+		if err := json.Unmarshal(buf, &req); err != nil {
+			s.writeError(err, w, http.StatusBadRequest)
+			return
+		}
+	}
 
-	entry, err := s.blocker.BlockIP(ip)
+	if err := req.validate(); err != nil {
+		s.writeBadRequest(w, err)
+		return
+	}
+
+	entry, err := s.blocker.BlockIP(r.Context(), ip, blocker.BlockOptions{
+		Duration:  req.Duration,
+		Permanent: req.Permanent,
+		Reason:    req.Reason,
+		Tags:      req.Tags,
+		Actor:     identityFromContext(r.Context()).Name,
+	})
+	if err == blocker.AllowedErr {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v bad request, %v is on the allowlist", http.StatusBadRequest, ip)
+		return
+	}
 	if err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 		return
 	}
 
 	if err := json.NewEncoder(w).Encode(entry); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 	}
 }
 
 func (s *Server) unblock(w http.ResponseWriter, r *http.Request) {
 	ip := mux.Vars(r)["ip"]
 
-	if blocked, _, _ := s.blocker.IsBlocked(ip); !blocked {
+	if blocked, _, _ := s.blocker.IsBlocked(r.Context(), ip); !blocked {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%v bad request, %v is not blocked", http.StatusBadRequest, ip)
 		return
 	}
 
-	if err := s.blocker.UnblockIP(ip); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+	if err := s.blocker.UnblockIP(r.Context(), ip, identityFromContext(r.Context()).Name); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
 		return
 	}
 
-	writeSuccess(w)
+	s.writeSuccess(w)
 }
 
-func (s *Server) getPolicy(w http.ResponseWriter, _ *http.Request) {
+func (s *Server) getPolicy(w http.ResponseWriter, r *http.Request) {
 	if err := json.NewEncoder(w).Encode(s.blocker.Policy()); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 	}
 }
 
 func (s *Server) updatePolicy(w http.ResponseWriter, r *http.Request) {
 	buf, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 		return
 	}
 
 	var policy blocker.Policy
 	if err := json.Unmarshal(buf, &policy); err != nil {
-		writeError(err, w, http.StatusBadRequest)
+		s.writeError(err, w, http.StatusBadRequest)
 		return
 	}
 
+	if err := policy.Validate(); err != nil {
+		s.writeBadRequest(w, err)
+		return
+	}
+
+	old := s.blocker.Policy()
 	s.blocker.UpdatePolicy(policy)
-	writeSuccess(w)
+	s.audit(r, storage.AuditPolicyUpdate, "", fmt.Sprintf("policy changed from %+v to %+v", old, policy))
+	s.writeSuccess(w)
 }
 
-func (s *Server) getExternalModules(w http.ResponseWriter, _ *http.Request) {
-	modules, err := s.store.GetExternalModules()
+func (s *Server) getExternalModules(w http.ResponseWriter, r *http.Request) {
+	modules, err := s.store.GetExternalModules(r.Context())
 	if err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 		return
 	}
 
 	if err := json.NewEncoder(w).Encode(modules); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 	}
 }
 
 func (s *Server) addExternalModule(w http.ResponseWriter, r *http.Request) {
 	buf, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 		return
 	}
 
 	var module storage.ExternalModule
 	if err := json.Unmarshal(buf, &module); err != nil {
-		writeError(err, w, http.StatusBadRequest)
+		s.writeError(err, w, http.StatusBadRequest)
 		return
 	}
 
-	module.Id = rand.Uint32()
-
-	existingModule, err := s.store.GetExternalModuleByAddress(module.Address)
-	if err != nil && err != storage.NotFoundErr {
-		writeError(err, w, http.StatusInternalServerError)
+	if err := validateModule(module); err != nil {
+		s.writeBadRequest(w, err)
 		return
 	}
-	if err != storage.NotFoundErr {
-		module.Id = existingModule.Id
+
+	module.Id, _, err = s.externalModuleId(r.Context(), module.Address)
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
 	}
 
-	if err := s.store.AddExternalModule(module); err != nil {
-		writeError(err, w, http.StatusBadRequest)
+	if err := s.store.AddExternalModule(r.Context(), module); err != nil {
+		s.writeError(err, w, http.StatusBadRequest)
 		return
 	}
+	s.audit(r, storage.AuditModuleAdd, "", fmt.Sprintf("module %v: %v %v", module.Id, module.Method, module.Address))
 
 	if err := json.NewEncoder(w).Encode(module); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+		s.writeError(err, w, http.StatusInternalServerError)
 	}
 }
 
 func (s *Server) removeExternalModule(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	id, err := parseModuleId(mux.Vars(r)["id"])
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%v bad request, %v is not a valid number", http.StatusBadRequest, id)
+		s.writeBadRequest(w, err)
+		return
+	}
+
+	if err := s.store.RemoveExternalModule(r.Context(), id); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, storage.AuditModuleRemove, "", fmt.Sprintf("module %v", id))
+
+	s.writeSuccess(w)
+}
+
+func (s *Server) getAllowlist(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.store.GetAllowEntries(r.Context())
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) addAllowEntry(w http.ResponseWriter, r *http.Request) {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	var entry storage.AllowEntry
+	if err := json.Unmarshal(buf, &entry); err != nil {
+		s.writeError(err, w, http.StatusBadRequest)
+		return
+	}
+
+	if err := validateAllowEntry(entry); err != nil {
+		s.writeBadRequest(w, err)
+		return
+	}
+
+	if err := s.store.AddAllowEntry(r.Context(), entry); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
 		return
 	}
+	s.audit(r, storage.AuditAllowlistAdd, entry.Source, entry.Description)
+
+	if err := json.NewEncoder(w).Encode(entry); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) removeAllowEntry(w http.ResponseWriter, r *http.Request) {
+	source := mux.Vars(r)["source"]
 
-	if err := s.store.RemoveExternalModule(uint32(id)); err != nil {
-		writeError(err, w, http.StatusInternalServerError)
+	err := s.store.RemoveAllowEntry(r.Context(), source)
+	if err == storage.NotFoundErr {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%v not found, %v is not on the allowlist", http.StatusNotFound, source)
 		return
 	}
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, storage.AuditAllowlistRemove, source, "")
+
+	s.writeSuccess(w)
+}
+
+func (s *Server) getApiKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.store.GetApiKeys(r.Context())
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) addApiKey(w http.ResponseWriter, r *http.Request) {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	var key storage.ApiKey
+	if err := json.Unmarshal(buf, &key); err != nil {
+		s.writeError(err, w, http.StatusBadRequest)
+		return
+	}
+
+	if err := validateApiKey(key); err != nil {
+		s.writeBadRequest(w, err)
+		return
+	}
+
+	if _, exists, err := s.findApiKey(r.Context(), key.Name); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	} else if exists {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%v conflict, an API key named %v already exists", http.StatusConflict, key.Name)
+		return
+	}
+
+	res, err := s.createApiKey(r, key)
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) removeApiKey(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	err := s.store.RemoveApiKey(r.Context(), name)
+	if err == storage.NotFoundErr {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%v not found, there is no API key named %v", http.StatusNotFound, name)
+		return
+	}
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, storage.AuditApiKeyRemove, "", fmt.Sprintf("key %v", name))
+
+	s.writeSuccess(w)
+}
+
+// externalModuleId returns the ID of the module with the given address, or a new random ID when there is none yet
+func (s *Server) externalModuleId(ctx context.Context, address string) (uint32, bool, error) {
+	existingModule, err := s.store.GetExternalModuleByAddress(ctx, address)
+	if err == storage.NotFoundErr {
+		return rand.Uint32(), false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return existingModule.Id, true, nil
+}
+
+// findModule returns the external module with the given ID, and whether it exists
+func (s *Server) findModule(ctx context.Context, id uint32) (storage.ExternalModule, bool, error) {
+	modules, err := s.store.GetExternalModules(ctx)
+	if err != nil {
+		return storage.ExternalModule{}, false, err
+	}
+
+	for _, module := range modules {
+		if module.Id == id {
+			return module, true, nil
+		}
+	}
+	return storage.ExternalModule{}, false, nil
+}
+
+// findAllowEntry returns the allowlist entry of the given source, and whether it exists
+func (s *Server) findAllowEntry(ctx context.Context, source string) (storage.AllowEntry, bool, error) {
+	entries, err := s.store.GetAllowEntries(ctx)
+	if err != nil {
+		return storage.AllowEntry{}, false, err
+	}
+
+	for _, entry := range entries {
+		if entry.Source == source {
+			return entry, true, nil
+		}
+	}
+	return storage.AllowEntry{}, false, nil
+}
+
+// findApiKey returns the API key with the given name, and whether it exists
+func (s *Server) findApiKey(ctx context.Context, name string) (storage.ApiKey, bool, error) {
+	keys, err := s.store.GetApiKeys(ctx)
+	if err != nil {
+		return storage.ApiKey{}, false, err
+	}
+
+	for _, key := range keys {
+		if key.Name == name {
+			return key, true, nil
+		}
+	}
+	return storage.ApiKey{}, false, nil
+}
+
+// validate checks the duration of a block request, a zero duration uses the active policy
+func (req blockRequest) validate() error {
+	if req.Duration < 0 || (req.Permanent && req.Duration != 0) {
+		return errors.New("duration cannot be negative or combined with permanent")
+	}
+
+	return nil
+}
+
+// validateEntry checks an authentication entry reported for the IP in the path of the request
+func validateEntry(entry storage.AuthenticationEntry, ip string) error {
+	if entry.Source != ip {
+		return errors.New("the source of the entry must match the IP in the path")
+	}
+	if !entry.Valid() {
+		return errors.New("source, service and timestamp are required")
+	}
+
+	return nil
+}
+
+func validateModule(module storage.ExternalModule) error {
+	if module.Address == "" || module.Method == "" {
+		return errors.New("address and method are required")
+	}
+
+	return nil
+}
+
+func parseModuleId(id string) (uint32, error) {
+	parsed, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, errors.Errorf("%v is not a valid module ID", id)
+	}
+
+	return uint32(parsed), nil
+}
+
+func validateAllowEntry(entry storage.AllowEntry) error {
+	if !entry.Valid() {
+		return errors.Errorf("%v is not a valid IP or CIDR range", entry.Source)
+	}
+
+	return nil
+}
+
+// validateApiKey checks the name and scopes of an API key that is about to be created
+func validateApiKey(key storage.ApiKey) error {
+	if key.Name == "" || key.Name == defaultKeyName || len(key.Scopes) == 0 {
+		return errors.Errorf("a name other than %v and at least one scope are required", defaultKeyName)
+	}
+
+	for _, scope := range key.Scopes {
+		if _, ok := validScopes[scope]; !ok {
+			return errors.Errorf("%v is not a valid scope", scope)
+		}
+	}
+
+	return nil
+}
+
+// createdApiKey is returned once when a key is created, as only its hash is stored
+type createdApiKey struct {
+	storage.ApiKey
+	Key string `json:"key"`
+}
+
+// createApiKey generates a secret for the given key and stores its hash
+func (s *Server) createApiKey(r *http.Request, key storage.ApiKey) (createdApiKey, error) {
+	secret, err := uuid.NewRandom()
+	if err != nil {
+		return createdApiKey{}, errors.Wrap(err, "unable to generate key")
+	}
+
+	key.Hash = hashApiKey(secret.String())
+	key.Created = unix_time.Time(s.clock.Now())
+	if err := s.store.AddApiKey(r.Context(), key); err != nil {
+		return createdApiKey{}, errors.Wrap(err, "unable to store key")
+	}
+	s.audit(r, storage.AuditApiKeyAdd, "", fmt.Sprintf("key %v with scopes %v", key.Name, key.Scopes))
 
-	writeSuccess(w)
+	return createdApiKey{ApiKey: key, Key: secret.String()}, nil
 }
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/timanema/fail2ban-service/pkg/metrics"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// audit records a manual action performed by the identity of the request
+func (s *Server) audit(r *http.Request, action, source, details string) {
+	entry := storage.AuditEntry{
+		Timestamp: unix_time.Time(s.clock.Now()),
+		Action:    action,
+		Trigger:   metrics.ReasonManual,
+		Actor:     identityFromContext(r.Context()).Name,
+		Source:    source,
+		Details:   details,
+	}
+
+	if err := s.store.AddAuditEntry(r.Context(), entry); err != nil {
+		s.logger.Error("failed to add audit entry", "action", entry.Action, "source", entry.Source, "error", err)
+	}
+}
+
+func parseUnixParam(r *http.Request, name string) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	unix, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%v is not a valid unix timestamp", name)
+	}
+
+	return time.Unix(unix, 0), nil
+}
+
+func (s *Server) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	from, err := parseUnixParam(r, "from")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v bad request, %v", http.StatusBadRequest, err)
+		return
+	}
+
+	to, err := parseUnixParam(r, "to")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v bad request, %v", http.StatusBadRequest, err)
+		return
+	}
+
+	entries, err := s.store.FindAuditEntries(r.Context(), storage.AuditQuery{
+		From:   from,
+		To:     to,
+		Source: r.URL.Query().Get("source"),
+		Action: r.URL.Query().Get("action"),
+	})
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"net/http"
+	"strings"
+)
+
+// Scopes that can be granted to API keys, admin grants every other scope as well
+const (
+	ScopeRead          = "read"
+	ScopeReportEntries = "report-entries"
+	ScopeBlock         = "block"
+	ScopeAdmin         = "admin"
+)
+
+var validScopes = map[string]struct{}{
+	ScopeRead:          {},
+	ScopeReportEntries: {},
+	ScopeBlock:         {},
+	ScopeAdmin:         {},
+}
+
+// defaultKeyName is the name of the key configured using FAIL2BAN_API_KEY, which has the admin scope
+const defaultKeyName = "default"
+
+type identity struct {
+	Name   string
+	Scopes []string
+}
+
+func (i identity) hasScope(scope string) bool {
+	for _, s := range i.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+type identityKey struct{}
+
+// anonymous is used for all requests when API keys are disabled
+var anonymous = identity{Name: "anonymous", Scopes: []string{ScopeAdmin}}
+
+func identityFromContext(ctx context.Context) identity {
+	if id, ok := ctx.Value(identityKey{}).(identity); ok {
+		return id
+	}
+
+	return anonymous
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestApiKey returns the API key of the request, using either the Authorization header or the key query parameter
+func requestApiKey(r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if strings.HasPrefix(header, "Bearer ") {
+			return strings.TrimPrefix(header, "Bearer "), true
+		}
+
+		return "", false
+	}
+
+	key, ok := r.URL.Query()["key"]
+	if !ok || len(key) != 1 {
+		return "", false
+	}
+
+	return key[0], true
+}
+
+func (s *Server) authenticate(ctx context.Context, key string) (identity, bool, error) {
+	if s.config.ApiKey != "" && subtle.ConstantTimeCompare([]byte(s.config.ApiKey), []byte(key)) == 1 {
+		return identity{Name: defaultKeyName, Scopes: []string{ScopeAdmin}}, true, nil
+	}
+
+	apiKey, err := s.store.FindApiKeyByHash(ctx, hashApiKey(key))
+	if err == storage.NotFoundErr {
+		return identity{}, false, nil
+	}
+	if err != nil {
+		return identity{}, false, err
+	}
+
+	return identity{Name: apiKey.Name, Scopes: apiKey.Scopes}, true, nil
+}
+
+// authEnabled reports whether requests need to be authenticated, using either an API key or a client certificate
+func (s *Server) authEnabled() bool {
+	return s.config.ApiKeyEnabled || len(s.config.TlsClientIdentities) > 0
+}
+
+// requestIdentity identifies the API key or client certificate used for the request. Client certificates that map to
+// an identity take precedence over API keys. When the request cannot be authenticated the status code to respond with
+// is returned instead
+func (s *Server) requestIdentity(r *http.Request) (identity, int, error) {
+	if !s.authEnabled() {
+		return anonymous, http.StatusOK, nil
+	}
+
+	if id, ok := s.certificateIdentity(r); ok {
+		return id, http.StatusOK, nil
+	}
+
+	key, ok := requestApiKey(r)
+	if !ok {
+		return identity{}, http.StatusUnauthorized, nil
+	}
+
+	id, ok, err := s.authenticate(r.Context(), key)
+	if err != nil {
+		return identity{}, http.StatusInternalServerError, err
+	}
+	if !ok {
+		return identity{}, http.StatusForbidden, nil
+	}
+
+	return id, http.StatusOK, nil
+}
+
+// apiKeyMiddleware identifies the API key or client certificate used for the request, and stores it in the request
+// context
+func (s *Server) apiKeyMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, code, err := s.requestIdentity(r)
+		if err != nil {
+			s.writeError(err, w, code)
+			return
+		}
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// requireScope only calls the handler if the identity of the request has the given scope. Mutations are logged with
+// the name of the API key or client certificate that performed them
+func (s *Server) requireScope(scope string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := identityFromContext(r.Context())
+		if !id.hasScope(scope) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "%v forbidden, %v does not have the %v scope", http.StatusForbidden, id.Name, scope)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.logger.Info("request performed", "method", r.Method, "path", r.URL.Path, "actor", id.Name)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
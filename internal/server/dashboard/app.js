@@ -0,0 +1,347 @@
+// Dashboard for the fail2ban service, only uses the public API
+"use strict";
+
+const keyStorage = "fail2ban-api-key";
+const refreshInterval = 10000;
+const sampledSources = 25;
+const recentAttempts = 25;
+
+let apiKey = localStorage.getItem(keyStorage) || "";
+let blocks = [];
+
+class ApiError extends Error {
+    constructor(status, message) {
+        super(message);
+        this.status = status;
+    }
+}
+
+async function api(method, path, body) {
+    const url = new URL(path, window.location.origin);
+    const options = {method: method, headers: {"Accept": "application/json"}};
+    if (apiKey) {
+        options.headers["Authorization"] = `Bearer ${apiKey}`;
+    }
+
+    if (body !== undefined) {
+        options.headers["Content-Type"] = "application/json";
+        options.body = JSON.stringify(body);
+    }
+
+    const resp = await fetch(url, options);
+    const text = await resp.text();
+    if (!resp.ok) {
+        throw new ApiError(resp.status, text.trim() || resp.statusText);
+    }
+
+    return text ? JSON.parse(text) : null;
+}
+
+// Durations in the API are in nanoseconds, the dashboard uses Go style durations such as 1h30m
+const units = {ns: 1, us: 1e3, "µs": 1e3, ms: 1e6, s: 1e9, m: 60e9, h: 3600e9, d: 86400e9};
+
+function parseDuration(value) {
+    const re = /(\d+(?:\.\d+)?)(ns|us|µs|ms|s|m|h|d)/g;
+    const trimmed = value.replace(/\s+/g, "");
+    let total = 0;
+    let consumed = 0;
+    let match;
+
+    while ((match = re.exec(trimmed)) !== null) {
+        if (match.index !== consumed) {
+            break;
+        }
+        total += parseFloat(match[1]) * units[match[2]];
+        consumed += match[0].length;
+    }
+
+    if (consumed === 0 || consumed !== trimmed.length) {
+        throw new Error(`invalid duration: ${value}`);
+    }
+
+    return Math.round(total);
+}
+
+function formatDuration(ns) {
+    let seconds = Math.max(0, Math.floor(ns / 1e9));
+    if (seconds === 0) {
+        return ns > 0 ? `${Math.round(ns / 1e6)}ms` : "0s";
+    }
+
+    const parts = [];
+    for (const [unit, size] of [["d", 86400], ["h", 3600], ["m", 60], ["s", 1]]) {
+        if (seconds >= size) {
+            parts.push(`${Math.floor(seconds / size)}${unit}`);
+            seconds %= size;
+        }
+    }
+
+    return parts.join("");
+}
+
+function formatTime(unix) {
+    return new Date(unix * 1000).toLocaleString();
+}
+
+function remaining(entry) {
+    if (entry.permanent) {
+        return Infinity;
+    }
+
+    return (entry.timestamp * 1000 + entry.duration / 1e6 - Date.now()) * 1e6;
+}
+
+function cell(text, className) {
+    const td = document.createElement("td");
+    td.textContent = text;
+    if (className) {
+        td.className = className;
+    }
+    return td;
+}
+
+function button(text, className, handler) {
+    const td = document.createElement("td");
+    const b = document.createElement("button");
+    b.textContent = text;
+    b.className = className;
+    b.addEventListener("click", handler);
+    td.appendChild(b);
+    return td;
+}
+
+function fill(id, rows, columns) {
+    const body = document.getElementById(id);
+    body.replaceChildren();
+
+    if (rows.length === 0) {
+        const tr = document.createElement("tr");
+        const td = cell("Nothing to show", "empty");
+        td.colSpan = columns;
+        tr.appendChild(td);
+        body.appendChild(tr);
+        return;
+    }
+
+    for (const row of rows) {
+        const tr = document.createElement("tr");
+        row.forEach(c => tr.appendChild(c instanceof HTMLElement ? c : cell(String(c))));
+        body.appendChild(tr);
+    }
+}
+
+function setStatus(message, error) {
+    const status = document.getElementById("status");
+    status.textContent = message;
+    status.className = error ? "error" : "";
+}
+
+function handleError(err) {
+    if (err instanceof ApiError && (err.status === 401 || err.status === 403)) {
+        showLogin(err.status === 403 ? "The API key was rejected" : "");
+        return;
+    }
+
+    setStatus(err.message, true);
+}
+
+function showLogin(message) {
+    document.getElementById("content").hidden = true;
+    document.getElementById("logout").hidden = true;
+    document.getElementById("login").hidden = false;
+    document.getElementById("login-error").textContent = message;
+    setStatus("");
+}
+
+function showContent() {
+    document.getElementById("login").hidden = true;
+    document.getElementById("content").hidden = false;
+    document.getElementById("logout").hidden = !apiKey;
+}
+
+function renderBlocks() {
+    const active = blocks.filter(b => remaining(b) > 0);
+    active.sort((a, b) => remaining(a) - remaining(b));
+
+    document.getElementById("blocks-count").textContent = `(${active.length})`;
+    fill("blocks", active.map(b => [
+        b.source,
+        formatTime(b.timestamp),
+        b.permanent ? "permanent" : formatDuration(b.duration),
+        b.permanent ? "permanent" : formatDuration(remaining(b)),
+        (b.tags || []).join(", "),
+        b.reason || "",
+        button("Unblock", "danger", () => unblock(b.source)),
+    ]), 7);
+}
+
+async function loadBlocks() {
+    blocks = await api("GET", "/api/blocks") || [];
+    renderBlocks();
+}
+
+// Services and recent attempts are derived from the attempts of the most active sources, as the API has no
+// endpoint listing all attempts at once
+async function loadEntries() {
+    const sources = Object.entries(await api("GET", "/api/entries/") || {});
+    sources.sort((a, b) => b[1] - a[1]);
+
+    fill("sources", sources.slice(0, 10), 2);
+
+    const sampled = sources.slice(0, sampledSources);
+    const lists = await Promise.all(sampled.map(([source]) =>
+        api("GET", `/api/entries/list/${encodeURIComponent(source)}`)));
+    const attempts = lists.flat().filter(e => e);
+
+    const services = {};
+    for (const a of attempts) {
+        services[a.service] = (services[a.service] || 0) + 1;
+    }
+
+    const topServices = Object.entries(services);
+    topServices.sort((a, b) => b[1] - a[1]);
+    fill("services", topServices.slice(0, 10), 2);
+
+    document.getElementById("services-hint").textContent = sources.length > sampledSources
+        ? `Based on the ${sampledSources} most active of ${sources.length} sources`
+        : "";
+
+    attempts.sort((a, b) => b.timestamp - a.timestamp);
+    fill("attempts", attempts.slice(0, recentAttempts).map(a => [a.source, a.service, formatTime(a.timestamp)]), 3);
+}
+
+async function loadPolicy() {
+    const policy = await api("GET", "/api/policy");
+    const form = document.getElementById("policy-form");
+
+    // Do not overwrite values the operator is editing
+    if (form.contains(document.activeElement)) {
+        return;
+    }
+
+    document.getElementById("policy-attempts").value = policy.attempts;
+    document.getElementById("policy-period").value = formatDuration(policy.period);
+    document.getElementById("policy-blocktime").value = formatDuration(policy.blocktime);
+}
+
+async function loadModules() {
+    const modules = await api("GET", "/api/modules") || [];
+    modules.sort((a, b) => a.address.localeCompare(b.address));
+
+    fill("modules", modules.map(m => [
+        m.id,
+        m.method,
+        m.address,
+        button("Remove", "danger", () => removeModule(m.id)),
+    ]), 4);
+}
+
+async function refresh() {
+    try {
+        await Promise.all([loadBlocks(), loadEntries(), loadPolicy(), loadModules()]);
+        showContent();
+        setStatus(`Last updated ${new Date().toLocaleTimeString()}`);
+    } catch (err) {
+        handleError(err);
+    }
+}
+
+async function unblock(source) {
+    if (!confirm(`Unblock ${source}?`)) {
+        return;
+    }
+
+    try {
+        await api("POST", `/api/unblock/${encodeURIComponent(source)}`);
+        await refresh();
+    } catch (err) {
+        handleError(err);
+    }
+}
+
+async function removeModule(id) {
+    if (!confirm(`Remove module ${id}?`)) {
+        return;
+    }
+
+    try {
+        await api("DELETE", `/api/module/${id}`);
+        await refresh();
+    } catch (err) {
+        handleError(err);
+    }
+}
+
+document.getElementById("login-form").addEventListener("submit", e => {
+    e.preventDefault();
+    apiKey = document.getElementById("login-key").value;
+    localStorage.setItem(keyStorage, apiKey);
+    refresh();
+});
+
+document.getElementById("logout").addEventListener("click", () => {
+    apiKey = "";
+    localStorage.removeItem(keyStorage);
+    showLogin("");
+});
+
+document.getElementById("block-form").addEventListener("submit", async e => {
+    e.preventDefault();
+
+    try {
+        const body = {reason: document.getElementById("block-reason").value};
+        const duration = document.getElementById("block-duration").value.trim();
+        if (document.getElementById("block-permanent").checked) {
+            body.permanent = true;
+        } else if (duration) {
+            body.duration = parseDuration(duration);
+        }
+
+        const tags = document.getElementById("block-tags").value.split(",").map(t => t.trim()).filter(t => t);
+        if (tags.length > 0) {
+            body.tags = tags;
+        }
+
+        const ip = document.getElementById("block-ip").value.trim();
+        await api("POST", `/api/block/${encodeURIComponent(ip)}`, body);
+        e.target.reset();
+        await refresh();
+    } catch (err) {
+        handleError(err);
+    }
+});
+
+document.getElementById("policy-form").addEventListener("submit", async e => {
+    e.preventDefault();
+
+    try {
+        await api("PATCH", "/api/policy", {
+            attempts: parseInt(document.getElementById("policy-attempts").value, 10),
+            period: parseDuration(document.getElementById("policy-period").value),
+            blocktime: parseDuration(document.getElementById("policy-blocktime").value),
+        });
+        document.activeElement.blur();
+        await refresh();
+    } catch (err) {
+        handleError(err);
+    }
+});
+
+document.getElementById("module-form").addEventListener("submit", async e => {
+    e.preventDefault();
+
+    try {
+        await api("PUT", "/api/module", {
+            address: document.getElementById("module-address").value.trim(),
+            method: document.getElementById("module-method").value,
+        });
+        e.target.reset();
+        await refresh();
+    } catch (err) {
+        handleError(err);
+    }
+});
+
+refresh();
+setInterval(refresh, refreshInterval);
+setInterval(renderBlocks, 1000);
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the exported blocklist
+const (
+	exportPlain = "plain"
+	exportIpset = "ipset"
+	exportNginx = "nginx"
+	exportCsv   = "csv"
+)
+
+// defaultIpsetName is used when no set name is given, IPv6 sources are added to a set with the -v6 suffix
+const defaultIpsetName = "fail2ban"
+
+// ipsetNamePattern allows names that fit in the 31 characters of ipset, including the suffix
+var ipsetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,28}$`)
+
+type exportParams struct {
+	format       string
+	tag          string
+	service      string
+	minRemaining time.Duration
+	ipset        string
+}
+
+func parseExportParams(r *http.Request) (exportParams, error) {
+	query := r.URL.Query()
+	p := exportParams{
+		format:  query.Get("format"),
+		tag:     query.Get("tag"),
+		service: query.Get("service"),
+		ipset:   query.Get("set"),
+	}
+
+	switch p.format {
+	case "":
+		p.format = exportPlain
+	case exportPlain, exportIpset, exportNginx, exportCsv:
+	default:
+		return exportParams{}, errors.Errorf("format %v is not plain, ipset, nginx or csv", p.format)
+	}
+
+	if v := query.Get("min_remaining"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return exportParams{}, errors.Errorf("min_remaining %v is not a positive duration", v)
+		}
+		p.minRemaining = d
+	}
+
+	if p.ipset == "" {
+		p.ipset = defaultIpsetName
+	}
+	if !ipsetNamePattern.MatchString(p.ipset) {
+		return exportParams{}, errors.Errorf("set %v is not a valid ipset name", p.ipset)
+	}
+
+	return p, nil
+}
+
+// exportBlocklist serves the active blocks in a format other systems can load directly. The ETag is based on the
+// content, so pollers only download the list when it changed
+func (s *Server) exportBlocklist(w http.ResponseWriter, r *http.Request) {
+	params, err := parseExportParams(r)
+	if err != nil {
+		s.writeBadRequest(w, err)
+		return
+	}
+
+	page, err := s.store.ListBlockEntries(r.Context(), storage.BlockQuery{
+		Service: params.service,
+		Tag:     params.tag,
+		State:   storage.BlockStateActive,
+	})
+	if err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	now := s.clock.Now()
+	entries := make([]storage.BlockEntry, 0, len(page.Entries))
+	for _, e := range page.Entries {
+		if e.Permanent || e.Timestamp.Time().Add(e.Duration).Sub(now) >= params.minRemaining {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Source < entries[j].Source })
+
+	var buf bytes.Buffer
+	contentType := "text/plain; charset=utf-8"
+	switch params.format {
+	case exportPlain:
+		for _, e := range entries {
+			fmt.Fprintln(&buf, e.Source)
+		}
+	case exportIpset:
+		writeIpset(&buf, params.ipset, entries)
+	case exportNginx:
+		for _, e := range entries {
+			fmt.Fprintf(&buf, "deny %v;\n", e.Source)
+		}
+	case exportCsv:
+		contentType = "text/csv; charset=utf-8"
+		if err := writeCsv(&buf, entries); err != nil {
+			s.writeError(err, w, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+}
+
+// writeIpset writes an ipset restore file, which creates the sets when they do not exist yet
+func writeIpset(buf *bytes.Buffer, name string, entries []storage.BlockEntry) {
+	v6 := name + "-v6"
+	fmt.Fprintf(buf, "create %v hash:net family inet -exist\n", name)
+	fmt.Fprintf(buf, "create %v hash:net family inet6 -exist\n", v6)
+
+	for _, e := range entries {
+		set := name
+		if isIPv6(e.Source) {
+			set = v6
+		}
+		fmt.Fprintf(buf, "add %v %v -exist\n", set, e.Source)
+	}
+}
+
+func isIPv6(source string) bool {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		ip, _, _ = net.ParseCIDR(source)
+	}
+
+	return ip != nil && ip.To4() == nil
+}
+
+// writeCsv writes the blocks with unix timestamps, the expiry of permanent blocks is empty
+func writeCsv(buf *bytes.Buffer, entries []storage.BlockEntry) error {
+	cw := csv.NewWriter(buf)
+	if err := cw.Write([]string{"source", "timestamp", "expires", "permanent", "reason", "service", "tags"}); err != nil {
+		return errors.Wrap(err, "failed to write csv")
+	}
+
+	for _, e := range entries {
+		expires := ""
+		if !e.Permanent {
+			expires = strconv.FormatInt(e.Timestamp.Time().Add(e.Duration).Unix(), 10)
+		}
+
+		record := []string{
+			e.Source,
+			strconv.FormatInt(e.Timestamp.Time().Unix(), 10),
+			expires,
+			strconv.FormatBool(e.Permanent),
+			e.Reason,
+			e.Service,
+			strings.Join(e.Tags, ";"),
+		}
+		if err := cw.Write(record); err != nil {
+			return errors.Wrap(err, "failed to write csv")
+		}
+	}
+
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "failed to write csv")
+}
+
+// etagMatches checks whether the If-None-Match header contains the ETag, using a weak comparison
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
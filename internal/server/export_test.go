@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newExportServer serves a server with blocks of different durations, services, tags and address families
+func newExportServer(t *testing.T) (*Server, *httptest.Server, func(time.Duration) time.Time) {
+	t.Helper()
+
+	s, ts, c := newTestServer(t)
+	blocks := map[string]blocker.BlockOptions{
+		"10.0.0.1":    {Duration: time.Hour, Service: "smtp"},
+		"10.0.0.2":    {Duration: 10 * time.Minute, Service: "ssh", Tags: []string{"scanner", "botnet"}, Reason: "port scan"},
+		"10.1.0.0/16": {Duration: 2 * time.Minute, Service: "ssh"},
+		"2001:db8::1": {Permanent: true, Tags: []string{"scanner"}},
+	}
+	for source, opts := range blocks {
+		if _, err := s.blocker.BlockIP(context.Background(), source, opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	return s, ts, c.Advance
+}
+
+// export requests the blocklist with the given query and If-None-Match header, which is omitted when empty
+func export(t *testing.T, ts *httptest.Server, query, ifNoneMatch string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/export/blocklist?"+query, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+readKey)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return resp, string(buf)
+}
+
+func TestExportFormats(t *testing.T) {
+	_, ts, _ := newExportServer(t)
+
+	tests := []struct {
+		query       string
+		contentType string
+		body        string
+	}{
+		{"", "text/plain; charset=utf-8", "10.0.0.1\n10.0.0.2\n10.1.0.0/16\n2001:db8::1\n"},
+		{"format=plain&tag=scanner", "text/plain; charset=utf-8", "10.0.0.2\n2001:db8::1\n"},
+		{"format=nginx&service=ssh", "text/plain; charset=utf-8", "deny 10.0.0.2;\ndeny 10.1.0.0/16;\n"},
+		{"format=ipset&set=blocked&tag=scanner", "text/plain; charset=utf-8", "create blocked hash:net family inet -exist\n" +
+			"create blocked-v6 hash:net family inet6 -exist\nadd blocked 10.0.0.2 -exist\nadd blocked-v6 2001:db8::1 -exist\n"},
+	}
+
+	for _, test := range tests {
+		resp, body := export(t, ts, test.query, "")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != test.contentType {
+			t.Fatalf("expected %v to respond with %v, got %v and %v", test.query, test.contentType, resp.StatusCode,
+				resp.Header.Get("Content-Type"))
+		}
+		if body != test.body {
+			t.Fatalf("expected %v to export %q, got %q", test.query, test.body, body)
+		}
+	}
+
+	resp, body := export(t, ts, "format=csv&tag=scanner", "")
+	if resp.Header.Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("expected a CSV response, got %v", resp.Header.Get("Content-Type"))
+	}
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != "source,timestamp,expires,permanent,reason,service,tags" {
+		t.Fatalf("expected a header and two blocks, got %v", records)
+	}
+	if r := records[1]; r[0] != "10.0.0.2" || r[2] != "1600000600" || r[3] != "false" || r[4] != "port scan" ||
+		r[5] != "ssh" || r[6] != "scanner;botnet" {
+		t.Fatalf("unexpected CSV record %v", r)
+	}
+	if r := records[2]; r[0] != "2001:db8::1" || r[2] != "" || r[3] != "true" {
+		t.Fatalf("expected permanent blocks to not expire, got %v", r)
+	}
+
+	for _, query := range []string{"format=json", "set=invalid.name", "min_remaining=-1m", "min_remaining=soon"} {
+		if resp, _ := export(t, ts, query, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected %v to be rejected, got %v", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestExportETag(t *testing.T) {
+	s, ts, _ := newExportServer(t)
+
+	resp, _ := export(t, ts, "", "")
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag")
+	}
+
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		resp, body := export(t, ts, "", header)
+		if resp.StatusCode != http.StatusNotModified || body != "" {
+			t.Fatalf("expected If-None-Match %v to respond with 304 without a body, got %v", header, resp.StatusCode)
+		}
+	}
+
+	// Other formats and changed content have a different ETag
+	if resp, _ := export(t, ts, "format=nginx", etag); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected another format to be served, got %v", resp.StatusCode)
+	}
+	if _, err := s.blocker.BlockIP(context.Background(), "10.0.0.3", blocker.BlockOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, _ = export(t, ts, "", etag)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Fatalf("expected the changed list to be served with a new ETag, got %v", resp.StatusCode)
+	}
+}
+
+func TestExportMinRemaining(t *testing.T) {
+	_, ts, advance := newExportServer(t)
+
+	if _, body := export(t, ts, "min_remaining=5m", ""); body != "10.0.0.1\n10.0.0.2\n2001:db8::1\n" {
+		t.Fatalf("expected blocks ending within 5 minutes to be excluded, got %q", body)
+	}
+
+	// Permanent blocks are always included
+	advance(6 * time.Minute)
+	if _, body := export(t, ts, "min_remaining=5m", ""); body != "10.0.0.1\n2001:db8::1\n" {
+		t.Fatalf("expected only the hour long and permanent blocks, got %q", body)
+	}
+	if _, body := export(t, ts, "min_remaining=2h", ""); body != "2001:db8::1\n" {
+		t.Fatalf("expected only the permanent block, got %q", body)
+	}
+
+	// Expired blocks are never included
+	advance(time.Hour)
+	if _, body := export(t, ts, "", ""); body != "2001:db8::1\n" {
+		t.Fatalf("expected expired blocks to be excluded, got %q", body)
+	}
+}
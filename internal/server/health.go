@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	statusOk      = "ok"
+	statusFailing = "failing"
+)
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func (s *Server) writeHealth(w http.ResponseWriter, res healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if res.Status != statusOk {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		s.writeError(err, w, http.StatusInternalServerError)
+	}
+}
+
+// healthz only reports whether the process is alive and serving requests
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	s.writeHealth(w, healthResponse{Status: statusOk})
+}
+
+// readyz reports whether the server is able to handle requests, with the status of every individual check
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]error{
+		"storage":  storage.Ping(r.Context(), s.store),
+		"firewall": s.blocker.CheckFirewall(),
+	}
+
+	if atomic.LoadInt32(&s.notified) == 0 {
+		checks["initial_notify"] = errors.New("external modules and firewall have not been notified of existing blocks yet")
+	} else {
+		checks["initial_notify"] = nil
+	}
+
+	if atomic.LoadInt32(&s.shuttingDown) == 1 {
+		checks["shutdown"] = errors.New("server is shutting down")
+	} else {
+		checks["shutdown"] = nil
+	}
+
+	res := healthResponse{
+		Status: statusOk,
+		Checks: make(map[string]checkResult, len(checks)),
+	}
+	for name, err := range checks {
+		if err != nil {
+			res.Status = statusFailing
+			res.Checks[name] = checkResult{Status: statusFailing, Error: err.Error()}
+		} else {
+			res.Checks[name] = checkResult{Status: statusOk}
+		}
+	}
+
+	s.writeHealth(w, res)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// checkHealth requests the health endpoint, and verifies the status code and overall status of the response
+func checkHealth(t *testing.T, ts *httptest.Server, path string, status int, expected string) healthResponse {
+	t.Helper()
+
+	resp, buf := request(t, ts, http.MethodGet, path, "", "")
+	var res healthResponse
+	if err := json.Unmarshal(buf, &res); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != status || res.Status != expected {
+		t.Fatalf("expected %v to respond with %v and %v, got %v and %+v", path, status, expected, resp.StatusCode, res)
+	}
+	return res
+}
+
+func TestHealth(t *testing.T) {
+	s, ts, _ := newTestServer(t)
+	check := func(path string, status int, expected string) healthResponse {
+		t.Helper()
+		return checkHealth(t, ts, path, status, expected)
+	}
+
+	check("/healthz", http.StatusOK, statusOk)
+
+	// The server is not ready until existing blocks have been enforced
+	res := check("/readyz", http.StatusServiceUnavailable, statusFailing)
+	if res.Checks["initial_notify"].Status != statusFailing || res.Checks["storage"].Status != statusOk {
+		t.Fatalf("expected only the initial notification to fail, got %+v", res)
+	}
+
+	atomic.StoreInt32(&s.notified, 1)
+	check("/readyz", http.StatusOK, statusOk)
+
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	res = check("/readyz", http.StatusServiceUnavailable, statusFailing)
+	if res.Checks["shutdown"].Status != statusFailing {
+		t.Fatalf("expected the shutdown check to fail, got %+v", res)
+	}
+	check("/healthz", http.StatusOK, statusOk)
+}
+
+// failingFirewall is a firewall that cannot be used, for example because iptables is missing
+type failingFirewall struct {
+	blocker.NoopFirewall
+}
+
+func (failingFirewall) Check() error {
+	return errors.New("iptables not found")
+}
+
+func TestReadyFirewall(t *testing.T) {
+	s, ts, c := newTestServer(t)
+	atomic.StoreInt32(&s.notified, 1)
+	checkHealth(t, ts, "/readyz", http.StatusOK, statusOk)
+
+	// The server is not ready when blocks cannot be enforced, but is still alive
+	s.blocker = blocker.New(s.store, testPolicy, failingFirewall{}, c, logging.Discard())
+	res := checkHealth(t, ts, "/readyz", http.StatusServiceUnavailable, statusFailing)
+	if check := res.Checks["firewall"]; check.Status != statusFailing || check.Error != "iptables not found" {
+		t.Fatalf("expected only the firewall check to fail, got %+v", res)
+	}
+	for name, check := range res.Checks {
+		if name != "firewall" && check.Status != statusOk {
+			t.Fatalf("expected only the firewall check to fail, got %+v", res)
+		}
+	}
+	checkHealth(t, ts, "/healthz", http.StatusOK, statusOk)
+}
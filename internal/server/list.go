@@ -0,0 +1,149 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxListLimit is the maximum page size of list endpoints, larger limits are lowered to it
+const maxListLimit = 1000
+
+// nextCursorHeader contains the cursor of the next page for /api endpoints, whose bodies cannot contain it
+const nextCursorHeader = "X-Next-Cursor"
+
+var invalidNetworkErr = errors.New("not a valid IP or CIDR range")
+
+// listParams are the filters, sort order and pagination supported by all list endpoints
+type listParams struct {
+	network *net.IPNet
+	service string
+	tag     string
+	from    time.Time
+	to      time.Time
+	state   string
+	page    storage.Pagination
+}
+
+// parseListParams parses the query parameters of a list request, without a limit parameter the default limit is used
+func parseListParams(r *http.Request, defaultLimit int) (listParams, error) {
+	query := r.URL.Query()
+	p := listParams{
+		service: query.Get("service"),
+		tag:     query.Get("tag"),
+		state:   storage.BlockStateActive,
+		page: storage.Pagination{
+			Limit:  defaultLimit,
+			Cursor: query.Get("cursor"),
+		},
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return listParams{}, errors.Errorf("limit %v is not a positive number", v)
+		}
+		p.page.Limit = limit
+	}
+	if p.page.Limit > maxListLimit {
+		p.page.Limit = maxListLimit
+	}
+
+	switch order := query.Get("order"); order {
+	case "", "desc":
+	case "asc":
+		p.page.Ascending = true
+	default:
+		return listParams{}, errors.Errorf("order %v is not asc or desc", order)
+	}
+
+	switch state := query.Get("state"); state {
+	case "", storage.BlockStateActive:
+	case storage.BlockStateExpired:
+		p.state = storage.BlockStateExpired
+	case "all":
+		p.state = storage.BlockStateAny
+	default:
+		return listParams{}, errors.Errorf("state %v is not active, expired or all", state)
+	}
+
+	if v := query.Get("cidr"); v != "" {
+		network, err := parseNetwork(v)
+		if err != nil {
+			return listParams{}, err
+		}
+		p.network = network
+	}
+
+	var err error
+	if p.from, err = parseUnixParam(r, "from"); err != nil {
+		return listParams{}, err
+	}
+	if p.to, err = parseUnixParam(r, "to"); err != nil {
+		return listParams{}, err
+	}
+
+	return p, nil
+}
+
+// setNextCursor adds the cursor of the next page to the headers, if there is one
+func setNextCursor(w http.ResponseWriter, cursor string) {
+	if cursor != "" {
+		w.Header().Set(nextCursorHeader, cursor)
+	}
+}
+
+// parseNetwork parses a CIDR range, a single IP results in a range containing only that IP
+func parseNetwork(v string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(v); err == nil {
+		return network, nil
+	}
+
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, errors.Wrap(invalidNetworkErr, v)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (p listParams) blockQuery() storage.BlockQuery {
+	return storage.BlockQuery{
+		Network:    p.network,
+		Service:    p.service,
+		Tag:        p.tag,
+		From:       p.from,
+		To:         p.to,
+		State:      p.state,
+		Pagination: p.page,
+	}
+}
+
+func (p listParams) entryQuery(source string) storage.EntryQuery {
+	return storage.EntryQuery{
+		Source:     source,
+		Network:    p.network,
+		Service:    p.service,
+		From:       p.from,
+		To:         p.to,
+		Pagination: p.page,
+	}
+}
+
+func (p listParams) sourceQuery() storage.SourceQuery {
+	return storage.SourceQuery{
+		Network:    p.network,
+		Service:    p.service,
+		From:       p.from,
+		To:         p.to,
+		Pagination: p.page,
+	}
+}
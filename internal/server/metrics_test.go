@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/timanema/fail2ban-service/pkg/clock/fakeclock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns all samples exposed at /metrics, keyed by their name and labels as written in the exposition format
+func scrape(t *testing.T, ts *httptest.Server, key string) map[string]float64 {
+	t.Helper()
+
+	resp, buf := request(t, ts, http.MethodGet, "/metrics", key, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the metrics to be served, got %v: %s", resp.StatusCode, buf)
+	}
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	store := storage.NewInstrumentedStore(storage.NewMemoryStore(c, logging.Discard()))
+	s := New(store, testPolicy, Config{MetricsEnabled: true}, c, logging.Discard())
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	// The metrics are global, so only the difference caused by this test is checked
+	before := scrape(t, ts, "")
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if resp, buf := request(t, ts, http.MethodPost, "/api/block/"+ip, "", ""); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected %v to be blocked, got %v: %s", ip, resp.StatusCode, buf)
+		}
+	}
+	if resp, buf := request(t, ts, http.MethodPost, "/api/unblock/10.0.0.1", "", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 10.0.0.1 to be unblocked, got %v: %s", resp.StatusCode, buf)
+	}
+	after := scrape(t, ts, "")
+
+	counters := map[string]float64{
+		`fail2ban_blocks_total{reason="manual"}`:   2,
+		`fail2ban_unblocks_total{reason="manual"}`: 1,
+	}
+	for sample, expected := range counters {
+		if diff := after[sample] - before[sample]; diff != expected {
+			t.Fatalf("expected %v to increase by %v, got %v", sample, expected, diff)
+		}
+	}
+
+	// Every storage operation is observed in the histogram of its operation
+	for _, operation := range []string{"add_block_entry", "remove_block_entry"} {
+		sample := fmt.Sprintf(`fail2ban_storage_operation_duration_seconds_count{operation="%v"}`, operation)
+		if after[sample]-before[sample] < 1 {
+			t.Fatalf("expected %v to be observed, got %v before and %v after", operation, before[sample], after[sample])
+		}
+		bucket := fmt.Sprintf(`fail2ban_storage_operation_duration_seconds_bucket{operation="%v",le="+Inf"}`, operation)
+		if after[bucket] != after[sample] {
+			t.Fatalf("expected the +Inf bucket of %v to contain all observations, got %v of %v", operation, after[bucket],
+				after[sample])
+		}
+	}
+}
+
+func TestMetricsApiKey(t *testing.T) {
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	store := storage.NewMemoryStore(c, logging.Discard())
+	config := Config{ApiKeyEnabled: true, ApiKey: adminKey, MetricsEnabled: true, MetricsApiKeyEnabled: true}
+	ts := httptest.NewServer(New(store, testPolicy, config, c, logging.Discard()).Handler())
+	defer ts.Close()
+
+	if resp, _ := request(t, ts, http.MethodGet, "/metrics", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the metrics to require an API key, got %v", resp.StatusCode)
+	}
+	if samples := scrape(t, ts, adminKey); len(samples) == 0 {
+		t.Fatalf("expected the metrics to be served with an API key")
+	}
+}
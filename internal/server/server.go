@@ -5,141 +5,292 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock"
 	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/tracing"
 	"github.com/timanema/fail2ban-service/pkg/unix_time"
-	"log"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Config struct {
+	ListenAddress string `default:":8080" split_words:"true"`
+
+	// TLS is enabled when a certificate and key are given, the files are reloaded when they change
+	TlsCertFile string `split_words:"true"`
+	TlsKeyFile  string `split_words:"true"`
+	// Client certificates are verified against this CA bundle when it is given
+	TlsClientCaFile       string `split_words:"true"`
+	TlsClientCertRequired bool   `default:"false" split_words:"true"`
+	// TlsClientIdentities maps the common name or a DNS name of client certificates to scopes, joined using a +
+	TlsClientIdentities map[string]string `split_words:"true"`
+
 	GenerateDebugData bool `default:"true" split_words:"true"`
 
 	ApiKeyEnabled bool   `default:"false" split_words:"true"`
 	ApiKey        string `split_words:"true"`
 
 	IptablesBlockerEnabled bool `default:"true" split_words:"true"`
+
+	DashboardEnabled bool `default:"true" split_words:"true"`
+
+	MetricsEnabled       bool `default:"true" split_words:"true"`
+	MetricsApiKeyEnabled bool `default:"false" split_words:"true"`
+
+	// ShutdownDelay is the time between failing readiness checks and closing the listener on shutdown
+	ShutdownDelay time.Duration `default:"0s" split_words:"true"`
+	// ShutdownTimeout limits the time spent on finishing requests and draining in-flight work after the delay
+	ShutdownTimeout time.Duration `default:"10s" split_words:"true"`
 }
 
 type Server struct {
+	logger  *slog.Logger
 	store   storage.Storage
 	blocker *blocker.Blocker
 	config  Config
+	clock   clock.Clock
 
 	server *http.Server
+	// peerHandlers are used by other nodes of a cluster, by path
+	peerHandlers map[string]http.Handler
+
+	// ctx is cancelled on shutdown to stop the background loops, which are tracked by loops
+	ctx    context.Context
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
+
+	// Accessed atomically, used by the readiness check
+	notified     int32
+	shuttingDown int32
 }
 
-func New(store storage.Storage, policy blocker.Policy, config Config) *Server {
+// New creates a server using the given storage, the clock is used for the timestamps of blocks and audit entries, and
+// to determine which blocks are active
+func New(store storage.Storage, policy blocker.Policy, config Config, clock clock.Clock, logger *slog.Logger) *Server {
+	var firewall blocker.Firewall = blocker.NoopFirewall{}
+	if config.IptablesBlockerEnabled {
+		firewall = blocker.IptablesFirewall{}
+	}
+
 	s := &Server{
+		logger:  logger,
 		store:   store,
-		blocker: blocker.New(store, policy),
+		blocker: blocker.New(store, policy, firewall, clock, logger),
 		config:  config,
+		clock:   clock,
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	return s
 }
 
-func (s *Server) apiKeyMiddleware(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if s.config.ApiKeyEnabled {
-			params := r.URL.Query()
-			key, ok := params["key"]
-			if !ok || len(key) != 1 {
-				w.WriteHeader(http.StatusUnauthorized)
-			} else if s.config.ApiKey != key[0] {
-				w.WriteHeader(http.StatusForbidden)
-			} else {
-				h.ServeHTTP(w, r)
-			}
-		} else {
-			h.ServeHTTP(w, r)
-		}
-	})
+// Blocker returns the blocker used by the server, to change its policies while running
+func (s *Server) Blocker() *blocker.Blocker {
+	return s.blocker
+}
+
+// HandlePeer serves a handler used by other nodes of a cluster, such as the handler of the replicator. These
+// handlers authenticate the nodes themselves instead of using API keys. It should be called before the server is
+// started
+func (s *Server) HandlePeer(path string, h http.Handler) {
+	if s.peerHandlers == nil {
+		s.peerHandlers = make(map[string]http.Handler)
+	}
+	s.peerHandlers[path] = h
 }
 
-func (s *Server) ListenAndServe() {
+// Handler returns the HTTP handler serving the full API, including CORS and API key handling
+func (s *Server) Handler() http.Handler {
 	router := mux.NewRouter().StrictSlash(true)
+	router.Use(otelmux.Middleware(tracing.ServiceName))
+
+	// The v2 API has to be registered first, as /api would match it as well
+	s.registerV2(router.PathPrefix("/api/v2").Subrouter())
 
 	apiRouter := router.PathPrefix("/api").Subrouter()
-	apiRouter.HandleFunc("/blocked/{ip}", s.blockedQuery).Methods(http.MethodGet)
-	apiRouter.HandleFunc("/block/{ip}", s.block).Methods(http.MethodPost)
-	apiRouter.HandleFunc("/unblock/{ip}", s.unblock).Methods(http.MethodPost)
-	apiRouter.HandleFunc("/blocks", s.listBlocks).Methods(http.MethodGet)
-	apiRouter.HandleFunc("/policy", s.getPolicy).Methods(http.MethodGet)
-	apiRouter.HandleFunc("/policy", s.updatePolicy).Methods(http.MethodPatch)
-	apiRouter.HandleFunc("/modules", s.getExternalModules).Methods(http.MethodGet)
-	apiRouter.HandleFunc("/module", s.addExternalModule).Methods(http.MethodPut)
-	apiRouter.HandleFunc("/module/{id}", s.removeExternalModule).Methods(http.MethodDelete)
+	apiRouter.Use(s.apiKeyMiddleware)
+	apiRouter.Handle("/blocked/{ip}", s.requireScope(ScopeRead, s.blockedQuery)).Methods(http.MethodGet)
+	apiRouter.Handle("/block/{ip}", s.requireScope(ScopeBlock, s.block)).Methods(http.MethodPost)
+	apiRouter.Handle("/unblock/{ip}", s.requireScope(ScopeBlock, s.unblock)).Methods(http.MethodPost)
+	apiRouter.Handle("/blocks", s.requireScope(ScopeRead, s.listBlocks)).Methods(http.MethodGet)
+	apiRouter.Handle("/export/blocklist", s.requireScope(ScopeRead, s.exportBlocklist)).Methods(http.MethodGet)
+	apiRouter.Handle("/policy", s.requireScope(ScopeRead, s.getPolicy)).Methods(http.MethodGet)
+	apiRouter.Handle("/policy", s.requireScope(ScopeAdmin, s.updatePolicy)).Methods(http.MethodPatch)
+	apiRouter.Handle("/modules", s.requireScope(ScopeRead, s.getExternalModules)).Methods(http.MethodGet)
+	apiRouter.Handle("/module", s.requireScope(ScopeAdmin, s.addExternalModule)).Methods(http.MethodPut)
+	apiRouter.Handle("/module/{id}", s.requireScope(ScopeAdmin, s.removeExternalModule)).Methods(http.MethodDelete)
+	apiRouter.Handle("/allowlist", s.requireScope(ScopeRead, s.getAllowlist)).Methods(http.MethodGet)
+	apiRouter.Handle("/allowlist", s.requireScope(ScopeAdmin, s.addAllowEntry)).Methods(http.MethodPut)
+	apiRouter.Handle("/allowlist/{source:.+}", s.requireScope(ScopeAdmin, s.removeAllowEntry)).Methods(http.MethodDelete)
+	apiRouter.Handle("/audit", s.requireScope(ScopeRead, s.getAuditLog)).Methods(http.MethodGet)
+	apiRouter.Handle("/keys", s.requireScope(ScopeAdmin, s.getApiKeys)).Methods(http.MethodGet)
+	apiRouter.Handle("/keys", s.requireScope(ScopeAdmin, s.addApiKey)).Methods(http.MethodPut)
+	apiRouter.Handle("/keys/{name}", s.requireScope(ScopeAdmin, s.removeApiKey)).Methods(http.MethodDelete)
+	apiRouter.Handle("/admin/export", s.requireScope(ScopeAdmin, s.exportState)).Methods(http.MethodGet)
+	apiRouter.Handle("/admin/import", s.requireScope(ScopeAdmin, s.importState)).Methods(http.MethodPost)
 
 	entryRouter := apiRouter.PathPrefix("/entries").Subrouter()
-	entryRouter.HandleFunc("/", s.listSources)
-	entryRouter.HandleFunc("/list/{ip}", s.listEntries).Methods(http.MethodGet)
-	entryRouter.HandleFunc("/add/{ip}", s.addEntry).Methods(http.MethodPut)
+	entryRouter.Handle("/", s.requireScope(ScopeRead, s.listSources))
+	entryRouter.Handle("/list/{ip}", s.requireScope(ScopeRead, s.listEntries)).Methods(http.MethodGet)
+	entryRouter.Handle("/add/{ip}", s.requireScope(ScopeReportEntries, s.addEntry)).Methods(http.MethodPut)
+
+	router.HandleFunc("/healthz", s.healthz).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/readyz", s.readyz).Methods(http.MethodGet, http.MethodHead)
+
+	for path, h := range s.peerHandlers {
+		router.Handle(path, h).Methods(http.MethodPost)
+	}
+
+	if s.config.MetricsEnabled {
+		var metricsHandler http.Handler = promhttp.Handler()
+		if s.config.MetricsApiKeyEnabled {
+			metricsHandler = s.apiKeyMiddleware(s.requireScope(ScopeRead, metricsHandler.ServeHTTP))
+		}
+
+		router.Handle("/metrics", metricsHandler).Methods(http.MethodGet)
+	}
+
+	if s.config.DashboardEnabled {
+		router.PathPrefix("/dashboard/").Handler(http.StripPrefix("/dashboard/", dashboardHandler()))
+		router.Handle("/", http.RedirectHandler("/dashboard/", http.StatusFound))
+	}
 
 	c := cors.New(cors.Options{
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS", "PATCH", "HEAD", "PUT"},
+		AllowedMethods:   []string{"GET", "POST", "OPTIONS", "PATCH", "HEAD", "PUT", "DELETE"},
 		AllowedHeaders:   []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		ExposedHeaders:   []string{nextCursorHeader, "ETag"},
 		AllowCredentials: true,
 	})
 
-	s.server = &http.Server{Addr: ":8080", Handler: c.Handler(s.apiKeyMiddleware(router))}
+	return c.Handler(router)
+}
+
+// ListenAndServe starts the server and blocks until it is stopped. Like http.Server it always returns a non-nil error,
+// which is http.ErrServerClosed after Shutdown
+func (s *Server) ListenAndServe() error {
+	if err := s.checkClientIdentities(); err != nil {
+		return err
+	}
+
+	s.server = &http.Server{
+		Addr:     s.config.ListenAddress,
+		Handler:  s.Handler(),
+		ErrorLog: slog.NewLogLogger(s.logger.Handler(), slog.LevelError),
+	}
+
+	if s.tlsEnabled() {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			return errors.Wrap(err, "unable to configure TLS")
+		}
+
+		s.server.TLSConfig = tlsConfig
+	}
 
 	if s.config.GenerateDebugData {
-		go s.generateDebugData()
+		s.goLoop(s.generateDebugData)
 	}
 
 	if s.config.ApiKeyEnabled {
 		if s.config.ApiKey == "" {
 			id, err := uuid.NewRandom()
 			if err != nil {
-				log.Fatalf("unable to generate an API key: %v\n", err)
+				return errors.Wrap(err, "unable to generate an API key")
 			}
 
+			// A generated key is logged once, as there is no other way to learn it
 			s.config.ApiKey = id.String()
+			s.logger.Info("generated API key", "key", s.config.ApiKey, "name", defaultKeyName, "scopes", ScopeAdmin)
+		} else {
+			s.logger.Info("using API key", "name", defaultKeyName, "scopes", ScopeAdmin)
 		}
-
-		log.Printf("using API key: %v\n", s.config.ApiKey)
 	}
 
 	if s.config.IptablesBlockerEnabled {
-		log.Printf("internal iptables blocker is enabled, which requires sudo privileges to function properly")
+		s.logger.Info("internal iptables blocker is enabled, which requires sudo privileges to function properly")
 
 		if os.Geteuid() != 0 {
-			log.Printf("warning: it appears the server is not running with root privileges which is required for iptables, this might not work properly!")
+			s.logger.Warn("it appears the server is not running with root privileges which is required for iptables, this might not work properly!")
 		}
 	}
 
-	if err := s.blocker.NotifyAll(); err != nil {
-		log.Fatalf("unable to start blocker: %v\n", err)
+	if err := s.blocker.NotifyAll(s.ctx); err != nil {
+		return errors.Wrap(err, "unable to start blocker")
 	}
+	atomic.StoreInt32(&s.notified, 1)
+
+	s.goLoop(s.blocker.StartExternalUpdateLoop)
 
-	go s.blocker.StartExternalUpdateLoop()
+	s.logger.Info("listening", "address", s.config.ListenAddress, "tls", s.tlsEnabled())
+	if s.tlsEnabled() {
+		return s.server.ListenAndServeTLS("", "")
+	}
+	return s.server.ListenAndServe()
+}
 
-	log.Fatalln(s.server.ListenAndServe())
+// goLoop runs the given function in the background until the server is shut down
+func (s *Server) goLoop(f func(ctx context.Context)) {
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		f(s.ctx)
+	}()
 }
 
+// Shutdown stops the server. Readiness checks fail first, after which the server stops accepting requests and waits
+// for active requests. Finally the background loops are stopped and in-flight external notifications and firewall
+// operations are drained. Storage is not closed, as it is owned by the caller
 func (s *Server) Shutdown() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Fail readiness checks first, so no new traffic is sent while shutting down
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	time.Sleep(s.config.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
 	defer cancel()
 
-	return s.server.Shutdown(ctx)
+	if s.server != nil {
+		if err := s.server.Shutdown(ctx); err != nil {
+			return errors.Wrap(err, "failed to stop accepting requests")
+		}
+	}
+
+	s.cancel()
+	loopsDone := make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		close(loopsDone)
+	}()
+
+	select {
+	case <-loopsDone:
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "background loops did not stop")
+	}
+
+	return s.blocker.Drain(ctx)
 }
 
-func (s *Server) generateDebugData() {
-	log.Printf("generation of debug data is enabled, generating 10 random entries")
+func (s *Server) generateDebugData(ctx context.Context) {
+	s.logger.Info("generation of debug data is enabled, generating 10 random entries")
 	for i := 0; i < 10; i++ {
 		entry := storage.BlockEntry{
 			Source:    fmt.Sprintf("%v.%v.%v.%v", rand.Intn(255), rand.Intn(255), rand.Intn(255), rand.Intn(255)),
-			Timestamp: unix_time.Time(time.Now()),
+			Timestamp: unix_time.Time(s.clock.Now()),
 			Duration:  time.Hour*time.Duration(rand.Intn(4)) + time.Minute*time.Duration(rand.Intn(60)),
 		}
 
-		if err := s.store.AddBlockEntry(entry); err != nil {
-			log.Printf("unable to add debug block entry: %v\n", err)
+		if err := s.store.AddBlockEntry(ctx, entry); err != nil {
+			s.logger.Error("unable to add debug block entry", "source", entry.Source, "error", err)
 		}
 	}
 }
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock/fakeclock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	adminKey = "admin-key"
+	readKey  = "read-key"
+)
+
+var testPolicy = blocker.Policy{Attempts: 3, Period: time.Minute, BlockTime: 10 * time.Minute}
+
+// newTestServer serves a server with API keys enabled, using the admin key and a key named reader with the read
+// scope. The allowlist contains 192.168.0.0/16
+func newTestServer(t *testing.T) (*Server, *httptest.Server, *fakeclock.Clock) {
+	t.Helper()
+
+	ctx := context.Background()
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	store := storage.NewMemoryStore(c, logging.Discard())
+	if err := store.AddApiKey(ctx, storage.ApiKey{Name: "reader", Hash: hashApiKey(readKey), Scopes: []string{ScopeRead}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.AddAllowEntry(ctx, storage.AllowEntry{Source: "192.168.0.0/16"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s := New(store, testPolicy, Config{ApiKeyEnabled: true, ApiKey: adminKey}, c, logging.Discard())
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	return s, ts, c
+}
+
+// request performs a request using the given API key, which is omitted when empty, and returns the response with its
+// body
+func request(t *testing.T, ts *httptest.Server, method, path, key, body string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return resp, buf
+}
+
+type testV2Response struct {
+	Data       json.RawMessage `json:"data"`
+	NextCursor string          `json:"next_cursor"`
+	Error      *v2Error        `json:"error"`
+}
+
+// requestV2 performs a v2 request using the admin key, and checks the status and envelope of the response. The data of
+// successful responses is decoded into data
+func requestV2(t *testing.T, ts *httptest.Server, method, path, body string, status int, data interface{}) {
+	t.Helper()
+
+	resp, buf := request(t, ts, method, "/api/v2"+path, adminKey, body)
+	if resp.StatusCode != status {
+		t.Fatalf("expected %v %v to respond with %v, got %v: %s", method, path, status, resp.StatusCode, buf)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected a JSON response, got %v", ct)
+	}
+
+	var res testV2Response
+	if err := json.Unmarshal(buf, &res); err != nil {
+		t.Fatalf("expected a JSON envelope, got %s", buf)
+	}
+	if res.Error != nil || res.Data == nil {
+		t.Fatalf("expected data without an error, got %s", buf)
+	}
+	if data != nil {
+		if err := json.Unmarshal(res.Data, data); err != nil {
+			t.Fatalf("unexpected data %s: %v", res.Data, err)
+		}
+	}
+}
+
+func TestV2Blocks(t *testing.T) {
+	_, ts, c := newTestServer(t)
+
+	var entry storage.BlockEntry
+	requestV2(t, ts, http.MethodPost, "/blocks/10.0.0.1", `{"reason": "test"}`, http.StatusCreated, &entry)
+	if entry.Source != "10.0.0.1" || entry.Duration != testPolicy.BlockTime || entry.Reason != "test" ||
+		!entry.Timestamp.Time().Equal(c.Now()) {
+		t.Fatalf("unexpected block: %+v", entry)
+	}
+
+	var blocks []storage.BlockEntry
+	requestV2(t, ts, http.MethodGet, "/blocks", "", http.StatusOK, &blocks)
+	if len(blocks) != 1 || blocks[0].Source != "10.0.0.1" {
+		t.Fatalf("expected the block to be listed, got %+v", blocks)
+	}
+
+	// Unblocking responds with the block that was lifted
+	entry = storage.BlockEntry{}
+	requestV2(t, ts, http.MethodDelete, "/blocks/10.0.0.1", "", http.StatusOK, &entry)
+	if entry.Source != "10.0.0.1" || entry.Reason != "test" {
+		t.Fatalf("expected the lifted block, got %+v", entry)
+	}
+
+	resp, _ := request(t, ts, http.MethodGet, "/api/v2/blocks/10.0.0.1", adminKey, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the block to be lifted, got %v", resp.StatusCode)
+	}
+}
+
+func TestV2Remove(t *testing.T) {
+	_, ts, _ := newTestServer(t)
+
+	var module storage.ExternalModule
+	requestV2(t, ts, http.MethodPost, "/modules", `{"address": "http://localhost:9000", "method": "POST"}`,
+		http.StatusCreated, &module)
+	removed := storage.ExternalModule{}
+	requestV2(t, ts, http.MethodDelete, "/modules/"+strconv.FormatUint(uint64(module.Id), 10), "", http.StatusOK, &removed)
+	if removed != module {
+		t.Fatalf("expected the removed module %+v, got %+v", module, removed)
+	}
+
+	requestV2(t, ts, http.MethodPost, "/allowlist", `{"source": "10.0.0.0/8", "description": "internal"}`,
+		http.StatusCreated, nil)
+	var entry storage.AllowEntry
+	requestV2(t, ts, http.MethodDelete, "/allowlist/10.0.0.0/8", "", http.StatusOK, &entry)
+	if entry.Source != "10.0.0.0/8" || entry.Description != "internal" {
+		t.Fatalf("expected the removed allowlist entry, got %+v", entry)
+	}
+
+	var key createdApiKey
+	requestV2(t, ts, http.MethodPost, "/keys", `{"name": "agent", "scopes": ["report-entries"]}`, http.StatusCreated, &key)
+	if key.Key == "" {
+		t.Fatalf("expected the created key to contain the secret, got %+v", key)
+	}
+	var removedKey map[string]interface{}
+	requestV2(t, ts, http.MethodDelete, "/keys/agent", "", http.StatusOK, &removedKey)
+	if removedKey["name"] != "agent" || removedKey["key"] != nil {
+		t.Fatalf("expected the removed key without its secret, got %+v", removedKey)
+	}
+
+	var keys []storage.ApiKey
+	requestV2(t, ts, http.MethodGet, "/keys", "", http.StatusOK, &keys)
+	if len(keys) != 1 || keys[0].Name != "reader" {
+		t.Fatalf("expected only the reader key to remain, got %+v", keys)
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	_, ts, _ := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		body   string
+		status int
+		code   string
+	}{
+		{"no key", http.MethodGet, "/blocks", "", "", http.StatusUnauthorized, codeUnauthorized},
+		{"invalid key", http.MethodGet, "/blocks", "invalid", "", http.StatusForbidden, codeForbidden},
+		{"missing scope", http.MethodPost, "/blocks/10.0.0.1", readKey, "", http.StatusForbidden, codeForbidden},
+		{"invalid ip", http.MethodGet, "/blocks/10.0.0", adminKey, "", http.StatusBadRequest, codeInvalidIp},
+		{"invalid cidr", http.MethodGet, "/blocks?cidr=10.0.0.0/33", adminKey, "", http.StatusBadRequest, codeInvalidIp},
+		{"invalid cursor", http.MethodGet, "/blocks?cursor=invalid", adminKey, "", http.StatusBadRequest, codeInvalidRequest},
+		{"invalid body", http.MethodPost, "/blocks/10.0.0.1", adminKey, "{", http.StatusBadRequest, codeInvalidRequest},
+		{"negative duration", http.MethodPost, "/blocks/10.0.0.1", adminKey, `{"duration": -1}`, http.StatusBadRequest, codeInvalidRequest},
+		{"allowlisted", http.MethodPost, "/blocks/192.168.0.1", adminKey, "", http.StatusConflict, codeAllowlisted},
+		{"not blocked", http.MethodDelete, "/blocks/10.0.0.1", adminKey, "", http.StatusNotFound, codeNotBlocked},
+		{"entry of other ip", http.MethodPost, "/entries/10.0.0.1", adminKey,
+			`{"source": "10.0.0.2", "service": "ssh", "timestamp": 1600000000}`, http.StatusBadRequest, codeInvalidRequest},
+		{"missing body", http.MethodPatch, "/policy", adminKey, "", http.StatusBadRequest, codeInvalidRequest},
+		{"invalid policy", http.MethodPatch, "/policy", adminKey, `{"attempts": 0}`, http.StatusBadRequest, codeInvalidRequest},
+		{"invalid module", http.MethodPost, "/modules", adminKey, `{"address": "http://localhost"}`, http.StatusBadRequest, codeInvalidRequest},
+		{"invalid module id", http.MethodDelete, "/modules/abc", adminKey, "", http.StatusBadRequest, codeInvalidRequest},
+		{"missing module", http.MethodDelete, "/modules/42", adminKey, "", http.StatusNotFound, codeNotFound},
+		{"invalid allow entry", http.MethodPost, "/allowlist", adminKey, `{"source": "invalid"}`, http.StatusBadRequest, codeInvalidIp},
+		{"missing allow entry", http.MethodDelete, "/allowlist/10.0.0.0/8", adminKey, "", http.StatusNotFound, codeNotFound},
+		{"invalid scope", http.MethodPost, "/keys", adminKey, `{"name": "a", "scopes": ["all"]}`, http.StatusBadRequest, codeInvalidRequest},
+		{"existing key", http.MethodPost, "/keys", adminKey, `{"name": "reader", "scopes": ["read"]}`, http.StatusConflict, codeConflict},
+		{"missing key", http.MethodDelete, "/keys/missing", adminKey, "", http.StatusNotFound, codeNotFound},
+		{"unknown endpoint", http.MethodGet, "/unknown", adminKey, "", http.StatusNotFound, codeNotFound},
+		{"unknown method", http.MethodPut, "/blocks", adminKey, "", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, buf := request(t, ts, test.method, "/api/v2"+test.path, test.key, test.body)
+			if resp.StatusCode != test.status {
+				t.Fatalf("expected status %v, got %v: %s", test.status, resp.StatusCode, buf)
+			}
+
+			var res testV2Response
+			if err := json.Unmarshal(buf, &res); err != nil {
+				t.Fatalf("expected a JSON envelope, got %s", buf)
+			}
+			if res.Error == nil || res.Error.Code != test.code || res.Error.Message == "" || res.Data != nil {
+				t.Fatalf("expected an error with code %v, got %s", test.code, buf)
+			}
+		})
+	}
+}
+
+func TestOpenApi(t *testing.T) {
+	s, ts, _ := newTestServer(t)
+
+	// The document is available without an API key
+	resp, buf := request(t, ts, http.MethodGet, "/api/v2/openapi.json", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the document to be served, got %v", resp.StatusCode)
+	}
+
+	var doc struct {
+		OpenApi string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(buf, &doc); err != nil || doc.OpenApi == "" {
+		t.Fatalf("expected a valid OpenAPI document, got %v", err)
+	}
+
+	// Every route of the v2 API is documented, variables are documented without their pattern
+	variable := regexp.MustCompile(`\{(\w+):[^}]+\}`)
+	router := mux.NewRouter()
+	s.registerV2(router)
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path, _ := route.GetPathTemplate()
+		if path == "/openapi.json" {
+			return nil
+		}
+
+		path = variable.ReplaceAllString(path, "{$1}")
+		for _, method := range methods {
+			if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+				t.Errorf("%v %v is not documented", method, path)
+			}
+		}
+		return nil
+	})
+}
+
+func TestListSourcesOrder(t *testing.T) {
+	_, ts, _ := newTestServer(t)
+
+	// Sources are an object in /api, which has no order
+	resp, _ := request(t, ts, http.MethodGet, "/api/entries/?order=asc", adminKey, "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the order parameter to be rejected, got %v", resp.StatusCode)
+	}
+
+	resp, _ = request(t, ts, http.MethodGet, "/api/entries/?limit=10", adminKey, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected other parameters to be accepted, got %v", resp.StatusCode)
+	}
+
+	requestV2(t, ts, http.MethodGet, "/entries?order=asc", "", http.StatusOK, nil)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval limits how often the certificate files are checked for changes
+const certCheckInterval = 5 * time.Second
+
+// certReloader serves the certificate in the given files, and reloads it whenever one of the files is modified
+type certReloader struct {
+	certFile string
+	keyFile  string
+	clock    clock.Clock
+	logger   *slog.Logger
+
+	lock        sync.Mutex
+	cert        *tls.Certificate
+	modTime     time.Time
+	lastChecked time.Time
+}
+
+func newCertReloader(certFile, keyFile string, clock clock.Clock, logger *slog.Logger) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		clock:    clock,
+		logger:   logger.With("cert_file", certFile),
+	}
+
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "failed to stat %v", f)
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load TLS certificate")
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate, the previous certificate is kept if reloading fails
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.clock.Now()
+	if now.Sub(c.lastChecked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.lastChecked = now
+
+	modTime, err := c.latestModTime()
+	if err != nil {
+		c.logger.Warn("unable to check TLS certificate for changes, keeping current certificate", "error", err)
+		return c.cert, nil
+	}
+
+	if modTime.After(c.modTime) {
+		if err := c.reload(); err != nil {
+			c.logger.Error("unable to reload TLS certificate, keeping current certificate", "error", err)
+		} else {
+			c.logger.Info("reloaded TLS certificate")
+		}
+	}
+
+	return c.cert, nil
+}
+
+func (s *Server) tlsEnabled() bool {
+	return s.config.TlsCertFile != "" || s.config.TlsKeyFile != ""
+}
+
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	reloader, err := newCertReloader(s.config.TlsCertFile, s.config.TlsKeyFile, s.clock, s.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if s.config.TlsClientCaFile != "" {
+		buf, err := ioutil.ReadFile(s.config.TlsClientCaFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read client CA bundle")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, errors.Errorf("no certificates found in client CA bundle %v", s.config.TlsClientCaFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.config.TlsClientCertRequired {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// checkClientIdentities verifies that client certificates can be verified when they are mapped to identities. Without
+// verified certificates no identity is ever found, while authentication is still required
+func (s *Server) checkClientIdentities() error {
+	if len(s.config.TlsClientIdentities) > 0 && (!s.tlsEnabled() || s.config.TlsClientCaFile == "") {
+		return errors.New("client certificate identities require TLS and a client CA bundle")
+	}
+
+	return nil
+}
+
+// certificateIdentity maps the verified client certificate of the request to an identity, using either the common
+// name or one of the DNS names of the certificate
+func (s *Server) certificateIdentity(r *http.Request) (identity, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return identity{}, false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		if scopes, ok := s.config.TlsClientIdentities[name]; ok && name != "" {
+			return identity{Name: "cert:" + name, Scopes: strings.Split(scopes, "+")}, true
+		}
+	}
+
+	return identity{}, false
+}
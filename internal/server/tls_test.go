@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/timanema/fail2ban-service/pkg/clock/fakeclock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue creates a certificate for the given common name and DNS names, and returns it and its key PEM encoded
+func (ca *testCA) issue(t *testing.T, serial int64, name string, dnsNames ...string) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// writeFile writes the file and sets its modification time, as the file system might not be precise enough to notice
+// rewrites within the test
+func writeFile(t *testing.T, path string, buf []byte, modTime time.Time) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// serial returns the serial number of the certificate served by the reloader
+func serial(t *testing.T, r *certReloader) int64 {
+	t.Helper()
+
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return parsed.SerialNumber.Int64()
+}
+
+func TestCertReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Hour)
+
+	cert, key := ca.issue(t, 2, "server")
+	writeFile(t, certFile, cert, modTime)
+	writeFile(t, keyFile, key, modTime)
+
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	r, err := newCertReloader(certFile, keyFile, c, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s := serial(t, r); s != 2 {
+		t.Fatalf("expected the initial certificate to be served, got serial %v", s)
+	}
+
+	// The files are only checked for changes once per interval
+	cert, key = ca.issue(t, 3, "server")
+	modTime = modTime.Add(time.Minute)
+	writeFile(t, certFile, cert, modTime)
+	writeFile(t, keyFile, key, modTime)
+	c.Advance(certCheckInterval - time.Second)
+	if s := serial(t, r); s != 2 {
+		t.Fatalf("expected the certificate to not be reloaded within the check interval, got serial %v", s)
+	}
+
+	c.Advance(time.Second)
+	if s := serial(t, r); s != 3 {
+		t.Fatalf("expected the certificate to be reloaded after the check interval, got serial %v", s)
+	}
+
+	// Invalid certificates are ignored, and the current certificate is kept
+	modTime = modTime.Add(time.Minute)
+	writeFile(t, certFile, []byte("invalid"), modTime)
+	c.Advance(certCheckInterval)
+	if s := serial(t, r); s != 3 {
+		t.Fatalf("expected the current certificate to be kept after an invalid reload, got serial %v", s)
+	}
+
+	if _, err := newCertReloader(certFile, keyFile, c, logging.Discard()); err == nil {
+		t.Fatalf("expected an invalid certificate to be rejected at startup")
+	}
+}
+
+// newTLSTestServer starts a TLS server verifying client certificates against the CA, and maps them to the given
+// identities
+func newTLSTestServer(t *testing.T, ca *testCA, identities map[string]string) (*Server, *httptest.Server) {
+	t.Helper()
+
+	dir := t.TempDir()
+	cert, key := ca.issue(t, 2, "server", "localhost")
+	config := Config{
+		TlsCertFile:         filepath.Join(dir, "cert.pem"),
+		TlsKeyFile:          filepath.Join(dir, "key.pem"),
+		TlsClientCaFile:     filepath.Join(dir, "ca.pem"),
+		TlsClientIdentities: identities,
+	}
+	writeFile(t, config.TlsCertFile, cert, time.Now())
+	writeFile(t, config.TlsKeyFile, key, time.Now())
+	writeFile(t, config.TlsClientCaFile, ca.pem, time.Now())
+
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	s := New(storage.NewMemoryStore(c, logging.Discard()), testPolicy, config, c, logging.Discard())
+	if err := s.checkClientIdentities(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The certificate of httptest is only used by clients not sending a server name
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	return s, ts
+}
+
+// tlsClient returns a client trusting the CA, presenting a certificate for the given name if it is not empty
+func tlsClient(t *testing.T, ca *testCA, serial int64, name string) *http.Client {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	if name != "" {
+		cert, err := tls.X509KeyPair(ca.issue(t, serial, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func TestClientIdentities(t *testing.T) {
+	ca := newTestCA(t)
+	s, ts := newTLSTestServer(t, ca, map[string]string{"reader": "read", "edge": "read+block"})
+
+	do := func(client *http.Client, method, path string) int {
+		t.Helper()
+
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(""))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	reader := tlsClient(t, ca, 10, "reader")
+	edge := tlsClient(t, ca, 11, "edge")
+	if status := do(reader, http.MethodGet, "/api/blocks"); status != http.StatusOK {
+		t.Fatalf("expected the reader certificate to have the read scope, got %v", status)
+	}
+	if status := do(reader, http.MethodPost, "/api/block/10.0.0.1"); status != http.StatusForbidden {
+		t.Fatalf("expected the reader certificate to not have the block scope, got %v", status)
+	}
+	if status := do(edge, http.MethodPost, "/api/block/10.0.0.1"); status != http.StatusOK {
+		t.Fatalf("expected the edge certificate to have the block scope, got %v", status)
+	}
+	if status := do(edge, http.MethodGet, "/api/blocked/10.0.0.1"); status != http.StatusOK {
+		t.Fatalf("expected the edge certificate to have the read scope, got %v", status)
+	}
+
+	// The identity of the certificate is the actor of manual actions
+	audit, err := s.store.FindAuditEntries(context.Background(), storage.AuditQuery{Action: storage.AuditBlock})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(audit) != 1 || audit[0].Actor != "cert:edge" {
+		t.Fatalf("expected the block to be audited as cert:edge, got %+v", audit)
+	}
+
+	// Clients without a certificate, or with a certificate that is not mapped, are not authenticated
+	if status := do(tlsClient(t, ca, 0, ""), http.MethodGet, "/api/blocks"); status != http.StatusUnauthorized {
+		t.Fatalf("expected a client without a certificate to be rejected, got %v", status)
+	}
+	if status := do(tlsClient(t, ca, 12, "unknown"), http.MethodGet, "/api/blocks"); status != http.StatusUnauthorized {
+		t.Fatalf("expected an unmapped certificate to be rejected, got %v", status)
+	}
+
+	// Certificates of other CAs are rejected during the handshake
+	other := tlsClient(t, newTestCA(t), 13, "reader")
+	other.Transport.(*http.Transport).TLSClientConfig.RootCAs = reader.Transport.(*http.Transport).TLSClientConfig.RootCAs
+	if _, err := other.Get(ts.URL + "/api/blocks"); err == nil {
+		t.Fatalf("expected a certificate of another CA to be rejected")
+	}
+}
+
+func TestClientIdentitiesWithoutCA(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cert, key := ca.issue(t, 2, "server")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, certFile, cert, time.Now())
+	writeFile(t, keyFile, key, time.Now())
+
+	identities := map[string]string{"reader": "read"}
+	tests := map[string]Config{
+		"without TLS":       {TlsClientIdentities: identities, TlsClientCaFile: filepath.Join(dir, "ca.pem")},
+		"without client CA": {TlsClientIdentities: identities, TlsCertFile: certFile, TlsKeyFile: keyFile},
+	}
+
+	for name, config := range tests {
+		config.ListenAddress = "127.0.0.1:0"
+		c := fakeclock.New(time.Unix(1600000000, 0))
+		s := New(storage.NewMemoryStore(c, logging.Discard()), testPolicy, config, c, logging.Discard())
+		if err := s.ListenAndServe(); err == nil || err == http.ErrServerClosed {
+			t.Fatalf("expected client identities %v to be rejected, got %v", name, err)
+		}
+	}
+}
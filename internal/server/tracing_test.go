@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	recorderOnce sync.Once
+	testRecorder *tracetest.SpanRecorder
+)
+
+// spanRecorder installs a global tracer provider recording all spans. Tracers obtained before the first provider was
+// installed, such as the one of the blocker, keep using that provider, so it is only installed once
+func spanRecorder() *tracetest.SpanRecorder {
+	recorderOnce.Do(func() {
+		testRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(testRecorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return testRecorder
+}
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	recorder := spanRecorder()
+
+	traceparents := make(chan string, 1)
+	module := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+	}))
+	defer module.Close()
+
+	s, ts, _ := newTestServer(t)
+	if err := s.store.AddExternalModule(ctx, storage.ExternalModule{Id: 1, Address: module.URL, Method: http.MethodPost}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resp, buf := request(t, ts, http.MethodPost, "/api/block/10.0.0.1", adminKey, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the block to succeed, got %v: %s", resp.StatusCode, buf)
+	}
+
+	var traceparent string
+	select {
+	case traceparent = <-traceparents:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the module to be notified")
+	}
+	drainCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := s.blocker.Drain(drainCtx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The span of the notification is passed on to the module
+	var notify sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		sc := span.SpanContext()
+		if span.Name() == "external_module.notify" && traceparent == "00-"+sc.TraceID().String()+"-"+sc.SpanID().String()+"-01" {
+			notify = span
+		}
+	}
+	if notify == nil || notify.SpanKind() != trace.SpanKindClient {
+		t.Fatalf("expected the module to receive the trace context of the notification span, got %q", traceparent)
+	}
+
+	// The notification is part of the trace of the request, which is traced by the router using the route as name
+	spans := make(map[string]trace.SpanKind)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == notify.SpanContext().TraceID() {
+			spans[span.Name()] = span.SpanKind()
+		}
+	}
+	if kind, ok := spans["/api/block/{ip}"]; !ok || kind != trace.SpanKindServer {
+		t.Fatalf("expected a server span of the route in the trace of the notification, got %v", spans)
+	}
+	if _, ok := spans["Blocker.BlockIP"]; !ok {
+		t.Fatalf("expected the block to be part of the trace of the request, got %v", spans)
+	}
+}
@@ -0,0 +1,645 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+)
+
+// Error codes of the v2 API, which are stable and meant to be handled by clients
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeInvalidIp        = "invalid_ip"
+	codeNotBlocked       = "not_blocked"
+	codeNotFound         = "not_found"
+	codeAllowlisted      = "allowlisted"
+	codeConflict         = "conflict"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeInternal         = "internal_error"
+)
+
+// v2DefaultLimit is the page size of v2 list endpoints without a limit parameter
+const v2DefaultLimit = 100
+
+//go:embed openapi.json
+var openApiDocument []byte
+
+type v2Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// v2Response is the envelope of every v2 response body, which has either data or an error. Lists also contain the
+// cursor of the next page, if there is one
+type v2Response struct {
+	Data       interface{} `json:"data,omitempty"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Error      *v2Error    `json:"error,omitempty"`
+}
+
+func (s *Server) writeV2(w http.ResponseWriter, status int, res v2Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		s.logger.Error("failed to write response", "status", status, "error", err)
+	}
+}
+
+func (s *Server) writeV2Data(w http.ResponseWriter, status int, data interface{}) {
+	s.writeV2(w, status, v2Response{Data: data})
+}
+
+func (s *Server) writeV2Page(w http.ResponseWriter, data interface{}, nextCursor string) {
+	s.writeV2(w, http.StatusOK, v2Response{Data: data, NextCursor: nextCursor})
+}
+
+func (s *Server) writeV2Error(w http.ResponseWriter, status int, code, message string) {
+	s.writeV2(w, status, v2Response{Error: &v2Error{Code: code, Message: message}})
+}
+
+// writeV2InternalError logs the error, but does not expose it to the client
+func (s *Server) writeV2InternalError(w http.ResponseWriter, err error) {
+	s.logger.Error("request failed", "status", http.StatusInternalServerError, "error", err)
+	s.writeV2Error(w, http.StatusInternalServerError, codeInternal, "internal server error")
+}
+
+// registerV2 registers the v2 API on the given router, which is mounted at /api/v2. Unlike /api, every response body
+// is a JSON envelope and errors have a machine-readable code
+func (s *Server) registerV2(router *mux.Router) {
+	// The document describes the API, and is therefore available without authentication
+	router.HandleFunc("/openapi.json", s.v2OpenApi).Methods(http.MethodGet)
+
+	api := router.NewRoute().Subrouter()
+	api.Use(s.v2ApiKeyMiddleware)
+	api.Handle("/blocks", s.v2RequireScope(ScopeRead, s.v2ListBlocks)).Methods(http.MethodGet)
+	api.Handle("/blocks/{ip}", s.v2RequireScope(ScopeRead, s.v2GetBlock)).Methods(http.MethodGet)
+	api.Handle("/blocks/{ip}", s.v2RequireScope(ScopeBlock, s.v2Block)).Methods(http.MethodPost)
+	api.Handle("/blocks/{ip}", s.v2RequireScope(ScopeBlock, s.v2Unblock)).Methods(http.MethodDelete)
+	api.Handle("/entries", s.v2RequireScope(ScopeRead, s.v2ListSources)).Methods(http.MethodGet)
+	api.Handle("/entries/{ip}", s.v2RequireScope(ScopeRead, s.v2ListEntries)).Methods(http.MethodGet)
+	api.Handle("/entries/{ip}", s.v2RequireScope(ScopeReportEntries, s.v2AddEntry)).Methods(http.MethodPost)
+	api.Handle("/policy", s.v2RequireScope(ScopeRead, s.v2GetPolicy)).Methods(http.MethodGet)
+	api.Handle("/policy", s.v2RequireScope(ScopeAdmin, s.v2UpdatePolicy)).Methods(http.MethodPatch)
+	api.Handle("/modules", s.v2RequireScope(ScopeRead, s.v2ListModules)).Methods(http.MethodGet)
+	api.Handle("/modules", s.v2RequireScope(ScopeAdmin, s.v2AddModule)).Methods(http.MethodPost)
+	api.Handle("/modules/{id}", s.v2RequireScope(ScopeAdmin, s.v2RemoveModule)).Methods(http.MethodDelete)
+	api.Handle("/allowlist", s.v2RequireScope(ScopeRead, s.v2GetAllowlist)).Methods(http.MethodGet)
+	api.Handle("/allowlist", s.v2RequireScope(ScopeAdmin, s.v2AddAllowEntry)).Methods(http.MethodPost)
+	api.Handle("/allowlist/{source:.+}", s.v2RequireScope(ScopeAdmin, s.v2RemoveAllowEntry)).Methods(http.MethodDelete)
+	api.Handle("/audit", s.v2RequireScope(ScopeRead, s.v2GetAuditLog)).Methods(http.MethodGet)
+	api.Handle("/keys", s.v2RequireScope(ScopeAdmin, s.v2ListApiKeys)).Methods(http.MethodGet)
+	api.Handle("/keys", s.v2RequireScope(ScopeAdmin, s.v2AddApiKey)).Methods(http.MethodPost)
+	api.Handle("/keys/{name}", s.v2RequireScope(ScopeAdmin, s.v2RemoveApiKey)).Methods(http.MethodDelete)
+
+	fallback := s.v2Fallback(router)
+	router.NotFoundHandler = fallback
+	router.MethodNotAllowedHandler = fallback
+	api.NotFoundHandler = fallback
+	api.MethodNotAllowedHandler = fallback
+}
+
+// v2Fallback responds to requests that did not match any route. Nested gorilla/mux routers report a method mismatch as
+// not found, so the paths of all routes are matched here to tell both cases apart
+func (s *Server) v2Fallback(router *mux.Router) http.Handler {
+	var paths []*regexp.Regexp
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		// Routes without methods are subrouters, which match every path below their prefix
+		if _, err := route.GetMethods(); err != nil {
+			return nil
+		}
+
+		if path, err := route.GetPathRegexp(); err == nil {
+			paths = append(paths, regexp.MustCompile(path))
+		}
+		return nil
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range paths {
+			if path.MatchString(r.URL.Path) {
+				s.writeV2Error(w, http.StatusMethodNotAllowed, codeMethodNotAllowed,
+					fmt.Sprintf("%v is not allowed for %v", r.Method, r.URL.Path))
+				return
+			}
+		}
+
+		s.writeV2Error(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("%v does not exist", r.URL.Path))
+	})
+}
+
+// v2ApiKeyMiddleware is the v2 counterpart of apiKeyMiddleware, which responds with JSON errors
+func (s *Server) v2ApiKeyMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, code, err := s.requestIdentity(r)
+		switch {
+		case err != nil:
+			s.writeV2InternalError(w, err)
+			return
+		case code == http.StatusUnauthorized:
+			s.writeV2Error(w, code, codeUnauthorized, "an API key or client certificate is required")
+			return
+		case code != http.StatusOK:
+			s.writeV2Error(w, code, codeForbidden, "the API key is not valid")
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// v2RequireScope is the v2 counterpart of requireScope, which responds with JSON errors
+func (s *Server) v2RequireScope(scope string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := identityFromContext(r.Context())
+		if !id.hasScope(scope) {
+			s.writeV2Error(w, http.StatusForbidden, codeForbidden, fmt.Sprintf("%v does not have the %v scope", id.Name, scope))
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.logger.Info("request performed", "method", r.Method, "path", r.URL.Path, "actor", id.Name)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// v2Ip returns the IP in the path of the request, or writes an error if it is not a valid IP
+func (s *Server) v2Ip(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ip := mux.Vars(r)["ip"]
+	if net.ParseIP(ip) == nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidIp, fmt.Sprintf("%v is not a valid IP", ip))
+		return "", false
+	}
+
+	return ip, true
+}
+
+// v2ListParams parses the list parameters of the request, or writes an error if they are not valid
+func (s *Server) v2ListParams(w http.ResponseWriter, r *http.Request) (listParams, bool) {
+	params, err := parseListParams(r, v2DefaultLimit)
+	if errors.Cause(err) == invalidNetworkErr {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidIp, err.Error())
+		return listParams{}, false
+	}
+	if err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return listParams{}, false
+	}
+
+	return params, true
+}
+
+// v2ListError writes the error of a list operation, which is only caused by the client for invalid cursors
+func (s *Server) v2ListError(w http.ResponseWriter, err error) {
+	if err == storage.InvalidCursorErr {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	s.writeV2InternalError(w, err)
+}
+
+// v2Decode decodes the JSON body of the request into v, or writes an error if that is not possible. An empty body is
+// only accepted if it is optional, in which case v is left untouched
+func (s *Server) v2Decode(w http.ResponseWriter, r *http.Request, v interface{}, optional bool) bool {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, "unable to read request body")
+		return false
+	}
+
+	if len(bytes.TrimSpace(buf)) == 0 {
+		if optional {
+			return true
+		}
+
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, "a request body is required")
+		return false
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) v2OpenApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openApiDocument)
+}
+
+func (s *Server) v2ListBlocks(w http.ResponseWriter, r *http.Request) {
+	params, ok := s.v2ListParams(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := s.store.ListBlockEntries(r.Context(), params.blockQuery())
+	if err != nil {
+		s.v2ListError(w, err)
+		return
+	}
+
+	s.writeV2Page(w, page.Entries, page.NextCursor)
+}
+
+func (s *Server) v2GetBlock(w http.ResponseWriter, r *http.Request) {
+	ip, ok := s.v2Ip(w, r)
+	if !ok {
+		return
+	}
+
+	blocked, entry, err := s.blocker.IsBlocked(r.Context(), ip)
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	if !blocked {
+		s.writeV2Error(w, http.StatusNotFound, codeNotBlocked, fmt.Sprintf("%v is not blocked", ip))
+		return
+	}
+
+	s.writeV2Data(w, http.StatusOK, entry)
+}
+
+func (s *Server) v2Block(w http.ResponseWriter, r *http.Request) {
+	ip, ok := s.v2Ip(w, r)
+	if !ok {
+		return
+	}
+
+	// The body is optional, without it the active policy is used
+	var req blockRequest
+	if !s.v2Decode(w, r, &req, true) {
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	entry, err := s.blocker.BlockIP(r.Context(), ip, blocker.BlockOptions{
+		Duration:  req.Duration,
+		Permanent: req.Permanent,
+		Reason:    req.Reason,
+		Tags:      req.Tags,
+		Actor:     identityFromContext(r.Context()).Name,
+	})
+	if err == blocker.AllowedErr {
+		s.writeV2Error(w, http.StatusConflict, codeAllowlisted, fmt.Sprintf("%v is on the allowlist", ip))
+		return
+	}
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+
+	s.writeV2Data(w, http.StatusCreated, entry)
+}
+
+func (s *Server) v2Unblock(w http.ResponseWriter, r *http.Request) {
+	ip, ok := s.v2Ip(w, r)
+	if !ok {
+		return
+	}
+
+	blocked, entry, err := s.blocker.IsBlocked(r.Context(), ip)
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	if !blocked {
+		s.writeV2Error(w, http.StatusNotFound, codeNotBlocked, fmt.Sprintf("%v is not blocked", ip))
+		return
+	}
+
+	if err := s.blocker.UnblockIP(r.Context(), ip, identityFromContext(r.Context()).Name); err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+
+	s.writeV2Data(w, http.StatusOK, entry)
+}
+
+func (s *Server) v2ListSources(w http.ResponseWriter, r *http.Request) {
+	params, ok := s.v2ListParams(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := s.store.ListSources(r.Context(), params.sourceQuery())
+	if err != nil {
+		s.v2ListError(w, err)
+		return
+	}
+
+	s.writeV2Page(w, page.Sources, page.NextCursor)
+}
+
+func (s *Server) v2ListEntries(w http.ResponseWriter, r *http.Request) {
+	ip, ok := s.v2Ip(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := s.v2ListParams(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := s.store.ListAuthenticationEntries(r.Context(), params.entryQuery(ip))
+	if err != nil {
+		s.v2ListError(w, err)
+		return
+	}
+
+	s.writeV2Page(w, page.Entries, page.NextCursor)
+}
+
+func (s *Server) v2AddEntry(w http.ResponseWriter, r *http.Request) {
+	ip, ok := s.v2Ip(w, r)
+	if !ok {
+		return
+	}
+
+	var entry storage.AuthenticationEntry
+	if !s.v2Decode(w, r, &entry, false) {
+		return
+	}
+
+	if err := validateEntry(entry, ip); err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := s.blocker.AddEntry(r.Context(), entry); err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+
+	s.writeV2Data(w, http.StatusCreated, entry)
+}
+
+func (s *Server) v2GetPolicy(w http.ResponseWriter, r *http.Request) {
+	s.writeV2Data(w, http.StatusOK, s.blocker.Policy())
+}
+
+func (s *Server) v2UpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	var policy blocker.Policy
+	if !s.v2Decode(w, r, &policy, false) {
+		return
+	}
+
+	if err := policy.Validate(); err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	old := s.blocker.Policy()
+	s.blocker.UpdatePolicy(policy)
+	s.audit(r, storage.AuditPolicyUpdate, "", fmt.Sprintf("policy changed from %+v to %+v", old, policy))
+
+	s.writeV2Data(w, http.StatusOK, policy)
+}
+
+func (s *Server) v2ListModules(w http.ResponseWriter, r *http.Request) {
+	modules, err := s.store.GetExternalModules(r.Context())
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	if modules == nil {
+		modules = []storage.ExternalModule{}
+	}
+
+	s.writeV2Data(w, http.StatusOK, modules)
+}
+
+func (s *Server) v2AddModule(w http.ResponseWriter, r *http.Request) {
+	var module storage.ExternalModule
+	if !s.v2Decode(w, r, &module, false) {
+		return
+	}
+
+	if err := validateModule(module); err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	id, exists, err := s.externalModuleId(r.Context(), module.Address)
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	module.Id = id
+
+	if err := s.store.AddExternalModule(r.Context(), module); err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	s.audit(r, storage.AuditModuleAdd, "", fmt.Sprintf("module %v: %v %v", module.Id, module.Method, module.Address))
+
+	// Adding a module with an existing address updates that module instead
+	status := http.StatusCreated
+	if exists {
+		status = http.StatusOK
+	}
+	s.writeV2Data(w, status, module)
+}
+
+func (s *Server) v2RemoveModule(w http.ResponseWriter, r *http.Request) {
+	id, err := parseModuleId(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	module, found, err := s.findModule(r.Context(), id)
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	if !found {
+		s.writeV2Error(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("there is no module with ID %v", id))
+		return
+	}
+
+	if err := s.store.RemoveExternalModule(r.Context(), id); err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	s.audit(r, storage.AuditModuleRemove, "", fmt.Sprintf("module %v", id))
+
+	s.writeV2Data(w, http.StatusOK, module)
+}
+
+func (s *Server) v2GetAllowlist(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.store.GetAllowEntries(r.Context())
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []storage.AllowEntry{}
+	}
+
+	s.writeV2Data(w, http.StatusOK, entries)
+}
+
+func (s *Server) v2AddAllowEntry(w http.ResponseWriter, r *http.Request) {
+	var entry storage.AllowEntry
+	if !s.v2Decode(w, r, &entry, false) {
+		return
+	}
+
+	if err := validateAllowEntry(entry); err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidIp, err.Error())
+		return
+	}
+
+	if err := s.store.AddAllowEntry(r.Context(), entry); err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	s.audit(r, storage.AuditAllowlistAdd, entry.Source, entry.Description)
+
+	s.writeV2Data(w, http.StatusCreated, entry)
+}
+
+func (s *Server) v2RemoveAllowEntry(w http.ResponseWriter, r *http.Request) {
+	source := mux.Vars(r)["source"]
+
+	entry, found, err := s.findAllowEntry(r.Context(), source)
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+
+	if found {
+		err = s.store.RemoveAllowEntry(r.Context(), source)
+	}
+	if !found || err == storage.NotFoundErr {
+		s.writeV2Error(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("%v is not on the allowlist", source))
+		return
+	}
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	s.audit(r, storage.AuditAllowlistRemove, source, "")
+
+	s.writeV2Data(w, http.StatusOK, entry)
+}
+
+func (s *Server) v2GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	from, err := parseUnixParam(r, "from")
+	if err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	to, err := parseUnixParam(r, "to")
+	if err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	entries, err := s.store.FindAuditEntries(r.Context(), storage.AuditQuery{
+		From:   from,
+		To:     to,
+		Source: r.URL.Query().Get("source"),
+		Action: r.URL.Query().Get("action"),
+	})
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []storage.AuditEntry{}
+	}
+
+	s.writeV2Data(w, http.StatusOK, entries)
+}
+
+func (s *Server) v2ListApiKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.store.GetApiKeys(r.Context())
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	if keys == nil {
+		keys = []storage.ApiKey{}
+	}
+
+	s.writeV2Data(w, http.StatusOK, keys)
+}
+
+func (s *Server) v2AddApiKey(w http.ResponseWriter, r *http.Request) {
+	var key storage.ApiKey
+	if !s.v2Decode(w, r, &key, false) {
+		return
+	}
+
+	if err := validateApiKey(key); err != nil {
+		s.writeV2Error(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	if _, exists, err := s.findApiKey(r.Context(), key.Name); err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	} else if exists {
+		s.writeV2Error(w, http.StatusConflict, codeConflict, fmt.Sprintf("an API key named %v already exists", key.Name))
+		return
+	}
+
+	res, err := s.createApiKey(r, key)
+	if err != nil {
+		s.writeV2InternalError(w, errors.Wrap(err, "unable to create API key"))
+		return
+	}
+
+	s.writeV2Data(w, http.StatusCreated, res)
+}
+
+func (s *Server) v2RemoveApiKey(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	key, found, err := s.findApiKey(r.Context(), name)
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+
+	if found {
+		err = s.store.RemoveApiKey(r.Context(), name)
+	}
+	if !found || err == storage.NotFoundErr {
+		s.writeV2Error(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("there is no API key named %v", name))
+		return
+	}
+	if err != nil {
+		s.writeV2InternalError(w, err)
+		return
+	}
+	s.audit(r, storage.AuditApiKeyRemove, "", fmt.Sprintf("key %v", name))
+
+	s.writeV2Data(w, http.StatusOK, key)
+}
@@ -0,0 +1,239 @@
+// Package archive contains the versioned JSON archive of the full state of a server, used for backups and to move the
+// state to another server or storage type
+package archive
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"sort"
+)
+
+// Version is the version of archives created by this version of the service, archives of newer versions are rejected
+const Version = 1
+
+// Archive is the full state of a server. Policies are not kept in storage, so they are only set by the server itself
+type Archive struct {
+	Version int            `json:"version"`
+	Created unix_time.Time `json:"created"`
+
+	Policy          *blocker.Policy           `json:"policy,omitempty"`
+	ServicePolicies map[string]blocker.Policy `json:"service_policies,omitempty"`
+
+	Entries   []storage.AuthenticationEntry `json:"entries"`
+	Blocks    []storage.BlockEntry          `json:"blocks"`
+	Modules   []storage.ExternalModule      `json:"modules"`
+	Allowlist []storage.AllowEntry          `json:"allowlist"`
+	ApiKeys   []ApiKey                      `json:"api_keys"`
+	Audit     []storage.AuditEntry          `json:"audit"`
+}
+
+// ApiKey is an API key including its hash, which is not part of the API representation of keys
+type ApiKey struct {
+	Name    string         `json:"name"`
+	Hash    string         `json:"hash"`
+	Scopes  []string       `json:"scopes"`
+	Created unix_time.Time `json:"created"`
+}
+
+// Summary is the amount of items of each kind that were imported
+type Summary struct {
+	Entries   int `json:"entries"`
+	Blocks    int `json:"blocks"`
+	Modules   int `json:"modules"`
+	Allowlist int `json:"allowlist"`
+	ApiKeys   int `json:"api_keys"`
+	Audit     int `json:"audit"`
+	// AllowedBlocks is the amount of blocks that were not imported because their source is on the allowlist
+	AllowedBlocks int `json:"allowed_blocks"`
+}
+
+// Export reads all data of the storage, including expired blocks. The clock sets the creation time of the archive
+func Export(ctx context.Context, store storage.Storage, clock clock.Clock) (Archive, error) {
+	a := Archive{
+		Version: Version,
+		Created: unix_time.Time(clock.Now()),
+	}
+
+	sources, err := store.FindSources(ctx)
+	if err != nil {
+		return Archive{}, errors.Wrap(err, "failed to get sources")
+	}
+	for source := range sources {
+		entries, err := store.FindAuthenticationEntries(ctx, source)
+		if err != nil {
+			return Archive{}, errors.Wrapf(err, "failed to get entries of %v", source)
+		}
+
+		for e := range entries {
+			a.Entries = append(a.Entries, e)
+		}
+	}
+	sort.Slice(a.Entries, func(i, j int) bool {
+		if a.Entries[i].Source != a.Entries[j].Source {
+			return a.Entries[i].Source < a.Entries[j].Source
+		}
+		return a.Entries[i].Timestamp.Time().Before(a.Entries[j].Timestamp.Time())
+	})
+
+	if a.Blocks, err = store.AllBlockEntries(ctx, false); err != nil {
+		return Archive{}, errors.Wrap(err, "failed to get blocks")
+	}
+	sort.Slice(a.Blocks, func(i, j int) bool { return a.Blocks[i].Source < a.Blocks[j].Source })
+
+	if a.Modules, err = store.GetExternalModules(ctx); err != nil {
+		return Archive{}, errors.Wrap(err, "failed to get modules")
+	}
+	sort.Slice(a.Modules, func(i, j int) bool { return a.Modules[i].Id < a.Modules[j].Id })
+
+	if a.Allowlist, err = store.GetAllowEntries(ctx); err != nil {
+		return Archive{}, errors.Wrap(err, "failed to get allowlist")
+	}
+	sort.Slice(a.Allowlist, func(i, j int) bool { return a.Allowlist[i].Source < a.Allowlist[j].Source })
+
+	keys, err := store.GetApiKeys(ctx)
+	if err != nil {
+		return Archive{}, errors.Wrap(err, "failed to get API keys")
+	}
+	for _, k := range keys {
+		a.ApiKeys = append(a.ApiKeys, ApiKey{Name: k.Name, Hash: k.Hash, Scopes: k.Scopes, Created: k.Created})
+	}
+	sort.Slice(a.ApiKeys, func(i, j int) bool { return a.ApiKeys[i].Name < a.ApiKeys[j].Name })
+
+	if a.Audit, err = store.FindAuditEntries(ctx, storage.AuditQuery{}); err != nil {
+		return Archive{}, errors.Wrap(err, "failed to get audit log")
+	}
+
+	return a, nil
+}
+
+// Validate checks whether the archive can be imported by this version of the service
+func (a Archive) Validate() error {
+	if a.Version < 1 || a.Version > Version {
+		return errors.Errorf("archive version %v is not supported, expected at most %v", a.Version, Version)
+	}
+
+	if a.Policy != nil {
+		if err := a.Policy.Validate(); err != nil {
+			return errors.Wrap(err, "invalid policy")
+		}
+	}
+	for service, p := range a.ServicePolicies {
+		if err := p.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid policy of %v", service)
+		}
+	}
+
+	for _, e := range a.Entries {
+		if !e.Valid() {
+			return errors.Errorf("invalid authentication entry of %v", e.Source)
+		}
+	}
+	for _, e := range a.Blocks {
+		if e.Source == "" {
+			return errors.New("block without source")
+		}
+	}
+	for _, m := range a.Modules {
+		if m.Address == "" {
+			return errors.Errorf("module %v without address", m.Id)
+		}
+	}
+	for _, e := range a.Allowlist {
+		if !e.Valid() {
+			return errors.Errorf("invalid allowlist entry %v", e.Source)
+		}
+	}
+	for _, k := range a.ApiKeys {
+		if k.Name == "" || k.Hash == "" {
+			return errors.New("API key without name or hash")
+		}
+	}
+
+	return nil
+}
+
+// Import adds the data of the archive to the storage. Existing data is kept, items with the same key are replaced by
+// the ones in the archive. The audit log is only imported when the audit log of the storage is empty, so importing an
+// archive twice does not duplicate it. Blocks of sources on the allowlist, including the allowlist of the archive, are
+// skipped. Other blocks are stored as-is, enforcing them is up to the caller
+func Import(ctx context.Context, store storage.Storage, a Archive) (Summary, error) {
+	if err := a.Validate(); err != nil {
+		return Summary{}, err
+	}
+
+	var s Summary
+	for _, e := range a.Entries {
+		if err := store.AddAuthenticationEntry(ctx, e); err != nil {
+			return s, errors.Wrapf(err, "failed to import entry of %v", e.Source)
+		}
+		s.Entries++
+	}
+
+	for _, m := range a.Modules {
+		if err := store.AddExternalModule(ctx, m); err != nil {
+			return s, errors.Wrapf(err, "failed to import module %v", m.Address)
+		}
+		s.Modules++
+	}
+
+	for _, e := range a.Allowlist {
+		if err := store.AddAllowEntry(ctx, e); err != nil {
+			return s, errors.Wrapf(err, "failed to import allowlist entry %v", e.Source)
+		}
+		s.Allowlist++
+	}
+
+	allowlist, err := store.GetAllowEntries(ctx)
+	if err != nil {
+		return s, errors.Wrap(err, "failed to get allowlist")
+	}
+	for _, e := range a.Blocks {
+		if allowed(allowlist, e.Source) {
+			s.AllowedBlocks++
+			continue
+		}
+
+		if err := store.AddBlockEntry(ctx, e); err != nil {
+			return s, errors.Wrapf(err, "failed to import block of %v", e.Source)
+		}
+		s.Blocks++
+	}
+
+	for _, k := range a.ApiKeys {
+		key := storage.ApiKey{Name: k.Name, Hash: k.Hash, Scopes: k.Scopes, Created: k.Created}
+		if err := store.AddApiKey(ctx, key); err != nil {
+			return s, errors.Wrapf(err, "failed to import API key %v", k.Name)
+		}
+		s.ApiKeys++
+	}
+
+	existing, err := store.FindAuditEntries(ctx, storage.AuditQuery{})
+	if err != nil {
+		return s, errors.Wrap(err, "failed to get audit log")
+	}
+	if len(existing) == 0 {
+		for _, e := range a.Audit {
+			if err := store.AddAuditEntry(ctx, e); err != nil {
+				return s, errors.Wrap(err, "failed to import audit entry")
+			}
+			s.Audit++
+		}
+	}
+
+	return s, nil
+}
+
+// allowed checks whether the source, which can be an IP or a CIDR range, overlaps with an allowlist entry
+func allowed(allowlist []storage.AllowEntry, source string) bool {
+	for _, e := range allowlist {
+		if e.Overlaps(source) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,176 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock/fakeclock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var now = time.Unix(1600000000, 0)
+
+// newTestStore creates a memory store with an item of every kind that is part of an archive
+func newTestStore(t *testing.T, c *fakeclock.Clock) storage.Storage {
+	t.Helper()
+	ctx := context.Background()
+
+	store := storage.NewMemoryStore(c, logging.Discard())
+	add := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	add(store.AddAuthenticationEntry(ctx, storage.AuthenticationEntry{Source: "10.0.0.1", Service: "ssh",
+		Timestamp: unix_time.Time(now.Add(-time.Minute))}))
+	add(store.AddAuthenticationEntry(ctx, storage.AuthenticationEntry{Source: "10.0.0.2", Service: "smtp",
+		Timestamp: unix_time.Time(now)}))
+	add(store.AddBlockEntry(ctx, storage.BlockEntry{Source: "10.0.0.1", Timestamp: unix_time.Time(now),
+		Duration: time.Hour, Reason: "policy", Tags: []string{"ssh"}, Service: "ssh"}))
+	add(store.AddBlockEntry(ctx, storage.BlockEntry{Source: "10.1.0.0/16", Timestamp: unix_time.Time(now),
+		Permanent: true}))
+	add(store.AddExternalModule(ctx, storage.ExternalModule{Id: 1, Address: "http://example.com/block", Method: "POST"}))
+	add(store.AddAllowEntry(ctx, storage.AllowEntry{Source: "192.168.0.0/16", Description: "office"}))
+	add(store.AddApiKey(ctx, storage.ApiKey{Name: "reader", Hash: "hash", Scopes: []string{"read"},
+		Created: unix_time.Time(now)}))
+	add(store.AddAuditEntry(ctx, storage.AuditEntry{Timestamp: unix_time.Time(now), Action: storage.AuditBlock,
+		Trigger: "manual", Actor: "admin", Source: "10.0.0.1"}))
+
+	return store
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	c := fakeclock.New(now)
+
+	a, err := Export(ctx, newTestStore(t, c), c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(a.Entries) != 2 || len(a.Blocks) != 2 || len(a.Modules) != 1 || len(a.Allowlist) != 1 ||
+		len(a.ApiKeys) != 1 || len(a.Audit) != 1 {
+		t.Fatalf("expected every item to be exported, got %+v", a)
+	}
+
+	// Migrating copies everything into the new storage type, which keeps it after being reopened
+	config := storage.PersistentConfig{Path: filepath.Join(t.TempDir(), "data.gob")}
+	target, err := storage.NewPersistentStore(config, c, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	summary, err := Import(ctx, target, a)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := (Summary{Entries: 2, Blocks: 2, Modules: 1, Allowlist: 1, ApiKeys: 1, Audit: 1}); summary != expected {
+		t.Fatalf("expected summary %+v, got %+v", expected, summary)
+	}
+	if err := target.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reopened, err := storage.NewPersistentStore(config, c, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer reopened.Close()
+
+	c.Advance(time.Minute)
+	migrated, err := Export(ctx, reopened, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !migrated.Created.Time().Equal(c.Now()) {
+		t.Fatalf("expected the archive to be created at the time of the clock, got %v", migrated.Created)
+	}
+	// Archives are compared as JSON, as timestamps read from the data file have no location
+	migrated.Created = a.Created
+	expected, _ := json.Marshal(a)
+	got, _ := json.Marshal(migrated)
+	if string(got) != string(expected) {
+		t.Fatalf("expected the migrated storage to contain the same data\nexpected: %s\ngot:      %s", expected, got)
+	}
+
+	// Importing the same archive again does not duplicate the audit log
+	if summary, err := Import(ctx, reopened, a); err != nil || summary.Audit != 0 {
+		t.Fatalf("expected the audit log to not be imported twice, got %+v (%v)", summary, err)
+	}
+}
+
+func TestImportAllowlisted(t *testing.T) {
+	ctx := context.Background()
+	c := fakeclock.New(now)
+	store := storage.NewMemoryStore(c, logging.Discard())
+	if err := store.AddAllowEntry(ctx, storage.AllowEntry{Source: "10.0.0.0/24"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Blocks overlapping with the existing allowlist or the allowlist of the archive are skipped
+	a := Archive{
+		Version:   Version,
+		Allowlist: []storage.AllowEntry{{Source: "172.16.0.0/12"}},
+		Blocks: []storage.BlockEntry{
+			{Source: "10.0.0.1", Timestamp: unix_time.Time(now), Duration: time.Hour},
+			{Source: "10.0.0.0/8", Timestamp: unix_time.Time(now), Duration: time.Hour},
+			{Source: "172.16.0.1", Timestamp: unix_time.Time(now), Permanent: true},
+			{Source: "10.1.0.1", Timestamp: unix_time.Time(now), Duration: time.Hour},
+		},
+	}
+	summary, err := Import(ctx, store, a)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if summary.Blocks != 1 || summary.AllowedBlocks != 3 {
+		t.Fatalf("expected 1 imported and 3 skipped blocks, got %+v", summary)
+	}
+
+	for _, source := range []string{"10.0.0.1", "10.0.0.0/8", "172.16.0.1"} {
+		if _, err := store.FindBlockEntry(ctx, source); err != storage.NotFoundErr {
+			t.Fatalf("expected the block of %v to be skipped, got %v", source, err)
+		}
+	}
+	if _, err := store.FindBlockEntry(ctx, "10.1.0.1"); err != nil {
+		t.Fatalf("expected the other block to be imported, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]Archive{
+		"missing version":         {},
+		"newer version":           {Version: Version + 1},
+		"policy without attempts": {Version: Version, Policy: &blocker.Policy{Period: time.Minute, BlockTime: time.Hour}},
+		"service policy without block time": {Version: Version, ServicePolicies: map[string]blocker.Policy{
+			"ssh": {Attempts: 3, Period: time.Minute},
+		}},
+		"invalid entry":           {Version: Version, Entries: []storage.AuthenticationEntry{{Source: "invalid"}}},
+		"invalid allowlist entry": {Version: Version, Allowlist: []storage.AllowEntry{{Source: "10.0.0.0/33"}}},
+	}
+
+	for name, a := range tests {
+		if err := a.Validate(); err == nil {
+			t.Fatalf("expected an archive with %v to be rejected", name)
+		}
+
+		// Nothing is imported from invalid archives
+		store := storage.NewMemoryStore(fakeclock.New(now), logging.Discard())
+		a.Blocks = []storage.BlockEntry{{Source: "10.0.0.1", Timestamp: unix_time.Time(now), Duration: time.Hour}}
+		if _, err := Import(context.Background(), store, a); err == nil {
+			t.Fatalf("expected the import of an archive with %v to fail", name)
+		}
+		if _, err := store.FindBlockEntry(context.Background(), "10.0.0.1"); err != storage.NotFoundErr {
+			t.Fatalf("expected nothing to be imported from an archive with %v, got %v", name, err)
+		}
+	}
+
+	policy := blocker.Policy{Attempts: 3, Period: time.Minute, BlockTime: time.Hour}
+	if err := (Archive{Version: Version, Policy: &policy}).Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
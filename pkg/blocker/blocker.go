@@ -1,10 +1,20 @@
 package blocker
 
 import (
+	"context"
+	"fmt"
 	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/metrics"
 	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/tracing"
 	"github.com/timanema/fail2ban-service/pkg/unix_time"
-	"log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,88 +25,268 @@ type Policy struct {
 	BlockTime time.Duration `json:"blocktime"`
 }
 
+// Validate checks whether the policy can be used, a policy without attempts or block time would block every source
+// right away or not at all
+func (p Policy) Validate() error {
+	if p.Attempts <= 0 || p.Period <= 0 || p.BlockTime <= 0 {
+		return errors.New("attempts, period and blocktime must be positive")
+	}
+
+	return nil
+}
+
+// DefaultPolicy is used when no policy is configured
+var DefaultPolicy = Policy{
+	Attempts:  3,
+	Period:    5 * time.Second,
+	BlockTime: time.Minute,
+}
+
+// BlockOptions overrides the defaults of the active policy for a single block
+type BlockOptions struct {
+	// Duration of the block, the block time of the active policy is used when zero
+	Duration time.Duration
+	// Permanent blocks never expire, Duration is ignored for them
+	Permanent bool
+	Reason    string
+	Tags      []string
+	Service   string
+	// Actor is the name of whoever requested the block, which is recorded in the audit log
+	Actor string
+}
+
+var AllowedErr = errors.New("source is on the allowlist")
+
+var tracer = otel.Tracer("github.com/timanema/fail2ban-service/pkg/blocker")
+
 type Blocker struct {
-	lock   sync.Mutex
-	store  storage.Storage
-	policy Policy
+	lock     sync.Mutex
+	logger   *slog.Logger
+	store    storage.Storage
+	policy   Policy
+	firewall Firewall
+	// clock is used for the policy window, the timestamps of blocks and to determine which blocks are active
+	clock clock.Clock
+	// servicePolicies override the policy for entries of a single service
+	servicePolicies map[string]Policy
 
 	lastExternalUpdate map[string]bool
+
+	// inflight tracks external notifications and firewall operations, so they can be drained on shutdown. Once
+	// draining is set no new operations are started, so inflight is not added to while it is waited on
+	inflight sync.WaitGroup
+	draining bool
 }
 
-func New(store storage.Storage, policy Policy) *Blocker {
+func New(store storage.Storage, policy Policy, firewall Firewall, clock clock.Clock, logger *slog.Logger) *Blocker {
 	return &Blocker{
 		lock:               sync.Mutex{},
+		logger:             logger,
 		store:              store,
 		policy:             policy,
+		firewall:           firewall,
+		clock:              clock,
+		servicePolicies:    make(map[string]Policy),
 		lastExternalUpdate: make(map[string]bool),
 	}
 }
 
-func (b *Blocker) AddEntry(entry storage.AuthenticationEntry) error {
-	if blocked, _, _ := b.IsBlocked(entry.Source); blocked {
+func (b *Blocker) AddEntry(ctx context.Context, entry storage.AuthenticationEntry) (err error) {
+	ctx, span := tracer.Start(ctx, "Blocker.AddEntry", trace.WithAttributes(attribute.String("source", entry.Source),
+		attribute.String("service", entry.Service)))
+	defer func() { tracing.End(span, err) }()
+
+	if blocked, _, _ := b.IsBlocked(ctx, entry.Source); blocked {
 		return nil
 	}
 
-	if err := b.store.AddAuthenticationEntry(entry); err != nil {
+	if err := b.store.AddAuthenticationEntry(ctx, entry); err != nil {
 		return errors.Wrap(err, "failed to add entry to store")
 	}
+	metrics.AuthenticationEntries.WithLabelValues(entry.Service).Inc()
 
-	entries, err := b.store.FindAuthenticationEntries(entry.Source)
+	entries, err := b.store.FindAuthenticationEntries(ctx, entry.Source)
 	if err != nil {
 		return errors.Wrap(err, "failed to retrieve auth entries from store")
 	}
 
-	count := 0
-	for entry := range entries {
-		if time.Now().Add(-1 * b.policy.Period).Before(entry.Timestamp.Time()) {
-			count += 1
+	// Services with their own policy only count their own entries
+	policy, ok := b.ServicePolicy(entry.Service)
+	if !ok {
+		policy = b.Policy()
+	}
+
+	start := b.clock.Now().Add(-1 * policy.Period)
+	var window []storage.AuthenticationEntry
+	for e := range entries {
+		if ok && e.Service != entry.Service {
+			continue
+		}
 
-			if count >= b.policy.Attempts {
-				log.Printf("source %v has violated the active policy\n", entry.Source)
-				if _, err := b.BlockIP(entry.Source); err != nil {
-					return errors.Wrapf(err, "failed to block %v", entry.Source)
-				}
-				break
-			}
+		if start.Before(e.Timestamp.Time()) {
+			window = append(window, e)
 		}
 	}
 
+	if len(window) < policy.Attempts {
+		return nil
+	}
+
+	b.logger.Info("source has violated the active policy", "source", entry.Source, "service", entry.Service,
+		"attempts", len(window))
+	sort.Slice(window, func(i, j int) bool {
+		return window[i].Timestamp.Time().Before(window[j].Timestamp.Time())
+	})
+
+	opts := BlockOptions{
+		Duration: policy.BlockTime,
+		Reason: fmt.Sprintf("%v failed %v attempts within %v (policy: block after %v attempts within %v)",
+			len(window), describeServices(window), policy.Period, policy.Attempts, policy.Period),
+		Service: entry.Service,
+	}
+	if _, err := b.block(ctx, entry.Source, opts, metrics.ReasonPolicy, window); err == AllowedErr {
+		b.logger.Info("source is on the allowlist, not blocking", "source", entry.Source)
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to block %v", entry.Source)
+	}
+
 	return nil
 }
 
-func (b *Blocker) BlockIP(ip string) (storage.BlockEntry, error) {
+func (b *Blocker) BlockIP(ctx context.Context, ip string, opts BlockOptions) (entry storage.BlockEntry, err error) {
+	ctx, span := tracer.Start(ctx, "Blocker.BlockIP", trace.WithAttributes(attribute.String("source", ip)))
+	defer func() { tracing.End(span, err) }()
+
+	return b.block(ctx, ip, opts, metrics.ReasonManual, nil)
+}
+
+// block stores and enforces a block, trigger is one of the metrics reasons and cause the entries that caused it
+func (b *Blocker) block(ctx context.Context, ip string, opts BlockOptions, trigger string, cause []storage.AuthenticationEntry) (storage.BlockEntry, error) {
+	allowed, err := b.IsAllowed(ctx, ip)
+	if err != nil {
+		return storage.BlockEntry{}, errors.Wrap(err, "failed to check allowlist")
+	}
+	if allowed {
+		return storage.BlockEntry{}, AllowedErr
+	}
+
 	entry := storage.BlockEntry{
 		Source:    ip,
-		Timestamp: unix_time.Time(time.Now()),
-		Duration:  b.policy.BlockTime,
+		Timestamp: unix_time.Time(b.clock.Now()),
+		Duration:  opts.Duration,
+		Permanent: opts.Permanent,
+		Reason:    opts.Reason,
+		Tags:      opts.Tags,
+		Service:   opts.Service,
+	}
+	if entry.Permanent {
+		entry.Duration = 0
+	} else if entry.Duration == 0 {
+		entry.Duration = b.Policy().BlockTime
 	}
 
-	if err := b.store.AddBlockEntry(entry); err != nil {
+	if err := b.store.AddBlockEntry(ctx, entry); err != nil {
 		return storage.BlockEntry{}, errors.Wrap(err, "failed to store block in store")
 	}
 
-	log.Printf("source %v was blocked\n", ip)
-	return entry, errors.Wrap(b.notifyExternal(entry), "failed to notify external modules of block")
+	details := fmt.Sprintf("blocked for %v", entry.Duration)
+	if entry.Permanent {
+		details = "blocked permanently"
+	}
+	if entry.Reason != "" {
+		details += ": " + entry.Reason
+	}
+	if len(entry.Tags) > 0 {
+		details += fmt.Sprintf(" (tags: %v)", strings.Join(entry.Tags, ", "))
+	}
+
+	metrics.Blocks.WithLabelValues(trigger).Inc()
+	b.audit(ctx, storage.AuditEntry{
+		Action:  storage.AuditBlock,
+		Trigger: trigger,
+		Actor:   opts.Actor,
+		Source:  ip,
+		Details: details,
+		Entries: cause,
+	})
+	b.logger.Info("source was blocked", "source", ip, "service", entry.Service, "trigger", trigger,
+		"duration", entry.Duration, "permanent", entry.Permanent)
+	return entry, errors.Wrap(b.notifyExternal(ctx, entry), "failed to notify external modules of block")
+}
+
+// BlockListed blocks a source of an imported blocklist, which can be an IP or a CIDR range. Ranges that overlap with
+// the allowlist are not blocked
+func (b *Blocker) BlockListed(ctx context.Context, source string, opts BlockOptions) (entry storage.BlockEntry, err error) {
+	ctx, span := tracer.Start(ctx, "Blocker.BlockListed", trace.WithAttributes(attribute.String("source", source)))
+	defer func() { tracing.End(span, err) }()
+
+	return b.block(ctx, source, opts, metrics.ReasonList, nil)
 }
 
-func (b *Blocker) UnblockIP(ip string) error {
+// BlockMirrored blocks a source that is blocked by an upstream server, which can be an IP or a CIDR range
+func (b *Blocker) BlockMirrored(ctx context.Context, source string, opts BlockOptions) (entry storage.BlockEntry, err error) {
+	ctx, span := tracer.Start(ctx, "Blocker.BlockMirrored", trace.WithAttributes(attribute.String("source", source)))
+	defer func() { tracing.End(span, err) }()
+
+	return b.block(ctx, source, opts, metrics.ReasonFederation, nil)
+}
+
+// UnblockIP removes the block of the given IP, actor is recorded in the audit log
+func (b *Blocker) UnblockIP(ctx context.Context, ip string, actor string) (err error) {
+	ctx, span := tracer.Start(ctx, "Blocker.UnblockIP", trace.WithAttributes(attribute.String("source", ip)))
+	defer func() { tracing.End(span, err) }()
+
+	return b.unblock(ctx, ip, actor, metrics.ReasonManual)
+}
+
+// UnblockListed removes the block of a source that disappeared from an imported blocklist
+func (b *Blocker) UnblockListed(ctx context.Context, source string, actor string) (err error) {
+	ctx, span := tracer.Start(ctx, "Blocker.UnblockListed", trace.WithAttributes(attribute.String("source", source)))
+	defer func() { tracing.End(span, err) }()
+
+	return b.unblock(ctx, source, actor, metrics.ReasonList)
+}
+
+// UnblockMirrored removes the block of a source that is no longer blocked by an upstream server
+func (b *Blocker) UnblockMirrored(ctx context.Context, source string, actor string) (err error) {
+	ctx, span := tracer.Start(ctx, "Blocker.UnblockMirrored", trace.WithAttributes(attribute.String("source", source)))
+	defer func() { tracing.End(span, err) }()
+
+	return b.unblock(ctx, source, actor, metrics.ReasonFederation)
+}
+
+// unblock removes a block, trigger is one of the metrics reasons
+func (b *Blocker) unblock(ctx context.Context, ip string, actor string, trigger string) error {
 	// Expired entry
 	entry := storage.BlockEntry{
 		Source:    ip,
-		Timestamp: unix_time.Time(time.Now()),
-		Duration:  -1 * b.policy.BlockTime,
+		Timestamp: unix_time.Time(b.clock.Now()),
+		Duration:  -1 * b.Policy().BlockTime,
 	}
 
-	if err := b.store.RemoveBlockEntry(ip); err != nil {
+	if err := b.store.RemoveBlockEntry(ctx, ip); err != nil {
 		return errors.Wrap(err, "failed to remove block entry from store")
 	}
 
-	log.Printf("source %v was unblocked\n", ip)
-	return errors.Wrap(b.notifyExternal(entry), "failed to notify external modules of unblock")
+	metrics.Unblocks.WithLabelValues(trigger).Inc()
+	b.audit(ctx, storage.AuditEntry{
+		Action:  storage.AuditUnblock,
+		Trigger: trigger,
+		Actor:   actor,
+		Source:  ip,
+	})
+	b.logger.Info("source was unblocked", "source", ip, "trigger", trigger, "actor", actor)
+	return errors.Wrap(b.notifyExternal(ctx, entry), "failed to notify external modules of unblock")
 }
 
-func (b *Blocker) IsBlocked(ip string) (bool, storage.BlockEntry, error) {
-	entry, err := b.store.FindBlockEntry(ip)
+// Enforce updates the firewall and external modules for a block or unblock that was stored without the blocker, such
+// as one received from a peer
+func (b *Blocker) Enforce(ctx context.Context, entry storage.BlockEntry) error {
+	return errors.Wrap(b.notifyExternal(ctx, entry), "failed to notify external modules")
+}
+
+func (b *Blocker) IsBlocked(ctx context.Context, ip string) (bool, storage.BlockEntry, error) {
+	entry, err := b.store.FindBlockEntry(ctx, ip)
 	if err == storage.NotFoundErr {
 		return false, storage.BlockEntry{}, nil
 	}
@@ -105,11 +295,28 @@ func (b *Blocker) IsBlocked(ip string) (bool, storage.BlockEntry, error) {
 		return false, storage.BlockEntry{}, errors.Wrap(err, "unable to load block entry")
 	}
 
-	if err := b.notifyExternal(entry); err != nil {
+	if err := b.notifyExternal(ctx, entry); err != nil {
 		return false, storage.BlockEntry{}, errors.Wrap(err, "unable to update external modules")
 	}
 
-	return entry.Timestamp.Time().Add(entry.Duration).After(time.Now()), entry, nil
+	return entry.ActiveAt(b.clock.Now()), entry, nil
+}
+
+// IsAllowed checks whether the given IP is covered by an allowlist entry. For CIDR ranges it checks whether the range
+// overlaps with an allowlist entry
+func (b *Blocker) IsAllowed(ctx context.Context, ip string) (bool, error) {
+	entries, err := b.store.GetAllowEntries(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to load allowlist")
+	}
+
+	for _, e := range entries {
+		if e.Overlaps(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
 func (b *Blocker) UpdatePolicy(policy Policy) {
@@ -117,7 +324,8 @@ func (b *Blocker) UpdatePolicy(policy Policy) {
 	defer b.lock.Unlock()
 
 	b.policy = policy
-	log.Printf("block policy was updated: %+v\n", policy)
+	b.logger.Info("block policy was updated", "attempts", policy.Attempts, "period", policy.Period,
+		"blocktime", policy.BlockTime)
 }
 
 func (b *Blocker) Policy() Policy {
@@ -127,20 +335,115 @@ func (b *Blocker) Policy() Policy {
 	return b.policy
 }
 
-func (b *Blocker) NotifyAll() error {
-	entries, err := b.store.AllBlockEntries(false)
+// UpdateServicePolicies replaces all service specific policies
+func (b *Blocker) UpdateServicePolicies(policies map[string]Policy) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.servicePolicies = make(map[string]Policy, len(policies))
+	for service, policy := range policies {
+		b.servicePolicies[service] = policy
+	}
+	for service, policy := range policies {
+		b.logger.Info("service policy was updated", "service", service, "attempts", policy.Attempts,
+			"period", policy.Period, "blocktime", policy.BlockTime)
+	}
+}
+
+// ServicePolicy returns the policy for the given service, if it has one
+func (b *Blocker) ServicePolicy(service string) (Policy, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	policy, ok := b.servicePolicies[service]
+	return policy, ok
+}
+
+// ServicePolicies returns a copy of all service specific policies
+func (b *Blocker) ServicePolicies() map[string]Policy {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	policies := make(map[string]Policy, len(b.servicePolicies))
+	for service, policy := range b.servicePolicies {
+		policies[service] = policy
+	}
+	return policies
+}
+
+// describeServices lists the services of the given entries, for example "ssh and smtp"
+func describeServices(entries []storage.AuthenticationEntry) string {
+	seen := make(map[string]struct{})
+	var services []string
+	for _, e := range entries {
+		if _, ok := seen[e.Service]; !ok {
+			seen[e.Service] = struct{}{}
+			services = append(services, e.Service)
+		}
+	}
+
+	if len(services) == 1 {
+		return services[0]
+	}
+
+	return strings.Join(services[:len(services)-1], ", ") + " and " + services[len(services)-1]
+}
+
+// audit records the given entry in the audit log, failures are only logged as they should not stop enforcement
+func (b *Blocker) audit(ctx context.Context, entry storage.AuditEntry) {
+	entry.Timestamp = unix_time.Time(b.clock.Now())
+	if err := b.store.AddAuditEntry(ctx, entry); err != nil {
+		b.logger.Error("failed to add audit entry", "action", entry.Action, "source", entry.Source, "error", err)
+	}
+}
+
+// CheckFirewall verifies whether the firewall used to enforce blocks is usable
+func (b *Blocker) CheckFirewall() error {
+	return b.firewall.Check()
+}
+
+func (b *Blocker) NotifyAll(ctx context.Context) error {
+	entries, err := b.store.AllBlockEntries(ctx, false)
 	if err != nil {
 		return errors.Wrap(err, "failed to retrieve all block entries")
 	}
 
+	now := b.clock.Now()
+	active := 0
 	for _, e := range entries {
-		if err := b.notifyExternal(e); err != nil {
+		if err := b.notifyExternal(ctx, e); err != nil {
 			return errors.Wrapf(err, "failed to notify modules of %v", e)
 		}
+
+		if e.ActiveAt(now) {
+			active++
+		}
 	}
+	metrics.ActiveBlocks.Set(float64(active))
 
-	if err := b.store.CleanBlockEntries(); err != nil {
+	if err := b.store.CleanBlockEntries(ctx); err != nil {
 		return errors.Wrap(err, "failed to clean block store")
 	}
 	return nil
 }
+
+// Drain waits until all in-flight external notifications and firewall operations are done, or the context expires.
+// Blocks and unblocks made after Drain was called are stored, but not enforced anymore
+func (b *Blocker) Drain(ctx context.Context) error {
+	b.lock.Lock()
+	b.draining = true
+	b.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "in-flight notifications and firewall operations did not finish")
+	}
+}
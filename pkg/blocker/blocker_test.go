@@ -0,0 +1,315 @@
+package blocker
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/timanema/fail2ban-service/pkg/clock/fakeclock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/metrics"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{Attempts: 3, Period: time.Minute, BlockTime: 10 * time.Minute}
+
+func newTestBlocker(policy Policy) (*Blocker, *fakeclock.Clock) {
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	return New(storage.NewMemoryStore(c, logging.Discard()), policy, NoopFirewall{}, c, logging.Discard()), c
+}
+
+// attempt reports a failed attempt of the source at the current time of the clock
+func attempt(t *testing.T, b *Blocker, c *fakeclock.Clock, source, service string) {
+	t.Helper()
+
+	entry := storage.AuthenticationEntry{Source: source, Service: service, Timestamp: unix_time.Time(c.Now())}
+	if err := b.AddEntry(context.Background(), entry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func isBlocked(t *testing.T, b *Blocker, source string) bool {
+	t.Helper()
+
+	blocked, _, err := b.IsBlocked(context.Background(), source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return blocked
+}
+
+func TestPolicyWindow(t *testing.T) {
+	b, c := newTestBlocker(testPolicy)
+
+	attempt(t, b, c, "10.0.0.1", "ssh")
+	c.Advance(30 * time.Second)
+	attempt(t, b, c, "10.0.0.1", "ssh")
+
+	// The first attempt is outside of the window by now
+	c.Advance(40 * time.Second)
+	attempt(t, b, c, "10.0.0.1", "ssh")
+	if isBlocked(t, b, "10.0.0.1") {
+		t.Fatalf("expected attempts outside of the window to not be counted")
+	}
+
+	c.Advance(10 * time.Second)
+	attempt(t, b, c, "10.0.0.1", "ssh")
+	blocked, entry, err := b.IsBlocked(context.Background(), "10.0.0.1")
+	if err != nil || !blocked {
+		t.Fatalf("expected three attempts within the window to cause a block, got %v (%v)", blocked, err)
+	}
+	if !entry.Timestamp.Time().Equal(c.Now()) || entry.Duration != testPolicy.BlockTime || entry.Service != "ssh" {
+		t.Fatalf("expected a block of the policy starting now, got %+v", entry)
+	}
+
+	if isBlocked(t, b, "10.0.0.2") {
+		t.Fatalf("expected other sources to not be blocked")
+	}
+}
+
+func TestServicePolicyWindow(t *testing.T) {
+	b, c := newTestBlocker(testPolicy)
+	b.UpdateServicePolicies(map[string]Policy{"smtp": {Attempts: 2, Period: time.Minute, BlockTime: time.Hour}})
+
+	// Services with their own policy only count their own entries
+	attempt(t, b, c, "10.0.0.1", "ssh")
+	c.Advance(time.Second)
+	attempt(t, b, c, "10.0.0.1", "ssh")
+	c.Advance(time.Second)
+	attempt(t, b, c, "10.0.0.1", "smtp")
+	if isBlocked(t, b, "10.0.0.1") {
+		t.Fatalf("expected entries of other services to not be counted")
+	}
+
+	c.Advance(time.Second)
+	attempt(t, b, c, "10.0.0.1", "smtp")
+	_, entry, _ := b.IsBlocked(context.Background(), "10.0.0.1")
+	if !entry.ActiveAt(c.Now()) || entry.Duration != time.Hour || entry.Service != "smtp" {
+		t.Fatalf("expected a block of the service policy, got %+v", entry)
+	}
+}
+
+func TestBlockExpiry(t *testing.T) {
+	ctx := context.Background()
+	b, c := newTestBlocker(testPolicy)
+
+	if _, err := b.BlockIP(ctx, "10.0.0.1", BlockOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := b.BlockIP(ctx, "10.0.0.2", BlockOptions{Permanent: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.Advance(testPolicy.BlockTime - time.Second)
+	if !isBlocked(t, b, "10.0.0.1") {
+		t.Fatalf("expected the block to be active until the block time has passed")
+	}
+
+	c.Advance(time.Second)
+	if isBlocked(t, b, "10.0.0.1") {
+		t.Fatalf("expected the block to expire after the block time")
+	}
+
+	// Expired blocks are removed, permanent blocks never expire
+	c.Advance(365 * 24 * time.Hour)
+	if err := b.NotifyAll(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := b.store.FindBlockEntry(ctx, "10.0.0.1"); err != storage.NotFoundErr {
+		t.Fatalf("expected the expired block to be removed, got %v", err)
+	}
+	if !isBlocked(t, b, "10.0.0.2") {
+		t.Fatalf("expected the permanent block to stay active")
+	}
+}
+
+func TestAttemptsAfterExpiry(t *testing.T) {
+	b, c := newTestBlocker(testPolicy)
+
+	for i := 0; i < testPolicy.Attempts; i++ {
+		c.Advance(time.Second)
+		attempt(t, b, c, "10.0.0.1", "ssh")
+	}
+	if !isBlocked(t, b, "10.0.0.1") {
+		t.Fatalf("expected the source to be blocked")
+	}
+
+	// Attempts while blocked are ignored, the block expires at the time of the clock and not of the system
+	c.Advance(testPolicy.BlockTime - time.Second)
+	attempt(t, b, c, "10.0.0.1", "ssh")
+	c.Advance(time.Second)
+	if isBlocked(t, b, "10.0.0.1") {
+		t.Fatalf("expected the block to expire after the block time")
+	}
+
+	// Old attempts do not cause a new block once the block expired, new attempts do
+	for i := 0; i < testPolicy.Attempts-1; i++ {
+		attempt(t, b, c, "10.0.0.1", "ssh")
+		if isBlocked(t, b, "10.0.0.1") {
+			t.Fatalf("expected attempts before and during the block to not be counted again")
+		}
+		c.Advance(time.Second)
+	}
+	attempt(t, b, c, "10.0.0.1", "ssh")
+
+	blocked, entry, err := b.IsBlocked(context.Background(), "10.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !blocked || !entry.Timestamp.Time().Equal(c.Now()) {
+		t.Fatalf("expected a new block at the time of the clock, got %+v", entry)
+	}
+}
+
+func TestBlockAllowed(t *testing.T) {
+	ctx := context.Background()
+	b, c := newTestBlocker(testPolicy)
+	if err := b.store.AddAllowEntry(ctx, storage.AllowEntry{Source: "10.0.0.0/24"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := b.BlockIP(ctx, "10.0.0.1", BlockOptions{}); err != AllowedErr {
+		t.Fatalf("expected AllowedErr for a source on the allowlist, got %v", err)
+	}
+
+	// Policy violations of allowed sources are not an error, but do not cause a block either
+	for i := 0; i < testPolicy.Attempts; i++ {
+		c.Advance(time.Second)
+		attempt(t, b, c, "10.0.0.1", "ssh")
+	}
+	if isBlocked(t, b, "10.0.0.1") {
+		t.Fatalf("expected a source on the allowlist to not be blocked")
+	}
+}
+
+func TestBlockDefaultDuration(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestBlocker(testPolicy)
+
+	entry, err := b.BlockIP(ctx, "10.0.0.1", BlockOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry.Duration != testPolicy.BlockTime || entry.Permanent {
+		t.Fatalf("expected a block without duration to use the block time of the policy, got %+v", entry)
+	}
+
+	entry, err = b.BlockIP(ctx, "10.0.0.2", BlockOptions{Duration: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry.Duration != time.Hour {
+		t.Fatalf("expected the given duration to be used, got %+v", entry)
+	}
+}
+
+// recordingFirewall records the sources it blocked
+type recordingFirewall struct {
+	NoopFirewall
+	lock    sync.Mutex
+	blocked []string
+}
+
+func (f *recordingFirewall) Block(source string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.blocked = append(f.blocked, source)
+	return nil
+}
+
+// failingFirewall fails every operation
+type failingFirewall struct{}
+
+func (failingFirewall) Block(string) error {
+	return errors.New("iptables not found")
+}
+
+func (failingFirewall) Unblock(string) error {
+	return errors.New("iptables not found")
+}
+
+func (failingFirewall) Check() error {
+	return errors.New("iptables not found")
+}
+
+func TestFirewallErrors(t *testing.T) {
+	ctx := context.Background()
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	b := New(storage.NewMemoryStore(c, logging.Discard()), testPolicy, failingFirewall{}, c, logging.Discard())
+
+	// Blocks are still stored and lifted when the firewall fails, which is counted as an error of the operation
+	blockErrors := testutil.ToFloat64(metrics.FirewallErrors.WithLabelValues("block"))
+	unblockErrors := testutil.ToFloat64(metrics.FirewallErrors.WithLabelValues("unblock"))
+	if _, err := b.BlockIP(ctx, "10.0.0.1", BlockOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !isBlocked(t, b, "10.0.0.1") {
+		t.Fatalf("expected the block to be stored")
+	}
+	if err := b.UnblockIP(ctx, "10.0.0.1", "admin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isBlocked(t, b, "10.0.0.1") {
+		t.Fatalf("expected the block to be lifted")
+	}
+
+	if diff := testutil.ToFloat64(metrics.FirewallErrors.WithLabelValues("block")) - blockErrors; diff != 1 {
+		t.Fatalf("expected 1 failed firewall block, got %v", diff)
+	}
+	if diff := testutil.ToFloat64(metrics.FirewallErrors.WithLabelValues("unblock")) - unblockErrors; diff != 1 {
+		t.Fatalf("expected 1 failed firewall unblock, got %v", diff)
+	}
+	if err := b.CheckFirewall(); err == nil {
+		t.Fatalf("expected the firewall check to fail")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ctx := context.Background()
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	firewall := &recordingFirewall{}
+	b := New(storage.NewMemoryStore(c, logging.Discard()), testPolicy, firewall, c, logging.Discard())
+
+	if _, err := b.BlockIP(ctx, "10.0.0.1", BlockOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Drain(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Blocks after draining are stored, but not enforced
+	if _, err := b.BlockIP(ctx, "10.0.0.2", BlockOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !isBlocked(t, b, "10.0.0.2") {
+		t.Fatalf("expected the block to be stored")
+	}
+	if len(firewall.blocked) != 1 || firewall.blocked[0] != "10.0.0.1" {
+		t.Fatalf("expected only the block before draining to be enforced, got %v", firewall.blocked)
+	}
+}
+
+func TestUpdatePolicyConcurrently(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestBlocker(testPolicy)
+
+	// The policy is replaced by configuration reloads and imports while sources are unblocked, which is detected by
+	// the race detector (go test -race) if the policy is read without the lock
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			b.UpdatePolicy(Policy{Attempts: i + 1, Period: time.Minute, BlockTime: time.Duration(i+1) * time.Minute})
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		_ = b.UnblockIP(ctx, "10.0.0.1", "test")
+	}
+	wg.Wait()
+}
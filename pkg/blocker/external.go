@@ -2,13 +2,21 @@ package blocker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/metrics"
 	"github.com/timanema/fail2ban-service/pkg/storage"
-	"log"
+	"github.com/timanema/fail2ban-service/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -17,8 +25,8 @@ type externalRequest struct {
 	Blocked bool `json:"blocked"`
 }
 
-func (b *Blocker) notifyExternal(entry storage.BlockEntry) error {
-	block := entry.IsActive()
+func (b *Blocker) notifyExternal(ctx context.Context, entry storage.BlockEntry) error {
+	block := entry.ActiveAt(b.clock.Now())
 	req := externalRequest{
 		BlockEntry: entry,
 		Blocked:    block,
@@ -34,45 +42,62 @@ func (b *Blocker) notifyExternal(entry storage.BlockEntry) error {
 		return nil
 	}
 
+	// The notification is tracked as a whole, so deliveries can be added to inflight while Drain waits on it
+	b.lock.Lock()
+	if b.draining {
+		b.lock.Unlock()
+		b.logger.Warn("blocker is draining, not enforcing change", "source", entry.Source, "blocked", block)
+		return nil
+	}
+	b.inflight.Add(1)
+	b.lock.Unlock()
+	defer b.inflight.Done()
+
 	marshalledReq, err := json.Marshal(req)
 	if err != nil {
 		return errors.Wrap(err, "unable to marshal request")
 	}
 
-	external, err := b.store.GetExternalModules()
+	external, err := b.store.GetExternalModules(ctx)
 	if err != nil {
 		return errors.Wrap(err, "unable to get external modules")
 	}
 
-	id := rand.Uint32()
-	log.Printf("notifying external modules (%v) of %+v (event=%v)\n", len(external), req, id)
+	logger := b.logger.With("event_id", strconv.FormatUint(uint64(rand.Uint32()), 10), "source", entry.Source)
+	logger.Info("notifying external modules", "modules", len(external), "blocked", block,
+		"duration", entry.Duration, "permanent", entry.Permanent)
 	for _, module := range external {
 		module := module
 
+		// Deliveries outlive the request that caused them, so they should not be cancelled with it
+		b.inflight.Add(1)
 		go func() {
-			r, err := http.NewRequest(module.Method, module.Address, bytes.NewBuffer(marshalledReq))
-			if err != nil {
-				log.Printf("failed to create request for module %v for event %v: %v\n", module, id, err)
-				return
-			}
-
-			resp, err := http.DefaultClient.Do(r)
-			if err != nil {
-				log.Printf("failed to update external module %v for event %v (method=%v): %v\n", module, id, err)
-				return
-			}
-
-			if resp.StatusCode != http.StatusOK {
-				log.Printf("updated external module %v for event %v, but reacted with http status: %v (%v)\n", module, id, resp.StatusCode, http.StatusText(resp.StatusCode))
-			}
+			defer b.inflight.Done()
+			b.notifyModule(context.WithoutCancel(ctx), logger, module, marshalledReq)
 		}()
 	}
 
-	// Iptables banning
+	// Unblocks created by UnblockIP have a negative duration, any other inactive entry has expired
+	if !block && entry.Duration > 0 && !entry.Permanent {
+		metrics.Unblocks.WithLabelValues(metrics.ReasonExpiry).Inc()
+		b.audit(ctx, storage.AuditEntry{
+			Action:  storage.AuditUnblock,
+			Trigger: metrics.ReasonExpiry,
+			Source:  entry.Source,
+			Details: fmt.Sprintf("block of %v expired", entry.Duration),
+		})
+	}
+
 	if block {
-		b.addIptablesBan(entry.Source)
+		if err := b.firewall.Block(entry.Source); err != nil {
+			metrics.FirewallErrors.WithLabelValues("block").Inc()
+			b.logger.Error("failed to block source in firewall", "source", entry.Source, "error", err)
+		}
 	} else {
-		b.removeIptablesBan(entry.Source)
+		if err := b.firewall.Unblock(entry.Source); err != nil {
+			metrics.FirewallErrors.WithLabelValues("unblock").Inc()
+			b.logger.Error("failed to unblock source in firewall", "source", entry.Source, "error", err)
+		}
 	}
 
 	b.lock.Lock()
@@ -82,14 +107,59 @@ func (b *Blocker) notifyExternal(entry storage.BlockEntry) error {
 	return nil
 }
 
-func (b *Blocker) StartExternalUpdateLoop() {
+// notifyModule delivers a single notification to an external module, passing on the trace context in its headers
+func (b *Blocker) notifyModule(ctx context.Context, logger *slog.Logger, module storage.ExternalModule, body []byte) {
+	moduleId := strconv.FormatUint(uint64(module.Id), 10)
+	logger = logger.With("module_id", moduleId, "method", module.Method, "address", module.Address)
+
+	ctx, span := tracer.Start(ctx, "external_module.notify", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("module_id", moduleId), attribute.String("http.request.method", module.Method),
+			attribute.String("url.full", module.Address)))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	r, err := http.NewRequestWithContext(ctx, module.Method, module.Address, bytes.NewBuffer(body))
+	if err != nil {
+		metrics.ExternalNotifications.WithLabelValues(moduleId, metrics.ResultFailure).Inc()
+		logger.Error("failed to create request for external module", "error", err)
+		return
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(r)
+	metrics.ExternalNotificationDuration.WithLabelValues(moduleId).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.ExternalNotifications.WithLabelValues(moduleId, metrics.ResultFailure).Inc()
+		logger.Warn("failed to update external module", "error", err)
+		return
+	}
+	resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("unexpected status %v", resp.StatusCode)
+		metrics.ExternalNotifications.WithLabelValues(moduleId, metrics.ResultFailure).Inc()
+		logger.Warn("external module responded with unexpected status", "status", resp.StatusCode)
+		return
+	}
+
+	metrics.ExternalNotifications.WithLabelValues(moduleId, metrics.ResultSuccess).Inc()
+}
+
+// StartExternalUpdateLoop periodically updates external modules and the firewall of expired blocks, until the context
+// is cancelled
+func (b *Blocker) StartExternalUpdateLoop(ctx context.Context) {
 	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
-			if err := b.NotifyAll(); err != nil {
-				log.Printf("error while running unblock loop: %v\n", err)
+			if err := b.NotifyAll(ctx); err != nil {
+				b.logger.Error("error while running unblock loop", "error", err)
 			}
 		}
 	}
@@ -0,0 +1,24 @@
+package blocker
+
+// Firewall enforces blocks on the local machine
+type Firewall interface {
+	Block(source string) error
+	Unblock(source string) error
+	// Check verifies whether the firewall is usable
+	Check() error
+}
+
+// NoopFirewall does not enforce anything, for when only external modules are used
+type NoopFirewall struct{}
+
+func (NoopFirewall) Block(string) error {
+	return nil
+}
+
+func (NoopFirewall) Unblock(string) error {
+	return nil
+}
+
+func (NoopFirewall) Check() error {
+	return nil
+}
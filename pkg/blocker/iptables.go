@@ -2,29 +2,36 @@ package blocker
 
 import (
 	"github.com/coreos/go-iptables/iptables"
-	"log"
+	"github.com/pkg/errors"
 )
 
-func (b *Blocker) addIptablesBan(source string) {
+// IptablesFirewall drops all traffic of blocked sources using the INPUT chain of the filter table
+type IptablesFirewall struct{}
+
+func (IptablesFirewall) Block(source string) error {
 	ipt, err := iptables.New()
 	if err != nil {
-		log.Printf("failed to get iptables link for blocking: %v\n", err)
-		return
+		return errors.Wrap(err, "failed to get iptables link for blocking")
 	}
 
-	if err := ipt.AppendUnique("filter", "INPUT", "-s", source, "-j", "DROP"); err != nil {
-		log.Printf("failed to insert iptables rule for blocking: %v\n", err)
-	}
+	return errors.Wrap(ipt.AppendUnique("filter", "INPUT", "-s", source, "-j", "DROP"), "failed to insert iptables rule for blocking")
 }
 
-func (b *Blocker) removeIptablesBan(source string) {
+func (IptablesFirewall) Unblock(source string) error {
 	ipt, err := iptables.New()
 	if err != nil {
-		log.Printf("failed to get iptables link for unblocking: %v\n", err)
-		return
+		return errors.Wrap(err, "failed to get iptables link for unblocking")
 	}
 
-	if err := ipt.DeleteIfExists("filter", "INPUT", "-s", source, "-j", "DROP"); err != nil {
-		log.Printf("failed to insert iptables rule for unblocking: %v\n", err)
+	return errors.Wrap(ipt.DeleteIfExists("filter", "INPUT", "-s", source, "-j", "DROP"), "failed to delete iptables rule for unblocking")
+}
+
+func (IptablesFirewall) Check() error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return errors.Wrap(err, "failed to get iptables link")
 	}
+
+	_, err = ipt.ListChains("filter")
+	return errors.Wrap(err, "failed to list iptables chains")
 }
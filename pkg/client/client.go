@@ -0,0 +1,350 @@
+// Package client provides a typed Go client for the fail2ban service API
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/archive"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	address    string
+	key        string
+	httpClient *http.Client
+
+	retries      int
+	retryBackoff time.Duration
+}
+
+type Option func(c *Client)
+
+// WithApiKey sets the API key sent with every request
+func WithApiKey(key string) Option {
+	return func(c *Client) {
+		c.key = key
+	}
+}
+
+// WithHTTPClient replaces the default HTTP client, for example to configure timeouts or transports
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of the default HTTP client, for example to trust a private CA or to
+// authenticate using a client certificate
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		c.httpClient.Transport = transport
+	}
+}
+
+// WithRetries sets the amount of times a failed request is retried, and the initial backoff between attempts.
+// The backoff is doubled after every attempt. Only GET, HEAD and DELETE requests are retried, and only after network
+// errors and 5xx responses, as other requests might have been applied before failing
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryBackoff = backoff
+	}
+}
+
+// New creates a client for the server at the given address, for example http://localhost:8080
+func New(address string, opts ...Option) *Client {
+	c := &Client{
+		address:      strings.TrimSuffix(address, "/"),
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+		retries:      2,
+		retryBackoff: 100 * time.Millisecond,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+type BlockStatus struct {
+	Blocked bool                `json:"blocked"`
+	Entry   *storage.BlockEntry `json:"entry,omitempty"`
+}
+
+type success struct {
+	Success bool `json:"success"`
+}
+
+// Blocked checks whether the given IP is blocked, the entry is only set when it is
+func (c *Client) Blocked(ctx context.Context, ip string) (BlockStatus, error) {
+	var res BlockStatus
+	err := c.do(ctx, http.MethodGet, "/api/blocked/"+url.PathEscape(ip), nil, &res)
+	return res, err
+}
+
+// BlockRequest optionally overrides the active policy of the server for a manual block
+type BlockRequest struct {
+	Duration time.Duration `json:"duration,omitempty"`
+	// Permanent blocks never expire, and cannot be combined with a duration
+	Permanent bool     `json:"permanent,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// Block blocks the given IP, the zero BlockRequest uses the active policy of the server
+func (c *Client) Block(ctx context.Context, ip string, req BlockRequest) (storage.BlockEntry, error) {
+	var res storage.BlockEntry
+	err := c.do(ctx, http.MethodPost, "/api/block/"+url.PathEscape(ip), req, &res)
+	return res, err
+}
+
+// Unblock removes the block of the given IP, returns ErrNotBlocked if the IP was not blocked
+func (c *Client) Unblock(ctx context.Context, ip string) error {
+	err := c.do(ctx, http.MethodPost, "/api/unblock/"+url.PathEscape(ip), nil, &success{})
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest {
+		apiErr.kinds = append(apiErr.kinds, ErrNotBlocked)
+	}
+
+	return err
+}
+
+// Blocks returns all active blocks
+func (c *Client) Blocks(ctx context.Context) ([]storage.BlockEntry, error) {
+	var res []storage.BlockEntry
+	err := c.do(ctx, http.MethodGet, "/api/blocks", nil, &res)
+	return res, err
+}
+
+func (c *Client) Policy(ctx context.Context) (blocker.Policy, error) {
+	var res blocker.Policy
+	err := c.do(ctx, http.MethodGet, "/api/policy", nil, &res)
+	return res, err
+}
+
+func (c *Client) UpdatePolicy(ctx context.Context, policy blocker.Policy) error {
+	return c.do(ctx, http.MethodPatch, "/api/policy", policy, &success{})
+}
+
+// Sources returns all known sources with the amount of authentication entries they have
+func (c *Client) Sources(ctx context.Context) (map[string]int, error) {
+	var res map[string]int
+	err := c.do(ctx, http.MethodGet, "/api/entries/", nil, &res)
+	return res, err
+}
+
+// Entries returns all authentication entries of the given IP
+func (c *Client) Entries(ctx context.Context, ip string) ([]storage.AuthenticationEntry, error) {
+	var res []storage.AuthenticationEntry
+	err := c.do(ctx, http.MethodGet, "/api/entries/list/"+url.PathEscape(ip), nil, &res)
+	return res, err
+}
+
+// AddEntry reports a failed authentication attempt, which might result in a block depending on the active policy
+func (c *Client) AddEntry(ctx context.Context, entry storage.AuthenticationEntry) error {
+	return c.do(ctx, http.MethodPut, "/api/entries/add/"+url.PathEscape(entry.Source), entry, &success{})
+}
+
+func (c *Client) Modules(ctx context.Context) ([]storage.ExternalModule, error) {
+	var res []storage.ExternalModule
+	err := c.do(ctx, http.MethodGet, "/api/modules", nil, &res)
+	return res, err
+}
+
+// AddModule registers an external module, adding a module with an existing address updates that module instead
+func (c *Client) AddModule(ctx context.Context, address, method string) (storage.ExternalModule, error) {
+	req := storage.ExternalModule{
+		Address: address,
+		Method:  method,
+	}
+
+	var res storage.ExternalModule
+	err := c.do(ctx, http.MethodPut, "/api/module", req, &res)
+	return res, err
+}
+
+func (c *Client) RemoveModule(ctx context.Context, id uint32) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/api/module/%v", id), nil, &success{})
+}
+
+func (c *Client) Allowlist(ctx context.Context) ([]storage.AllowEntry, error) {
+	var res []storage.AllowEntry
+	err := c.do(ctx, http.MethodGet, "/api/allowlist", nil, &res)
+	return res, err
+}
+
+// AddAllowEntry adds an IP or CIDR range to the allowlist, sources on the allowlist are never blocked
+func (c *Client) AddAllowEntry(ctx context.Context, entry storage.AllowEntry) error {
+	return c.do(ctx, http.MethodPut, "/api/allowlist", entry, &storage.AllowEntry{})
+}
+
+func (c *Client) RemoveAllowEntry(ctx context.Context, source string) error {
+	return c.do(ctx, http.MethodDelete, "/api/allowlist/"+source, nil, &success{})
+}
+
+// AuditLog returns all audit entries matching the given query, ordered from old to new
+func (c *Client) AuditLog(ctx context.Context, query storage.AuditQuery) ([]storage.AuditEntry, error) {
+	params := url.Values{}
+	if !query.From.IsZero() {
+		params.Set("from", strconv.FormatInt(query.From.Unix(), 10))
+	}
+	if !query.To.IsZero() {
+		params.Set("to", strconv.FormatInt(query.To.Unix(), 10))
+	}
+	if query.Source != "" {
+		params.Set("source", query.Source)
+	}
+	if query.Action != "" {
+		params.Set("action", query.Action)
+	}
+
+	var res []storage.AuditEntry
+	err := c.do(ctx, http.MethodGet, "/api/audit?"+params.Encode(), nil, &res)
+	return res, err
+}
+
+// NewApiKey is returned when creating an API key, it is the only time the key itself is available
+type NewApiKey struct {
+	storage.ApiKey
+	Key string `json:"key"`
+}
+
+func (c *Client) ApiKeys(ctx context.Context) ([]storage.ApiKey, error) {
+	var res []storage.ApiKey
+	err := c.do(ctx, http.MethodGet, "/api/keys", nil, &res)
+	return res, err
+}
+
+// CreateApiKey creates a new named API key with the given scopes, requires the admin scope
+func (c *Client) CreateApiKey(ctx context.Context, name string, scopes []string) (NewApiKey, error) {
+	req := storage.ApiKey{
+		Name:   name,
+		Scopes: scopes,
+	}
+
+	var res NewApiKey
+	err := c.do(ctx, http.MethodPut, "/api/keys", req, &res)
+	return res, err
+}
+
+func (c *Client) RemoveApiKey(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/api/keys/"+url.PathEscape(name), nil, &success{})
+}
+
+// Export returns an archive of the full state of the server, including the active policies. Requires the admin scope
+func (c *Client) Export(ctx context.Context) (archive.Archive, error) {
+	var res archive.Archive
+	err := c.do(ctx, http.MethodGet, "/api/admin/export", nil, &res)
+	return res, err
+}
+
+// Import adds the data of an archive to the server, and replaces its policies with the ones in the archive. Requires
+// the admin scope
+func (c *Client) Import(ctx context.Context, a archive.Archive) (archive.Summary, error) {
+	var res archive.Summary
+	err := c.do(ctx, http.MethodPost, "/api/admin/import", a, &res)
+	return res, err
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, res interface{}) error {
+	var buf []byte
+	if body != nil {
+		var err error
+		if buf, err = json.Marshal(body); err != nil {
+			return errors.Wrap(err, "failed to marshal request body")
+		}
+	}
+
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, path, buf, res)
+		if err == nil || attempt >= c.retries || !idempotent(method) || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, body []byte, res interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.address+path, reader)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to perform %v %v", method, path)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response body")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return newError(resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if err := json.Unmarshal(respBody, res); err != nil {
+		return errors.Wrap(err, "failed to decode response body")
+	}
+
+	return nil
+}
+
+func retryable(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// idempotent reports whether requests with the method can safely be sent again
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
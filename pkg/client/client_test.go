@@ -0,0 +1,464 @@
+package client
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/internal/server"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testPolicy = blocker.Policy{
+	Attempts:  3,
+	Period:    time.Minute,
+	BlockTime: time.Hour,
+}
+
+func newTestServer(t *testing.T, config server.Config) *httptest.Server {
+	t.Helper()
+
+	s := server.New(storage.NewMemoryStore(clock.Real, logging.Discard()), testPolicy, config, clock.Real,
+		logging.Discard())
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestBlockLifecycle(t *testing.T) {
+	ts := newTestServer(t, server.Config{})
+	c := New(ts.URL)
+	ctx := context.Background()
+
+	status, err := c.Blocked(ctx, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.Blocked || status.Entry != nil {
+		t.Fatalf("expected 10.0.0.1 to not be blocked, got %+v", status)
+	}
+
+	entry, err := c.Block(ctx, "10.0.0.1", BlockRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry.Source != "10.0.0.1" || entry.Duration != testPolicy.BlockTime {
+		t.Fatalf("unexpected block entry: %+v", entry)
+	}
+
+	status, err = c.Blocked(ctx, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !status.Blocked || status.Entry == nil || status.Entry.Source != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1 to be blocked, got %+v", status)
+	}
+
+	blocks, err := c.Blocks(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(blocks) != 1 {
+		t.Fatalf("expected 1 active block, got %v", len(blocks))
+	}
+
+	if err := c.Unblock(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = c.Unblock(ctx, "10.0.0.1")
+	if !errors.Is(err, ErrNotBlocked) || !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrNotBlocked, got %v", err)
+	}
+}
+
+func TestBlockWithOptions(t *testing.T) {
+	ts := newTestServer(t, server.Config{})
+	c := New(ts.URL)
+
+	entry, err := c.Block(context.Background(), "10.0.0.4", BlockRequest{Duration: time.Minute, Reason: "manual"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry.Duration != time.Minute || entry.Reason != "manual" {
+		t.Fatalf("expected options to be applied, got %+v", entry)
+	}
+
+	entry, err = c.Block(context.Background(), "10.0.0.8", BlockRequest{Permanent: true, Tags: []string{"scanner"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !entry.Permanent || entry.Duration != 0 || !entry.HasTag("scanner") {
+		t.Fatalf("expected a permanent block with tag, got %+v", entry)
+	}
+
+	status, err := c.Blocked(context.Background(), "10.0.0.8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !status.Blocked || !status.Entry.Permanent || !status.Entry.HasTag("scanner") {
+		t.Fatalf("expected a permanent block to be active, got %+v", status)
+	}
+
+	_, err = c.Block(context.Background(), "10.0.0.9", BlockRequest{Permanent: true, Duration: time.Minute})
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for a permanent block with duration, got %v", err)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	ts := newTestServer(t, server.Config{})
+	c := New(ts.URL)
+	ctx := context.Background()
+
+	if err := c.AddAllowEntry(ctx, storage.AllowEntry{Source: "not an ip"}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for invalid source, got %v", err)
+	}
+
+	if err := c.AddAllowEntry(ctx, storage.AllowEntry{Source: "10.1.0.0/16", Description: "office"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries, err := c.Allowlist(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Description != "office" {
+		t.Fatalf("expected one allowlist entry, got %+v", entries)
+	}
+
+	if _, err := c.Block(ctx, "10.1.2.3", BlockRequest{}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest when blocking an allowed source, got %v", err)
+	}
+
+	if err := c.RemoveAllowEntry(ctx, "10.1.0.0/16"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.RemoveAllowEntry(ctx, "10.1.0.0/16"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound when removing a missing entry, got %v", err)
+	}
+
+	if _, err := c.Block(ctx, "10.1.2.3", BlockRequest{}); err != nil {
+		t.Fatalf("unexpected error after removing allowlist entry: %v", err)
+	}
+}
+
+func TestEntriesTriggerBlock(t *testing.T) {
+	ts := newTestServer(t, server.Config{})
+	c := New(ts.URL)
+	ctx := context.Background()
+
+	for i := 0; i < testPolicy.Attempts; i++ {
+		entry := storage.AuthenticationEntry{
+			Source:    "10.0.0.2",
+			Service:   "ssh",
+			Timestamp: unix_time.Time(time.Now().Add(-time.Duration(i) * time.Second)),
+		}
+
+		if err := c.AddEntry(ctx, entry); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	sources, err := c.Sources(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sources["10.0.0.2"] != testPolicy.Attempts {
+		t.Fatalf("expected %v entries for 10.0.0.2, got %v", testPolicy.Attempts, sources)
+	}
+
+	entries, err := c.Entries(ctx, "10.0.0.2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != testPolicy.Attempts {
+		t.Fatalf("expected %v entries, got %v", testPolicy.Attempts, len(entries))
+	}
+
+	status, err := c.Blocked(ctx, "10.0.0.2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !status.Blocked {
+		t.Fatalf("expected 10.0.0.2 to be blocked after violating the policy")
+	}
+	if status.Entry.Service != "ssh" || status.Entry.Reason == "" {
+		t.Fatalf("expected the block to describe the policy and service, got %+v", status.Entry)
+	}
+}
+
+func TestInvalidEntry(t *testing.T) {
+	ts := newTestServer(t, server.Config{})
+	c := New(ts.URL)
+
+	err := c.AddEntry(context.Background(), storage.AuthenticationEntry{
+		Source:    "10.0.0.3",
+		Timestamp: unix_time.Time(time.Now()),
+	})
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for entry without service, got %v", err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	ts := newTestServer(t, server.Config{})
+	c := New(ts.URL)
+	ctx := context.Background()
+
+	policy, err := c.Policy(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if policy != testPolicy {
+		t.Fatalf("expected policy %+v, got %+v", testPolicy, policy)
+	}
+
+	updated := blocker.Policy{
+		Attempts:  5,
+		Period:    time.Second,
+		BlockTime: time.Minute,
+	}
+	if err := c.UpdatePolicy(ctx, updated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	policy, err = c.Policy(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if policy != updated {
+		t.Fatalf("expected policy %+v, got %+v", updated, policy)
+	}
+}
+
+func TestModules(t *testing.T) {
+	ts := newTestServer(t, server.Config{})
+	c := New(ts.URL)
+	ctx := context.Background()
+
+	module, err := c.AddModule(ctx, "http://localhost:1234/hook", http.MethodPost)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	again, err := c.AddModule(ctx, "http://localhost:1234/hook", http.MethodPut)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again.Id != module.Id {
+		t.Fatalf("expected module with existing address to keep id %v, got %v", module.Id, again.Id)
+	}
+
+	modules, err := c.Modules(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(modules) != 1 || modules[0].Method != http.MethodPut {
+		t.Fatalf("expected one updated module, got %+v", modules)
+	}
+
+	if err := c.RemoveModule(ctx, module.Id); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	modules, err = c.Modules(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(modules) != 0 {
+		t.Fatalf("expected no modules, got %+v", modules)
+	}
+}
+
+func TestApiKey(t *testing.T) {
+	ts := newTestServer(t, server.Config{ApiKeyEnabled: true, ApiKey: "secret"})
+	ctx := context.Background()
+
+	if _, err := New(ts.URL).Blocks(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized without key, got %v", err)
+	}
+
+	if _, err := New(ts.URL, WithApiKey("wrong")).Blocks(ctx); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected ErrForbidden with wrong key, got %v", err)
+	}
+
+	if _, err := New(ts.URL, WithApiKey("secret")).Blocks(ctx); err != nil {
+		t.Fatalf("unexpected error with correct key: %v", err)
+	}
+}
+
+func TestApiKeyScopes(t *testing.T) {
+	ts := newTestServer(t, server.Config{ApiKeyEnabled: true, ApiKey: "secret"})
+	admin := New(ts.URL, WithApiKey("secret"))
+	ctx := context.Background()
+
+	if _, err := admin.CreateApiKey(ctx, "invalid", []string{"everything"}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for an invalid scope, got %v", err)
+	}
+
+	shipper, err := admin.CreateApiKey(ctx, "shipper", []string{server.ScopeReportEntries})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if shipper.Key == "" || shipper.Name != "shipper" {
+		t.Fatalf("expected a new key to be returned, got %+v", shipper)
+	}
+
+	if _, err := admin.CreateApiKey(ctx, "shipper", []string{server.ScopeRead}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected an error for a duplicate name, got %v", err)
+	}
+
+	c := New(ts.URL, WithApiKey(shipper.Key))
+	err = c.AddEntry(ctx, storage.AuthenticationEntry{
+		Source:    "10.0.0.5",
+		Service:   "ssh",
+		Timestamp: unix_time.Time(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("expected shipper to be allowed to report entries, got %v", err)
+	}
+
+	if _, err := c.Blocks(ctx); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected shipper to not be allowed to read, got %v", err)
+	}
+	if _, err := c.Block(ctx, "10.0.0.5", BlockRequest{}); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected shipper to not be allowed to block, got %v", err)
+	}
+	if _, err := c.ApiKeys(ctx); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected shipper to not be allowed to manage keys, got %v", err)
+	}
+
+	keys, err := admin.ApiKeys(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Name != "shipper" || keys[0].Hash != "" {
+		t.Fatalf("expected only the shipper key without hash, got %+v", keys)
+	}
+
+	if err := admin.RemoveApiKey(ctx, "shipper"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = c.AddEntry(ctx, storage.AuthenticationEntry{
+		Source:    "10.0.0.5",
+		Service:   "ssh",
+		Timestamp: unix_time.Time(time.Now()),
+	})
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected removed key to be rejected, got %v", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	ts := newTestServer(t, server.Config{ApiKeyEnabled: true, ApiKey: "secret"})
+	c := New(ts.URL, WithApiKey("secret"))
+	ctx := context.Background()
+
+	for i := 0; i < testPolicy.Attempts; i++ {
+		err := c.AddEntry(ctx, storage.AuthenticationEntry{
+			Source:    "10.0.0.6",
+			Service:   "ssh",
+			Timestamp: unix_time.Time(time.Now().Add(-time.Duration(i) * time.Second)),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if _, err := c.Block(ctx, "10.0.0.7", BlockRequest{Reason: "scanner"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.UpdatePolicy(ctx, testPolicy); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries, err := c.AuditLog(ctx, storage.AuditQuery{Source: "10.0.0.6"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Trigger != "policy" || len(entries[0].Entries) != testPolicy.Attempts {
+		t.Fatalf("expected a policy block with the triggering entries, got %+v", entries)
+	}
+
+	entries, err = c.AuditLog(ctx, storage.AuditQuery{Source: "10.0.0.7", Action: storage.AuditBlock})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Trigger != "manual" || entries[0].Actor != "default" {
+		t.Fatalf("expected a manual block by the default key, got %+v", entries)
+	}
+
+	entries, err = c.AuditLog(ctx, storage.AuditQuery{From: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 3 || entries[2].Action != storage.AuditPolicyUpdate {
+		t.Fatalf("expected 3 entries ending with the policy update, got %+v", entries)
+	}
+
+	entries, err = c.AuditLog(ctx, storage.AuditQuery{To: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries before the test started, got %+v", entries)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("[]"))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, WithRetries(2, time.Millisecond))
+	if _, err := c.Blocks(context.Background()); err != nil {
+		t.Fatalf("expected request to succeed after retries, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %v", calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	c = New(ts.URL, WithRetries(1, time.Millisecond))
+	if _, err := c.Blocks(context.Background()); !errors.Is(err, ErrServer) {
+		t.Fatalf("expected ErrServer when retries are exhausted, got %v", err)
+	}
+
+	// Requests that are not idempotent are never retried
+	atomic.StoreInt32(&calls, 0)
+	c = New(ts.URL, WithRetries(2, time.Millisecond))
+	if _, err := c.Block(context.Background(), "10.0.0.1", BlockRequest{}); !errors.Is(err, ErrServer) {
+		t.Fatalf("expected ErrServer without retries, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single call, got %v", calls)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	ts := newTestServer(t, server.Config{})
+	c := New(ts.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := c.Blocks(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
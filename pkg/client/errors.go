@@ -0,0 +1,69 @@
+package client
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized, API key missing")
+	ErrForbidden    = errors.New("forbidden, API key invalid")
+	ErrNotFound     = errors.New("not found")
+	ErrNotBlocked   = errors.New("source is not blocked")
+	ErrServer       = errors.New("internal server error")
+)
+
+// Error is returned for every non-2xx response of the server. It matches the sentinel errors above using errors.Is
+type Error struct {
+	StatusCode int
+	Message    string
+
+	kinds []error
+}
+
+func newError(code int, message string) *Error {
+	e := &Error{
+		StatusCode: code,
+		Message:    message,
+	}
+
+	switch {
+	case code == http.StatusUnauthorized:
+		e.kinds = append(e.kinds, ErrUnauthorized)
+	case code == http.StatusForbidden:
+		e.kinds = append(e.kinds, ErrForbidden)
+	case code == http.StatusNotFound:
+		e.kinds = append(e.kinds, ErrNotFound)
+	case code >= http.StatusInternalServerError:
+		e.kinds = append(e.kinds, ErrServer)
+	case code >= http.StatusBadRequest:
+		e.kinds = append(e.kinds, ErrBadRequest)
+	}
+
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("fail2ban: %v %v", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("fail2ban: %v %v: %v", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	for _, k := range e.kinds {
+		if target == k {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Temporary reports whether the request might succeed when retried
+func (e *Error) Temporary() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,19 @@
+// Package clock abstracts the current time, so behaviour that depends on it can be tested and simulated without
+// waiting. Use Real in production and the fakeclock package in tests and simulations
+package clock
+
+import "time"
+
+// Clock returns the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// Real is the clock of the system
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,42 @@
+// Package fakeclock contains a clock that only moves when it is told to, for tests and simulations
+package fakeclock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a clock.Clock that is set manually, it is safe for concurrent use
+type Clock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// New returns a clock that is set to the given time
+func New(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// Set moves the clock to the given time, which may be before the current time of the clock
+func (c *Clock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = now
+}
+
+// Advance moves the clock forward by the given duration, and returns the new time
+func (c *Clock) Advance(d time.Duration) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	return c.now
+}
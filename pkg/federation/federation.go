@@ -0,0 +1,355 @@
+// Package federation lets a server subscribe to the blocks of one or more upstream servers. The active blocks of every
+// upstream are mirrored locally, limited by a trust policy, and local authentication entries can be reported upstream
+// so the upstream policy is evaluated using the entries of all subscribers
+package federation
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/client"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/metrics"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// queueSize limits the amount of entries waiting to be reported to a single upstream, newer entries are dropped
+const queueSize = 1024
+
+type Config struct {
+	// Upstreams are the base URLs of the servers to mirror, such as https://fail2ban.example.com. Federation is
+	// disabled without upstreams
+	Upstreams []string
+	// ApiKey is used for all upstreams, it needs the read scope, and the report-entries scope to report entries
+	ApiKey string `split_words:"true"`
+	// Interval is the time between fetching the blocks of an upstream
+	Interval time.Duration `default:"30s"`
+
+	// Tags only trusts upstream blocks with at least one of these tags, all blocks are trusted when it is empty
+	Tags []string
+	// MaxDuration limits the duration of mirrored blocks, permanent upstream blocks are mirrored with this duration.
+	// Durations are not limited when it is zero
+	MaxDuration time.Duration `default:"0s" split_words:"true"`
+
+	// ReportEntries sends local authentication entries to all upstreams
+	ReportEntries bool `default:"false" split_words:"true"`
+}
+
+func (c Config) Enabled() bool {
+	return len(c.Upstreams) > 0
+}
+
+// Tag returns the tag of the blocks mirrored from the upstream with the given address
+func Tag(address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		return "upstream:" + u.Host
+	}
+
+	return "upstream:" + address
+}
+
+type upstream struct {
+	address string
+	tag     string
+	client  *client.Client
+	entries chan storage.AuthenticationEntry
+
+	// lock is held during a sync, mirrored is the start of the upstream block each mirrored source is based on, so
+	// blocks that were shortened by the trust policy are not mirrored again once they expire
+	lock     sync.Mutex
+	mirrored map[string]time.Time
+}
+
+// Federation is a storage that queues the authentication entries added to it for its upstreams, and mirrors the
+// blocks of the upstreams using the blocker. All other operations are passed on to the wrapped storage
+type Federation struct {
+	storage.Storage
+
+	logger  *slog.Logger
+	config  Config
+	blocker *blocker.Blocker
+	// clock determines which upstream and local blocks are active, and how long mirrored blocks last
+	clock clock.Clock
+
+	upstreams []*upstream
+	ctx       context.Context
+	cancel    context.CancelFunc
+	loops     sync.WaitGroup
+}
+
+func New(store storage.Storage, config Config, clock clock.Clock, logger *slog.Logger) (*Federation, error) {
+	if config.Interval <= 0 {
+		return nil, errors.New("federation interval should be positive")
+	}
+	if config.MaxDuration < 0 {
+		return nil, errors.New("federation max duration cannot be negative")
+	}
+
+	f := &Federation{
+		Storage: store,
+		logger:  logger,
+		config:  config,
+		clock:   clock,
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+
+	for _, address := range config.Upstreams {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.Errorf("upstream %v is not an http or https URL", address)
+		}
+
+		var opts []client.Option
+		if config.ApiKey != "" {
+			opts = append(opts, client.WithApiKey(config.ApiKey))
+		}
+
+		f.upstreams = append(f.upstreams, &upstream{
+			address:  address,
+			tag:      Tag(address),
+			client:   client.New(address, opts...),
+			entries:  make(chan storage.AuthenticationEntry, queueSize),
+			mirrored: make(map[string]time.Time),
+		})
+	}
+
+	return f, nil
+}
+
+// SetBlocker sets the blocker used to apply mirrored blocks, it should be called before Start or Sync
+func (f *Federation) SetBlocker(b *blocker.Blocker) {
+	f.blocker = b
+}
+
+// Start starts mirroring every upstream right away, and again every interval
+func (f *Federation) Start() {
+	for _, u := range f.upstreams {
+		u := u
+
+		f.loops.Add(1)
+		go func() {
+			defer f.loops.Done()
+			f.run(f.ctx, u)
+		}()
+	}
+
+	f.logger.Info("mirroring upstreams", "upstreams", f.config.Upstreams, "tags", f.config.Tags,
+		"max_duration", f.config.MaxDuration, "report_entries", f.config.ReportEntries)
+}
+
+// Close stops mirroring, and closes the wrapped storage. Mirrored blocks are kept, and entries that were not reported
+// yet are dropped
+func (f *Federation) Close() error {
+	f.cancel()
+	f.loops.Wait()
+
+	return f.Storage.Close()
+}
+
+func (f *Federation) Ping(ctx context.Context) error {
+	return storage.Ping(ctx, f.Storage)
+}
+
+func (f *Federation) AddAuthenticationEntry(ctx context.Context, entry storage.AuthenticationEntry) error {
+	if err := f.Storage.AddAuthenticationEntry(ctx, entry); err != nil {
+		return err
+	}
+
+	if !f.config.ReportEntries {
+		return nil
+	}
+
+	for _, u := range f.upstreams {
+		select {
+		case u.entries <- entry:
+		default:
+			metrics.FederationReports.WithLabelValues(u.address, metrics.ResultDropped).Inc()
+		}
+	}
+	return nil
+}
+
+func (f *Federation) run(ctx context.Context, u *upstream) {
+	ticker := time.NewTicker(f.config.Interval)
+	defer ticker.Stop()
+
+	refresh := func() {
+		if err := f.sync(ctx, u); err != nil && ctx.Err() == nil {
+			f.logger.Error("failed to mirror upstream", "upstream", u.address, "error", err)
+		}
+	}
+	refresh()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refresh()
+		case entry := <-u.entries:
+			f.report(ctx, u, entry)
+		}
+	}
+}
+
+func (f *Federation) report(ctx context.Context, u *upstream, entry storage.AuthenticationEntry) {
+	if err := u.client.AddEntry(ctx, entry); err != nil {
+		metrics.FederationReports.WithLabelValues(u.address, metrics.ResultFailure).Inc()
+		if ctx.Err() == nil {
+			f.logger.Warn("failed to report entry to upstream", "upstream", u.address, "source", entry.Source,
+				"error", err)
+		}
+		return
+	}
+
+	metrics.FederationReports.WithLabelValues(u.address, metrics.ResultSuccess).Inc()
+}
+
+// Sync mirrors the blocks of all upstreams once, and returns the first error
+func (f *Federation) Sync(ctx context.Context) error {
+	var first error
+	for _, u := range f.upstreams {
+		if err := f.sync(ctx, u); err != nil && first == nil {
+			first = errors.Wrapf(err, "failed to mirror %v", u.address)
+		}
+	}
+
+	return first
+}
+
+// sync blocks the trusted upstream blocks that are not mirrored yet, and unblocks the mirrored blocks that are no
+// longer active upstream. When the upstream cannot be reached, the mirrored blocks are kept
+func (f *Federation) sync(ctx context.Context, u *upstream) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	blocks, err := u.client.Blocks(ctx)
+	if err != nil {
+		metrics.FederationSyncs.WithLabelValues(u.address, metrics.ResultFailure).Inc()
+		return errors.Wrap(err, "failed to get blocks of upstream")
+	}
+	metrics.FederationSyncs.WithLabelValues(u.address, metrics.ResultSuccess).Inc()
+
+	trusted := make(map[string]storage.BlockEntry, len(blocks))
+	now := f.clock.Now()
+	for _, e := range blocks {
+		if e.ActiveAt(now) && f.trusts(e) {
+			trusted[e.Source] = e
+		}
+	}
+	metrics.FederationMirroredBlocks.WithLabelValues(u.address).Set(float64(len(trusted)))
+
+	page, err := f.Storage.ListBlockEntries(ctx, storage.BlockQuery{Tag: u.tag, State: storage.BlockStateActive})
+	if err != nil {
+		return errors.Wrap(err, "failed to get mirrored blocks")
+	}
+
+	removed := 0
+	for _, e := range page.Entries {
+		if _, ok := trusted[e.Source]; ok {
+			continue
+		}
+
+		if err := f.blocker.UnblockMirrored(ctx, e.Source, u.tag); err != nil {
+			f.logger.Error("failed to unblock source that is no longer blocked upstream", "upstream", u.address,
+				"source", e.Source, "error", err)
+			continue
+		}
+		removed++
+	}
+
+	for source := range u.mirrored {
+		if _, ok := trusted[source]; !ok {
+			delete(u.mirrored, source)
+		}
+	}
+
+	added, allowed := 0, 0
+	for source, e := range trusted {
+		if start, ok := u.mirrored[source]; ok && start.Equal(e.Timestamp.Time()) {
+			continue
+		}
+
+		// Sources that are blocked for another reason keep their block, they are mirrored once that block is lifted
+		local, err := f.Storage.FindBlockEntry(ctx, source)
+		if err == nil && local.ActiveAt(now) && !local.HasTag(u.tag) {
+			continue
+		} else if err != nil && err != storage.NotFoundErr {
+			return errors.Wrapf(err, "failed to get block of %v", source)
+		}
+
+		opts, ok := f.mirror(e, u)
+		if !ok {
+			continue
+		}
+
+		_, err = f.blocker.BlockMirrored(ctx, source, opts)
+		if err == blocker.AllowedErr {
+			u.mirrored[source] = e.Timestamp.Time()
+			allowed++
+			continue
+		}
+		if err != nil {
+			f.logger.Error("failed to mirror block of upstream", "upstream", u.address, "source", source, "error", err)
+			continue
+		}
+
+		u.mirrored[source] = e.Timestamp.Time()
+		added++
+	}
+
+	if added > 0 || removed > 0 {
+		f.logger.Info("updated blocks of upstream", "upstream", u.address, "trusted", len(trusted), "added", added,
+			"removed", removed, "allowlisted", allowed)
+	}
+	return nil
+}
+
+// trusts checks whether an upstream block has one of the trusted tags
+func (f *Federation) trusts(e storage.BlockEntry) bool {
+	if len(f.config.Tags) == 0 {
+		return true
+	}
+
+	for _, tag := range f.config.Tags {
+		if e.HasTag(tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mirror returns the options of the local block of an upstream block, which ends when the upstream block ends unless
+// it is limited by the max duration. Blocks that end within a second are not mirrored
+func (f *Federation) mirror(e storage.BlockEntry, u *upstream) (blocker.BlockOptions, bool) {
+	opts := blocker.BlockOptions{
+		Permanent: e.Permanent,
+		Reason:    fmt.Sprintf("blocked by %v", u.address),
+		Tags:      append(append([]string{}, e.Tags...), u.tag),
+		Service:   e.Service,
+		Actor:     u.tag,
+	}
+	if e.Reason != "" {
+		opts.Reason += ": " + e.Reason
+	}
+
+	if !e.Permanent {
+		opts.Duration = e.Timestamp.Time().Add(e.Duration).Sub(f.clock.Now()).Truncate(time.Second)
+		if opts.Duration < time.Second {
+			return blocker.BlockOptions{}, false
+		}
+	}
+
+	if max := f.config.MaxDuration; max > 0 && (opts.Permanent || opts.Duration > max) {
+		opts.Permanent = false
+		opts.Duration = max
+	}
+
+	return opts, true
+}
@@ -0,0 +1,289 @@
+package federation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/timanema/fail2ban-service/internal/server"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/client"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testApiKey = "subscriber"
+
+var testPolicy = blocker.Policy{Attempts: 3, Period: time.Minute, BlockTime: time.Hour}
+
+// testSetup is an upstream server and a downstream server that subscribes to it, both served on loopback
+type testSetup struct {
+	upstream   *client.Client
+	downstream *client.Client
+	federation *Federation
+	tag        string
+}
+
+func newTestSetup(t *testing.T, config Config) testSetup {
+	t.Helper()
+	ctx := context.Background()
+
+	// The upstream only allows the subscriber to read blocks and report entries
+	upstreamStore := storage.NewMemoryStore(clock.Real, logging.Discard())
+	sum := sha256.Sum256([]byte(testApiKey))
+	key := storage.ApiKey{
+		Name:   "subscriber",
+		Hash:   hex.EncodeToString(sum[:]),
+		Scopes: []string{server.ScopeRead, server.ScopeReportEntries},
+	}
+	if err := upstreamStore.AddApiKey(ctx, key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	upstream := server.New(upstreamStore, testPolicy, server.Config{ApiKeyEnabled: true, ApiKey: "admin"},
+		clock.Real, logging.Discard())
+	upstreamServer := httptest.NewServer(upstream.Handler())
+	t.Cleanup(upstreamServer.Close)
+
+	config.Upstreams = []string{upstreamServer.URL}
+	config.ApiKey = testApiKey
+	if config.Interval == 0 {
+		config.Interval = time.Hour
+	}
+
+	federation, err := New(storage.NewMemoryStore(clock.Real, logging.Discard()), config, clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { federation.Close() })
+
+	downstream := server.New(federation, testPolicy, server.Config{}, clock.Real, logging.Discard())
+	federation.SetBlocker(downstream.Blocker())
+	downstreamServer := httptest.NewServer(downstream.Handler())
+	t.Cleanup(downstreamServer.Close)
+
+	return testSetup{
+		upstream:   client.New(upstreamServer.URL, client.WithApiKey("admin")),
+		downstream: client.New(downstreamServer.URL),
+		federation: federation,
+		tag:        Tag(upstreamServer.URL),
+	}
+}
+
+func (s testSetup) block(t *testing.T, ip string, req client.BlockRequest) {
+	t.Helper()
+
+	if _, err := s.upstream.Block(context.Background(), ip, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func (s testSetup) sync(t *testing.T) {
+	t.Helper()
+
+	if err := s.federation.Sync(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// blocked returns the local block of the given IP, or nil when it is not blocked
+func (s testSetup) blocked(t *testing.T, ip string) *storage.BlockEntry {
+	t.Helper()
+
+	status, err := s.downstream.Blocked(context.Background(), ip)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return status.Entry
+}
+
+func eventually(t *testing.T, condition func() bool, format string, args ...interface{}) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMirrorsUpstreamBlocks(t *testing.T) {
+	s := newTestSetup(t, Config{})
+
+	s.block(t, "10.0.0.1", client.BlockRequest{Duration: 10 * time.Minute, Reason: "scanner", Tags: []string{"shared"}})
+	s.sync(t)
+
+	entry := s.blocked(t, "10.0.0.1")
+	if entry == nil {
+		t.Fatalf("expected the upstream block to be mirrored")
+	}
+	if !entry.HasTag(s.tag) || !entry.HasTag("shared") {
+		t.Fatalf("expected the upstream and mirror tags, got %v", entry.Tags)
+	}
+	if entry.Permanent || entry.Duration > 10*time.Minute || entry.Duration < 9*time.Minute {
+		t.Fatalf("expected the block to end with the upstream block, got %v", entry.Duration)
+	}
+
+	// Blocks lifted upstream are lifted locally as well
+	if err := s.upstream.Unblock(context.Background(), "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.sync(t)
+
+	if entry := s.blocked(t, "10.0.0.1"); entry != nil {
+		t.Fatalf("expected the mirrored block to be lifted, got %v", entry)
+	}
+}
+
+func TestTrustPolicy(t *testing.T) {
+	s := newTestSetup(t, Config{Tags: []string{"shared"}, MaxDuration: time.Hour})
+
+	s.block(t, "10.0.0.1", client.BlockRequest{Permanent: true, Tags: []string{"shared"}})
+	s.block(t, "10.0.0.2", client.BlockRequest{Duration: 10 * time.Minute, Tags: []string{"shared", "ssh"}})
+	s.block(t, "10.0.0.3", client.BlockRequest{Duration: 10 * time.Minute, Tags: []string{"internal"}})
+	s.block(t, "10.0.0.4", client.BlockRequest{Duration: 10 * time.Minute})
+	s.sync(t)
+
+	// Permanent blocks are limited to the max duration
+	entry := s.blocked(t, "10.0.0.1")
+	if entry == nil || entry.Permanent || entry.Duration != time.Hour {
+		t.Fatalf("expected a block of an hour, got %v", entry)
+	}
+
+	// Shorter blocks keep their duration
+	entry = s.blocked(t, "10.0.0.2")
+	if entry == nil || entry.Duration > 10*time.Minute {
+		t.Fatalf("expected a block of at most 10 minutes, got %v", entry)
+	}
+
+	for _, ip := range []string{"10.0.0.3", "10.0.0.4"} {
+		if entry := s.blocked(t, ip); entry != nil {
+			t.Fatalf("expected the untrusted block of %v to not be mirrored, got %v", ip, entry)
+		}
+	}
+}
+
+func TestExpiredMirrorIsNotRenewed(t *testing.T) {
+	s := newTestSetup(t, Config{MaxDuration: time.Hour})
+	ctx := context.Background()
+
+	s.block(t, "10.0.0.1", client.BlockRequest{Permanent: true})
+	s.sync(t)
+
+	// The mirrored block ran out, while the upstream block is still active
+	expired := storage.BlockEntry{
+		Source:    "10.0.0.1",
+		Timestamp: unix_time.Time(time.Now().Add(-2 * time.Hour)),
+		Duration:  time.Hour,
+		Tags:      []string{s.tag},
+	}
+	if err := s.federation.AddBlockEntry(ctx, expired); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.sync(t)
+
+	if entry := s.blocked(t, "10.0.0.1"); entry != nil {
+		t.Fatalf("expected the block to not be mirrored again, got %v", entry)
+	}
+
+	// A new upstream block is mirrored again
+	if err := s.upstream.Unblock(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.sync(t)
+	s.block(t, "10.0.0.1", client.BlockRequest{Permanent: true})
+	s.sync(t)
+
+	if entry := s.blocked(t, "10.0.0.1"); entry == nil {
+		t.Fatalf("expected the new upstream block to be mirrored")
+	}
+}
+
+func TestLocalBlocksAreKept(t *testing.T) {
+	s := newTestSetup(t, Config{})
+	ctx := context.Background()
+
+	if _, err := s.downstream.Block(ctx, "10.0.0.1", client.BlockRequest{Permanent: true, Reason: "local"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.downstream.AddAllowEntry(ctx, storage.AllowEntry{Source: "10.0.0.2"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s.block(t, "10.0.0.1", client.BlockRequest{Duration: time.Minute})
+	s.block(t, "10.0.0.2", client.BlockRequest{Duration: time.Minute})
+	s.sync(t)
+
+	if entry := s.blocked(t, "10.0.0.2"); entry != nil {
+		t.Fatalf("expected the allowlisted source to not be blocked, got %v", entry)
+	}
+
+	if err := s.upstream.Unblock(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.sync(t)
+
+	entry := s.blocked(t, "10.0.0.1")
+	if entry == nil || !entry.Permanent || entry.Reason != "local" {
+		t.Fatalf("expected the local block to be kept, got %v", entry)
+	}
+}
+
+func TestUnreachableUpstreamKeepsBlocks(t *testing.T) {
+	s := newTestSetup(t, Config{})
+
+	s.block(t, "10.0.0.1", client.BlockRequest{Duration: time.Hour})
+	s.sync(t)
+
+	s.federation.upstreams[0].client = client.New("http://127.0.0.1:1", client.WithRetries(0, 0))
+	if err := s.federation.Sync(context.Background()); err == nil {
+		t.Fatalf("expected an error for an unreachable upstream")
+	}
+
+	if entry := s.blocked(t, "10.0.0.1"); entry == nil {
+		t.Fatalf("expected the mirrored block to be kept")
+	}
+}
+
+func TestReportsEntries(t *testing.T) {
+	s := newTestSetup(t, Config{ReportEntries: true})
+	s.federation.Start()
+
+	entry := storage.AuthenticationEntry{Source: "10.0.0.1", Service: "ssh", Timestamp: unix_time.Time(time.Now())}
+	if err := s.downstream.AddEntry(context.Background(), entry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	eventually(t, func() bool {
+		entries, err := s.upstream.Entries(context.Background(), entry.Source)
+		return err == nil && len(entries) == 1 && entries[0].Service == entry.Service
+	}, "expected the entry to be reported upstream")
+}
+
+func TestEntriesNotReportedByDefault(t *testing.T) {
+	s := newTestSetup(t, Config{})
+	s.federation.Start()
+
+	entry := storage.AuthenticationEntry{Source: "10.0.0.1", Service: "ssh", Timestamp: unix_time.Time(time.Now())}
+	if err := s.downstream.AddEntry(context.Background(), entry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := len(s.federation.upstreams[0].entries); n != 0 {
+		t.Fatalf("expected no entries to be queued, got %v", n)
+	}
+}
+
+func TestUpstreamsValidated(t *testing.T) {
+	config := Config{Upstreams: []string{"ftp://example.com"}, Interval: time.Minute}
+	if _, err := New(storage.NewMemoryStore(clock.Real, logging.Discard()), config, clock.Real, logging.Discard()); err == nil {
+		t.Fatalf("expected an error for an upstream that is not an http URL")
+	}
+}
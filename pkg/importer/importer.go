@@ -0,0 +1,331 @@
+// Package importer blocks the sources of third-party blocklists, such as the Spamhaus DROP list or FireHOL lists
+package importer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/metrics"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultInterval is used for lists without an interval
+const DefaultInterval = time.Hour
+
+// maxListSize limits the size of lists, larger lists are rejected so the previously loaded version is used instead
+const maxListSize = 32 << 20
+
+// List is a blocklist loaded from either a local file or an HTTP URL
+type List struct {
+	Name     string
+	URL      string
+	Path     string
+	Interval time.Duration
+}
+
+// Tag returns the tag of the blocks of the list with the given name
+func Tag(name string) string {
+	return "list:" + name
+}
+
+// Importer periodically loads a single list, and keeps the blocks of the list in sync with it
+type Importer struct {
+	list    List
+	store   storage.Storage
+	blocker *blocker.Blocker
+	clock   clock.Clock
+	logger  *slog.Logger
+	client  *http.Client
+
+	// sources, etag and lastModified are the last successfully loaded version of the list, only used by the loop
+	sources      []string
+	etag         string
+	lastModified string
+	// invalid is the amount of invalid lines in the last loaded version, they are only logged when it changes
+	invalid int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func New(list List, store storage.Storage, b *blocker.Blocker, clock clock.Clock, logger *slog.Logger) *Importer {
+	if list.Interval <= 0 {
+		list.Interval = DefaultInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Importer{
+		list:    list,
+		store:   store,
+		blocker: b,
+		clock:   clock,
+		logger:  logger.With("list", list.Name),
+		client:  &http.Client{Timeout: time.Minute},
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+}
+
+// Start loads the list right away, and again every interval
+func (i *Importer) Start() {
+	i.logger.Info("importing blocklist", "url", i.list.URL, "path", i.list.Path, "interval", i.list.Interval)
+	go i.run()
+}
+
+// Stop stops loading the list and waits until the importer has stopped, the blocks of the list are kept
+func (i *Importer) Stop() {
+	i.cancel()
+	<-i.done
+	i.logger.Info("stopped importing blocklist")
+}
+
+func (i *Importer) run() {
+	defer close(i.done)
+
+	ticker := time.NewTicker(i.list.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := i.Refresh(i.ctx); err != nil && i.ctx.Err() == nil {
+			i.logger.Error("failed to import blocklist", "error", err)
+		}
+
+		select {
+		case <-i.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh loads the list and updates the blocks. When the list cannot be loaded, the previously loaded version is
+// used, so blocks are not lifted because the list is temporarily unavailable
+func (i *Importer) Refresh(ctx context.Context) error {
+	sources, err := i.load(ctx)
+	if err != nil {
+		metrics.ListRefreshes.WithLabelValues(i.list.Name, metrics.ResultFailure).Inc()
+		if i.sources == nil {
+			return err
+		}
+
+		i.logger.Warn("failed to load blocklist, using the previous version", "error", err)
+		sources = i.sources
+	} else {
+		metrics.ListRefreshes.WithLabelValues(i.list.Name, metrics.ResultSuccess).Inc()
+		metrics.ListEntries.WithLabelValues(i.list.Name).Set(float64(len(sources)))
+		i.sources = sources
+	}
+
+	return i.apply(ctx, sources)
+}
+
+// Remove lifts all blocks of the list, it is used when the list is no longer imported
+func (i *Importer) Remove(ctx context.Context) error {
+	metrics.ListEntries.DeleteLabelValues(i.list.Name)
+	return i.apply(ctx, []string{})
+}
+
+// apply blocks the listed sources that are not blocked yet, and unblocks the sources that are no longer listed
+func (i *Importer) apply(ctx context.Context, sources []string) error {
+	tag := Tag(i.list.Name)
+	page, err := i.store.ListBlockEntries(ctx, storage.BlockQuery{Tag: tag})
+	if err != nil {
+		return errors.Wrap(err, "failed to get blocks of list")
+	}
+
+	listed := make(map[string]struct{}, len(sources))
+	for _, s := range sources {
+		listed[s] = struct{}{}
+	}
+
+	existing := make(map[string]storage.BlockEntry, len(page.Entries))
+	removed := 0
+	for _, e := range page.Entries {
+		existing[e.Source] = e
+		if _, ok := listed[e.Source]; ok {
+			continue
+		}
+
+		if err := i.blocker.UnblockListed(ctx, e.Source, tag); err != nil {
+			i.logger.Error("failed to unblock source that is no longer listed", "source", e.Source, "error", err)
+			continue
+		}
+		removed++
+	}
+
+	added, allowed := 0, 0
+	now := i.clock.Now()
+	for _, s := range sources {
+		if e, ok := existing[s]; ok && e.ActiveAt(now) {
+			continue
+		}
+
+		// Sources that are blocked for another reason keep their block, they are added once that block is lifted
+		if e, err := i.store.FindBlockEntry(ctx, s); err == nil && e.ActiveAt(now) {
+			continue
+		} else if err != nil && err != storage.NotFoundErr {
+			return errors.Wrapf(err, "failed to get block of %v", s)
+		}
+
+		_, err := i.blocker.BlockListed(ctx, s, blocker.BlockOptions{
+			Permanent: true,
+			Reason:    fmt.Sprintf("listed in %v", i.list.Name),
+			Tags:      []string{tag},
+			Actor:     tag,
+		})
+		if err == blocker.AllowedErr {
+			allowed++
+			continue
+		}
+		if err != nil {
+			i.logger.Error("failed to block listed source", "source", s, "error", err)
+			continue
+		}
+		added++
+	}
+
+	if added > 0 || removed > 0 {
+		i.logger.Info("updated blocks of blocklist", "sources", len(sources), "added", added, "removed", removed,
+			"allowlisted", allowed)
+	}
+	return nil
+}
+
+func (i *Importer) load(ctx context.Context) ([]string, error) {
+	if i.list.Path != "" {
+		f, err := os.Open(i.list.Path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open list")
+		}
+		defer f.Close()
+
+		return i.parse(f)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, i.list.URL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+
+	// Unchanged lists are not downloaded again
+	if i.sources != nil {
+		if i.etag != "" {
+			req.Header.Set("If-None-Match", i.etag)
+		}
+		if i.lastModified != "" {
+			req.Header.Set("If-Modified-Since", i.lastModified)
+		}
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to download list")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if i.sources != nil {
+			return i.sources, nil
+		}
+		fallthrough
+	default:
+		return nil, errors.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	sources, err := i.parse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	i.etag, i.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return sources, nil
+}
+
+// parse reads one IP or CIDR range per line, text after # or ; is a comment. Invalid lines are skipped
+func (i *Importer) parse(r io.Reader) ([]string, error) {
+	sources, invalid, err := parseList(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if invalid > 0 && invalid != i.invalid {
+		i.logger.Warn("skipped invalid lines in blocklist", "lines", invalid)
+	}
+	i.invalid = invalid
+	return sources, nil
+}
+
+// parseList reads a list with one IP or CIDR range per line, and returns the sorted unique sources and the amount of
+// invalid lines. Text after # or ; is a comment, and only the first field of a line is used, so lists such as the
+// Spamhaus DROP list can be used directly. Lists larger than maxListSize are rejected instead of being truncated
+func parseList(r io.Reader) ([]string, int, error) {
+	seen := make(map[string]struct{})
+	invalid := 0
+
+	limited := &io.LimitedReader{R: r, N: maxListSize + 1}
+	scanner := bufio.NewScanner(limited)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexAny(line, "#;"); idx >= 0 {
+			line = line[:idx]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		source, ok := normalize(fields[0])
+		if !ok {
+			invalid++
+			continue
+		}
+		seen[source] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, errors.Wrap(err, "failed to read list")
+	}
+	if limited.N == 0 {
+		return nil, 0, errors.Errorf("list is larger than %v bytes", maxListSize)
+	}
+
+	sources := make([]string, 0, len(seen))
+	for s := range seen {
+		sources = append(sources, s)
+	}
+	sort.Strings(sources)
+
+	return sources, invalid, nil
+}
+
+// normalize returns the canonical form of an IP or CIDR range, ranges of a single address are returned as an IP
+func normalize(source string) (string, bool) {
+	if ip := net.ParseIP(source); ip != nil {
+		return ip.String(), true
+	}
+
+	_, network, err := net.ParseCIDR(source)
+	if err != nil {
+		return "", false
+	}
+
+	if ones, bits := network.Mask.Size(); ones == bits {
+		return network.IP.String(), true
+	}
+	return network.String(), true
+}
@@ -0,0 +1,218 @@
+package importer
+
+import (
+	"context"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock/fakeclock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1":           "10.0.0.1",
+		"10.0.0.0/8":         "10.0.0.0/8",
+		"10.1.2.3/8":         "10.0.0.0/8",
+		"10.0.0.1/32":        "10.0.0.1",
+		"2001:0db8::0001":    "2001:db8::1",
+		"2001:db8::/32":      "2001:db8::/32",
+		"2001:db8::1/128":    "2001:db8::1",
+		"::ffff:10.0.0.1":    "10.0.0.1",
+		"not-an-ip":          "",
+		"10.0.0.0/33":        "",
+		"10.0.0.256":         "",
+		"2001:db8::1/129":    "",
+		"10.0.0.1 10.0.0.2":  "",
+		"http://10.0.0.1/24": "",
+	}
+
+	for source, expected := range tests {
+		normalized, ok := normalize(source)
+		if ok != (expected != "") || normalized != expected {
+			t.Fatalf("expected %v to be normalized to %q, got %q (%v)", source, expected, normalized, ok)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	list := `# Spamhaus DROP list
+; comments can start with either character
+1.10.16.0/20 ; SBL256894
+10.0.0.1
+10.0.0.1/32 # the same address
+
+  2001:db8::/32	some description
+invalid
+10.0.0.0/33
+`
+
+	sources, invalid, err := parseList(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"1.10.16.0/20", "10.0.0.1", "2001:db8::/32"}; !reflect.DeepEqual(sources, expected) {
+		t.Fatalf("expected the sorted unique sources %v, got %v", expected, sources)
+	}
+	if invalid != 2 {
+		t.Fatalf("expected 2 invalid lines, got %v", invalid)
+	}
+
+	if sources, _, err := parseList(strings.NewReader("")); err != nil || len(sources) != 0 {
+		t.Fatalf("expected an empty list to be valid, got %v (%v)", sources, err)
+	}
+}
+
+// repeatReader endlessly repeats a line
+type repeatReader string
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		n += copy(p[n:], r)
+	}
+	return n, nil
+}
+
+func TestParseListSize(t *testing.T) {
+	line := repeatReader("10.0.0.1\n")
+
+	// Lists up to the maximum size are accepted, larger lists are rejected instead of truncated
+	if _, _, err := parseList(io.LimitReader(line, maxListSize-maxListSize%9)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := parseList(io.LimitReader(line, maxListSize+9)); err == nil {
+		t.Fatalf("expected a list larger than %v bytes to be rejected", maxListSize)
+	}
+}
+
+func newTestImporter(t *testing.T, list List) (*Importer, storage.Storage, *blocker.Blocker) {
+	t.Helper()
+
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	store := storage.NewMemoryStore(c, logging.Discard())
+	if err := store.AddAllowEntry(context.Background(), storage.AllowEntry{Source: "192.168.0.0/16"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b := blocker.New(store, blocker.DefaultPolicy, blocker.NoopFirewall{}, c, logging.Discard())
+	return New(list, store, b, c, logging.Discard()), store, b
+}
+
+// listed returns the sources blocked because of the list
+func listed(t *testing.T, store storage.Storage, name string) []string {
+	t.Helper()
+
+	page, err := store.ListBlockEntries(context.Background(), storage.BlockQuery{Tag: Tag(name), State: storage.BlockStateActive})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sources := make([]string, 0, len(page.Entries))
+	for _, e := range page.Entries {
+		if !e.Permanent {
+			t.Fatalf("expected blocks of lists to be permanent, got %+v", e)
+		}
+		sources = append(sources, e.Source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+func writeList(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "list.txt")
+	writeList(t, path, "10.0.0.1\n10.0.0.5\n10.1.0.0/16\n192.168.1.1\n")
+
+	i, store, b := newTestImporter(t, List{Name: "test", Path: path})
+	if _, err := b.BlockIP(ctx, "10.0.0.5", blocker.BlockOptions{Duration: time.Hour, Reason: "manual"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Sources on the allowlist are not blocked, and sources that are already blocked keep their block
+	if err := i.Refresh(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sources := listed(t, store, "test"); !reflect.DeepEqual(sources, []string{"10.0.0.1", "10.1.0.0/16"}) {
+		t.Fatalf("expected the listed sources to be blocked, got %v", sources)
+	}
+	if e, err := store.FindBlockEntry(ctx, "10.0.0.5"); err != nil || e.Reason != "manual" {
+		t.Fatalf("expected the manual block to be kept, got %+v (%v)", e, err)
+	}
+
+	// Sources that are no longer listed are unblocked
+	writeList(t, path, "10.1.0.0/16\n10.0.0.2\n")
+	if err := i.Refresh(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sources := listed(t, store, "test"); !reflect.DeepEqual(sources, []string{"10.0.0.2", "10.1.0.0/16"}) {
+		t.Fatalf("expected the blocks to follow the list, got %v", sources)
+	}
+	if blocked, _, _ := b.IsBlocked(ctx, "10.0.0.1"); blocked {
+		t.Fatalf("expected the source that is no longer listed to be unblocked")
+	}
+
+	// Lists that cannot be loaded keep their blocks
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := i.Refresh(ctx); err != nil {
+		t.Fatalf("expected the previous version to be used, got %v", err)
+	}
+	if sources := listed(t, store, "test"); len(sources) != 2 {
+		t.Fatalf("expected the blocks to be kept, got %v", sources)
+	}
+
+	if err := i.Remove(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sources := listed(t, store, "test"); len(sources) != 0 {
+		t.Fatalf("expected all blocks of the list to be lifted, got %v", sources)
+	}
+}
+
+func TestRefreshTooLarge(t *testing.T) {
+	ctx := context.Background()
+	var large int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&large) == 0 {
+			w.Write([]byte("10.0.0.1\n"))
+			return
+		}
+
+		io.Copy(w, io.LimitReader(repeatReader("10.0.0.2\n"), maxListSize+9))
+	}))
+	defer ts.Close()
+
+	i, store, _ := newTestImporter(t, List{Name: "test", URL: ts.URL})
+	if err := i.Refresh(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A list that grew too large is not truncated, the previous version is used instead
+	atomic.StoreInt32(&large, 1)
+	if err := i.Refresh(ctx); err != nil {
+		t.Fatalf("expected the previous version to be used, got %v", err)
+	}
+	if sources := listed(t, store, "test"); !reflect.DeepEqual(sources, []string{"10.0.0.1"}) {
+		t.Fatalf("expected the blocks of the previous version, got %v", sources)
+	}
+}
@@ -0,0 +1,164 @@
+// Package logging creates the structured loggers used throughout the service. The same attributes are used for the
+// same things everywhere: source for IPs, service, module_id and event_id for external modules, and error for errors
+package logging
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return 0, errors.Errorf("invalid log level %v", level)
+	}
+
+	return l, nil
+}
+
+// New creates a logger writing the given format to w. The text format is meant for humans and looks like the output
+// of the standard log package, with attributes appended as key=value pairs
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatText:
+		return slog.New(&textHandler{w: w, level: l, lock: &sync.Mutex{}}), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})), nil
+	default:
+		return nil, errors.Errorf("invalid log format %v", format)
+	}
+}
+
+// Discard returns a logger that drops everything, which is useful in tests
+func Discard() *slog.Logger {
+	return slog.New(&textHandler{w: io.Discard, level: slog.LevelError + 1, lock: &sync.Mutex{}})
+}
+
+// textHandler writes lines like "2006/01/02 15:04:05 WARN message key=value", the level is omitted for info
+type textHandler struct {
+	w     io.Writer
+	level slog.Level
+	// lock is shared by all handlers derived from the same handler
+	lock *sync.Mutex
+
+	// attrs are preformatted attributes added using WithAttrs, prefix is the current group
+	attrs  string
+	prefix string
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	b.WriteString(t.Format("2006/01/02 15:04:05 "))
+
+	if r.Level != slog.LevelInfo {
+		b.WriteString(r.Level.String())
+		b.WriteByte(' ')
+	}
+
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&b, h.prefix, a)
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	for _, a := range attrs {
+		writeAttr(&b, h.prefix, a)
+	}
+
+	clone := *h
+	clone.attrs += b.String()
+	return &clone
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	clone := *h
+	clone.prefix += name + "."
+	return &clone
+}
+
+func writeAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+
+		for _, g := range a.Value.Group() {
+			writeAttr(b, prefix, g)
+		}
+		return
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(prefix)
+	b.WriteString(a.Key)
+	b.WriteByte('=')
+	b.WriteString(quote(formatValue(a.Value)))
+}
+
+func formatValue(v slog.Value) string {
+	switch v.Kind() {
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339)
+	case slog.KindAny:
+		return fmt.Sprintf("%+v", v.Any())
+	default:
+		return v.String()
+	}
+}
+
+// quote only quotes values that would otherwise be ambiguous
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
@@ -0,0 +1,128 @@
+// Package metrics contains all Prometheus metrics exposed by the service
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "fail2ban"
+
+// Reasons used for the blocks and unblocks counters
+const (
+	ReasonPolicy = "policy"
+	ReasonManual = "manual"
+	ReasonExpiry = "expiry"
+	// ReasonList is used for sources that were added to or removed from an imported blocklist
+	ReasonList = "list"
+	// ReasonFederation is used for blocks that were mirrored from or lifted by an upstream server
+	ReasonFederation = "federation"
+)
+
+// Results used for the external notifications counter
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	// ResultDropped is used for authentication entries that were not reported upstream because the queue was full
+	ResultDropped = "dropped"
+)
+
+var (
+	AuthenticationEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authentication_entries_total",
+		Help:      "Amount of failed authentication entries reported, by service.",
+	}, []string{"service"})
+
+	Blocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocks_total",
+		Help:      "Amount of sources blocked, by reason.",
+	}, []string{"reason"})
+
+	Unblocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unblocks_total",
+		Help:      "Amount of sources unblocked, by reason.",
+	}, []string{"reason"})
+
+	ActiveBlocks = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_blocks",
+		Help:      "Amount of currently active blocks.",
+	})
+
+	ExternalNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "external_notifications_total",
+		Help:      "Amount of notifications sent to external modules, by module and result.",
+	}, []string{"module_id", "result"})
+
+	ExternalNotificationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "external_notification_duration_seconds",
+		Help:      "Latency of notifications sent to external modules, by module.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"module_id"})
+
+	FirewallErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "firewall_errors_total",
+		Help:      "Amount of failed firewall operations, by operation.",
+	}, []string{"operation"})
+
+	ReplicationOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "replication_operations_total",
+		Help:      "Amount of operations sent to peers, by peer and result.",
+	}, []string{"peer", "result"})
+
+	ReplicationApplied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "replication_applied_total",
+		Help:      "Amount of operations received from peers that changed local state, by type.",
+	}, []string{"type"})
+
+	ReplicationPeerUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "replication_peer_up",
+		Help:      "Whether the last delivery to a peer succeeded, by peer.",
+	}, []string{"peer"})
+
+	ListEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "list_entries",
+		Help:      "Amount of sources in the last successfully loaded version of an imported blocklist, by list.",
+	}, []string{"list"})
+
+	ListRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "list_refreshes_total",
+		Help:      "Amount of times an imported blocklist was loaded, by list and result.",
+	}, []string{"list", "result"})
+
+	FederationSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "federation_syncs_total",
+		Help:      "Amount of times the blocks of an upstream server were mirrored, by upstream and result.",
+	}, []string{"upstream", "result"})
+
+	FederationMirroredBlocks = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "federation_mirrored_blocks",
+		Help:      "Amount of trusted active blocks of an upstream server during the last sync, by upstream.",
+	}, []string{"upstream"})
+
+	FederationReports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "federation_reports_total",
+		Help:      "Amount of authentication entries reported to an upstream server, by upstream and result.",
+	}, []string{"upstream", "result"})
+
+	StorageOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Latency of storage operations, by operation.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"operation"})
+)
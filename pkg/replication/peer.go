@@ -0,0 +1,207 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/metrics"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// queueSize is the amount of operations buffered per peer, a full sync is needed once it overflows
+const queueSize = 1024
+
+// maxBatch is the maximum amount of operations sent in a single request
+const maxBatch = 500
+
+// maxRequestSize limits the size of requests received from peers. Full syncs are sent in batches of maxBatch
+// operations, which stay well below it even with long reasons and many tags
+const maxRequestSize = 16 << 20
+
+type peer struct {
+	address string
+	queue   chan Op
+
+	// needsSync is set when operations were lost, accessed atomically
+	needsSync int32
+	// up, failed and lastSync are only used by the delivery loop of the peer. A peer is neither up nor failed until
+	// the first delivery
+	up       bool
+	failed   bool
+	lastSync time.Time
+}
+
+func newPeer(address string) *peer {
+	return &peer{
+		address:   strings.TrimSuffix(address, "/"),
+		queue:     make(chan Op, queueSize),
+		needsSync: 1,
+	}
+}
+
+// broadcast queues the operation for all peers. Peers with a full queue get the full state instead
+func (r *Replicator) broadcast(op Op) {
+	for _, p := range r.peers {
+		select {
+		case p.queue <- op:
+		default:
+			atomic.StoreInt32(&p.needsSync, 1)
+		}
+	}
+}
+
+// runPeer delivers queued operations to the peer until the context is cancelled. The full state is sent when the loop
+// starts, every sync interval and whenever operations were lost
+func (r *Replicator) runPeer(ctx context.Context, p *peer) {
+	ticker := time.NewTicker(r.config.RetryInterval)
+	defer ticker.Stop()
+
+	r.sync(ctx, p)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if atomic.LoadInt32(&p.needsSync) == 1 || r.clock.Now().Sub(p.lastSync) >= r.config.SyncInterval {
+				r.sync(ctx, p)
+			}
+		case op := <-p.queue:
+			// Operations queued while a full sync is needed are part of the next one
+			if atomic.LoadInt32(&p.needsSync) == 1 {
+				continue
+			}
+
+			batch := []Op{op}
+		drain:
+			for len(batch) < maxBatch {
+				select {
+				case op := <-p.queue:
+					batch = append(batch, op)
+				default:
+					break drain
+				}
+			}
+
+			if err := r.send(ctx, p, batch); err != nil {
+				r.markDown(p, err)
+			}
+		}
+	}
+}
+
+// sync sends the full state of this node to the peer
+func (r *Replicator) sync(ctx context.Context, p *peer) {
+	// Operations that happen from now on are sent after the snapshot, so the flag is cleared before taking it
+	atomic.StoreInt32(&p.needsSync, 0)
+
+	ops, err := r.snapshot(ctx)
+	if err != nil {
+		atomic.StoreInt32(&p.needsSync, 1)
+		r.logger.Error("unable to take snapshot for peer", "peer", p.address, "error", err)
+		return
+	}
+
+	// An empty state is still sent, so the peer is known to be reachable
+	for start := 0; start < len(ops) || start == 0; start += maxBatch {
+		end := start + maxBatch
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		if err := r.send(ctx, p, ops[start:end]); err != nil {
+			r.markDown(p, err)
+			return
+		}
+	}
+
+	p.lastSync = r.clock.Now()
+	p.failed = false
+	if !p.up {
+		p.up = true
+		metrics.ReplicationPeerUp.WithLabelValues(p.address).Set(1)
+		r.logger.Info("synchronized state with peer", "peer", p.address, "operations", len(ops))
+	}
+}
+
+// markDown records a failed delivery, the peer gets the full state once it is reachable again
+func (r *Replicator) markDown(p *peer, err error) {
+	atomic.StoreInt32(&p.needsSync, 1)
+	if !p.failed {
+		r.logger.Warn("peer is unreachable, retrying", "peer", p.address, "error", err)
+	}
+
+	p.up, p.failed = false, true
+	metrics.ReplicationPeerUp.WithLabelValues(p.address).Set(0)
+}
+
+func (r *Replicator) send(ctx context.Context, p *peer, ops []Op) error {
+	body, err := json.Marshal(request{Node: r.config.NodeId, Ops: ops})
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal operations")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.address+OpsPath, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "unable to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.config.Secret)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		metrics.ReplicationOperations.WithLabelValues(p.address, metrics.ResultFailure).Add(float64(len(ops)))
+		return errors.Wrap(err, "unable to send operations")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		metrics.ReplicationOperations.WithLabelValues(p.address, metrics.ResultFailure).Add(float64(len(ops)))
+		return errors.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	metrics.ReplicationOperations.WithLabelValues(p.address, metrics.ResultSuccess).Add(float64(len(ops)))
+	return nil
+}
+
+// Handler receives operations from peers, which have to use the shared secret
+func (r *Replicator) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		secret := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(r.config.Secret)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var body request
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxRequestSize)).Decode(&body); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				r.logger.Warn("request of peer is too large", "limit", maxErr.Limit)
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for _, op := range body.Ops {
+			if err := r.apply(req.Context(), op); err != nil {
+				r.logger.Error("unable to apply operation of peer", "peer", body.Node, "type", op.Type,
+					"source", op.Source, "error", err)
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,391 @@
+// Package replication keeps the block state of several nodes in sync. Every node sends its changes to all of its peers,
+// conflicting changes are resolved by keeping the most recent one. Changes that could not be delivered are recovered by
+// periodically sending the full state, which also happens as soon as an unreachable peer is reachable again
+package replication
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/metrics"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// OpsPath is the path on which nodes receive operations from their peers
+const OpsPath = "/replication/ops"
+
+type Config struct {
+	// Peers are the base URLs of the other nodes, such as http://10.0.0.2:8080. Replication is disabled without peers
+	Peers []string
+	// Secret is shared by all nodes, and authenticates their requests
+	Secret string
+	// NodeId identifies this node, the hostname is used when it is empty
+	NodeId string `split_words:"true"`
+	// Entries enables replication of authentication entries, so the policy is evaluated using the entries of all nodes
+	Entries bool `default:"false"`
+
+	// SyncInterval is the time between sending the full state to every peer
+	SyncInterval time.Duration `default:"1m" split_words:"true"`
+	// RetryInterval is the time between attempts to reach a peer that is unreachable
+	RetryInterval time.Duration `default:"5s" split_words:"true"`
+	// TombstoneTtl is how long unblocks are remembered, peers that are unreachable for longer might restore the block
+	TombstoneTtl time.Duration `default:"24h" split_words:"true"`
+	// EntryWindow limits the authentication entries sent in a full sync to the most recent ones
+	EntryWindow time.Duration `default:"24h" split_words:"true"`
+}
+
+func (c Config) Enabled() bool {
+	return len(c.Peers) > 0
+}
+
+// Operation types
+const (
+	OpBlock   = "block"
+	OpUnblock = "unblock"
+	OpEntry   = "entry"
+)
+
+// Version orders the changes of a single source, the change with the highest version wins
+type Version struct {
+	Time int64  `json:"time"`
+	Node string `json:"node"`
+}
+
+func (v Version) newerThan(o Version) bool {
+	if v.Time != o.Time {
+		return v.Time > o.Time
+	}
+	return v.Node > o.Node
+}
+
+// Op is a single change, sent to peers
+type Op struct {
+	Type    string                       `json:"type"`
+	Source  string                       `json:"source"`
+	Version Version                      `json:"version"`
+	Block   *storage.BlockEntry          `json:"block,omitempty"`
+	Entry   *storage.AuthenticationEntry `json:"entry,omitempty"`
+}
+
+type request struct {
+	Node string `json:"node"`
+	Ops  []Op   `json:"ops"`
+}
+
+// state is the version of the last change of a source, deleted is set for unblocks
+type state struct {
+	version Version
+	deleted bool
+	updated time.Time
+}
+
+// EnforceFunc applies a block or unblock received from a peer to the firewall and external modules
+type EnforceFunc func(ctx context.Context, entry storage.BlockEntry) error
+
+// Replicator is a storage that sends block changes to its peers, and applies the changes it receives from them. All
+// other operations are passed on to the wrapped storage
+type Replicator struct {
+	storage.Storage
+
+	logger  *slog.Logger
+	config  Config
+	client  *http.Client
+	enforce EnforceFunc
+	// clock is used for versions, tombstones and to determine which blocks are active
+	clock clock.Clock
+
+	// lock guards states, and is held while changing blocks so changes and their versions are applied in the same order
+	lock   sync.Mutex
+	states map[string]state
+	last   int64
+
+	peers  []*peer
+	ctx    context.Context
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
+}
+
+func New(store storage.Storage, config Config, clock clock.Clock, logger *slog.Logger) (*Replicator, error) {
+	if config.Secret == "" {
+		return nil, errors.New("replication requires a secret")
+	}
+
+	if config.NodeId == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to determine node id")
+		}
+		config.NodeId = hostname
+	}
+
+	r := &Replicator{
+		Storage: store,
+		logger:  logger.With("node", config.NodeId),
+		config:  config,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		states:  make(map[string]state),
+		clock:   clock,
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	// Existing blocks are versioned by the time they started, so any newer change of a peer replaces them
+	blocks, err := store.AllBlockEntries(context.Background(), false)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load block entries")
+	}
+	for _, e := range blocks {
+		r.states[e.Source] = state{version: Version{Time: e.Timestamp.Time().UnixNano()}, updated: r.clock.Now()}
+	}
+
+	for _, address := range config.Peers {
+		r.peers = append(r.peers, newPeer(address))
+	}
+
+	return r, nil
+}
+
+// SetEnforcer sets the function used to enforce changes received from peers, it should be called before Start
+func (r *Replicator) SetEnforcer(enforce EnforceFunc) {
+	r.enforce = enforce
+}
+
+// Start starts delivering changes to peers, beginning with the full state
+func (r *Replicator) Start() {
+	for _, p := range r.peers {
+		p := p
+
+		r.loops.Add(1)
+		go func() {
+			defer r.loops.Done()
+			r.runPeer(r.ctx, p)
+		}()
+	}
+
+	r.logger.Info("replicating to peers", "peers", r.config.Peers, "entries", r.config.Entries)
+}
+
+// Close stops delivering changes to peers, and closes the wrapped storage. Changes that were not delivered yet are
+// sent by the peers themselves during their next full sync
+func (r *Replicator) Close() error {
+	r.cancel()
+	r.loops.Wait()
+
+	return r.Storage.Close()
+}
+
+func (r *Replicator) Ping(ctx context.Context) error {
+	return storage.Ping(ctx, r.Storage)
+}
+
+// nextVersion returns a version newer than any version handed out before by this node, r.lock must be held
+func (r *Replicator) nextVersion() Version {
+	now := r.clock.Now().UnixNano()
+	if now <= r.last {
+		now = r.last + 1
+	}
+	r.last = now
+
+	return Version{Time: now, Node: r.config.NodeId}
+}
+
+func (r *Replicator) AddBlockEntry(ctx context.Context, entry storage.BlockEntry) error {
+	r.lock.Lock()
+	if err := r.Storage.AddBlockEntry(ctx, entry); err != nil {
+		r.lock.Unlock()
+		return err
+	}
+
+	v := r.nextVersion()
+	r.states[entry.Source] = state{version: v, updated: r.clock.Now()}
+	r.lock.Unlock()
+
+	r.broadcast(Op{Type: OpBlock, Source: entry.Source, Version: v, Block: &entry})
+	return nil
+}
+
+func (r *Replicator) RemoveBlockEntry(ctx context.Context, ip string) error {
+	r.lock.Lock()
+	if err := r.Storage.RemoveBlockEntry(ctx, ip); err != nil {
+		r.lock.Unlock()
+		return err
+	}
+
+	v := r.nextVersion()
+	r.states[ip] = state{version: v, deleted: true, updated: r.clock.Now()}
+	r.lock.Unlock()
+
+	r.broadcast(Op{Type: OpUnblock, Source: ip, Version: v})
+	return nil
+}
+
+func (r *Replicator) AddAuthenticationEntry(ctx context.Context, entry storage.AuthenticationEntry) error {
+	if err := r.Storage.AddAuthenticationEntry(ctx, entry); err != nil {
+		return err
+	}
+
+	// Entries are never changed or removed, so they need no version
+	if r.config.Entries {
+		r.broadcast(Op{Type: OpEntry, Source: entry.Source, Entry: &entry})
+	}
+	return nil
+}
+
+// apply applies a single operation received from a peer, changes older than the current state are ignored
+func (r *Replicator) apply(ctx context.Context, op Op) error {
+	switch op.Type {
+	case OpBlock:
+		if op.Block == nil || op.Block.Source != op.Source {
+			return errors.Errorf("invalid block operation for %v", op.Source)
+		}
+		return r.applyBlock(ctx, op)
+	case OpUnblock:
+		return r.applyUnblock(ctx, op)
+	case OpEntry:
+		if op.Entry == nil || !op.Entry.Valid() {
+			return errors.Errorf("invalid entry operation for %v", op.Source)
+		}
+		if !r.config.Entries {
+			return nil
+		}
+
+		if err := r.Storage.AddAuthenticationEntry(ctx, *op.Entry); err != nil {
+			return errors.Wrap(err, "unable to add authentication entry")
+		}
+		metrics.ReplicationApplied.WithLabelValues(OpEntry).Inc()
+		return nil
+	default:
+		return errors.Errorf("unknown operation type %v", op.Type)
+	}
+}
+
+func (r *Replicator) applyBlock(ctx context.Context, op Op) error {
+	// The allowlist of this node applies to blocks of peers as well, which can block CIDR ranges
+	allowEntries, err := r.Storage.GetAllowEntries(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to load allowlist")
+	}
+	for _, e := range allowEntries {
+		if e.Overlaps(op.Source) {
+			return nil
+		}
+	}
+
+	r.lock.Lock()
+	if current, ok := r.states[op.Source]; ok && !op.Version.newerThan(current.version) {
+		r.lock.Unlock()
+		return nil
+	}
+
+	if err := r.Storage.AddBlockEntry(ctx, *op.Block); err != nil {
+		r.lock.Unlock()
+		return errors.Wrap(err, "unable to add block entry")
+	}
+	r.states[op.Source] = state{version: op.Version, updated: r.clock.Now()}
+	r.lock.Unlock()
+
+	metrics.ReplicationApplied.WithLabelValues(OpBlock).Inc()
+	r.logger.Info("applied block of peer", "source", op.Source, "peer", op.Version.Node)
+	return r.enforceEntry(ctx, *op.Block)
+}
+
+func (r *Replicator) applyUnblock(ctx context.Context, op Op) error {
+	r.lock.Lock()
+	if current, ok := r.states[op.Source]; ok && !op.Version.newerThan(current.version) {
+		r.lock.Unlock()
+		return nil
+	}
+
+	existing, err := r.Storage.FindBlockEntry(ctx, op.Source)
+	if err != nil && err != storage.NotFoundErr {
+		r.lock.Unlock()
+		return errors.Wrap(err, "unable to find block entry")
+	}
+	blocked := err == nil && existing.ActiveAt(r.clock.Now())
+
+	if err := r.Storage.RemoveBlockEntry(ctx, op.Source); err != nil {
+		r.lock.Unlock()
+		return errors.Wrap(err, "unable to remove block entry")
+	}
+	r.states[op.Source] = state{version: op.Version, deleted: true, updated: r.clock.Now()}
+	r.lock.Unlock()
+
+	if !blocked {
+		return nil
+	}
+
+	metrics.ReplicationApplied.WithLabelValues(OpUnblock).Inc()
+	r.logger.Info("applied unblock of peer", "source", op.Source, "peer", op.Version.Node)
+
+	// Like unblocks of the blocker itself, an expired entry lifts the block
+	return r.enforceEntry(ctx, storage.BlockEntry{
+		Source:    op.Source,
+		Timestamp: unix_time.Time(r.clock.Now()),
+		Duration:  -1 * time.Second,
+	})
+}
+
+func (r *Replicator) enforceEntry(ctx context.Context, entry storage.BlockEntry) error {
+	if r.enforce == nil {
+		return nil
+	}
+
+	return errors.Wrap(r.enforce(ctx, entry), "unable to enforce change")
+}
+
+// snapshot returns the full state of this node as operations. Unblocks older than the tombstone TTL are forgotten
+func (r *Replicator) snapshot(ctx context.Context) ([]Op, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	blocks, err := r.Storage.AllBlockEntries(ctx, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load block entries")
+	}
+
+	var ops []Op
+	active := make(map[string]struct{}, len(blocks))
+	for _, e := range blocks {
+		e := e
+		active[e.Source] = struct{}{}
+
+		s, ok := r.states[e.Source]
+		if !ok {
+			s = state{version: Version{Time: e.Timestamp.Time().UnixNano()}, updated: r.clock.Now()}
+			r.states[e.Source] = s
+		}
+		ops = append(ops, Op{Type: OpBlock, Source: e.Source, Version: s.version, Block: &e})
+	}
+
+	for source, s := range r.states {
+		if _, ok := active[source]; ok {
+			continue
+		}
+
+		// Expired blocks are removed by every node on its own, so their state is no longer needed
+		if !s.deleted || r.clock.Now().Sub(s.updated) > r.config.TombstoneTtl {
+			delete(r.states, source)
+			continue
+		}
+		ops = append(ops, Op{Type: OpUnblock, Source: source, Version: s.version})
+	}
+
+	if r.config.Entries {
+		page, err := r.Storage.ListAuthenticationEntries(ctx, storage.EntryQuery{From: r.clock.Now().Add(-r.config.EntryWindow)})
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load authentication entries")
+		}
+
+		for _, e := range page.Entries {
+			e := e
+			ops = append(ops, Op{Type: OpEntry, Source: e.Source, Entry: &e})
+		}
+	}
+
+	return ops, nil
+}
@@ -0,0 +1,529 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/clock/fakeclock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	replicator *Replicator
+	server     *httptest.Server
+
+	// down makes the node respond with 503 to its peers, accessed atomically
+	down int32
+
+	lock     sync.Mutex
+	enforced []storage.BlockEntry
+}
+
+func (n *testNode) setDown(down bool) {
+	v := int32(0)
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&n.down, v)
+}
+
+func (n *testNode) enforcedEntries() []storage.BlockEntry {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return append([]storage.BlockEntry{}, n.enforced...)
+}
+
+func testConfig(id string, peers []string) Config {
+	return Config{
+		Peers:         peers,
+		Secret:        "secret",
+		NodeId:        id,
+		SyncInterval:  time.Hour,
+		RetryInterval: 10 * time.Millisecond,
+		TombstoneTtl:  time.Hour,
+		EntryWindow:   time.Hour,
+	}
+}
+
+// newCluster starts the given amount of nodes on loopback, which all replicate to each other
+func newCluster(t *testing.T, size int, entries bool) []*testNode {
+	t.Helper()
+
+	nodes := make([]*testNode, size)
+	for i := range nodes {
+		n := &testNode{}
+		n.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&n.down) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			n.replicator.Handler().ServeHTTP(w, r)
+		}))
+		t.Cleanup(n.server.Close)
+		nodes[i] = n
+	}
+
+	for i, n := range nodes {
+		var peers []string
+		for j, p := range nodes {
+			if i != j {
+				peers = append(peers, p.server.URL)
+			}
+		}
+
+		config := testConfig(fmt.Sprintf("node-%v", i), peers)
+		config.Entries = entries
+
+		r, err := New(storage.NewMemoryStore(clock.Real, logging.Discard()), config, clock.Real, logging.Discard())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		n := n
+		r.SetEnforcer(func(_ context.Context, entry storage.BlockEntry) error {
+			n.lock.Lock()
+			defer n.lock.Unlock()
+
+			n.enforced = append(n.enforced, entry)
+			return nil
+		})
+		n.replicator = r
+	}
+
+	for _, n := range nodes {
+		n.replicator.Start()
+		t.Cleanup(func() { n.replicator.Close() })
+	}
+
+	return nodes
+}
+
+func eventually(t *testing.T, condition func() bool, format string, args ...interface{}) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func isBlocked(n *testNode, ip string) bool {
+	entry, err := n.replicator.FindBlockEntry(context.Background(), ip)
+	return err == nil && entry.ActiveAt(clock.Real.Now())
+}
+
+func hasEntry(n *testNode, entry storage.AuthenticationEntry) bool {
+	entries, err := n.replicator.FindAuthenticationEntries(context.Background(), entry.Source)
+	if err != nil {
+		return false
+	}
+
+	// Timestamps are sent with second precision
+	for e := range entries {
+		if e.Service == entry.Service && e.Timestamp.Time().Unix() == entry.Timestamp.Time().Unix() {
+			return true
+		}
+	}
+	return false
+}
+
+func testBlock(ip string) storage.BlockEntry {
+	return storage.BlockEntry{
+		Source:    ip,
+		Timestamp: unix_time.Time(time.Now()),
+		Duration:  time.Hour,
+	}
+}
+
+func TestBlockReplicates(t *testing.T) {
+	nodes := newCluster(t, 3, false)
+
+	if err := nodes[0].replicator.AddBlockEntry(context.Background(), testBlock("10.0.0.1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, n := range nodes[1:] {
+		eventually(t, func() bool { return isBlocked(n, "10.0.0.1") }, "expected 10.0.0.1 to be blocked on node %v", i+1)
+
+		enforced := n.enforcedEntries()
+		if len(enforced) != 1 || enforced[0].Source != "10.0.0.1" || !enforced[0].ActiveAt(clock.Real.Now()) {
+			t.Fatalf("expected the block to be enforced on node %v, got %+v", i+1, enforced)
+		}
+	}
+
+	if enforced := nodes[0].enforcedEntries(); len(enforced) != 0 {
+		t.Fatalf("expected local blocks to not be enforced by replication, got %+v", enforced)
+	}
+}
+
+func TestUnblockReplicates(t *testing.T) {
+	nodes := newCluster(t, 3, false)
+	ctx := context.Background()
+
+	if err := nodes[0].replicator.AddBlockEntry(ctx, testBlock("10.0.0.1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	eventually(t, func() bool { return isBlocked(nodes[1], "10.0.0.1") && isBlocked(nodes[2], "10.0.0.1") },
+		"expected 10.0.0.1 to be blocked on all nodes")
+
+	if err := nodes[1].replicator.RemoveBlockEntry(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, i := range []int{0, 2} {
+		n := nodes[i]
+		eventually(t, func() bool {
+			_, err := n.replicator.FindBlockEntry(ctx, "10.0.0.1")
+			return err == storage.NotFoundErr
+		}, "expected 10.0.0.1 to be unblocked on node %v", i)
+
+		enforced := n.enforcedEntries()
+		if last := enforced[len(enforced)-1]; last.Source != "10.0.0.1" || last.ActiveAt(clock.Real.Now()) {
+			t.Fatalf("expected the unblock to be enforced on node %v, got %+v", i, enforced)
+		}
+	}
+}
+
+func TestConflictResolution(t *testing.T) {
+	r, err := New(storage.NewMemoryStore(clock.Real, logging.Discard()), testConfig("node-0", nil), clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	ctx := context.Background()
+	block := testBlock("10.0.0.1")
+	apply := func(op Op) {
+		t.Helper()
+		if err := r.apply(ctx, op); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	apply(Op{Type: OpBlock, Source: block.Source, Version: Version{Time: 20, Node: "a"}, Block: &block})
+
+	// An older unblock, for example one that was delayed, does not lift a newer block
+	apply(Op{Type: OpUnblock, Source: block.Source, Version: Version{Time: 10, Node: "b"}})
+	if _, err := r.FindBlockEntry(ctx, block.Source); err != nil {
+		t.Fatalf("expected the block to remain after an older unblock, got %v", err)
+	}
+
+	// Ties are broken using the node
+	apply(Op{Type: OpUnblock, Source: block.Source, Version: Version{Time: 20, Node: "b"}})
+	if _, err := r.FindBlockEntry(ctx, block.Source); err != storage.NotFoundErr {
+		t.Fatalf("expected the unblock to win the tie, got %v", err)
+	}
+
+	// The unblock is remembered, so the older block is not restored when it is received again
+	apply(Op{Type: OpBlock, Source: block.Source, Version: Version{Time: 20, Node: "a"}, Block: &block})
+	if _, err := r.FindBlockEntry(ctx, block.Source); err != storage.NotFoundErr {
+		t.Fatalf("expected the older block to be ignored, got %v", err)
+	}
+
+	apply(Op{Type: OpBlock, Source: block.Source, Version: Version{Time: 30, Node: "a"}, Block: &block})
+	if _, err := r.FindBlockEntry(ctx, block.Source); err != nil {
+		t.Fatalf("expected the newer block to be applied, got %v", err)
+	}
+}
+
+func TestLocalChangesWinFromOlderPeerChanges(t *testing.T) {
+	r, err := New(storage.NewMemoryStore(clock.Real, logging.Discard()), testConfig("node-0", nil), clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	ctx := context.Background()
+	old := time.Now().Add(-time.Minute).UnixNano()
+	block := testBlock("10.0.0.1")
+
+	if err := r.RemoveBlockEntry(ctx, block.Source); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.apply(ctx, Op{Type: OpBlock, Source: block.Source, Version: Version{Time: old, Node: "node-1"}, Block: &block}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := r.FindBlockEntry(ctx, block.Source); err != storage.NotFoundErr {
+		t.Fatalf("expected the block of the peer to be older than the local unblock, got %v", err)
+	}
+}
+
+func TestAntiEntropyOnReconnect(t *testing.T) {
+	nodes := newCluster(t, 3, false)
+	ctx := context.Background()
+
+	if err := nodes[0].replicator.AddBlockEntry(ctx, testBlock("10.0.0.1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	eventually(t, func() bool { return isBlocked(nodes[2], "10.0.0.1") }, "expected 10.0.0.1 to be blocked on node 2")
+
+	// Changes made while node 2 is unreachable are lost, until it is reachable again
+	nodes[2].setDown(true)
+	if err := nodes[0].replicator.AddBlockEntry(ctx, testBlock("10.0.0.2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := nodes[1].replicator.RemoveBlockEntry(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	eventually(t, func() bool { return isBlocked(nodes[1], "10.0.0.2") }, "expected 10.0.0.2 to be blocked on node 1")
+
+	time.Sleep(50 * time.Millisecond)
+	if isBlocked(nodes[2], "10.0.0.2") || !isBlocked(nodes[2], "10.0.0.1") {
+		t.Fatalf("expected node 2 to not receive changes while it is unreachable")
+	}
+
+	nodes[2].setDown(false)
+	eventually(t, func() bool { return isBlocked(nodes[2], "10.0.0.2") && !isBlocked(nodes[2], "10.0.0.1") },
+		"expected node 2 to catch up after reconnecting")
+}
+
+func TestAntiEntropyOnStart(t *testing.T) {
+	// The existing block of node 1 is sent to node 0 as soon as replication starts
+	nodes := newCluster(t, 1, false)
+	store := storage.NewMemoryStore(clock.Real, logging.Discard())
+	if err := store.AddBlockEntry(context.Background(), testBlock("10.0.0.1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, err := New(store, testConfig("node-1", []string{nodes[0].server.URL}), clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r.Start()
+	defer r.Close()
+
+	eventually(t, func() bool { return isBlocked(nodes[0], "10.0.0.1") }, "expected 10.0.0.1 to be blocked on node 0")
+}
+
+func TestPeriodicSync(t *testing.T) {
+	// The peer only counts the requests it receives, every request is a full sync as no changes are made
+	var syncs int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&syncs, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer peer.Close()
+
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	r, err := New(storage.NewMemoryStore(c, logging.Discard()), testConfig("node-0", []string{peer.URL}), c, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r.Start()
+	defer r.Close()
+
+	eventually(t, func() bool { return atomic.LoadInt32(&syncs) == 1 }, "expected the state to be synced on start")
+
+	// The retry interval passes many times, but the sync interval only passes on the clock of the replicator
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&syncs); n != 1 {
+		t.Fatalf("expected no sync before the sync interval passed, got %v syncs", n)
+	}
+
+	c.Advance(time.Hour)
+	eventually(t, func() bool { return atomic.LoadInt32(&syncs) == 2 }, "expected the state to be synced again")
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&syncs); n != 2 {
+		t.Fatalf("expected a single sync per sync interval, got %v syncs", n)
+	}
+}
+
+func TestEntriesReplicate(t *testing.T) {
+	nodes := newCluster(t, 2, true)
+	entry := storage.AuthenticationEntry{Source: "10.0.0.1", Service: "ssh", Timestamp: unix_time.Time(time.Now())}
+
+	if err := nodes[0].replicator.AddAuthenticationEntry(context.Background(), entry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	eventually(t, func() bool { return hasEntry(nodes[1], entry) }, "expected the entry to be replicated")
+}
+
+func TestEntriesNotReplicatedByDefault(t *testing.T) {
+	r, err := New(storage.NewMemoryStore(clock.Real, logging.Discard()), testConfig("node-0", nil), clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	entry := storage.AuthenticationEntry{Source: "10.0.0.1", Service: "ssh", Timestamp: unix_time.Time(time.Now())}
+	if err := r.apply(context.Background(), Op{Type: OpEntry, Source: entry.Source, Entry: &entry}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := r.FindAuthenticationEntries(context.Background(), entry.Source); err != storage.NotFoundErr {
+		t.Fatalf("expected entries of peers to be ignored, got %v", err)
+	}
+}
+
+func TestPolicyIsClusterWide(t *testing.T) {
+	nodes := newCluster(t, 3, true)
+	policy := blocker.Policy{Attempts: 3, Period: time.Minute, BlockTime: time.Hour}
+	ctx := context.Background()
+
+	// Every node sees a single attempt, which only violates the policy when the attempts of all nodes are counted
+	var entries []storage.AuthenticationEntry
+	for i, n := range nodes {
+		b := blocker.New(n.replicator, policy, blocker.NoopFirewall{}, clock.Real, logging.Discard())
+		entry := storage.AuthenticationEntry{
+			Source:    "10.0.0.1",
+			Service:   "ssh",
+			Timestamp: unix_time.Time(time.Now().Add(time.Duration(i) * time.Second)),
+		}
+
+		for _, e := range entries {
+			e := e
+			eventually(t, func() bool { return hasEntry(n, e) }, "expected earlier entries to be replicated to node %v", i)
+		}
+
+		if err := b.AddEntry(ctx, entry); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	for i, n := range nodes {
+		eventually(t, func() bool { return isBlocked(n, "10.0.0.1") }, "expected 10.0.0.1 to be blocked on node %v", i)
+	}
+}
+
+func TestAllowlistAppliesToPeerBlocks(t *testing.T) {
+	r, err := New(storage.NewMemoryStore(clock.Real, logging.Discard()), testConfig("node-0", nil), clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	ctx := context.Background()
+	if err := r.AddAllowEntry(ctx, storage.AllowEntry{Source: "10.0.0.0/8"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	block := testBlock("10.0.0.1")
+	if err := r.apply(ctx, Op{Type: OpBlock, Source: block.Source, Version: Version{Time: 1, Node: "node-1"}, Block: &block}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := r.FindBlockEntry(ctx, block.Source); err != storage.NotFoundErr {
+		t.Fatalf("expected the block of an allowlisted source to be ignored, got %v", err)
+	}
+
+	// Ranges overlapping with the allowlist are ignored as well
+	block = testBlock("10.0.0.0/16")
+	if err := r.apply(ctx, Op{Type: OpBlock, Source: block.Source, Version: Version{Time: 2, Node: "node-1"}, Block: &block}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := r.FindBlockEntry(ctx, block.Source); err != storage.NotFoundErr {
+		t.Fatalf("expected the block of a range overlapping with the allowlist to be ignored, got %v", err)
+	}
+}
+
+func TestHandlerRequiresSecret(t *testing.T) {
+	r, err := New(storage.NewMemoryStore(clock.Real, logging.Discard()), testConfig("node-0", nil), clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	ts := httptest.NewServer(r.Handler())
+	defer ts.Close()
+
+	for secret, status := range map[string]int{"wrong": http.StatusUnauthorized, "secret": http.StatusNoContent} {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+OpsPath, bytes.NewBufferString(`{"node":"x","ops":[]}`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+secret)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Fatalf("expected status %v with secret %v, got %v", status, secret, resp.StatusCode)
+		}
+	}
+}
+
+func TestHandlerLimitsRequestSize(t *testing.T) {
+	ctx := context.Background()
+	r, err := New(storage.NewMemoryStore(clock.Real, logging.Discard()), testConfig("node-0", nil), clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	ts := httptest.NewServer(r.Handler())
+	defer ts.Close()
+
+	post := func(body []byte) int {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL+OpsPath, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// A full batch of a sync with long reasons is accepted
+	ops := make([]Op, maxBatch)
+	for i := range ops {
+		source := fmt.Sprintf("10.0.%v.%v", i/256, i%256)
+		ops[i] = Op{Type: OpBlock, Source: source, Version: Version{Time: 1, Node: "node-1"}, Block: &storage.BlockEntry{
+			Source: source, Timestamp: unix_time.Time(time.Now()), Duration: time.Hour,
+			Reason: strings.Repeat("r", 1024), Tags: []string{"ssh", "scan"},
+		}}
+	}
+	body, err := json.Marshal(request{Node: "node-1", Ops: ops})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status := post(body); status != http.StatusNoContent {
+		t.Fatalf("expected a full batch to be accepted, got %v", status)
+	}
+	if _, err := r.FindBlockEntry(ctx, ops[maxBatch-1].Source); err != nil {
+		t.Fatalf("expected the full batch to be applied, got %v", err)
+	}
+
+	if status := post([]byte(`{"node":"` + strings.Repeat("a", maxRequestSize) + `","ops":[]}`)); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected an oversized request to be rejected, got %v", status)
+	}
+}
+
+func TestSecretRequired(t *testing.T) {
+	config := testConfig("node-0", nil)
+	config.Secret = ""
+
+	if _, err := New(storage.NewMemoryStore(clock.Real, logging.Discard()), config, clock.Real, logging.Discard()); err == nil {
+		t.Fatalf("expected an error without a secret")
+	}
+}
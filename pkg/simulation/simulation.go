@@ -0,0 +1,189 @@
+// Package simulation replays recorded authentication entries through a blocker using a simulated clock, to find out
+// which blocks a policy would have made without enforcing anything
+package simulation
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/clock/fakeclock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"sort"
+	"time"
+)
+
+// Policies is a policy with the policies that override it for single services, as used by a blocker
+type Policies struct {
+	Policy   blocker.Policy            `json:"policy"`
+	Services map[string]blocker.Policy `json:"services,omitempty"`
+}
+
+// Result contains the blocks a policy made while replaying entries
+type Result struct {
+	Policies Policies `json:"policies"`
+	// Entries is the amount of replayed entries, Invalid entries are not replayed
+	Entries int `json:"entries"`
+	Invalid int `json:"invalid"`
+	// Blocks contains every block in the order they were made, a source can be blocked more than once
+	Blocks []storage.BlockEntry `json:"blocks"`
+}
+
+// SourceSummary is what a policy did to a single source
+type SourceSummary struct {
+	Source string `json:"source"`
+	Blocks int    `json:"blocks"`
+	// Duration is the sum of the durations of all blocks, permanent blocks are counted separately
+	Duration  time.Duration  `json:"duration"`
+	Permanent bool           `json:"permanent,omitempty"`
+	First     unix_time.Time `json:"first"`
+}
+
+// SourceChange is a source that is blocked by both policies, but not in the same way
+type SourceChange struct {
+	Source    string        `json:"source"`
+	Current   SourceSummary `json:"current"`
+	Candidate SourceSummary `json:"candidate"`
+}
+
+// Diff compares the blocks of the current policy to the blocks of a candidate policy
+type Diff struct {
+	// Added sources are only blocked by the candidate, these would be affected by switching to it
+	Added []SourceSummary `json:"added"`
+	// Removed sources are only blocked by the current policy
+	Removed []SourceSummary `json:"removed"`
+	Changed []SourceChange  `json:"changed"`
+}
+
+// recorder keeps every block that is stored, as blocks of the same source replace each other in storage
+type recorder struct {
+	storage.Storage
+	blocks []storage.BlockEntry
+}
+
+func (r *recorder) AddBlockEntry(ctx context.Context, entry storage.BlockEntry) error {
+	r.blocks = append(r.blocks, entry)
+	return r.Storage.AddBlockEntry(ctx, entry)
+}
+
+// Run replays the entries in the order of their timestamps through a blocker using the given policies. The clock of
+// the blocker is set to the timestamp of every entry before it is added, so windows and block expiry behave as if
+// the entries arrived live. Entries with the same timestamp, such as log lines with second precision, are a nanosecond
+// apart in the replay, so they are not merged into a single entry. Sources covered by the allowlist are never blocked
+func Run(ctx context.Context, entries []storage.AuthenticationEntry, policies Policies, allowlist []storage.AllowEntry) (Result, error) {
+	res := Result{Policies: policies}
+
+	sorted := make([]storage.AuthenticationEntry, 0, len(entries))
+	for _, e := range entries {
+		if !e.Valid() {
+			res.Invalid++
+			continue
+		}
+		sorted = append(sorted, e)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Time().Before(sorted[j].Timestamp.Time())
+	})
+	if len(sorted) == 0 {
+		return res, nil
+	}
+
+	c := fakeclock.New(sorted[0].Timestamp.Time())
+	store := &recorder{Storage: storage.NewMemoryStore(c, logging.Discard())}
+	for _, e := range allowlist {
+		if err := store.AddAllowEntry(ctx, e); err != nil {
+			return res, errors.Wrapf(err, "failed to add allowlist entry %v", e.Source)
+		}
+	}
+
+	b := blocker.New(store, policies.Policy, blocker.NoopFirewall{}, c, logging.Discard())
+	b.UpdateServicePolicies(policies.Services)
+
+	var previous time.Time
+	var offset time.Duration
+	for _, e := range sorted {
+		if t := e.Timestamp.Time(); t.Equal(previous) {
+			offset++
+		} else {
+			previous, offset = t, 0
+		}
+		e.Timestamp = unix_time.Time(previous.Add(offset))
+
+		c.Set(e.Timestamp.Time())
+		if err := b.AddEntry(ctx, e); err != nil {
+			return res, errors.Wrapf(err, "failed to replay entry of %v", e.Source)
+		}
+		res.Entries++
+	}
+
+	if err := b.Drain(ctx); err != nil {
+		return res, err
+	}
+
+	res.Blocks = store.blocks
+	return res, nil
+}
+
+// Sources summarizes the blocks of every blocked source, ordered by source
+func (r Result) Sources() []SourceSummary {
+	summaries := make(map[string]*SourceSummary)
+	for _, e := range r.Blocks {
+		s, ok := summaries[e.Source]
+		if !ok {
+			s = &SourceSummary{Source: e.Source, First: e.Timestamp}
+			summaries[e.Source] = s
+		}
+
+		s.Blocks++
+		s.Duration += e.Duration
+		s.Permanent = s.Permanent || e.Permanent
+	}
+
+	res := make([]SourceSummary, 0, len(summaries))
+	for _, s := range summaries {
+		res = append(res, *s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Source < res[j].Source })
+
+	return res
+}
+
+// Duration is the sum of the durations of all blocks
+func (r Result) Duration() time.Duration {
+	var d time.Duration
+	for _, e := range r.Blocks {
+		d += e.Duration
+	}
+
+	return d
+}
+
+// Compare lists the sources that are blocked differently by the candidate than by the current policy
+func Compare(current, candidate Result) Diff {
+	currentSources := make(map[string]SourceSummary)
+	for _, s := range current.Sources() {
+		currentSources[s.Source] = s
+	}
+
+	var d Diff
+	for _, s := range candidate.Sources() {
+		c, ok := currentSources[s.Source]
+		delete(currentSources, s.Source)
+
+		switch {
+		case !ok:
+			d.Added = append(d.Added, s)
+		case c.Blocks != s.Blocks || c.Duration != s.Duration || c.Permanent != s.Permanent:
+			d.Changed = append(d.Changed, SourceChange{Source: s.Source, Current: c, Candidate: s})
+		}
+	}
+
+	for _, s := range current.Sources() {
+		if _, ok := currentSources[s.Source]; ok {
+			d.Removed = append(d.Removed, s)
+		}
+	}
+
+	return d
+}
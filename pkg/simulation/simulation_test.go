@@ -0,0 +1,128 @@
+package simulation
+
+import (
+	"context"
+	"github.com/timanema/fail2ban-service/pkg/blocker"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1600000000, 0)
+
+var (
+	lenient = Policies{Policy: blocker.Policy{Attempts: 5, Period: time.Minute, BlockTime: 10 * time.Minute}}
+	strict  = Policies{Policy: blocker.Policy{Attempts: 3, Period: time.Minute, BlockTime: time.Hour}}
+)
+
+// attempts returns n entries of the source, the given interval apart
+func attempts(source string, from time.Time, n int, interval time.Duration) []storage.AuthenticationEntry {
+	entries := make([]storage.AuthenticationEntry, n)
+	for i := range entries {
+		entries[i] = storage.AuthenticationEntry{
+			Source:    source,
+			Service:   "ssh",
+			Timestamp: unix_time.Time(from.Add(time.Duration(i) * interval)),
+		}
+	}
+
+	return entries
+}
+
+func run(t *testing.T, entries []storage.AuthenticationEntry, policies Policies, allowlist ...storage.AllowEntry) Result {
+	t.Helper()
+
+	res, err := Run(context.Background(), entries, policies, allowlist)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return res
+}
+
+func TestRun(t *testing.T) {
+	var entries []storage.AuthenticationEntry
+	// An attacker trying every second for ten minutes, and a user mistyping their password three times
+	entries = append(entries, attempts("10.0.0.1", start, 600, time.Second)...)
+	entries = append(entries, attempts("10.0.0.2", start.Add(time.Minute), 3, 10*time.Second)...)
+	// Entries do not have to be ordered, and invalid entries are skipped
+	entries[0], entries[len(entries)-1] = entries[len(entries)-1], entries[0]
+	entries = append(entries, storage.AuthenticationEntry{Source: "invalid", Service: "ssh", Timestamp: unix_time.Time(start)})
+
+	res := run(t, entries, lenient)
+	if res.Entries != 603 || res.Invalid != 1 {
+		t.Fatalf("expected 603 replayed and 1 invalid entry, got %v and %v", res.Entries, res.Invalid)
+	}
+
+	// Only the attacker reaches the attempts of the policy
+	sources := res.Sources()
+	if len(sources) != 1 || sources[0].Source != "10.0.0.1" || sources[0].Blocks != 1 {
+		t.Fatalf("expected a single block of the attacker, got %+v", sources)
+	}
+	if first := res.Blocks[0]; !first.Timestamp.Time().Equal(start.Add(4*time.Second)) || first.Duration != 10*time.Minute {
+		t.Fatalf("expected the attacker to be blocked at the fifth attempt, got %+v", first)
+	}
+
+	// Attempts while blocked are ignored, the attacker is blocked again after 5 attempts once a block expired
+	res = run(t, attempts("10.0.0.1", start, 3600, time.Second), lenient)
+	if n := len(res.Blocks); n != 6 {
+		t.Fatalf("expected the attacker to be blocked again after every block expired, got %v blocks", n)
+	}
+	if d := res.Duration(); d != time.Hour {
+		t.Fatalf("expected the blocks to take an hour in total, got %v", d)
+	}
+}
+
+func TestRunSameTimestamp(t *testing.T) {
+	// Log lines have second precision, so attempts within the same second have the same timestamp
+	res := run(t, attempts("10.0.0.1", start, 3, 0), strict)
+	if len(res.Blocks) != 1 {
+		t.Fatalf("expected attempts with the same timestamp to be counted separately, got %v blocks", len(res.Blocks))
+	}
+}
+
+func TestRunServicePolicy(t *testing.T) {
+	policies := Policies{
+		Policy:   lenient.Policy,
+		Services: map[string]blocker.Policy{"ssh": strict.Policy},
+	}
+
+	res := run(t, attempts("10.0.0.1", start, 3, time.Second), policies)
+	if len(res.Blocks) != 1 || res.Blocks[0].Duration != time.Hour {
+		t.Fatalf("expected a block of the service policy, got %+v", res.Blocks)
+	}
+}
+
+func TestRunAllowlist(t *testing.T) {
+	res := run(t, attempts("10.0.0.1", start, 10, time.Second), strict, storage.AllowEntry{Source: "10.0.0.0/24"})
+	if len(res.Blocks) != 0 {
+		t.Fatalf("expected sources on the allowlist to not be blocked, got %+v", res.Blocks)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	var entries []storage.AuthenticationEntry
+	entries = append(entries, attempts("10.0.0.1", start, 10, time.Second)...)
+	entries = append(entries, attempts("10.0.0.2", start, 3, 10*time.Second)...)
+	entries = append(entries, attempts("10.0.0.3", start, 3, 2*time.Minute)...)
+
+	current := run(t, entries, lenient)
+	candidate := run(t, entries, strict)
+	diff := Compare(current, candidate)
+
+	if len(diff.Added) != 1 || diff.Added[0].Source != "10.0.0.2" {
+		t.Fatalf("expected the user to only be blocked by the candidate, got %+v", diff.Added)
+	}
+	if len(diff.Removed) != 0 {
+		t.Fatalf("expected no sources to only be blocked by the current policy, got %+v", diff.Removed)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Source != "10.0.0.1" ||
+		diff.Changed[0].Current.Duration != 10*time.Minute || diff.Changed[0].Candidate.Duration != time.Hour {
+		t.Fatalf("expected the block time of the attacker to change, got %+v", diff.Changed)
+	}
+
+	// Comparing the other way around swaps added and removed sources
+	if diff := Compare(candidate, current); len(diff.Removed) != 1 || len(diff.Added) != 0 {
+		t.Fatalf("expected the user to be removed, got %+v", diff)
+	}
+}
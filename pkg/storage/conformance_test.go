@@ -0,0 +1,100 @@
+package storage_test
+
+import (
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/storage/storagetest"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewMemoryStore(clock.Real, logging.Discard())
+	})
+}
+
+func TestInstrumentedConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewInstrumentedStore(storage.NewMemoryStore(clock.Real, logging.Discard()))
+	})
+}
+
+func TestTracedConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewTracedStore(storage.NewMemoryStore(clock.Real, logging.Discard()))
+	})
+}
+
+func openPersistent(t *testing.T, config storage.PersistentConfig) storage.Storage {
+	t.Helper()
+
+	store, err := storage.NewPersistentStore(config, clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return store
+}
+
+func TestPersistentConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return openPersistent(t, storage.PersistentConfig{Path: filepath.Join(t.TempDir(), "data.gob")})
+	})
+
+	t.Run("Persistence", func(t *testing.T) {
+		config := storage.PersistentConfig{Path: filepath.Join(t.TempDir(), "data.gob")}
+		storagetest.RunPersistence(t, func(t *testing.T) storage.Storage {
+			return openPersistent(t, config)
+		})
+	})
+}
+
+// singleRaftConfig is the configuration of a cluster consisting of a single node, which elects itself
+func singleRaftConfig(t *testing.T) storage.RaftConfig {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	return storage.RaftConfig{
+		NodeId:       "a",
+		Peers:        []string{"a=" + address + "=http://127.0.0.1:1"},
+		DataDir:      t.TempDir(),
+		Secret:       "secret",
+		ApplyTimeout: 10 * time.Second,
+	}
+}
+
+func openRaft(t *testing.T, config storage.RaftConfig) storage.Storage {
+	t.Helper()
+
+	store, err := storage.NewRaftStore(config, clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return store
+}
+
+func TestRaftConformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("raft stores wait for a leader election")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return openRaft(t, singleRaftConfig(t))
+	})
+
+	t.Run("Persistence", func(t *testing.T) {
+		config := singleRaftConfig(t)
+		storagetest.RunPersistence(t, func(t *testing.T) storage.Storage {
+			return openRaft(t, config)
+		})
+	})
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"github.com/timanema/fail2ban-service/pkg/metrics"
+	"time"
+)
+
+// InstrumentedStorage records the latency of every operation of the wrapped storage
+type InstrumentedStorage struct {
+	store Storage
+}
+
+func NewInstrumentedStore(store Storage) Storage {
+	return &InstrumentedStorage{store: store}
+}
+
+func observe(operation string, start time.Time) {
+	metrics.StorageOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func (i *InstrumentedStorage) AddAuthenticationEntry(ctx context.Context, entry AuthenticationEntry) error {
+	defer observe("add_authentication_entry", time.Now())
+	return i.store.AddAuthenticationEntry(ctx, entry)
+}
+
+func (i *InstrumentedStorage) FindAuthenticationEntries(ctx context.Context, ip string) (map[AuthenticationEntry]struct{}, error) {
+	defer observe("find_authentication_entries", time.Now())
+	return i.store.FindAuthenticationEntries(ctx, ip)
+}
+
+func (i *InstrumentedStorage) FindSources(ctx context.Context) (map[string]int, error) {
+	defer observe("find_sources", time.Now())
+	return i.store.FindSources(ctx)
+}
+
+func (i *InstrumentedStorage) ListAuthenticationEntries(ctx context.Context, query EntryQuery) (EntryPage, error) {
+	defer observe("list_authentication_entries", time.Now())
+	return i.store.ListAuthenticationEntries(ctx, query)
+}
+
+func (i *InstrumentedStorage) ListSources(ctx context.Context, query SourceQuery) (SourcePage, error) {
+	defer observe("list_sources", time.Now())
+	return i.store.ListSources(ctx, query)
+}
+
+func (i *InstrumentedStorage) AddBlockEntry(ctx context.Context, entry BlockEntry) error {
+	defer observe("add_block_entry", time.Now())
+	return i.store.AddBlockEntry(ctx, entry)
+}
+
+func (i *InstrumentedStorage) RemoveBlockEntry(ctx context.Context, ip string) error {
+	defer observe("remove_block_entry", time.Now())
+	return i.store.RemoveBlockEntry(ctx, ip)
+}
+
+func (i *InstrumentedStorage) FindBlockEntry(ctx context.Context, ip string) (BlockEntry, error) {
+	defer observe("find_block_entry", time.Now())
+	return i.store.FindBlockEntry(ctx, ip)
+}
+
+func (i *InstrumentedStorage) AllBlockEntries(ctx context.Context, onlyActive bool) ([]BlockEntry, error) {
+	defer observe("all_block_entries", time.Now())
+	return i.store.AllBlockEntries(ctx, onlyActive)
+}
+
+func (i *InstrumentedStorage) ListBlockEntries(ctx context.Context, query BlockQuery) (BlockPage, error) {
+	defer observe("list_block_entries", time.Now())
+	return i.store.ListBlockEntries(ctx, query)
+}
+
+func (i *InstrumentedStorage) CleanBlockEntries(ctx context.Context) error {
+	defer observe("clean_block_entries", time.Now())
+	return i.store.CleanBlockEntries(ctx)
+}
+
+func (i *InstrumentedStorage) AddExternalModule(ctx context.Context, module ExternalModule) error {
+	defer observe("add_external_module", time.Now())
+	return i.store.AddExternalModule(ctx, module)
+}
+
+func (i *InstrumentedStorage) RemoveExternalModule(ctx context.Context, id uint32) error {
+	defer observe("remove_external_module", time.Now())
+	return i.store.RemoveExternalModule(ctx, id)
+}
+
+func (i *InstrumentedStorage) GetExternalModules(ctx context.Context) ([]ExternalModule, error) {
+	defer observe("get_external_modules", time.Now())
+	return i.store.GetExternalModules(ctx)
+}
+
+func (i *InstrumentedStorage) GetExternalModuleByAddress(ctx context.Context, address string) (ExternalModule, error) {
+	defer observe("get_external_module_by_address", time.Now())
+	return i.store.GetExternalModuleByAddress(ctx, address)
+}
+
+func (i *InstrumentedStorage) AddAllowEntry(ctx context.Context, entry AllowEntry) error {
+	defer observe("add_allow_entry", time.Now())
+	return i.store.AddAllowEntry(ctx, entry)
+}
+
+func (i *InstrumentedStorage) RemoveAllowEntry(ctx context.Context, source string) error {
+	defer observe("remove_allow_entry", time.Now())
+	return i.store.RemoveAllowEntry(ctx, source)
+}
+
+func (i *InstrumentedStorage) GetAllowEntries(ctx context.Context) ([]AllowEntry, error) {
+	defer observe("get_allow_entries", time.Now())
+	return i.store.GetAllowEntries(ctx)
+}
+
+func (i *InstrumentedStorage) AddApiKey(ctx context.Context, key ApiKey) error {
+	defer observe("add_api_key", time.Now())
+	return i.store.AddApiKey(ctx, key)
+}
+
+func (i *InstrumentedStorage) RemoveApiKey(ctx context.Context, name string) error {
+	defer observe("remove_api_key", time.Now())
+	return i.store.RemoveApiKey(ctx, name)
+}
+
+func (i *InstrumentedStorage) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	defer observe("get_api_keys", time.Now())
+	return i.store.GetApiKeys(ctx)
+}
+
+func (i *InstrumentedStorage) FindApiKeyByHash(ctx context.Context, hash string) (ApiKey, error) {
+	defer observe("find_api_key_by_hash", time.Now())
+	return i.store.FindApiKeyByHash(ctx, hash)
+}
+
+func (i *InstrumentedStorage) AddAuditEntry(ctx context.Context, entry AuditEntry) error {
+	defer observe("add_audit_entry", time.Now())
+	return i.store.AddAuditEntry(ctx, entry)
+}
+
+func (i *InstrumentedStorage) FindAuditEntries(ctx context.Context, query AuditQuery) ([]AuditEntry, error) {
+	defer observe("find_audit_entries", time.Now())
+	return i.store.FindAuditEntries(ctx, query)
+}
+
+func (i *InstrumentedStorage) Ping(ctx context.Context) error {
+	defer observe("ping", time.Now())
+	return Ping(ctx, i.store)
+}
+
+func (i *InstrumentedStorage) Close() error {
+	defer observe("close", time.Now())
+	return i.store.Close()
+}
@@ -1,29 +1,42 @@
 package storage
 
 import (
-	"log"
+	"context"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"log/slog"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type MemoryStorage struct {
-	lock sync.RWMutex
+	lock   sync.RWMutex
+	clock  clock.Clock
+	logger *slog.Logger
 
 	authEntries     map[string]map[AuthenticationEntry]struct{}
 	blockEntries    map[string]BlockEntry
 	externalModules map[uint32]ExternalModule
+	allowEntries    map[string]AllowEntry
+	apiKeys         map[string]ApiKey
+	auditEntries    []AuditEntry
 }
 
-func NewMemoryStore() Storage {
+// NewMemoryStore creates an empty storage, the clock determines which blocks are active
+func NewMemoryStore(clock clock.Clock, logger *slog.Logger) Storage {
 	return &MemoryStorage{
 		lock:            sync.RWMutex{},
+		clock:           clock,
+		logger:          logger,
 		authEntries:     make(map[string]map[AuthenticationEntry]struct{}),
 		blockEntries:    make(map[string]BlockEntry),
 		externalModules: make(map[uint32]ExternalModule),
+		allowEntries:    make(map[string]AllowEntry),
+		apiKeys:         make(map[string]ApiKey),
 	}
 }
 
-func (m *MemoryStorage) AddAuthenticationEntry(entry AuthenticationEntry) error {
+func (m *MemoryStorage) AddAuthenticationEntry(_ context.Context, entry AuthenticationEntry) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
@@ -35,7 +48,7 @@ func (m *MemoryStorage) AddAuthenticationEntry(entry AuthenticationEntry) error
 	return nil
 }
 
-func (m *MemoryStorage) FindAuthenticationEntries(ip string) (map[AuthenticationEntry]struct{}, error) {
+func (m *MemoryStorage) FindAuthenticationEntries(_ context.Context, ip string) (map[AuthenticationEntry]struct{}, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
@@ -52,7 +65,7 @@ func (m *MemoryStorage) FindAuthenticationEntries(ip string) (map[Authentication
 	return nil, NotFoundErr
 }
 
-func (m *MemoryStorage) FindSources() (map[string]int, error) {
+func (m *MemoryStorage) FindSources(_ context.Context) (map[string]int, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
@@ -64,7 +77,75 @@ func (m *MemoryStorage) FindSources() (map[string]int, error) {
 	return res, nil
 }
 
-func (m *MemoryStorage) AddBlockEntry(entry BlockEntry) error {
+func (m *MemoryStorage) ListAuthenticationEntries(_ context.Context, query EntryQuery) (EntryPage, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var entries []AuthenticationEntry
+	add := func(e AuthenticationEntry) {
+		if query.Matches(e) {
+			entries = append(entries, e)
+		}
+	}
+
+	if query.Source != "" {
+		for e := range m.authEntries[query.Source] {
+			add(e)
+		}
+	} else {
+		for _, sourceEntries := range m.authEntries {
+			for e := range sourceEntries {
+				add(e)
+			}
+		}
+	}
+
+	keys := make([]cursor, len(entries))
+	for i, e := range entries {
+		keys[i] = cursor{Time: e.Timestamp.Time().Unix(), Source: e.Source, Service: e.Service}
+	}
+
+	from, to, next, err := paginate(keys, func(i, j int) { entries[i], entries[j] = entries[j], entries[i] }, query.Pagination)
+	if err != nil {
+		return EntryPage{}, err
+	}
+
+	return EntryPage{Entries: append([]AuthenticationEntry{}, entries[from:to]...), NextCursor: next}, nil
+}
+
+func (m *MemoryStorage) ListSources(_ context.Context, query SourceQuery) (SourcePage, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	entryQuery := query.entryQuery()
+	var sources []SourceCount
+	for source, entries := range m.authEntries {
+		count := 0
+		for e := range entries {
+			if entryQuery.Matches(e) {
+				count++
+			}
+		}
+
+		if count > 0 {
+			sources = append(sources, SourceCount{Source: source, Attempts: count})
+		}
+	}
+
+	keys := make([]cursor, len(sources))
+	for i, s := range sources {
+		keys[i] = cursor{Count: s.Attempts, Source: s.Source}
+	}
+
+	from, to, next, err := paginate(keys, func(i, j int) { sources[i], sources[j] = sources[j], sources[i] }, query.Pagination)
+	if err != nil {
+		return SourcePage{}, err
+	}
+
+	return SourcePage{Sources: append([]SourceCount{}, sources[from:to]...), NextCursor: next}, nil
+}
+
+func (m *MemoryStorage) AddBlockEntry(_ context.Context, entry BlockEntry) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
@@ -72,7 +153,7 @@ func (m *MemoryStorage) AddBlockEntry(entry BlockEntry) error {
 	return nil
 }
 
-func (m *MemoryStorage) RemoveBlockEntry(ip string) error {
+func (m *MemoryStorage) RemoveBlockEntry(_ context.Context, ip string) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
@@ -80,7 +161,7 @@ func (m *MemoryStorage) RemoveBlockEntry(ip string) error {
 	return nil
 }
 
-func (m *MemoryStorage) FindBlockEntry(ip string) (BlockEntry, error) {
+func (m *MemoryStorage) FindBlockEntry(_ context.Context, ip string) (BlockEntry, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
@@ -91,13 +172,14 @@ func (m *MemoryStorage) FindBlockEntry(ip string) (BlockEntry, error) {
 	return BlockEntry{}, NotFoundErr
 }
 
-func (m *MemoryStorage) AllBlockEntries(onlyActive bool) ([]BlockEntry, error) {
+func (m *MemoryStorage) AllBlockEntries(_ context.Context, onlyActive bool) ([]BlockEntry, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
+	now := m.clock.Now()
 	entries := make([]BlockEntry, 0, len(m.blockEntries))
 	for _, e := range m.blockEntries {
-		if !onlyActive || (onlyActive && e.IsActive()) {
+		if !onlyActive || (onlyActive && e.ActiveAt(now)) {
 			entries = append(entries, e)
 		}
 	}
@@ -105,41 +187,72 @@ func (m *MemoryStorage) AllBlockEntries(onlyActive bool) ([]BlockEntry, error) {
 	return entries, nil
 }
 
-func (m *MemoryStorage) CleanBlockEntries() error {
+func (m *MemoryStorage) ListBlockEntries(_ context.Context, query BlockQuery) (BlockPage, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	now := m.clock.Now()
+	var entries []BlockEntry
+	for _, e := range m.blockEntries {
+		if query.Matches(e, now) {
+			entries = append(entries, e)
+		}
+	}
+
+	keys := make([]cursor, len(entries))
+	for i, e := range entries {
+		keys[i] = cursor{Time: e.Timestamp.Time().Unix(), Source: e.Source}
+	}
+
+	from, to, next, err := paginate(keys, func(i, j int) { entries[i], entries[j] = entries[j], entries[i] }, query.Pagination)
+	if err != nil {
+		return BlockPage{}, err
+	}
+
+	return BlockPage{Entries: append([]BlockEntry{}, entries[from:to]...), NextCursor: next}, nil
+}
+
+func (m *MemoryStorage) CleanBlockEntries(_ context.Context) error {
+	m.cleanBlockEntries(m.clock.Now())
+	return nil
+}
+
+// cleanBlockEntries removes the block entries that are no longer active at the given time
+func (m *MemoryStorage) cleanBlockEntries(t time.Time) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	for ip, e := range m.blockEntries {
-		if e.Timestamp.Time().Add(e.Duration).Before(time.Now()) {
+		if !e.ActiveAt(t) {
 			delete(m.blockEntries, ip)
 		}
 	}
-
-	return nil
 }
 
-func (m *MemoryStorage) AddExternalModule(module ExternalModule) error {
+func (m *MemoryStorage) AddExternalModule(_ context.Context, module ExternalModule) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	m.externalModules[module.Id] = module
-	log.Printf("added external module: %+v\n", module)
+	m.logger.Info("added external module", "module_id", strconv.FormatUint(uint64(module.Id), 10),
+		"method", module.Method, "address", module.Address)
 	return nil
 }
 
-func (m *MemoryStorage) RemoveExternalModule(id uint32) error {
+func (m *MemoryStorage) RemoveExternalModule(_ context.Context, id uint32) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	module, ok := m.externalModules[id]
 	if ok {
-		log.Printf("removed external module: %+v\n", module)
+		m.logger.Info("removed external module", "module_id", strconv.FormatUint(uint64(module.Id), 10),
+			"method", module.Method, "address", module.Address)
 	}
 	delete(m.externalModules, id)
 	return nil
 }
 
-func (m *MemoryStorage) GetExternalModules() ([]ExternalModule, error) {
+func (m *MemoryStorage) GetExternalModules(_ context.Context) ([]ExternalModule, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
@@ -151,7 +264,7 @@ func (m *MemoryStorage) GetExternalModules() ([]ExternalModule, error) {
 	return res, nil
 }
 
-func (m *MemoryStorage) GetExternalModuleByAddress(address string) (ExternalModule, error) {
+func (m *MemoryStorage) GetExternalModuleByAddress(_ context.Context, address string) (ExternalModule, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
@@ -164,6 +277,110 @@ func (m *MemoryStorage) GetExternalModuleByAddress(address string) (ExternalModu
 	return ExternalModule{}, NotFoundErr
 }
 
+func (m *MemoryStorage) AddAllowEntry(_ context.Context, entry AllowEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.allowEntries[entry.Source] = entry
+	m.logger.Info("added allowlist entry", "source", entry.Source, "description", entry.Description)
+	return nil
+}
+
+func (m *MemoryStorage) RemoveAllowEntry(_ context.Context, source string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.allowEntries[source]; !ok {
+		return NotFoundErr
+	}
+
+	delete(m.allowEntries, source)
+	m.logger.Info("removed allowlist entry", "source", source)
+	return nil
+}
+
+func (m *MemoryStorage) GetAllowEntries(_ context.Context) ([]AllowEntry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	res := make([]AllowEntry, 0, len(m.allowEntries))
+	for _, entry := range m.allowEntries {
+		res = append(res, entry)
+	}
+
+	return res, nil
+}
+
+func (m *MemoryStorage) AddApiKey(_ context.Context, key ApiKey) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.apiKeys[key.Name] = key
+	m.logger.Info("added API key", "name", key.Name, "scopes", key.Scopes)
+	return nil
+}
+
+func (m *MemoryStorage) RemoveApiKey(_ context.Context, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.apiKeys[name]; !ok {
+		return NotFoundErr
+	}
+
+	delete(m.apiKeys, name)
+	m.logger.Info("removed API key", "name", name)
+	return nil
+}
+
+func (m *MemoryStorage) GetApiKeys(_ context.Context) ([]ApiKey, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	res := make([]ApiKey, 0, len(m.apiKeys))
+	for _, key := range m.apiKeys {
+		res = append(res, key)
+	}
+
+	return res, nil
+}
+
+func (m *MemoryStorage) FindApiKeyByHash(_ context.Context, hash string) (ApiKey, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, key := range m.apiKeys {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+
+	return ApiKey{}, NotFoundErr
+}
+
+func (m *MemoryStorage) AddAuditEntry(_ context.Context, entry AuditEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry.Id = uint64(len(m.auditEntries)) + 1
+	m.auditEntries = append(m.auditEntries, entry)
+	return nil
+}
+
+func (m *MemoryStorage) FindAuditEntries(_ context.Context, query AuditQuery) ([]AuditEntry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	res := make([]AuditEntry, 0)
+	for _, e := range m.auditEntries {
+		if query.Matches(e) {
+			res = append(res, e)
+		}
+	}
+
+	return res, nil
+}
+
 func (m *MemoryStorage) Close() error {
 	return nil
 }
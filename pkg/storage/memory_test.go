@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"github.com/timanema/fail2ban-service/pkg/clock/fakeclock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"testing"
+	"time"
+)
+
+func TestMemoryBlockExpiry(t *testing.T) {
+	ctx := context.Background()
+	start := time.Unix(1600000000, 0)
+	c := fakeclock.New(start)
+	store := NewMemoryStore(c, logging.Discard())
+
+	blocks := []BlockEntry{
+		{Source: "10.0.0.1", Timestamp: unix_time.Time(start), Duration: time.Minute},
+		{Source: "10.0.0.2", Timestamp: unix_time.Time(start), Duration: time.Hour},
+		{Source: "10.0.0.3", Timestamp: unix_time.Time(start), Permanent: true},
+	}
+	for _, e := range blocks {
+		if err := store.AddBlockEntry(ctx, e); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	active := func() int {
+		t.Helper()
+
+		entries, err := store.AllBlockEntries(ctx, true)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		page, err := store.ListBlockEntries(ctx, BlockQuery{State: BlockStateActive})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(page.Entries) != len(entries) {
+			t.Fatalf("expected listing and getting active blocks to agree, got %v and %v", page.Entries, entries)
+		}
+		return len(entries)
+	}
+
+	if n := active(); n != 3 {
+		t.Fatalf("expected 3 active blocks, got %v", n)
+	}
+
+	c.Advance(time.Minute)
+	if n := active(); n != 2 {
+		t.Fatalf("expected 2 active blocks after a minute, got %v", n)
+	}
+
+	// Cleaning only removes the blocks that expired at the time of the clock
+	if err := store.CleanBlockEntries(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if all, _ := store.AllBlockEntries(ctx, false); len(all) != 2 {
+		t.Fatalf("expected the expired block to be removed, got %v", all)
+	}
+
+	c.Advance(time.Hour)
+	if err := store.CleanBlockEntries(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if all, _ := store.AllBlockEntries(ctx, false); len(all) != 1 || !all[0].Permanent {
+		t.Fatalf("expected only the permanent block to remain, got %v", all)
+	}
+}
@@ -1,76 +1,208 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
 	"github.com/pkg/errors"
-	"log"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sync"
 )
 
 type persistentData struct {
 	AuthEntries     map[string]map[AuthenticationEntry]struct{}
 	BlockEntries    map[string]BlockEntry
 	ExternalModules map[uint32]ExternalModule
+	AllowEntries    map[string]AllowEntry
+	ApiKeys         map[string]ApiKey
+	AuditEntries    []AuditEntry
+}
+
+// PersistentConfig configures the persistent storage type, the data file is only readable by its owner
+type PersistentConfig struct {
+	// Path of the data file, its directory is created when it does not exist
+	Path string `default:"data.gob"`
+	// Key enables encryption of the data file using AES-256-GCM, it is 32 bytes encoded using hex or base64
+	Key string
+	// KeyFile contains the key, and takes precedence over Key
+	KeyFile string `split_words:"true"`
+	// PreviousKey and PreviousKeyFile are only used to read a data file written before the key was rotated, which is
+	// encrypted using the current key on the next save
+	PreviousKey     string `split_words:"true"`
+	PreviousKeyFile string `split_words:"true"`
 }
 
 type PersistentStorage struct {
 	memory *MemoryStorage
+	clock  clock.Clock
+	logger *slog.Logger
+
+	path string
+	// key is nil when encryption is disabled, previousKey is only used when reading
+	key         []byte
+	previousKey []byte
+
+	// saveLock serializes saves, pending tracks asynchronous saves that have not finished yet
+	saveLock sync.Mutex
+	pending  sync.WaitGroup
 }
 
-func NewPersistentStore() Storage {
-	p := &PersistentStorage{}
+// NewPersistentStore reads the data file, an error is returned when it cannot be read or decrypted
+func NewPersistentStore(config PersistentConfig, clock clock.Clock, logger *slog.Logger) (*PersistentStorage, error) {
+	if config.Path == "" {
+		config.Path = "data.gob"
+	}
+
+	key, err := loadKey(config.Key, config.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid data file key")
+	}
+	previousKey, err := loadKey(config.PreviousKey, config.PreviousKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid previous data file key")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create data directory")
+	}
 
+	p := &PersistentStorage{
+		clock:       clock,
+		logger:      logger,
+		path:        config.Path,
+		key:         key,
+		previousKey: previousKey,
+	}
 	if err := p.Read(); err != nil {
-		log.Fatalf("failed to read from persistent storage: %v\n", err)
+		return nil, errors.Wrapf(err, "failed to read data file %v", config.Path)
 	}
 
-	return p
+	return p, nil
 }
 
+// Read replaces all data with the data of the data file. Data files that are not encrypted using the current key are
+// encrypted using it on the next save
 func (p *PersistentStorage) Read() error {
-	m := NewMemoryStore().(*MemoryStorage)
-	p.memory = m
+	p.memory = NewMemoryStore(p.clock, p.logger).(*MemoryStorage)
 
-	if _, err := os.Stat("data.gob"); errors.Is(err, os.ErrNotExist) {
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
-
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	d := &persistentData{}
-
-	f, err := os.Open("data.gob")
 	if err != nil {
 		return errors.Wrap(err, "failed to open data file")
 	}
 
-	dec := gob.NewDecoder(f)
-	if err := dec.Decode(d); err != nil {
-		return errors.Wrap(err, "failed to decode data")
+	switch {
+	case isEncrypted(data) && p.key == nil && p.previousKey == nil:
+		return DataFileEncryptedErr
+	case isEncrypted(data):
+		plain, err := p.decrypt(data)
+		if err != nil {
+			return err
+		}
+		data = plain
+	case p.key != nil:
+		p.logger.Info("data file is not encrypted yet, it is encrypted on the next save", "path", p.path)
 	}
 
-	m.authEntries = d.AuthEntries
-	m.blockEntries = d.BlockEntries
-	m.externalModules = d.ExternalModules
-	return nil
+	return p.memory.decode(bytes.NewReader(data))
+}
+
+// decrypt tries the current key first, and the previous key after that
+func (p *PersistentStorage) decrypt(data []byte) ([]byte, error) {
+	if p.key != nil {
+		if plain, err := decrypt(p.key, data); err != DecryptDataFileErr {
+			return plain, err
+		}
+	}
+
+	if p.previousKey == nil {
+		return nil, DecryptDataFileErr
+	}
+
+	plain, err := decrypt(p.previousKey, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.key == nil {
+		p.logger.Warn("data file is encrypted using the previous key, it is no longer encrypted after the next save",
+			"path", p.path)
+	} else {
+		p.logger.Info("data file is encrypted using the previous key, it is encrypted using the current key on the "+
+			"next save", "path", p.path)
+	}
+	return plain, nil
 }
 
+// Save writes all data to a temporary file first, which replaces the data file once it is fully written. This way
+// the data file is never left half written when the process is stopped
 func (p *PersistentStorage) Save() error {
-	f, err := os.Create("data.gob")
+	p.saveLock.Lock()
+	defer p.saveLock.Unlock()
+
+	var buf bytes.Buffer
+	if err := p.memory.encode(&buf); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+	if p.key != nil {
+		var err error
+		if data, err = encrypt(p.key, data); err != nil {
+			return errors.Wrap(err, "failed to encrypt data")
+		}
+	}
+
+	tmp := p.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return errors.Wrap(err, "failed to create data file")
 	}
 
-	p.memory.lock.RLock()
-	defer p.memory.lock.RUnlock()
+	// A temporary file left behind by an older version might have looser permissions
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to set permissions of data file")
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write data file")
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to sync data file")
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close data file")
+	}
+
+	return errors.Wrap(os.Rename(tmp, p.path), "failed to replace data file")
+}
+
+// encode writes all data of the memory storage to w
+func (m *MemoryStorage) encode(w io.Writer) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 
 	d := persistentData{
-		AuthEntries:     p.memory.authEntries,
-		BlockEntries:    p.memory.blockEntries,
-		ExternalModules: p.memory.externalModules,
+		AuthEntries:     m.authEntries,
+		BlockEntries:    m.blockEntries,
+		ExternalModules: m.externalModules,
+		AllowEntries:    m.allowEntries,
+		ApiKeys:         m.apiKeys,
+		AuditEntries:    m.auditEntries,
 	}
 
-	enc := gob.NewEncoder(f)
+	enc := gob.NewEncoder(w)
 	if err := enc.Encode(d); err != nil {
 		return errors.Wrap(err, "failed to encode data")
 	}
@@ -78,68 +210,163 @@ func (p *PersistentStorage) Save() error {
 	return nil
 }
 
+// decode replaces all data of the memory storage with the data read from r
+func (m *MemoryStorage) decode(r io.Reader) error {
+	d := &persistentData{}
+
+	dec := gob.NewDecoder(r)
+	if err := dec.Decode(d); err != nil {
+		return errors.Wrap(err, "failed to decode data")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.authEntries = make(map[string]map[AuthenticationEntry]struct{})
+	m.blockEntries = make(map[string]BlockEntry)
+	m.externalModules = make(map[uint32]ExternalModule)
+	if d.AuthEntries != nil {
+		m.authEntries = d.AuthEntries
+	}
+	if d.BlockEntries != nil {
+		m.blockEntries = d.BlockEntries
+	}
+	if d.ExternalModules != nil {
+		m.externalModules = d.ExternalModules
+	}
+
+	// Data files written by older versions do not contain allowlist entries, API keys or audit entries
+	m.allowEntries = make(map[string]AllowEntry)
+	m.apiKeys = make(map[string]ApiKey)
+	if d.AllowEntries != nil {
+		m.allowEntries = d.AllowEntries
+	}
+	if d.ApiKeys != nil {
+		m.apiKeys = d.ApiKeys
+	}
+	m.auditEntries = d.AuditEntries
+	return nil
+}
+
 func (p *PersistentStorage) AsyncSave() {
+	p.pending.Add(1)
 	go func() {
+		defer p.pending.Done()
 		if err := p.Save(); err != nil {
-			log.Printf("error occurred while saving data: %v\n", err)
+			p.logger.Error("error occurred while saving data", "error", err)
 		}
 	}()
 }
 
-func (p *PersistentStorage) AddAuthenticationEntry(entry AuthenticationEntry) error {
+func (p *PersistentStorage) AddAuthenticationEntry(ctx context.Context, entry AuthenticationEntry) error {
+	defer p.AsyncSave()
+	return p.memory.AddAuthenticationEntry(ctx, entry)
+}
+
+func (p *PersistentStorage) FindAuthenticationEntries(ctx context.Context, ip string) (map[AuthenticationEntry]struct{}, error) {
+	return p.memory.FindAuthenticationEntries(ctx, ip)
+}
+
+func (p *PersistentStorage) FindSources(ctx context.Context) (map[string]int, error) {
+	return p.memory.FindSources(ctx)
+}
+
+func (p *PersistentStorage) ListAuthenticationEntries(ctx context.Context, query EntryQuery) (EntryPage, error) {
+	return p.memory.ListAuthenticationEntries(ctx, query)
+}
+
+func (p *PersistentStorage) ListSources(ctx context.Context, query SourceQuery) (SourcePage, error) {
+	return p.memory.ListSources(ctx, query)
+}
+
+func (p *PersistentStorage) AddBlockEntry(ctx context.Context, entry BlockEntry) error {
 	defer p.AsyncSave()
-	return p.memory.AddAuthenticationEntry(entry)
+	return p.memory.AddBlockEntry(ctx, entry)
+}
+
+func (p *PersistentStorage) RemoveBlockEntry(ctx context.Context, ip string) error {
+	defer p.AsyncSave()
+	return p.memory.RemoveBlockEntry(ctx, ip)
+}
+
+func (p *PersistentStorage) FindBlockEntry(ctx context.Context, ip string) (BlockEntry, error) {
+	return p.memory.FindBlockEntry(ctx, ip)
+}
+
+func (p *PersistentStorage) AllBlockEntries(ctx context.Context, onlyActive bool) ([]BlockEntry, error) {
+	return p.memory.AllBlockEntries(ctx, onlyActive)
 }
 
-func (p *PersistentStorage) FindAuthenticationEntries(ip string) (map[AuthenticationEntry]struct{}, error) {
-	return p.memory.FindAuthenticationEntries(ip)
+func (p *PersistentStorage) ListBlockEntries(ctx context.Context, query BlockQuery) (BlockPage, error) {
+	return p.memory.ListBlockEntries(ctx, query)
 }
 
-func (p *PersistentStorage) FindSources() (map[string]int, error) {
-	return p.memory.FindSources()
+func (p *PersistentStorage) CleanBlockEntries(ctx context.Context) error {
+	defer p.AsyncSave()
+	return p.memory.CleanBlockEntries(ctx)
 }
 
-func (p *PersistentStorage) AddBlockEntry(entry BlockEntry) error {
+func (p *PersistentStorage) AddExternalModule(ctx context.Context, module ExternalModule) error {
 	defer p.AsyncSave()
-	return p.memory.AddBlockEntry(entry)
+	return p.memory.AddExternalModule(ctx, module)
 }
 
-func (p *PersistentStorage) RemoveBlockEntry(ip string) error {
+func (p *PersistentStorage) RemoveExternalModule(ctx context.Context, id uint32) error {
 	defer p.AsyncSave()
-	return p.memory.RemoveBlockEntry(ip)
+	return p.memory.RemoveExternalModule(ctx, id)
+}
+
+func (p *PersistentStorage) GetExternalModules(ctx context.Context) ([]ExternalModule, error) {
+	return p.memory.GetExternalModules(ctx)
 }
 
-func (p *PersistentStorage) FindBlockEntry(ip string) (BlockEntry, error) {
-	return p.memory.FindBlockEntry(ip)
+func (p *PersistentStorage) GetExternalModuleByAddress(ctx context.Context, address string) (ExternalModule, error) {
+	return p.memory.GetExternalModuleByAddress(ctx, address)
 }
 
-func (p *PersistentStorage) AllBlockEntries(onlyActive bool) ([]BlockEntry, error) {
-	return p.memory.AllBlockEntries(onlyActive)
+func (p *PersistentStorage) AddAllowEntry(ctx context.Context, entry AllowEntry) error {
+	defer p.AsyncSave()
+	return p.memory.AddAllowEntry(ctx, entry)
 }
 
-func (p *PersistentStorage) CleanBlockEntries() error {
+func (p *PersistentStorage) RemoveAllowEntry(ctx context.Context, source string) error {
 	defer p.AsyncSave()
-	return p.memory.CleanBlockEntries()
+	return p.memory.RemoveAllowEntry(ctx, source)
+}
+
+func (p *PersistentStorage) GetAllowEntries(ctx context.Context) ([]AllowEntry, error) {
+	return p.memory.GetAllowEntries(ctx)
 }
 
-func (p *PersistentStorage) AddExternalModule(module ExternalModule) error {
+func (p *PersistentStorage) AddApiKey(ctx context.Context, key ApiKey) error {
 	defer p.AsyncSave()
-	return p.memory.AddExternalModule(module)
+	return p.memory.AddApiKey(ctx, key)
 }
 
-func (p *PersistentStorage) RemoveExternalModule(id uint32) error {
+func (p *PersistentStorage) RemoveApiKey(ctx context.Context, name string) error {
 	defer p.AsyncSave()
-	return p.memory.RemoveExternalModule(id)
+	return p.memory.RemoveApiKey(ctx, name)
+}
+
+func (p *PersistentStorage) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	return p.memory.GetApiKeys(ctx)
 }
 
-func (p *PersistentStorage) GetExternalModules() ([]ExternalModule, error) {
-	return p.memory.GetExternalModules()
+func (p *PersistentStorage) FindApiKeyByHash(ctx context.Context, hash string) (ApiKey, error) {
+	return p.memory.FindApiKeyByHash(ctx, hash)
+}
+
+func (p *PersistentStorage) AddAuditEntry(ctx context.Context, entry AuditEntry) error {
+	defer p.AsyncSave()
+	return p.memory.AddAuditEntry(ctx, entry)
 }
 
-func (p *PersistentStorage) GetExternalModuleByAddress(address string) (ExternalModule, error) {
-	return p.memory.GetExternalModuleByAddress(address)
+func (p *PersistentStorage) FindAuditEntries(ctx context.Context, query AuditQuery) ([]AuditEntry, error) {
+	return p.memory.FindAuditEntries(ctx, query)
 }
 
+// Close waits for pending saves, and saves all data one final time
 func (p *PersistentStorage) Close() error {
+	p.pending.Wait()
 	return p.Save()
 }
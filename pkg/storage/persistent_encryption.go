@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// encryptedMagic starts every encrypted data file. Gob streams never start with a zero byte, so it cannot be confused
+// with an unencrypted data file
+var encryptedMagic = []byte("\x00fail2ban-aes-gcm-v1\n")
+
+// DataFileEncryptedErr is returned when the data file is encrypted, but no key is configured
+var DataFileEncryptedErr = errors.New("data file is encrypted, but no key is configured")
+
+// DecryptDataFileErr is returned when none of the configured keys can decrypt the data file
+var DecryptDataFileErr = errors.New("unable to decrypt data file, the key is wrong or the file is corrupted")
+
+// loadKey returns the AES-256 key given directly or in a file, the file takes precedence. Keys are 32 bytes encoded
+// using hex or base64, such as the output of openssl rand -base64 32. It returns nil when neither is given
+func loadKey(key, file string) ([]byte, error) {
+	if file != "" {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read key file")
+		}
+		key = string(buf)
+	}
+
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, nil
+	}
+
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		if decoded, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, errors.New("key is not hex or base64 encoded")
+		}
+	}
+	if len(decoded) != 32 {
+		return nil, errors.Errorf("key is %v bytes, expected 32", len(decoded))
+	}
+
+	return decoded, nil
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// encrypt seals the data using AES-GCM with a random nonce, the magic is used as additional data
+func encrypt(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	res := append(append([]byte{}, encryptedMagic...), nonce...)
+	return gcm.Seal(res, nonce, data, encryptedMagic), nil
+}
+
+// decrypt opens data written by encrypt, it returns DecryptDataFileErr when the key does not match
+func decrypt(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimPrefix(data, encryptedMagic)
+	if len(data) < gcm.NonceSize() {
+		return nil, DecryptDataFileErr
+	}
+
+	res, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], encryptedMagic)
+	if err != nil {
+		return nil, DecryptDataFileErr
+	}
+
+	return res, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	return gcm, errors.Wrap(err, "failed to create cipher")
+}
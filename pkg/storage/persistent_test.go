@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	testKey      = hex.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	otherTestKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+)
+
+var testModule = ExternalModule{Id: 1, Method: "POST", Address: "http://secret.example.com/block"}
+
+// writePersistent creates a data file containing a module and a block
+func writePersistent(t *testing.T, config PersistentConfig) {
+	t.Helper()
+	ctx := context.Background()
+
+	store, err := NewPersistentStore(config, clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.AddExternalModule(ctx, testModule); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	block := BlockEntry{Source: "10.0.0.1", Timestamp: unix_time.Time(time.Now()), Duration: time.Hour}
+	if err := store.AddBlockEntry(ctx, block); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// readPersistent opens the data file, and checks whether it contains the data of writePersistent
+func readPersistent(t *testing.T, config PersistentConfig) {
+	t.Helper()
+
+	store, err := NewPersistentStore(config, clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if module, err := store.GetExternalModuleByAddress(context.Background(), testModule.Address); err != nil || module != testModule {
+		t.Fatalf("expected the module to be read, got %v (%v)", module, err)
+	}
+	if _, err := store.FindBlockEntry(context.Background(), "10.0.0.1"); err != nil {
+		t.Fatalf("expected the block to be read, got %v", err)
+	}
+}
+
+func TestPersistentDataFile(t *testing.T) {
+	config := PersistentConfig{Path: filepath.Join(t.TempDir(), "state", "data.gob")}
+	writePersistent(t, config)
+
+	info, err := os.Stat(config.Path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("expected the data file to only be readable by its owner, got %v", perm)
+	}
+
+	readPersistent(t, config)
+}
+
+func TestPersistentEncryption(t *testing.T) {
+	config := PersistentConfig{Path: filepath.Join(t.TempDir(), "data.gob"), Key: testKey}
+	writePersistent(t, config)
+
+	data, err := os.ReadFile(config.Path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !isEncrypted(data) || bytes.Contains(data, []byte(testModule.Address)) {
+		t.Fatalf("expected the data file to be encrypted")
+	}
+
+	readPersistent(t, config)
+
+	// The key can be read from a file as well
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(testKey+"\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	readPersistent(t, PersistentConfig{Path: config.Path, KeyFile: keyFile})
+}
+
+func TestPersistentDecryptionFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.gob")
+	writePersistent(t, PersistentConfig{Path: path, Key: testKey})
+
+	_, err := NewPersistentStore(PersistentConfig{Path: path, Key: otherTestKey}, clock.Real, logging.Discard())
+	if errors.Cause(err) != DecryptDataFileErr {
+		t.Fatalf("expected %v, got %v", DecryptDataFileErr, err)
+	}
+
+	_, err = NewPersistentStore(PersistentConfig{Path: path}, clock.Real, logging.Discard())
+	if errors.Cause(err) != DataFileEncryptedErr {
+		t.Fatalf("expected %v, got %v", DataFileEncryptedErr, err)
+	}
+
+	if _, err := NewPersistentStore(PersistentConfig{Path: path, Key: "short"}, clock.Real, logging.Discard()); err == nil {
+		t.Fatalf("expected an error for an invalid key")
+	}
+}
+
+func TestPersistentKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.gob")
+	writePersistent(t, PersistentConfig{Path: path})
+
+	// Existing data files are encrypted on the next save
+	rotated := PersistentConfig{Path: path, Key: testKey}
+	readPersistent(t, rotated)
+	writePersistent(t, rotated)
+
+	// The previous key is only used to read the data file, which is encrypted using the new key on the next save
+	rotated = PersistentConfig{Path: path, Key: otherTestKey, PreviousKey: testKey}
+	readPersistent(t, rotated)
+	writePersistent(t, rotated)
+
+	readPersistent(t, PersistentConfig{Path: path, Key: otherTestKey})
+	if _, err := NewPersistentStore(PersistentConfig{Path: path, Key: testKey}, clock.Real, logging.Discard()); err == nil {
+		t.Fatalf("expected the old key to no longer work")
+	}
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net"
+	"sort"
+	"time"
+)
+
+var InvalidCursorErr = errors.New("invalid cursor")
+
+// Pagination selects a page of a list. Lists are ordered from new to old, or from most to least attempts for sources,
+// unless Ascending is set. Cursors are opaque, and are returned with the previous page
+type Pagination struct {
+	// Limit is the maximum amount of results, zero returns everything
+	Limit     int
+	Cursor    string
+	Ascending bool
+}
+
+// Block states that can be filtered on
+const (
+	BlockStateAny     = ""
+	BlockStateActive  = "active"
+	BlockStateExpired = "expired"
+)
+
+// BlockQuery filters block entries, zero values match everything
+type BlockQuery struct {
+	// Network only matches sources within the range
+	Network *net.IPNet
+	Service string
+	Tag     string
+	// From and To filter on the time the block started
+	From  time.Time
+	To    time.Time
+	State string
+	Pagination
+}
+
+// Matches reports whether the entry matches the query, the state of the block is determined at the given time
+func (q BlockQuery) Matches(e BlockEntry, now time.Time) bool {
+	return matchesNetwork(q.Network, e.Source) && matchesTime(q.From, q.To, e.Timestamp.Time()) &&
+		(q.Service == "" || q.Service == e.Service) &&
+		(q.Tag == "" || e.HasTag(q.Tag)) &&
+		(q.State == BlockStateAny || (q.State == BlockStateActive) == e.ActiveAt(now))
+}
+
+// EntryQuery filters authentication entries, zero values match everything
+type EntryQuery struct {
+	// Source only matches the entries of a single IP
+	Source  string
+	Network *net.IPNet
+	Service string
+	From    time.Time
+	To      time.Time
+	Pagination
+}
+
+func (q EntryQuery) Matches(e AuthenticationEntry) bool {
+	return matchesNetwork(q.Network, e.Source) && matchesTime(q.From, q.To, e.Timestamp.Time()) &&
+		(q.Source == "" || q.Source == e.Source) &&
+		(q.Service == "" || q.Service == e.Service)
+}
+
+// SourceQuery filters sources by their authentication entries, only the entries matching the query are counted
+type SourceQuery struct {
+	Network *net.IPNet
+	Service string
+	From    time.Time
+	To      time.Time
+	Pagination
+}
+
+func (q SourceQuery) entryQuery() EntryQuery {
+	return EntryQuery{Network: q.Network, Service: q.Service, From: q.From, To: q.To}
+}
+
+// SourceCount is the amount of authentication entries of a source
+type SourceCount struct {
+	Source   string `json:"source"`
+	Attempts int    `json:"attempts"`
+}
+
+type BlockPage struct {
+	Entries []BlockEntry
+	// NextCursor is empty on the last page
+	NextCursor string
+}
+
+type EntryPage struct {
+	Entries    []AuthenticationEntry
+	NextCursor string
+}
+
+type SourcePage struct {
+	Sources    []SourceCount
+	NextCursor string
+}
+
+func matchesNetwork(network *net.IPNet, source string) bool {
+	if network == nil {
+		return true
+	}
+
+	ip := net.ParseIP(source)
+	return ip != nil && network.Contains(ip)
+}
+
+func matchesTime(from, to, t time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || !t.After(to))
+}
+
+// cursor is the sort key of a list item, a page continues after the item with the key in its cursor
+type cursor struct {
+	Time    int64  `json:"t,omitempty"`
+	Count   int    `json:"c,omitempty"`
+	Source  string `json:"s,omitempty"`
+	Service string `json:"v,omitempty"`
+}
+
+func (c cursor) less(o cursor) bool {
+	if c.Time != o.Time {
+		return c.Time < o.Time
+	}
+	if c.Count != o.Count {
+		return c.Count < o.Count
+	}
+	if c.Source != o.Source {
+		return c.Source < o.Source
+	}
+	return c.Service < o.Service
+}
+
+func (c cursor) encode() string {
+	buf, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, InvalidCursorErr
+	}
+
+	var c cursor
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return cursor{}, InvalidCursorErr
+	}
+
+	return c, nil
+}
+
+// sortable sorts items by their keys, swap is called to keep the items in the same order as the keys
+type sortable struct {
+	keys      []cursor
+	swap      func(i, j int)
+	ascending bool
+}
+
+func (s sortable) Len() int {
+	return len(s.keys)
+}
+
+func (s sortable) Less(i, j int) bool {
+	if s.ascending {
+		return s.keys[i].less(s.keys[j])
+	}
+	return s.keys[j].less(s.keys[i])
+}
+
+func (s sortable) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.swap(i, j)
+}
+
+// paginate sorts the items with the given keys, and returns the bounds of the requested page within them
+func paginate(keys []cursor, swap func(i, j int), p Pagination) (int, int, string, error) {
+	sort.Sort(sortable{keys: keys, swap: swap, ascending: p.Ascending})
+
+	from := 0
+	if p.Cursor != "" {
+		after, err := decodeCursor(p.Cursor)
+		if err != nil {
+			return 0, 0, "", err
+		}
+
+		from = sort.Search(len(keys), func(i int) bool {
+			if p.Ascending {
+				return after.less(keys[i])
+			}
+			return keys[i].less(after)
+		})
+	}
+
+	to, next := len(keys), ""
+	if p.Limit > 0 && from+p.Limit < len(keys) {
+		to = from + p.Limit
+		next = keys[to-1].encode()
+	}
+
+	return from, to, next, nil
+}
@@ -0,0 +1,474 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/gob"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RaftApplyPath receives the changes that followers forward to the leader, it is served by the API listener
+const RaftApplyPath = "/raft/apply"
+
+// raftRetryInterval is the time between attempts to apply a change while there is no leader
+const raftRetryInterval = 100 * time.Millisecond
+
+// maxRaftCommandSize limits the size of forwarded changes
+const maxRaftCommandSize = 1 << 20
+
+var noLeaderErr = errors.New("no leader is available")
+
+type RaftConfig struct {
+	// NodeId identifies this node, it has to be one of the peers
+	NodeId string `split_words:"true"`
+	// Peers are all nodes of the cluster including this one, as id=raft address=API URL. For example
+	// a=10.0.0.1:7000=http://10.0.0.1:8080
+	Peers []string
+	// BindAddress is the address Raft listens on, the Raft address of this node in Peers is used when it is empty
+	BindAddress string `split_words:"true"`
+	// DataDir contains the Raft log and snapshots
+	DataDir string `default:"raft" split_words:"true"`
+	// Secret is shared by all nodes, and authenticates the changes that followers forward to the leader
+	Secret string
+	// ApplyTimeout limits how long a change waits for a leader and for being committed
+	ApplyTimeout time.Duration `default:"10s" split_words:"true"`
+}
+
+type raftPeer struct {
+	address raft.ServerAddress
+	api     string
+}
+
+func parseRaftPeers(peers []string) (map[raft.ServerID]raftPeer, error) {
+	res := make(map[raft.ServerID]raftPeer, len(peers))
+	for _, p := range peers {
+		parts := strings.SplitN(p, "=", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, errors.Errorf("peer %v is not formatted as id=raft address=API URL", p)
+		}
+
+		res[raft.ServerID(parts[0])] = raftPeer{
+			address: raft.ServerAddress(parts[1]),
+			api:     strings.TrimSuffix(parts[2], "/"),
+		}
+	}
+
+	return res, nil
+}
+
+// RaftStorage keeps all data in memory on every node of a Raft cluster. Changes are committed to the Raft log by the
+// leader, followers forward them to it. Reads are served by the local node, and can lag behind the leader slightly
+type RaftStorage struct {
+	memory *MemoryStorage
+	clock  clock.Clock
+	logger *slog.Logger
+	config RaftConfig
+	peers  map[raft.ServerID]raftPeer
+	client *http.Client
+
+	raft      *raft.Raft
+	transport *raft.NetworkTransport
+	store     *raftboltdb.BoltStore
+}
+
+// NewRaftStore starts the Raft node. The cluster is bootstrapped with all peers when the data directory is empty, so
+// all nodes have to use the same peers
+func NewRaftStore(config RaftConfig, clock clock.Clock, logger *slog.Logger) (*RaftStorage, error) {
+	if config.Secret == "" {
+		return nil, errors.New("a secret is required for raft storage")
+	}
+
+	peers, err := parseRaftPeers(config.Peers)
+	if err != nil {
+		return nil, err
+	}
+
+	self, ok := peers[raft.ServerID(config.NodeId)]
+	if !ok {
+		return nil, errors.Errorf("node %v is not one of the peers", config.NodeId)
+	}
+
+	if config.BindAddress == "" {
+		config.BindAddress = string(self.address)
+	}
+
+	advertise, err := net.ResolveTCPAddr("tcp", string(self.address))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve raft address")
+	}
+
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create raft data directory")
+	}
+
+	r := &RaftStorage{
+		memory: NewMemoryStore(clock, logger).(*MemoryStorage),
+		clock:  clock,
+		logger: logger,
+		config: config,
+		peers:  peers,
+		client: &http.Client{Timeout: config.ApplyTimeout},
+	}
+	raftLogger := newRaftLogger(logger)
+
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(config.DataDir, 2, raftLogger)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open raft snapshots")
+	}
+
+	if r.store, err = raftboltdb.NewBoltStore(filepath.Join(config.DataDir, "raft.db")); err != nil {
+		return nil, errors.Wrap(err, "failed to open raft log")
+	}
+
+	r.transport, err = raft.NewTCPTransportWithLogger(config.BindAddress, advertise, 3, 10*time.Second, raftLogger)
+	if err != nil {
+		r.store.Close()
+		return nil, errors.Wrap(err, "failed to listen for raft traffic")
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.NodeId)
+	raftConfig.Logger = raftLogger
+
+	if r.raft, err = raft.NewRaft(raftConfig, &raftFSM{memory: r.memory}, r.store, r.store, snapshots, r.transport); err != nil {
+		r.transport.Close()
+		r.store.Close()
+		return nil, errors.Wrap(err, "failed to start raft")
+	}
+
+	var servers []raft.Server
+	for id, p := range peers {
+		servers = append(servers, raft.Server{ID: id, Address: p.address})
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+
+	if err := r.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil &&
+		!errors.Is(err, raft.ErrCantBootstrap) {
+		r.Close()
+		return nil, errors.Wrap(err, "failed to bootstrap raft cluster")
+	}
+
+	logger.Info("started raft node", "node", config.NodeId, "address", self.address, "peers", len(peers))
+	return r, nil
+}
+
+// apply commits the change to the Raft log, waiting for a leader when there is none
+func (r *RaftStorage) apply(ctx context.Context, c raftCommand) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		return errors.Wrap(err, "failed to encode change")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.config.ApplyTimeout)
+	defer cancel()
+
+	for {
+		err := r.applyOrForward(ctx, buf.Bytes())
+		if !errors.Is(err, noLeaderErr) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(err, "failed to apply change")
+		case <-time.After(raftRetryInterval):
+		}
+	}
+}
+
+// applyOrForward commits the change when this node is the leader, and forwards it to the leader otherwise
+func (r *RaftStorage) applyOrForward(ctx context.Context, data []byte) error {
+	if r.raft.State() == raft.Leader {
+		return r.applyLocal(ctx, data)
+	}
+
+	_, id := r.raft.LeaderWithID()
+	if id == raft.ServerID(r.config.NodeId) {
+		return noLeaderErr
+	}
+
+	leader, ok := r.peers[id]
+	if !ok {
+		return noLeaderErr
+	}
+
+	return r.forward(ctx, leader, data)
+}
+
+func (r *RaftStorage) applyLocal(ctx context.Context, data []byte) error {
+	timeout := r.config.ApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	f := r.raft.Apply(data, timeout)
+	if err := f.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return noLeaderErr
+		}
+		return errors.Wrap(err, "failed to apply change")
+	}
+
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (r *RaftStorage) forward(ctx context.Context, leader raftPeer, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leader.api+RaftApplyPath, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Authorization", "Bearer "+r.config.Secret)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		// The leader might just have failed, so the change is retried once another leader is elected
+		return errors.Wrap(noLeaderErr, err.Error())
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return NotFoundErr
+	case http.StatusServiceUnavailable:
+		return noLeaderErr
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("leader failed to apply change: %v", strings.TrimSpace(string(body)))
+	}
+}
+
+// Handler receives the changes forwarded by followers, which have to use the shared secret
+func (r *RaftStorage) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		secret := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(r.config.Secret)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(req.Body, maxRaftCommandSize))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, err := decodeRaftCommand(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Followers retry with the new leader when leadership changed in the meantime
+		if r.raft.State() != raft.Leader {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), r.config.ApplyTimeout)
+		defer cancel()
+
+		switch err := r.applyLocal(ctx, data); {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, NotFoundErr):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, noLeaderErr):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Ping fails when no leader is known or this node is not a member of the cluster, in both cases changes cannot be
+// committed
+func (r *RaftStorage) Ping(_ context.Context) error {
+	if _, id := r.raft.LeaderWithID(); id == "" {
+		return noLeaderErr
+	}
+
+	f := r.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return errors.Wrap(err, "failed to get cluster configuration")
+	}
+
+	for _, s := range f.Configuration().Servers {
+		if s.ID == raft.ServerID(r.config.NodeId) {
+			return nil
+		}
+	}
+
+	return errors.Errorf("node %v is not a member of the cluster", r.config.NodeId)
+}
+
+func (r *RaftStorage) AddAuthenticationEntry(ctx context.Context, entry AuthenticationEntry) error {
+	return r.apply(ctx, raftCommand{Op: raftAddAuthenticationEntry, AuthEntry: entry})
+}
+
+func (r *RaftStorage) FindAuthenticationEntries(ctx context.Context, ip string) (map[AuthenticationEntry]struct{}, error) {
+	return r.memory.FindAuthenticationEntries(ctx, ip)
+}
+
+func (r *RaftStorage) FindSources(ctx context.Context) (map[string]int, error) {
+	return r.memory.FindSources(ctx)
+}
+
+func (r *RaftStorage) ListAuthenticationEntries(ctx context.Context, query EntryQuery) (EntryPage, error) {
+	return r.memory.ListAuthenticationEntries(ctx, query)
+}
+
+func (r *RaftStorage) ListSources(ctx context.Context, query SourceQuery) (SourcePage, error) {
+	return r.memory.ListSources(ctx, query)
+}
+
+func (r *RaftStorage) AddBlockEntry(ctx context.Context, entry BlockEntry) error {
+	return r.apply(ctx, raftCommand{Op: raftAddBlockEntry, BlockEntry: entry})
+}
+
+func (r *RaftStorage) RemoveBlockEntry(ctx context.Context, ip string) error {
+	return r.apply(ctx, raftCommand{Op: raftRemoveBlockEntry, Key: ip})
+}
+
+func (r *RaftStorage) FindBlockEntry(ctx context.Context, ip string) (BlockEntry, error) {
+	return r.memory.FindBlockEntry(ctx, ip)
+}
+
+func (r *RaftStorage) AllBlockEntries(ctx context.Context, onlyActive bool) ([]BlockEntry, error) {
+	return r.memory.AllBlockEntries(ctx, onlyActive)
+}
+
+func (r *RaftStorage) ListBlockEntries(ctx context.Context, query BlockQuery) (BlockPage, error) {
+	return r.memory.ListBlockEntries(ctx, query)
+}
+
+// CleanBlockEntries includes the current time in the change, so all nodes remove the same entries
+func (r *RaftStorage) CleanBlockEntries(ctx context.Context) error {
+	return r.apply(ctx, raftCommand{Op: raftCleanBlockEntries, Time: r.clock.Now()})
+}
+
+func (r *RaftStorage) AddExternalModule(ctx context.Context, module ExternalModule) error {
+	return r.apply(ctx, raftCommand{Op: raftAddExternalModule, Module: module})
+}
+
+func (r *RaftStorage) RemoveExternalModule(ctx context.Context, id uint32) error {
+	return r.apply(ctx, raftCommand{Op: raftRemoveExternalModule, Id: id})
+}
+
+func (r *RaftStorage) GetExternalModules(ctx context.Context) ([]ExternalModule, error) {
+	return r.memory.GetExternalModules(ctx)
+}
+
+func (r *RaftStorage) GetExternalModuleByAddress(ctx context.Context, address string) (ExternalModule, error) {
+	return r.memory.GetExternalModuleByAddress(ctx, address)
+}
+
+func (r *RaftStorage) AddAllowEntry(ctx context.Context, entry AllowEntry) error {
+	return r.apply(ctx, raftCommand{Op: raftAddAllowEntry, AllowEntry: entry})
+}
+
+func (r *RaftStorage) RemoveAllowEntry(ctx context.Context, source string) error {
+	return r.apply(ctx, raftCommand{Op: raftRemoveAllowEntry, Key: source})
+}
+
+func (r *RaftStorage) GetAllowEntries(ctx context.Context) ([]AllowEntry, error) {
+	return r.memory.GetAllowEntries(ctx)
+}
+
+func (r *RaftStorage) AddApiKey(ctx context.Context, key ApiKey) error {
+	return r.apply(ctx, raftCommand{Op: raftAddApiKey, ApiKey: key})
+}
+
+func (r *RaftStorage) RemoveApiKey(ctx context.Context, name string) error {
+	return r.apply(ctx, raftCommand{Op: raftRemoveApiKey, Key: name})
+}
+
+func (r *RaftStorage) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	return r.memory.GetApiKeys(ctx)
+}
+
+func (r *RaftStorage) FindApiKeyByHash(ctx context.Context, hash string) (ApiKey, error) {
+	return r.memory.FindApiKeyByHash(ctx, hash)
+}
+
+func (r *RaftStorage) AddAuditEntry(ctx context.Context, entry AuditEntry) error {
+	return r.apply(ctx, raftCommand{Op: raftAddAuditEntry, AuditEntry: entry})
+}
+
+func (r *RaftStorage) FindAuditEntries(ctx context.Context, query AuditQuery) ([]AuditEntry, error) {
+	return r.memory.FindAuditEntries(ctx, query)
+}
+
+// Close hands leadership to another node when this node is the leader, and stops the Raft node
+func (r *RaftStorage) Close() error {
+	if r.raft.State() == raft.Leader {
+		if err := r.raft.LeadershipTransfer().Error(); err != nil {
+			r.logger.Warn("failed to transfer raft leadership", "error", err)
+		}
+	}
+
+	err := errors.Wrap(r.raft.Shutdown().Error(), "failed to stop raft")
+	if closeErr := r.transport.Close(); err == nil {
+		err = errors.Wrap(closeErr, "failed to close raft transport")
+	}
+	if closeErr := r.store.Close(); err == nil {
+		err = errors.Wrap(closeErr, "failed to close raft log")
+	}
+
+	return err
+}
+
+// raftLogWriter writes the logs of Raft to the logger of the service
+type raftLogWriter struct {
+	logger *slog.Logger
+}
+
+var raftLogLevels = map[string]slog.Level{
+	"[TRACE]": slog.LevelDebug,
+	"[DEBUG]": slog.LevelDebug,
+	"[INFO]":  slog.LevelInfo,
+	"[WARN]":  slog.LevelWarn,
+	"[ERROR]": slog.LevelError,
+}
+
+func newRaftLogger(logger *slog.Logger) hclog.Logger {
+	return hclog.New(&hclog.LoggerOptions{
+		Level:       hclog.Info,
+		Output:      raftLogWriter{logger: logger},
+		DisableTime: true,
+	})
+}
+
+func (w raftLogWriter) Write(p []byte) (int, error) {
+	msg, level := strings.TrimSpace(string(p)), slog.LevelInfo
+	for prefix, l := range raftLogLevels {
+		if strings.HasPrefix(msg, prefix) {
+			msg, level = strings.TrimSpace(strings.TrimPrefix(msg, prefix)), l
+			break
+		}
+	}
+
+	w.logger.Log(context.Background(), level, msg, "component", "raft")
+	return len(p), nil
+}
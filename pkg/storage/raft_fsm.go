@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"io"
+	"time"
+)
+
+// Changes committed to the Raft log
+const (
+	raftAddAuthenticationEntry = "add_authentication_entry"
+	raftAddBlockEntry          = "add_block_entry"
+	raftRemoveBlockEntry       = "remove_block_entry"
+	raftCleanBlockEntries      = "clean_block_entries"
+	raftAddExternalModule      = "add_external_module"
+	raftRemoveExternalModule   = "remove_external_module"
+	raftAddAllowEntry          = "add_allow_entry"
+	raftRemoveAllowEntry       = "remove_allow_entry"
+	raftAddApiKey              = "add_api_key"
+	raftRemoveApiKey           = "remove_api_key"
+	raftAddAuditEntry          = "add_audit_entry"
+)
+
+// raftCommand is a single change, only the fields used by its operation are set
+type raftCommand struct {
+	Op         string
+	AuthEntry  AuthenticationEntry
+	BlockEntry BlockEntry
+	Module     ExternalModule
+	AllowEntry AllowEntry
+	ApiKey     ApiKey
+	AuditEntry AuditEntry
+	// Key is the source or name of the entry to remove
+	Key  string
+	Id   uint32
+	Time time.Time
+}
+
+func decodeRaftCommand(data []byte) (raftCommand, error) {
+	var c raftCommand
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&c); err != nil {
+		return raftCommand{}, errors.Wrap(err, "failed to decode change")
+	}
+
+	return c, nil
+}
+
+// raftFSM applies committed changes to the memory storage of a node
+type raftFSM struct {
+	memory *MemoryStorage
+}
+
+// Apply returns the error of the change, if any
+func (f *raftFSM) Apply(l *raft.Log) interface{} {
+	c, err := decodeRaftCommand(l.Data)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch c.Op {
+	case raftAddAuthenticationEntry:
+		return f.memory.AddAuthenticationEntry(ctx, c.AuthEntry)
+	case raftAddBlockEntry:
+		return f.memory.AddBlockEntry(ctx, c.BlockEntry)
+	case raftRemoveBlockEntry:
+		return f.memory.RemoveBlockEntry(ctx, c.Key)
+	case raftCleanBlockEntries:
+		f.memory.cleanBlockEntries(c.Time)
+		return nil
+	case raftAddExternalModule:
+		return f.memory.AddExternalModule(ctx, c.Module)
+	case raftRemoveExternalModule:
+		return f.memory.RemoveExternalModule(ctx, c.Id)
+	case raftAddAllowEntry:
+		return f.memory.AddAllowEntry(ctx, c.AllowEntry)
+	case raftRemoveAllowEntry:
+		return f.memory.RemoveAllowEntry(ctx, c.Key)
+	case raftAddApiKey:
+		return f.memory.AddApiKey(ctx, c.ApiKey)
+	case raftRemoveApiKey:
+		return f.memory.RemoveApiKey(ctx, c.Key)
+	case raftAddAuditEntry:
+		return f.memory.AddAuditEntry(ctx, c.AuditEntry)
+	}
+
+	return errors.Errorf("unknown change %v", c.Op)
+}
+
+// Snapshot encodes all data right away, as changes can be applied while the snapshot is persisted
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	var buf bytes.Buffer
+	if err := f.memory.encode(&buf); err != nil {
+		return nil, err
+	}
+
+	return raftSnapshot(buf.Bytes()), nil
+}
+
+func (f *raftFSM) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	return f.memory.decode(r)
+}
+
+type raftSnapshot []byte
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return errors.Wrap(err, "failed to write snapshot")
+	}
+
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
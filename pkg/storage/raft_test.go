@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type raftTestNode struct {
+	config RaftConfig
+	server *httptest.Server
+
+	lock  sync.Mutex
+	store *RaftStorage
+}
+
+func (n *raftTestNode) get() *RaftStorage {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.store
+}
+
+func (n *raftTestNode) set(store *RaftStorage) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.store = store
+}
+
+// start creates the raft store of the node, using the data directory of a previous run if there is one
+func (n *raftTestNode) start(t *testing.T) {
+	t.Helper()
+
+	store, err := NewRaftStore(n.config, clock.Real, logging.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n.set(store)
+}
+
+// kill stops the node without handing over leadership, as if the process crashed
+func (n *raftTestNode) kill() {
+	store := n.get()
+	n.set(nil)
+
+	store.raft.Shutdown().Error()
+	store.transport.Close()
+	store.store.Close()
+}
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// newRaftCluster starts a cluster of the given size on loopback, the API of every node only serves forwarded changes
+func newRaftCluster(t *testing.T, size int) []*raftTestNode {
+	t.Helper()
+
+	nodes := make([]*raftTestNode, size)
+	var peers []string
+	for i := range nodes {
+		n := &raftTestNode{}
+		n.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			store := n.get()
+			if store == nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			store.Handler().ServeHTTP(w, r)
+		}))
+		t.Cleanup(n.server.Close)
+
+		n.config = RaftConfig{
+			NodeId:       fmt.Sprintf("node-%v", i),
+			DataDir:      t.TempDir(),
+			Secret:       "secret",
+			ApplyTimeout: 10 * time.Second,
+		}
+		peers = append(peers, fmt.Sprintf("%v=%v=%v", n.config.NodeId, freeAddress(t), n.server.URL))
+		nodes[i] = n
+	}
+
+	for _, n := range nodes {
+		n.config.Peers = peers
+		n.start(t)
+		t.Cleanup(func() {
+			if store := n.get(); store != nil {
+				store.Close()
+			}
+		})
+	}
+
+	return nodes
+}
+
+func eventually(t *testing.T, condition func() bool, format string, args ...interface{}) {
+	t.Helper()
+
+	deadline := time.Now().Add(15 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForLeader returns the index of the leader, after all running nodes agree on it
+func waitForLeader(t *testing.T, nodes []*raftTestNode) int {
+	t.Helper()
+
+	leader := -1
+	eventually(t, func() bool {
+		leader = -1
+		var leaderId raft.ServerID
+		for i, n := range nodes {
+			store := n.get()
+			if store == nil {
+				continue
+			}
+
+			_, id := store.raft.LeaderWithID()
+			if id == "" || (leaderId != "" && id != leaderId) {
+				return false
+			}
+			leaderId = id
+
+			if store.raft.State() == raft.Leader {
+				leader = i
+			}
+		}
+
+		return leader != -1
+	}, "expected a leader to be elected")
+
+	return leader
+}
+
+func follower(nodes []*raftTestNode, leader int) *RaftStorage {
+	for i, n := range nodes {
+		if i != leader && n.get() != nil {
+			return n.get()
+		}
+	}
+
+	return nil
+}
+
+func hasBlock(n *raftTestNode, ip string) bool {
+	_, err := n.get().FindBlockEntry(context.Background(), ip)
+	return err == nil
+}
+
+func TestRaftWritesAreReplicated(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+	ctx := context.Background()
+
+	// Followers forward their changes to the leader
+	block := BlockEntry{Source: "10.0.0.1", Timestamp: unix_time.Time(time.Now()), Duration: time.Hour}
+	if err := follower(nodes, leader).AddBlockEntry(ctx, block); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	module := ExternalModule{Id: 1, Method: http.MethodPost, Address: "http://localhost:9000/block"}
+	if err := nodes[leader].get().AddExternalModule(ctx, module); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, n := range nodes {
+		eventually(t, func() bool {
+			modules, err := n.get().GetExternalModules(ctx)
+			return hasBlock(n, block.Source) && err == nil && len(modules) == 1 && modules[0] == module
+		}, "expected the changes to be applied on node %v", i)
+	}
+
+	// Writes return once the change is committed, so the leader has it right away
+	if err := follower(nodes, leader).RemoveBlockEntry(ctx, block.Source); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hasBlock(nodes[leader], block.Source) {
+		t.Fatalf("expected the block to be removed on the leader")
+	}
+}
+
+func TestRaftForwardsErrors(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	if err := follower(nodes, leader).RemoveAllowEntry(context.Background(), "10.0.0.1"); err != NotFoundErr {
+		t.Fatalf("expected %v, got %v", NotFoundErr, err)
+	}
+	if err := nodes[leader].get().RemoveApiKey(context.Background(), "unknown"); err != NotFoundErr {
+		t.Fatalf("expected %v, got %v", NotFoundErr, err)
+	}
+}
+
+func TestRaftLeaderFailure(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+	ctx := context.Background()
+
+	first := BlockEntry{Source: "10.0.0.1", Timestamp: unix_time.Time(time.Now()), Duration: time.Hour}
+	if err := nodes[leader].get().AddBlockEntry(ctx, first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	nodes[leader].kill()
+	newLeader := waitForLeader(t, nodes)
+	if newLeader == leader {
+		t.Fatalf("expected another leader to be elected")
+	}
+
+	// The remaining nodes still form a majority, so they accept changes and remain ready
+	second := BlockEntry{Source: "10.0.0.2", Timestamp: unix_time.Time(time.Now()), Duration: time.Hour}
+	if err := follower(nodes, newLeader).AddBlockEntry(ctx, second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, n := range nodes {
+		if i == leader {
+			continue
+		}
+
+		eventually(t, func() bool { return hasBlock(n, first.Source) && hasBlock(n, second.Source) },
+			"expected all blocks to be present on node %v", i)
+		if err := n.get().Ping(ctx); err != nil {
+			t.Fatalf("expected node %v to be ready, got %v", i, err)
+		}
+	}
+
+	// The old leader catches up once it is restarted
+	nodes[leader].start(t)
+	eventually(t, func() bool { return hasBlock(nodes[leader], first.Source) && hasBlock(nodes[leader], second.Source) },
+		"expected the restarted node to catch up")
+}
+
+func TestRaftWithoutQuorum(t *testing.T) {
+	nodes := newRaftCluster(t, 3)
+	waitForLeader(t, nodes)
+
+	nodes[1].kill()
+	nodes[2].kill()
+
+	// A single node cannot elect a leader, so it is not ready and does not accept changes
+	store := nodes[0].get()
+	eventually(t, func() bool { return store.Ping(context.Background()) != nil }, "expected the node to not be ready")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	block := BlockEntry{Source: "10.0.0.1", Timestamp: unix_time.Time(time.Now()), Duration: time.Hour}
+	if err := store.AddBlockEntry(ctx, block); err == nil {
+		t.Fatalf("expected the change to fail without a majority")
+	}
+}
+
+func TestRaftSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	source := &raftFSM{memory: NewMemoryStore(clock.Real, logging.Discard()).(*MemoryStorage)}
+
+	entry := AuthenticationEntry{Source: "10.0.0.1", Service: "ssh", Timestamp: unix_time.Time(time.Unix(100, 0))}
+	if err := source.memory.AddAuthenticationEntry(ctx, entry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := source.memory.AddApiKey(ctx, ApiKey{Name: "agent", Hash: "hash"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	snapshot, err := source.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	snapshots := raft.NewInmemSnapshotStore()
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := snapshot.Persist(sink); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, r, err := snapshots.Open(sink.ID())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	target := &raftFSM{memory: NewMemoryStore(clock.Real, logging.Discard()).(*MemoryStorage)}
+	if err := target.Restore(r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries, err := target.memory.FindAuthenticationEntries(ctx, entry.Source)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected the entry to be restored, got %v (%v)", entries, err)
+	}
+	if _, err := target.memory.FindApiKeyByHash(ctx, "hash"); err != nil {
+		t.Fatalf("expected the API key to be restored, got %v", err)
+	}
+}
+
+func TestRaftPeersValidated(t *testing.T) {
+	config := RaftConfig{NodeId: "a", Secret: "secret", DataDir: t.TempDir(), Peers: []string{"a=127.0.0.1:7000"}}
+	if _, err := NewRaftStore(config, clock.Real, logging.Discard()); err == nil {
+		t.Fatalf("expected an error for a peer without API URL")
+	}
+
+	config.Peers = []string{"b=127.0.0.1:7000=http://127.0.0.1:8080"}
+	if _, err := NewRaftStore(config, clock.Real, logging.Discard()); err == nil {
+		t.Fatalf("expected an error when the node is not one of the peers")
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"github.com/pkg/errors"
 	"github.com/timanema/fail2ban-service/pkg/unix_time"
 	"net"
@@ -23,10 +24,27 @@ type BlockEntry struct {
 	Source    string         `json:"source"`
 	Timestamp unix_time.Time `json:"timestamp"`
 	Duration  time.Duration  `json:"duration"`
+	// Permanent blocks never expire, their duration is zero
+	Permanent bool     `json:"permanent,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	// Service is set for blocks caused by the policy, and is the service of the entry that violated it
+	Service string `json:"service,omitempty"`
 }
 
-func (e BlockEntry) IsActive() bool {
-	return e.Timestamp.Time().Add(e.Duration).After(time.Now())
+// ActiveAt reports whether the block is active at the given time
+func (e BlockEntry) ActiveAt(t time.Time) bool {
+	return e.Permanent || e.Timestamp.Time().Add(e.Duration).After(t)
+}
+
+func (e BlockEntry) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
 }
 
 type ExternalModule struct {
@@ -35,18 +53,143 @@ type ExternalModule struct {
 	Method  string `json:"method"`
 }
 
+// AllowEntry describes an IP or CIDR range that will never be blocked
+type AllowEntry struct {
+	Source      string `json:"source"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e AllowEntry) Valid() bool {
+	if _, _, err := net.ParseCIDR(e.Source); err == nil {
+		return true
+	}
+
+	return net.ParseIP(e.Source) != nil
+}
+
+// Contains checks whether the given IP is covered by this entry
+func (e AllowEntry) Contains(ip string) bool {
+	if _, network, err := net.ParseCIDR(e.Source); err == nil {
+		parsed := net.ParseIP(ip)
+		return parsed != nil && network.Contains(parsed)
+	}
+
+	allowed, parsed := net.ParseIP(e.Source), net.ParseIP(ip)
+	return allowed != nil && parsed != nil && allowed.Equal(parsed)
+}
+
+// Overlaps checks whether blocking the given IP or CIDR range would block any address covered by this entry
+func (e AllowEntry) Overlaps(source string) bool {
+	_, blocked, err := net.ParseCIDR(source)
+	if err != nil {
+		return e.Contains(source)
+	}
+
+	if _, network, err := net.ParseCIDR(e.Source); err == nil {
+		return network.Contains(blocked.IP) || blocked.Contains(network.IP)
+	}
+
+	allowed := net.ParseIP(e.Source)
+	return allowed != nil && blocked.Contains(allowed)
+}
+
+// ApiKey is a named API key with the scopes it grants, only a hash of the key itself is stored
+type ApiKey struct {
+	Name    string         `json:"name"`
+	Hash    string         `json:"-"`
+	Scopes  []string       `json:"scopes"`
+	Created unix_time.Time `json:"created"`
+}
+
+// Actions recorded in the audit log
+const (
+	AuditBlock           = "block"
+	AuditUnblock         = "unblock"
+	AuditPolicyUpdate    = "policy_update"
+	AuditModuleAdd       = "module_add"
+	AuditModuleRemove    = "module_remove"
+	AuditAllowlistAdd    = "allowlist_add"
+	AuditAllowlistRemove = "allowlist_remove"
+	AuditApiKeyAdd       = "api_key_add"
+	AuditApiKeyRemove    = "api_key_remove"
+	AuditImport          = "import"
+)
+
+// AuditEntry records an administrative action or block decision, and who or what triggered it
+type AuditEntry struct {
+	Id        uint64         `json:"id"`
+	Timestamp unix_time.Time `json:"timestamp"`
+	Action    string         `json:"action"`
+	// Trigger is policy, manual or expiry for blocks and unblocks, and manual for all other actions
+	Trigger string `json:"trigger"`
+	// Actor is the name of the API key or client certificate for manual actions
+	Actor   string `json:"actor,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Details string `json:"details,omitempty"`
+	// Entries contains the authentication entries that caused a block by policy
+	Entries []AuthenticationEntry `json:"entries,omitempty"`
+}
+
+// AuditQuery filters audit entries, zero values match everything
+type AuditQuery struct {
+	From   time.Time
+	To     time.Time
+	Source string
+	Action string
+}
+
+func (q AuditQuery) Matches(e AuditEntry) bool {
+	t := e.Timestamp.Time()
+	return (q.From.IsZero() || !t.Before(q.From)) &&
+		(q.To.IsZero() || !t.After(q.To)) &&
+		(q.Source == "" || q.Source == e.Source) &&
+		(q.Action == "" || q.Action == e.Action)
+}
+
+// Pinger can be implemented by storage backends that are able to check whether they are reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks whether the given storage is reachable, using a cheap read if it does not implement Pinger
+func Ping(ctx context.Context, s Storage) error {
+	if p, ok := s.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+
+	_, err := s.GetExternalModules(ctx)
+	return err
+}
+
 type Storage interface {
-	AddAuthenticationEntry(entry AuthenticationEntry) error
-	FindAuthenticationEntries(ip string) (map[AuthenticationEntry]struct{}, error)
-	FindSources() (map[string]int, error)
-	AddBlockEntry(entry BlockEntry) error
-	RemoveBlockEntry(ip string) error
-	FindBlockEntry(ip string) (BlockEntry, error)
-	AllBlockEntries(onlyActive bool) ([]BlockEntry, error)
-	CleanBlockEntries() error
-	AddExternalModule(module ExternalModule) error
-	RemoveExternalModule(id uint32) error
-	GetExternalModules() ([]ExternalModule, error)
-	GetExternalModuleByAddress(address string) (ExternalModule, error)
+	AddAuthenticationEntry(ctx context.Context, entry AuthenticationEntry) error
+	FindAuthenticationEntries(ctx context.Context, ip string) (map[AuthenticationEntry]struct{}, error)
+	FindSources(ctx context.Context) (map[string]int, error)
+	// ListAuthenticationEntries returns a page of the matching entries, ordered by timestamp
+	ListAuthenticationEntries(ctx context.Context, query EntryQuery) (EntryPage, error)
+	// ListSources returns a page of the sources with matching entries, ordered by their amount of matching entries
+	ListSources(ctx context.Context, query SourceQuery) (SourcePage, error)
+	AddBlockEntry(ctx context.Context, entry BlockEntry) error
+	RemoveBlockEntry(ctx context.Context, ip string) error
+	FindBlockEntry(ctx context.Context, ip string) (BlockEntry, error)
+	AllBlockEntries(ctx context.Context, onlyActive bool) ([]BlockEntry, error)
+	// ListBlockEntries returns a page of the matching block entries, ordered by the time the block started
+	ListBlockEntries(ctx context.Context, query BlockQuery) (BlockPage, error)
+	CleanBlockEntries(ctx context.Context) error
+	AddExternalModule(ctx context.Context, module ExternalModule) error
+	RemoveExternalModule(ctx context.Context, id uint32) error
+	GetExternalModules(ctx context.Context) ([]ExternalModule, error)
+	GetExternalModuleByAddress(ctx context.Context, address string) (ExternalModule, error)
+	AddAllowEntry(ctx context.Context, entry AllowEntry) error
+	RemoveAllowEntry(ctx context.Context, source string) error
+	GetAllowEntries(ctx context.Context) ([]AllowEntry, error)
+	AddApiKey(ctx context.Context, key ApiKey) error
+	RemoveApiKey(ctx context.Context, name string) error
+	GetApiKeys(ctx context.Context) ([]ApiKey, error)
+	FindApiKeyByHash(ctx context.Context, hash string) (ApiKey, error)
+	// AddAuditEntry appends an entry to the audit log, the id of the entry is assigned by the storage
+	AddAuditEntry(ctx context.Context, entry AuditEntry) error
+	// FindAuditEntries returns all matching audit entries, ordered from old to new
+	FindAuditEntries(ctx context.Context, query AuditQuery) ([]AuditEntry, error)
 	Close() error
 }
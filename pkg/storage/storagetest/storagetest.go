@@ -0,0 +1,797 @@
+// Package storagetest contains a conformance suite for storage backends. Every backend should pass Run, and durable
+// backends RunPersistence as well, so backends can be used interchangeably.
+//
+// The suite follows the behaviour of the memory storage. Errors are returned as is, so callers can compare them to
+// storage.NotFoundErr and storage.InvalidCursorErr directly. Removing a block or module that does not exist succeeds,
+// while removing an allowlist entry or API key that does not exist returns storage.NotFoundErr
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory creates a new empty storage, it is closed by the suite once the test is done
+type Factory func(t *testing.T) storage.Storage
+
+// Opener opens the same storage every time it is called, the previously opened storage is closed first
+type Opener func(t *testing.T) storage.Storage
+
+// Run runs every test against a new storage of the factory, as subtests
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s storage.Storage)
+	}{
+		{"AuthenticationEntries", testAuthenticationEntries},
+		{"ListAuthenticationEntries", testListAuthenticationEntries},
+		{"ListSources", testListSources},
+		{"BlockEntries", testBlockEntries},
+		{"ListBlockEntries", testListBlockEntries},
+		{"CleanBlockEntries", testCleanBlockEntries},
+		{"ExternalModules", testExternalModules},
+		{"AllowEntries", testAllowEntries},
+		{"ApiKeys", testApiKeys},
+		{"AuditEntries", testAuditEntries},
+		{"NotFound", testNotFound},
+		{"InvalidCursor", testInvalidCursor},
+		{"Concurrency", testConcurrency},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s := newStorage(t)
+			t.Cleanup(func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("failed to close storage: %v", err)
+				}
+			})
+
+			test.run(t, s)
+		})
+	}
+}
+
+// RunPersistence checks that all data is kept when the storage is closed and opened again, and that the storage can
+// still be changed after that. The reopened storage has catchUpTimeout to serve the data again
+func RunPersistence(t *testing.T, open Opener) {
+	ctx := context.Background()
+
+	s := open(t)
+	populate(t, s)
+	want := dump(t, s)
+	must(t, s.Close())
+
+	s = open(t)
+	defer func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("failed to close storage: %v", err)
+		}
+	}()
+
+	// Reads may lag behind after opening, such as while a raft node replays its log
+	deadline := time.Now().Add(catchUpTimeout)
+	for got := dump(t, s); !reflect.DeepEqual(got, want); got = dump(t, s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the data to be kept\nexpected: %+v\ngot:      %+v", want, got)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// New audit entries are appended after the existing ones
+	must(t, s.AddAuditEntry(ctx, storage.AuditEntry{Timestamp: unix_time.Time(now()), Action: storage.AuditBlock}))
+	audit, err := s.FindAuditEntries(ctx, storage.AuditQuery{})
+	must(t, err)
+	checkAuditIds(t, audit)
+}
+
+// catchUpTimeout limits how long a reopened storage may take to serve the data it contained
+const catchUpTimeout = 10 * time.Second
+
+// base is a fixed time in the past, so results do not depend on the time the tests run at
+var base = time.Unix(1600000000, 0)
+
+func at(offset time.Duration) unix_time.Time {
+	return unix_time.Time(base.Add(offset))
+}
+
+// now is the current time at second precision, which every backend is able to store
+func now() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func network(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+
+	_, n, err := net.ParseCIDR(cidr)
+	must(t, err)
+	return n
+}
+
+func entryKey(e storage.AuthenticationEntry) string {
+	return fmt.Sprintf("%v/%v/%v", e.Source, e.Service, e.Timestamp.Time().UnixNano())
+}
+
+func entryKeys(entries []storage.AuthenticationEntry) []string {
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, entryKey(e))
+	}
+
+	return keys
+}
+
+func blockKey(e storage.BlockEntry) string {
+	return fmt.Sprintf("%v/%v/%v/%v/%v/%v/%v", e.Source, e.Timestamp.Time().UnixNano(), e.Duration, e.Permanent,
+		e.Reason, strings.Join(e.Tags, ","), e.Service)
+}
+
+func blockSources(entries []storage.BlockEntry) []string {
+	sources := make([]string, 0, len(entries))
+	for _, e := range entries {
+		sources = append(sources, e.Source)
+	}
+
+	return sources
+}
+
+func apiKeyKey(k storage.ApiKey) string {
+	return fmt.Sprintf("%v/%v/%v/%v", k.Name, k.Hash, strings.Join(k.Scopes, ","), k.Created.Time().UnixNano())
+}
+
+func auditKey(e storage.AuditEntry) string {
+	return fmt.Sprintf("%v/%v/%v/%v/%v/%v/%v", e.Timestamp.Time().UnixNano(), e.Action, e.Trigger, e.Actor, e.Source,
+		e.Details, entryKeys(e.Entries))
+}
+
+func equal(t *testing.T, what string, got, want interface{}) {
+	t.Helper()
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected %v\nexpected: %v\ngot:      %v", what, want, got)
+	}
+}
+
+// checkAuditIds checks that the ids of the audit entries increase in the order the entries were added
+func checkAuditIds(t *testing.T, entries []storage.AuditEntry) {
+	t.Helper()
+
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Id <= entries[i-1].Id {
+			t.Fatalf("expected increasing audit ids, got %v after %v", entries[i].Id, entries[i-1].Id)
+		}
+	}
+}
+
+func testAuthenticationEntries(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	first := storage.AuthenticationEntry{Source: "10.0.0.1", Service: "ssh", Timestamp: at(0)}
+	second := storage.AuthenticationEntry{Source: "10.0.0.1", Service: "smtp", Timestamp: at(time.Second)}
+	other := storage.AuthenticationEntry{Source: "10.0.0.2", Service: "ssh", Timestamp: at(0)}
+
+	// Adding the same entry twice stores it once
+	for _, e := range []storage.AuthenticationEntry{first, second, first, other} {
+		must(t, s.AddAuthenticationEntry(ctx, e))
+	}
+
+	entries, err := s.FindAuthenticationEntries(ctx, first.Source)
+	must(t, err)
+	var found []storage.AuthenticationEntry
+	for e := range entries {
+		found = append(found, e)
+	}
+	keys := entryKeys(found)
+	sort.Strings(keys)
+	want := entryKeys([]storage.AuthenticationEntry{second, first})
+	sort.Strings(want)
+	equal(t, "entries", keys, want)
+
+	// The result is a copy
+	for e := range entries {
+		delete(entries, e)
+	}
+	if entries, err := s.FindAuthenticationEntries(ctx, first.Source); err != nil || len(entries) != 2 {
+		t.Fatalf("expected changing the result to not change the storage, got %v (%v)", entries, err)
+	}
+
+	sources, err := s.FindSources(ctx)
+	must(t, err)
+	equal(t, "sources", sources, map[string]int{"10.0.0.1": 2, "10.0.0.2": 1})
+}
+
+func testListAuthenticationEntries(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	entries := []storage.AuthenticationEntry{
+		{Source: "10.0.0.1", Service: "ssh", Timestamp: at(0)},
+		{Source: "10.0.0.2", Service: "smtp", Timestamp: at(1 * time.Second)},
+		{Source: "10.0.0.1", Service: "smtp", Timestamp: at(2 * time.Second)},
+		{Source: "10.1.0.1", Service: "ssh", Timestamp: at(3 * time.Second)},
+		{Source: "10.0.0.3", Service: "ssh", Timestamp: at(4 * time.Second)},
+	}
+	for _, e := range entries {
+		must(t, s.AddAuthenticationEntry(ctx, e))
+	}
+
+	list := func(query storage.EntryQuery) []string {
+		t.Helper()
+
+		page, err := s.ListAuthenticationEntries(ctx, query)
+		must(t, err)
+		if page.NextCursor != "" {
+			t.Fatalf("expected a single page, got cursor %v", page.NextCursor)
+		}
+		return entryKeys(page.Entries)
+	}
+	pick := func(indices ...int) []string {
+		var res []storage.AuthenticationEntry
+		for _, i := range indices {
+			res = append(res, entries[i])
+		}
+		return entryKeys(res)
+	}
+
+	equal(t, "entries from new to old", list(storage.EntryQuery{}), pick(4, 3, 2, 1, 0))
+	equal(t, "entries from old to new", list(storage.EntryQuery{Pagination: storage.Pagination{Ascending: true}}),
+		pick(0, 1, 2, 3, 4))
+	equal(t, "entries of source", list(storage.EntryQuery{Source: "10.0.0.1"}), pick(2, 0))
+	equal(t, "entries of service", list(storage.EntryQuery{Service: "smtp"}), pick(2, 1))
+	equal(t, "entries in network", list(storage.EntryQuery{Network: network(t, "10.0.0.0/24")}), pick(4, 2, 1, 0))
+	equal(t, "entries in time range", list(storage.EntryQuery{From: at(time.Second).Time(), To: at(3 * time.Second).Time()}),
+		pick(3, 2, 1))
+
+	// Following the cursors returns every entry once, in the same order
+	var paged []string
+	query := storage.EntryQuery{Pagination: storage.Pagination{Limit: 2}}
+	for {
+		page, err := s.ListAuthenticationEntries(ctx, query)
+		must(t, err)
+		if len(page.Entries) > 2 {
+			t.Fatalf("expected at most 2 entries, got %v", len(page.Entries))
+		}
+
+		paged = append(paged, entryKeys(page.Entries)...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	equal(t, "paged entries", paged, pick(4, 3, 2, 1, 0))
+}
+
+func testListSources(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	entries := []storage.AuthenticationEntry{
+		{Source: "10.0.0.1", Service: "ssh", Timestamp: at(0)},
+		{Source: "10.0.0.1", Service: "ssh", Timestamp: at(time.Second)},
+		{Source: "10.0.0.1", Service: "smtp", Timestamp: at(2 * time.Second)},
+		{Source: "10.0.0.2", Service: "ssh", Timestamp: at(3 * time.Second)},
+		{Source: "10.0.0.3", Service: "smtp", Timestamp: at(4 * time.Second)},
+		{Source: "10.0.0.3", Service: "smtp", Timestamp: at(5 * time.Second)},
+	}
+	for _, e := range entries {
+		must(t, s.AddAuthenticationEntry(ctx, e))
+	}
+
+	list := func(query storage.SourceQuery) []storage.SourceCount {
+		t.Helper()
+
+		page, err := s.ListSources(ctx, query)
+		must(t, err)
+		return page.Sources
+	}
+
+	equal(t, "sources", list(storage.SourceQuery{}), []storage.SourceCount{
+		{Source: "10.0.0.1", Attempts: 3}, {Source: "10.0.0.3", Attempts: 2}, {Source: "10.0.0.2", Attempts: 1},
+	})
+	equal(t, "ascending sources", list(storage.SourceQuery{Pagination: storage.Pagination{Ascending: true}}),
+		[]storage.SourceCount{
+			{Source: "10.0.0.2", Attempts: 1}, {Source: "10.0.0.3", Attempts: 2}, {Source: "10.0.0.1", Attempts: 3},
+		})
+
+	// Only matching entries are counted
+	equal(t, "sources of service", list(storage.SourceQuery{Service: "ssh"}), []storage.SourceCount{
+		{Source: "10.0.0.1", Attempts: 2}, {Source: "10.0.0.2", Attempts: 1},
+	})
+	equal(t, "sources in time range", list(storage.SourceQuery{From: at(2 * time.Second).Time()}),
+		[]storage.SourceCount{
+			{Source: "10.0.0.3", Attempts: 2}, {Source: "10.0.0.2", Attempts: 1}, {Source: "10.0.0.1", Attempts: 1},
+		})
+
+	page, err := s.ListSources(ctx, storage.SourceQuery{Pagination: storage.Pagination{Limit: 1}})
+	must(t, err)
+	if len(page.Sources) != 1 || page.NextCursor == "" {
+		t.Fatalf("expected a single source and a cursor, got %v", page)
+	}
+	page, err = s.ListSources(ctx, storage.SourceQuery{Pagination: storage.Pagination{Limit: 5, Cursor: page.NextCursor}})
+	must(t, err)
+	equal(t, "second page of sources", page.Sources, []storage.SourceCount{
+		{Source: "10.0.0.3", Attempts: 2}, {Source: "10.0.0.2", Attempts: 1},
+	})
+}
+
+func testBlockEntries(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	active := storage.BlockEntry{
+		Source:    "10.0.0.1",
+		Timestamp: unix_time.Time(now()),
+		Duration:  time.Hour,
+		Reason:    "too many attempts",
+		Tags:      []string{"abuse", "ssh"},
+		Service:   "ssh",
+	}
+	expired := storage.BlockEntry{Source: "10.0.0.2", Timestamp: at(0), Duration: time.Minute}
+	permanent := storage.BlockEntry{Source: "10.0.0.0/24", Timestamp: at(0), Permanent: true}
+
+	for _, e := range []storage.BlockEntry{active, expired, permanent} {
+		must(t, s.AddBlockEntry(ctx, e))
+	}
+
+	found, err := s.FindBlockEntry(ctx, active.Source)
+	must(t, err)
+	equal(t, "block", blockKey(found), blockKey(active))
+
+	// Adding a block of the same source replaces it
+	active.Reason = "manual"
+	must(t, s.AddBlockEntry(ctx, active))
+	found, err = s.FindBlockEntry(ctx, active.Source)
+	must(t, err)
+	equal(t, "replaced block", blockKey(found), blockKey(active))
+
+	all, err := s.AllBlockEntries(ctx, false)
+	must(t, err)
+	sort.Slice(all, func(i, j int) bool { return all[i].Source < all[j].Source })
+	equal(t, "blocks", blockSources(all), []string{"10.0.0.0/24", "10.0.0.1", "10.0.0.2"})
+
+	all, err = s.AllBlockEntries(ctx, true)
+	must(t, err)
+	sort.Slice(all, func(i, j int) bool { return all[i].Source < all[j].Source })
+	equal(t, "active blocks", blockSources(all), []string{"10.0.0.0/24", "10.0.0.1"})
+
+	// Removing a block that does not exist succeeds
+	must(t, s.RemoveBlockEntry(ctx, active.Source))
+	must(t, s.RemoveBlockEntry(ctx, active.Source))
+	if _, err := s.FindBlockEntry(ctx, active.Source); err != storage.NotFoundErr {
+		t.Fatalf("expected %v for a removed block, got %v", storage.NotFoundErr, err)
+	}
+}
+
+func testListBlockEntries(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	current := now()
+	blocks := []storage.BlockEntry{
+		{Source: "10.0.0.1", Timestamp: unix_time.Time(current.Add(-3 * time.Minute)), Duration: time.Hour, Service: "ssh"},
+		{Source: "10.0.0.2", Timestamp: unix_time.Time(current.Add(-2 * time.Minute)), Duration: time.Hour, Tags: []string{"abuse"}},
+		{Source: "10.1.0.1", Timestamp: unix_time.Time(current.Add(-time.Minute)), Permanent: true, Tags: []string{"abuse", "list"}},
+		{Source: "10.0.0.3", Timestamp: unix_time.Time(current.Add(-2 * time.Hour)), Duration: time.Hour, Service: "ssh"},
+	}
+	for _, e := range blocks {
+		must(t, s.AddBlockEntry(ctx, e))
+	}
+
+	list := func(query storage.BlockQuery) []string {
+		t.Helper()
+
+		page, err := s.ListBlockEntries(ctx, query)
+		must(t, err)
+		return blockSources(page.Entries)
+	}
+
+	equal(t, "blocks from new to old", list(storage.BlockQuery{}), []string{"10.1.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3"})
+	equal(t, "blocks from old to new", list(storage.BlockQuery{Pagination: storage.Pagination{Ascending: true}}),
+		[]string{"10.0.0.3", "10.0.0.1", "10.0.0.2", "10.1.0.1"})
+	equal(t, "blocks in network", list(storage.BlockQuery{Network: network(t, "10.0.0.0/24")}),
+		[]string{"10.0.0.2", "10.0.0.1", "10.0.0.3"})
+	equal(t, "blocks of service", list(storage.BlockQuery{Service: "ssh"}), []string{"10.0.0.1", "10.0.0.3"})
+	equal(t, "blocks with tag", list(storage.BlockQuery{Tag: "abuse"}), []string{"10.1.0.1", "10.0.0.2"})
+	equal(t, "active blocks", list(storage.BlockQuery{State: storage.BlockStateActive}),
+		[]string{"10.1.0.1", "10.0.0.2", "10.0.0.1"})
+	equal(t, "expired blocks", list(storage.BlockQuery{State: storage.BlockStateExpired}), []string{"10.0.0.3"})
+	equal(t, "blocks in time range", list(storage.BlockQuery{From: current.Add(-3 * time.Minute), To: current.Add(-2 * time.Minute)}),
+		[]string{"10.0.0.2", "10.0.0.1"})
+
+	var paged []string
+	query := storage.BlockQuery{Pagination: storage.Pagination{Limit: 3}}
+	for {
+		page, err := s.ListBlockEntries(ctx, query)
+		must(t, err)
+		if len(page.Entries) > 3 {
+			t.Fatalf("expected at most 3 blocks, got %v", len(page.Entries))
+		}
+
+		paged = append(paged, blockSources(page.Entries)...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	equal(t, "paged blocks", paged, []string{"10.1.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3"})
+}
+
+func testCleanBlockEntries(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	blocks := []storage.BlockEntry{
+		{Source: "10.0.0.1", Timestamp: unix_time.Time(now()), Duration: time.Hour},
+		{Source: "10.0.0.2", Timestamp: at(0), Duration: time.Hour},
+		{Source: "10.0.0.3", Timestamp: at(0), Permanent: true},
+	}
+	for _, e := range blocks {
+		must(t, s.AddBlockEntry(ctx, e))
+	}
+
+	must(t, s.CleanBlockEntries(ctx))
+
+	all, err := s.AllBlockEntries(ctx, false)
+	must(t, err)
+	sort.Slice(all, func(i, j int) bool { return all[i].Source < all[j].Source })
+	equal(t, "blocks after cleaning", blockSources(all), []string{"10.0.0.1", "10.0.0.3"})
+}
+
+func testExternalModules(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	first := storage.ExternalModule{Id: 1, Address: "http://localhost:9000/block", Method: "POST"}
+	second := storage.ExternalModule{Id: 2, Address: "http://localhost:9001/block", Method: "PUT"}
+
+	must(t, s.AddExternalModule(ctx, first))
+	must(t, s.AddExternalModule(ctx, second))
+
+	modules, err := s.GetExternalModules(ctx)
+	must(t, err)
+	sort.Slice(modules, func(i, j int) bool { return modules[i].Id < modules[j].Id })
+	equal(t, "modules", modules, []storage.ExternalModule{first, second})
+
+	found, err := s.GetExternalModuleByAddress(ctx, second.Address)
+	must(t, err)
+	equal(t, "module", found, second)
+
+	// Adding a module with the same id replaces it
+	first.Method = "PATCH"
+	must(t, s.AddExternalModule(ctx, first))
+	found, err = s.GetExternalModuleByAddress(ctx, first.Address)
+	must(t, err)
+	equal(t, "replaced module", found, first)
+
+	// Removing a module that does not exist succeeds
+	must(t, s.RemoveExternalModule(ctx, first.Id))
+	must(t, s.RemoveExternalModule(ctx, first.Id))
+
+	modules, err = s.GetExternalModules(ctx)
+	must(t, err)
+	equal(t, "modules after removal", modules, []storage.ExternalModule{second})
+}
+
+func testAllowEntries(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	ip := storage.AllowEntry{Source: "10.0.0.1", Description: "monitoring"}
+	network := storage.AllowEntry{Source: "10.1.0.0/16"}
+
+	must(t, s.AddAllowEntry(ctx, ip))
+	must(t, s.AddAllowEntry(ctx, network))
+
+	// Adding an entry with the same source replaces it
+	ip.Description = "office"
+	must(t, s.AddAllowEntry(ctx, ip))
+
+	entries, err := s.GetAllowEntries(ctx)
+	must(t, err)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Source < entries[j].Source })
+	equal(t, "allowlist", entries, []storage.AllowEntry{ip, network})
+
+	must(t, s.RemoveAllowEntry(ctx, network.Source))
+	if err := s.RemoveAllowEntry(ctx, network.Source); err != storage.NotFoundErr {
+		t.Fatalf("expected %v when removing twice, got %v", storage.NotFoundErr, err)
+	}
+
+	entries, err = s.GetAllowEntries(ctx)
+	must(t, err)
+	equal(t, "allowlist after removal", entries, []storage.AllowEntry{ip})
+}
+
+func testApiKeys(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	reader := storage.ApiKey{Name: "reader", Hash: "hash-1", Scopes: []string{"read"}, Created: at(0)}
+	agent := storage.ApiKey{Name: "agent", Hash: "hash-2", Scopes: []string{"read", "report-entries"}, Created: at(time.Second)}
+
+	must(t, s.AddApiKey(ctx, reader))
+	must(t, s.AddApiKey(ctx, agent))
+
+	// Adding a key with the same name replaces it
+	reader.Scopes = []string{"read", "block"}
+	must(t, s.AddApiKey(ctx, reader))
+
+	keys, err := s.GetApiKeys(ctx)
+	must(t, err)
+	var found []string
+	for _, k := range keys {
+		found = append(found, apiKeyKey(k))
+	}
+	sort.Strings(found)
+	equal(t, "API keys", found, []string{apiKeyKey(agent), apiKeyKey(reader)})
+
+	key, err := s.FindApiKeyByHash(ctx, reader.Hash)
+	must(t, err)
+	equal(t, "API key", apiKeyKey(key), apiKeyKey(reader))
+
+	must(t, s.RemoveApiKey(ctx, reader.Name))
+	if err := s.RemoveApiKey(ctx, reader.Name); err != storage.NotFoundErr {
+		t.Fatalf("expected %v when removing twice, got %v", storage.NotFoundErr, err)
+	}
+	if _, err := s.FindApiKeyByHash(ctx, reader.Hash); err != storage.NotFoundErr {
+		t.Fatalf("expected %v for a removed key, got %v", storage.NotFoundErr, err)
+	}
+}
+
+func testAuditEntries(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	entries := []storage.AuditEntry{
+		{Timestamp: at(0), Action: storage.AuditBlock, Trigger: "policy", Source: "10.0.0.1", Details: "blocked",
+			Entries: []storage.AuthenticationEntry{{Source: "10.0.0.1", Service: "ssh", Timestamp: at(0)}}},
+		{Timestamp: at(time.Second), Action: storage.AuditModuleAdd, Trigger: "manual", Actor: "admin"},
+		// The id is assigned by the storage
+		{Id: 100, Timestamp: at(2 * time.Second), Action: storage.AuditUnblock, Trigger: "expiry", Source: "10.0.0.1"},
+		{Timestamp: at(3 * time.Second), Action: storage.AuditBlock, Trigger: "manual", Actor: "admin", Source: "10.0.0.2"},
+	}
+	for _, e := range entries {
+		must(t, s.AddAuditEntry(ctx, e))
+	}
+
+	find := func(query storage.AuditQuery) []string {
+		t.Helper()
+
+		found, err := s.FindAuditEntries(ctx, query)
+		must(t, err)
+		checkAuditIds(t, found)
+
+		var keys []string
+		for _, e := range found {
+			keys = append(keys, auditKey(e))
+		}
+		return keys
+	}
+	pick := func(indices ...int) []string {
+		var keys []string
+		for _, i := range indices {
+			keys = append(keys, auditKey(entries[i]))
+		}
+		return keys
+	}
+
+	equal(t, "audit log", find(storage.AuditQuery{}), pick(0, 1, 2, 3))
+	equal(t, "audit entries of source", find(storage.AuditQuery{Source: "10.0.0.1"}), pick(0, 2))
+	equal(t, "audit entries of action", find(storage.AuditQuery{Action: storage.AuditBlock}), pick(0, 3))
+	equal(t, "audit entries in time range", find(storage.AuditQuery{From: at(time.Second).Time(), To: at(2 * time.Second).Time()}),
+		pick(1, 2))
+
+	all, err := s.FindAuditEntries(ctx, storage.AuditQuery{})
+	must(t, err)
+	if all[2].Id == 100 || all[3].Id <= all[2].Id {
+		t.Fatalf("expected the storage to assign audit ids, got %v", all)
+	}
+}
+
+func testNotFound(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	if _, err := s.FindAuthenticationEntries(ctx, "10.0.0.1"); err != storage.NotFoundErr {
+		t.Errorf("FindAuthenticationEntries: expected %v, got %v", storage.NotFoundErr, err)
+	}
+	if _, err := s.FindBlockEntry(ctx, "10.0.0.1"); err != storage.NotFoundErr {
+		t.Errorf("FindBlockEntry: expected %v, got %v", storage.NotFoundErr, err)
+	}
+	if _, err := s.GetExternalModuleByAddress(ctx, "http://localhost:9000"); err != storage.NotFoundErr {
+		t.Errorf("GetExternalModuleByAddress: expected %v, got %v", storage.NotFoundErr, err)
+	}
+	if err := s.RemoveAllowEntry(ctx, "10.0.0.1"); err != storage.NotFoundErr {
+		t.Errorf("RemoveAllowEntry: expected %v, got %v", storage.NotFoundErr, err)
+	}
+	if err := s.RemoveApiKey(ctx, "unknown"); err != storage.NotFoundErr {
+		t.Errorf("RemoveApiKey: expected %v, got %v", storage.NotFoundErr, err)
+	}
+	if _, err := s.FindApiKeyByHash(ctx, "unknown"); err != storage.NotFoundErr {
+		t.Errorf("FindApiKeyByHash: expected %v, got %v", storage.NotFoundErr, err)
+	}
+
+	// Removing blocks and modules that do not exist succeeds, and lists of an empty storage are empty
+	if err := s.RemoveBlockEntry(ctx, "10.0.0.1"); err != nil {
+		t.Errorf("RemoveBlockEntry: unexpected error: %v", err)
+	}
+	if err := s.RemoveExternalModule(ctx, 1); err != nil {
+		t.Errorf("RemoveExternalModule: unexpected error: %v", err)
+	}
+	if sources, err := s.FindSources(ctx); err != nil || len(sources) != 0 {
+		t.Errorf("FindSources: expected no sources, got %v (%v)", sources, err)
+	}
+	if blocks, err := s.AllBlockEntries(ctx, false); err != nil || len(blocks) != 0 {
+		t.Errorf("AllBlockEntries: expected no blocks, got %v (%v)", blocks, err)
+	}
+	if audit, err := s.FindAuditEntries(ctx, storage.AuditQuery{}); err != nil || len(audit) != 0 {
+		t.Errorf("FindAuditEntries: expected no entries, got %v (%v)", audit, err)
+	}
+}
+
+func testInvalidCursor(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	p := storage.Pagination{Cursor: "not a cursor!"}
+
+	if _, err := s.ListBlockEntries(ctx, storage.BlockQuery{Pagination: p}); err != storage.InvalidCursorErr {
+		t.Errorf("ListBlockEntries: expected %v, got %v", storage.InvalidCursorErr, err)
+	}
+	if _, err := s.ListAuthenticationEntries(ctx, storage.EntryQuery{Pagination: p}); err != storage.InvalidCursorErr {
+		t.Errorf("ListAuthenticationEntries: expected %v, got %v", storage.InvalidCursorErr, err)
+	}
+	if _, err := s.ListSources(ctx, storage.SourceQuery{Pagination: p}); err != storage.InvalidCursorErr {
+		t.Errorf("ListSources: expected %v, got %v", storage.InvalidCursorErr, err)
+	}
+}
+
+// testConcurrency changes and reads the storage from several goroutines at once, run it with -race to find data races
+func testConcurrency(t *testing.T, s storage.Storage) {
+	const workers, changes = 8, 10
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		w := w
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < changes; i++ {
+				source := fmt.Sprintf("10.%v.0.%v", w, i)
+				entry := storage.AuthenticationEntry{Source: source, Service: "ssh", Timestamp: unix_time.Time(now())}
+				block := storage.BlockEntry{Source: source, Timestamp: unix_time.Time(now()), Duration: time.Hour}
+
+				errs := []error{
+					s.AddAuthenticationEntry(ctx, entry),
+					s.AddBlockEntry(ctx, block),
+					s.AddAllowEntry(ctx, storage.AllowEntry{Source: source}),
+					s.AddAuditEntry(ctx, storage.AuditEntry{Timestamp: unix_time.Time(now()), Action: storage.AuditBlock, Source: source}),
+				}
+				if i%2 == 0 {
+					errs = append(errs, s.RemoveBlockEntry(ctx, source))
+				}
+
+				_, err := s.FindSources(ctx)
+				errs = append(errs, err)
+				_, err = s.ListBlockEntries(ctx, storage.BlockQuery{State: storage.BlockStateActive})
+				errs = append(errs, err)
+				_, err = s.GetAllowEntries(ctx)
+				errs = append(errs, err)
+				_, err = s.FindAuditEntries(ctx, storage.AuditQuery{Source: source})
+				errs = append(errs, err)
+
+				for _, err := range errs {
+					if err != nil {
+						t.Errorf("unexpected error: %v", err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	sources, err := s.FindSources(ctx)
+	must(t, err)
+	blocks, err := s.AllBlockEntries(ctx, false)
+	must(t, err)
+	allowlist, err := s.GetAllowEntries(ctx)
+	must(t, err)
+	audit, err := s.FindAuditEntries(ctx, storage.AuditQuery{})
+	must(t, err)
+
+	if len(sources) != workers*changes || len(blocks) != workers*changes/2 || len(allowlist) != workers*changes {
+		t.Fatalf("expected every change to be kept, got %v sources, %v blocks and %v allowlist entries",
+			len(sources), len(blocks), len(allowlist))
+	}
+	if len(audit) != workers*changes {
+		t.Fatalf("expected %v audit entries, got %v", workers*changes, len(audit))
+	}
+	checkAuditIds(t, audit)
+}
+
+// populate adds data of every kind, including data that is removed again
+func populate(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	current := now()
+
+	must(t, s.AddAuthenticationEntry(ctx, storage.AuthenticationEntry{Source: "10.0.0.1", Service: "ssh", Timestamp: at(0)}))
+	must(t, s.AddAuthenticationEntry(ctx, storage.AuthenticationEntry{Source: "10.0.0.2", Service: "smtp", Timestamp: at(time.Second)}))
+
+	must(t, s.AddBlockEntry(ctx, storage.BlockEntry{Source: "10.0.0.1", Timestamp: unix_time.Time(current), Duration: time.Hour,
+		Reason: "too many attempts", Tags: []string{"abuse"}, Service: "ssh"}))
+	must(t, s.AddBlockEntry(ctx, storage.BlockEntry{Source: "10.1.0.0/16", Timestamp: at(0), Permanent: true}))
+	must(t, s.AddBlockEntry(ctx, storage.BlockEntry{Source: "10.0.0.3", Timestamp: unix_time.Time(current), Duration: time.Hour}))
+	must(t, s.RemoveBlockEntry(ctx, "10.0.0.3"))
+
+	must(t, s.AddExternalModule(ctx, storage.ExternalModule{Id: 1, Address: "http://localhost:9000/block", Method: "POST"}))
+	must(t, s.AddExternalModule(ctx, storage.ExternalModule{Id: 2, Address: "http://localhost:9001/block", Method: "POST"}))
+	must(t, s.RemoveExternalModule(ctx, 2))
+
+	must(t, s.AddAllowEntry(ctx, storage.AllowEntry{Source: "192.168.0.0/16", Description: "office"}))
+	must(t, s.AddAllowEntry(ctx, storage.AllowEntry{Source: "192.168.1.1"}))
+	must(t, s.RemoveAllowEntry(ctx, "192.168.1.1"))
+
+	must(t, s.AddApiKey(ctx, storage.ApiKey{Name: "agent", Hash: "hash-1", Scopes: []string{"report-entries"}, Created: at(0)}))
+	must(t, s.AddApiKey(ctx, storage.ApiKey{Name: "old", Hash: "hash-2", Scopes: []string{"read"}, Created: at(0)}))
+	must(t, s.RemoveApiKey(ctx, "old"))
+
+	must(t, s.AddAuditEntry(ctx, storage.AuditEntry{Timestamp: at(0), Action: storage.AuditBlock, Trigger: "policy",
+		Source: "10.0.0.1", Entries: []storage.AuthenticationEntry{{Source: "10.0.0.1", Service: "ssh", Timestamp: at(0)}}}))
+	must(t, s.AddAuditEntry(ctx, storage.AuditEntry{Timestamp: at(time.Second), Action: storage.AuditApiKeyAdd,
+		Trigger: "manual", Actor: "admin"}))
+}
+
+// state is all data of a storage in a form that can be compared
+type state struct {
+	Entries   []string
+	Blocks    []string
+	Modules   []storage.ExternalModule
+	Allowlist []storage.AllowEntry
+	ApiKeys   []string
+	Audit     []string
+}
+
+func dump(t *testing.T, s storage.Storage) state {
+	t.Helper()
+	ctx := context.Background()
+
+	var d state
+	sources, err := s.FindSources(ctx)
+	must(t, err)
+	for source := range sources {
+		entries, err := s.FindAuthenticationEntries(ctx, source)
+		must(t, err)
+		for e := range entries {
+			d.Entries = append(d.Entries, entryKey(e))
+		}
+	}
+	sort.Strings(d.Entries)
+
+	blocks, err := s.AllBlockEntries(ctx, false)
+	must(t, err)
+	for _, e := range blocks {
+		d.Blocks = append(d.Blocks, blockKey(e))
+	}
+	sort.Strings(d.Blocks)
+
+	d.Modules, err = s.GetExternalModules(ctx)
+	must(t, err)
+	sort.Slice(d.Modules, func(i, j int) bool { return d.Modules[i].Id < d.Modules[j].Id })
+
+	d.Allowlist, err = s.GetAllowEntries(ctx)
+	must(t, err)
+	sort.Slice(d.Allowlist, func(i, j int) bool { return d.Allowlist[i].Source < d.Allowlist[j].Source })
+
+	keys, err := s.GetApiKeys(ctx)
+	must(t, err)
+	for _, k := range keys {
+		d.ApiKeys = append(d.ApiKeys, apiKeyKey(k))
+	}
+	sort.Strings(d.ApiKeys)
+
+	audit, err := s.FindAuditEntries(ctx, storage.AuditQuery{})
+	must(t, err)
+	for _, e := range audit {
+		d.Audit = append(d.Audit, fmt.Sprintf("%v/%v", e.Id, auditKey(e)))
+	}
+
+	return d
+}
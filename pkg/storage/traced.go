@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"context"
+	"github.com/timanema/fail2ban-service/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/timanema/fail2ban-service/pkg/storage")
+
+// TracedStorage creates a span for every operation of the wrapped storage
+type TracedStorage struct {
+	store Storage
+}
+
+func NewTracedStore(store Storage) Storage {
+	return &TracedStorage{store: store}
+}
+
+// end ends the span, entries that are not found are an expected outcome and not recorded as errors
+func end(span trace.Span, err error) {
+	if err == NotFoundErr {
+		err = nil
+	}
+
+	tracing.End(span, err)
+}
+
+func withSource(source string) trace.SpanStartOption {
+	return trace.WithAttributes(attribute.String("source", source))
+}
+
+func (t *TracedStorage) AddAuthenticationEntry(ctx context.Context, entry AuthenticationEntry) error {
+	ctx, span := tracer.Start(ctx, "storage.add_authentication_entry", withSource(entry.Source))
+	err := t.store.AddAuthenticationEntry(ctx, entry)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) FindAuthenticationEntries(ctx context.Context, ip string) (map[AuthenticationEntry]struct{}, error) {
+	ctx, span := tracer.Start(ctx, "storage.find_authentication_entries", withSource(ip))
+	res, err := t.store.FindAuthenticationEntries(ctx, ip)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) FindSources(ctx context.Context) (map[string]int, error) {
+	ctx, span := tracer.Start(ctx, "storage.find_sources")
+	res, err := t.store.FindSources(ctx)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) ListAuthenticationEntries(ctx context.Context, query EntryQuery) (EntryPage, error) {
+	ctx, span := tracer.Start(ctx, "storage.list_authentication_entries")
+	res, err := t.store.ListAuthenticationEntries(ctx, query)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) ListSources(ctx context.Context, query SourceQuery) (SourcePage, error) {
+	ctx, span := tracer.Start(ctx, "storage.list_sources")
+	res, err := t.store.ListSources(ctx, query)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) AddBlockEntry(ctx context.Context, entry BlockEntry) error {
+	ctx, span := tracer.Start(ctx, "storage.add_block_entry", withSource(entry.Source))
+	err := t.store.AddBlockEntry(ctx, entry)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) RemoveBlockEntry(ctx context.Context, ip string) error {
+	ctx, span := tracer.Start(ctx, "storage.remove_block_entry", withSource(ip))
+	err := t.store.RemoveBlockEntry(ctx, ip)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) FindBlockEntry(ctx context.Context, ip string) (BlockEntry, error) {
+	ctx, span := tracer.Start(ctx, "storage.find_block_entry", withSource(ip))
+	res, err := t.store.FindBlockEntry(ctx, ip)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) AllBlockEntries(ctx context.Context, onlyActive bool) ([]BlockEntry, error) {
+	ctx, span := tracer.Start(ctx, "storage.all_block_entries")
+	res, err := t.store.AllBlockEntries(ctx, onlyActive)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) ListBlockEntries(ctx context.Context, query BlockQuery) (BlockPage, error) {
+	ctx, span := tracer.Start(ctx, "storage.list_block_entries")
+	res, err := t.store.ListBlockEntries(ctx, query)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) CleanBlockEntries(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "storage.clean_block_entries")
+	err := t.store.CleanBlockEntries(ctx)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) AddExternalModule(ctx context.Context, module ExternalModule) error {
+	ctx, span := tracer.Start(ctx, "storage.add_external_module")
+	err := t.store.AddExternalModule(ctx, module)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) RemoveExternalModule(ctx context.Context, id uint32) error {
+	ctx, span := tracer.Start(ctx, "storage.remove_external_module")
+	err := t.store.RemoveExternalModule(ctx, id)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) GetExternalModules(ctx context.Context) ([]ExternalModule, error) {
+	ctx, span := tracer.Start(ctx, "storage.get_external_modules")
+	res, err := t.store.GetExternalModules(ctx)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) GetExternalModuleByAddress(ctx context.Context, address string) (ExternalModule, error) {
+	ctx, span := tracer.Start(ctx, "storage.get_external_module_by_address")
+	res, err := t.store.GetExternalModuleByAddress(ctx, address)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) AddAllowEntry(ctx context.Context, entry AllowEntry) error {
+	ctx, span := tracer.Start(ctx, "storage.add_allow_entry", withSource(entry.Source))
+	err := t.store.AddAllowEntry(ctx, entry)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) RemoveAllowEntry(ctx context.Context, source string) error {
+	ctx, span := tracer.Start(ctx, "storage.remove_allow_entry", withSource(source))
+	err := t.store.RemoveAllowEntry(ctx, source)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) GetAllowEntries(ctx context.Context) ([]AllowEntry, error) {
+	ctx, span := tracer.Start(ctx, "storage.get_allow_entries")
+	res, err := t.store.GetAllowEntries(ctx)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) AddApiKey(ctx context.Context, key ApiKey) error {
+	ctx, span := tracer.Start(ctx, "storage.add_api_key")
+	err := t.store.AddApiKey(ctx, key)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) RemoveApiKey(ctx context.Context, name string) error {
+	ctx, span := tracer.Start(ctx, "storage.remove_api_key")
+	err := t.store.RemoveApiKey(ctx, name)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	ctx, span := tracer.Start(ctx, "storage.get_api_keys")
+	res, err := t.store.GetApiKeys(ctx)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) FindApiKeyByHash(ctx context.Context, hash string) (ApiKey, error) {
+	ctx, span := tracer.Start(ctx, "storage.find_api_key_by_hash")
+	res, err := t.store.FindApiKeyByHash(ctx, hash)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) AddAuditEntry(ctx context.Context, entry AuditEntry) error {
+	ctx, span := tracer.Start(ctx, "storage.add_audit_entry")
+	err := t.store.AddAuditEntry(ctx, entry)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) FindAuditEntries(ctx context.Context, query AuditQuery) ([]AuditEntry, error) {
+	ctx, span := tracer.Start(ctx, "storage.find_audit_entries")
+	res, err := t.store.FindAuditEntries(ctx, query)
+	end(span, err)
+	return res, err
+}
+
+func (t *TracedStorage) Ping(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "storage.ping")
+	err := Ping(ctx, t.store)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) Close() error {
+	return t.store.Close()
+}
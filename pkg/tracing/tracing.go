@@ -0,0 +1,85 @@
+// Package tracing configures OpenTelemetry tracing, spans are exported using OTLP or written to stdout
+package tracing
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters
+const (
+	ExporterNone   = "none"
+	ExporterOtlp   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+// ServiceName is reported as the name of the service in all spans
+const ServiceName = "fail2ban-service"
+
+// Setup installs the global tracer provider and propagator. The returned function flushes remaining spans and stops
+// the exporter. For OTLP the endpoint is a URL such as http://localhost:4318, when empty the standard
+// OTEL_EXPORTER_OTLP_* environment variables are used
+func Setup(ctx context.Context, exporter, endpoint string) (func(context.Context) error, error) {
+	// The propagator is always installed, so trace context is passed on even if spans are not exported
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	switch exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOtlp:
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+
+		e, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create OTLP exporter")
+		}
+		spanExporter = e
+	case ExporterStdout:
+		e, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create stdout exporter")
+		}
+		spanExporter = e
+	default:
+		return nil, errors.Errorf("invalid tracing exporter %v", exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(ServiceName)))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create tracing resource")
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Enabled reports whether spans are exported by the given exporter
+func Enabled(exporter string) bool {
+	return exporter != "" && exporter != ExporterNone
+}
+
+// End ends the span, and marks it as failed if err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
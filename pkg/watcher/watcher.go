@@ -0,0 +1,233 @@
+// Package watcher tails log files and reports failed authentication attempts found in them
+package watcher
+
+import (
+	"bufio"
+	"context"
+	"github.com/pkg/errors"
+	"github.com/timanema/fail2ban-service/pkg/clock"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"github.com/timanema/fail2ban-service/pkg/unix_time"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"time"
+)
+
+// SourceGroup is the name of the capture group in patterns that contains the IP of the failed attempt
+const SourceGroup = "source"
+
+const pollInterval = time.Second
+
+// ReportFunc is called for every line matching the pattern of a watcher
+type ReportFunc func(ctx context.Context, entry storage.AuthenticationEntry) error
+
+// Watcher follows a single log file, including when it is truncated or rotated
+type Watcher struct {
+	path    string
+	service string
+	pattern *regexp.Regexp
+	report  ReportFunc
+	clock   clock.Clock
+	logger  *slog.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// CompilePattern compiles a watcher pattern, which must contain a capture group named source
+func CompilePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid pattern")
+	}
+
+	if re.SubexpIndex(SourceGroup) < 0 {
+		return nil, errors.Errorf("pattern %v has no capture group named %v", pattern, SourceGroup)
+	}
+
+	return re, nil
+}
+
+// New creates a watcher of the file at path, the clock sets the timestamps of the reported attempts
+func New(path, service string, pattern *regexp.Regexp, report ReportFunc, clock clock.Clock, logger *slog.Logger) *Watcher {
+	return &Watcher{
+		path:    path,
+		service: service,
+		pattern: pattern,
+		report:  report,
+		clock:   clock,
+		logger:  logger.With("path", path, "service", service),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start follows the file in the background, lines written before the watcher started are ignored
+func (w *Watcher) Start() {
+	w.logger.Info("watching log file for failed attempts")
+	go w.run()
+}
+
+// Stop stops following the file and waits until the watcher has stopped
+func (w *Watcher) Stop() {
+	close(w.stop)
+	<-w.done
+	w.logger.Info("stopped watching log file")
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+
+	var f *tailedFile
+	fromStart := false
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if f == nil {
+			var err error
+			if f, err = openTailed(w.path, fromStart, w.logger); err != nil {
+				if !os.IsNotExist(errors.Cause(err)) {
+					w.logger.Warn("unable to open log file", "error", err)
+				}
+			}
+
+			// Files created or rotated after the watcher started are read from the start
+			fromStart = true
+		}
+
+		if f != nil {
+			for _, line := range f.readLines() {
+				w.handleLine(line)
+			}
+
+			if f.replaced() {
+				f.close()
+				f = nil
+				continue
+			}
+		}
+
+		select {
+		case <-w.stop:
+			if f != nil {
+				f.close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ParseLine returns the source of a line matching the pattern, and whether the line matched
+func ParseLine(pattern *regexp.Regexp, line string) (string, bool) {
+	match := pattern.FindStringSubmatch(line)
+	if match == nil {
+		return "", false
+	}
+
+	return match[pattern.SubexpIndex(SourceGroup)], true
+}
+
+func (w *Watcher) handleLine(line string) {
+	source, ok := ParseLine(w.pattern, line)
+	if !ok {
+		return
+	}
+
+	entry := storage.AuthenticationEntry{
+		Source:    source,
+		Service:   w.service,
+		Timestamp: unix_time.Time(w.clock.Now()),
+	}
+	if !entry.Valid() {
+		w.logger.Debug("ignoring line with invalid source", "source", entry.Source)
+		return
+	}
+
+	if err := w.report(context.Background(), entry); err != nil {
+		w.logger.Error("unable to report entry", "source", entry.Source, "error", err)
+	}
+}
+
+// tailedFile reads complete lines appended to a file, and detects when the file is truncated or replaced
+type tailedFile struct {
+	path    string
+	logger  *slog.Logger
+	f       *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	offset  int64
+	partial string
+}
+
+func openTailed(path string, fromStart bool, logger *slog.Logger) (*tailedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to stat file")
+	}
+
+	t := &tailedFile{path: path, logger: logger, f: f, info: info, reader: bufio.NewReader(f)}
+	if !fromStart {
+		if t.offset, err = f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "failed to seek to end of file")
+		}
+	}
+
+	return t, nil
+}
+
+func (t *tailedFile) readLines() []string {
+	if info, err := t.f.Stat(); err == nil && info.Size() < t.offset {
+		t.logger.Info("log file was truncated, reading from the start")
+		if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+			t.logger.Error("unable to seek to start of log file", "error", err)
+			return nil
+		}
+
+		t.offset, t.partial = 0, ""
+		t.reader.Reset(t.f)
+	}
+
+	var lines []string
+	for {
+		chunk, err := t.reader.ReadString('\n')
+		t.offset += int64(len(chunk))
+		t.partial += chunk
+
+		if err != nil {
+			if err != io.EOF {
+				t.logger.Error("unable to read log file", "error", err)
+			}
+			return lines
+		}
+
+		lines = append(lines, t.partial[:len(t.partial)-1])
+		t.partial = ""
+	}
+}
+
+// replaced reports whether the path now refers to a different file, which happens when the log is rotated
+func (t *tailedFile) replaced() bool {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+
+	return !os.SameFile(info, t.info)
+}
+
+func (t *tailedFile) close() {
+	if err := t.f.Close(); err != nil {
+		t.logger.Warn("unable to close log file", "error", err)
+	}
+}
@@ -0,0 +1,171 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/timanema/fail2ban-service/pkg/clock/fakeclock"
+	"github.com/timanema/fail2ban-service/pkg/logging"
+	"github.com/timanema/fail2ban-service/pkg/storage"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPattern = `Failed password for .* from (?P<source>\S+)`
+
+// now is the time of the clock of test watchers, which sets the timestamps of reported entries
+var now = time.Unix(1600000000, 0)
+
+func newTestWatcher(t *testing.T, path string) (*Watcher, chan storage.AuthenticationEntry) {
+	t.Helper()
+
+	pattern, err := CompilePattern(testPattern)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reported := make(chan storage.AuthenticationEntry, 100)
+	w := New(path, "ssh", pattern, func(ctx context.Context, entry storage.AuthenticationEntry) error {
+		reported <- entry
+		return nil
+	}, fakeclock.New(now), logging.Discard())
+	w.Start()
+	t.Cleanup(w.Stop)
+
+	return w, reported
+}
+
+func appendLine(t *testing.T, path, line string) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(line); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func failedLine(source string) string {
+	return fmt.Sprintf("sshd[42]: Failed password for root from %v port 22 ssh2\n", source)
+}
+
+// waitForSource appends the line until an entry is reported, as lines written before the watcher opened the file are
+// ignored. The first reported entry must be of the given source
+func waitForSource(t *testing.T, path string, reported chan storage.AuthenticationEntry, source string) {
+	t.Helper()
+
+	deadline := time.After(10 * time.Second)
+	for {
+		appendLine(t, path, failedLine(source))
+
+		select {
+		case entry := <-reported:
+			if entry.Source != source || entry.Service != "ssh" || !entry.Timestamp.Time().Equal(now) {
+				t.Fatalf("expected an entry of %v for ssh at %v, got %+v", source, now, entry)
+			}
+			return
+		case <-time.After(3 * pollInterval / 2):
+		case <-deadline:
+			t.Fatalf("expected an entry of %v to be reported", source)
+		}
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	pattern, err := CompilePattern(testPattern)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if source, ok := ParseLine(pattern, failedLine("10.0.0.1")); !ok || source != "10.0.0.1" {
+		t.Fatalf("expected the source of a matching line, got %v (%v)", source, ok)
+	}
+	if _, ok := ParseLine(pattern, "sshd[42]: Accepted password for root from 10.0.0.1"); ok {
+		t.Fatalf("expected other lines to not match")
+	}
+
+	if _, err := CompilePattern(`from (\S+)`); err == nil {
+		t.Fatalf("expected patterns without a source group to be rejected")
+	}
+}
+
+func TestTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendLine(t, path, failedLine("10.0.0.9"))
+
+	_, reported := newTestWatcher(t, path)
+
+	// Lines written before the watcher started are ignored
+	waitForSource(t, path, reported, "10.0.0.1")
+
+	// Partial lines are only reported once they are complete, other lines and invalid sources are ignored
+	appendLine(t, path, "sshd[42]: Accepted password for root from 10.0.0.8 port 22 ssh2\n")
+	appendLine(t, path, failedLine("invalid"))
+	line := failedLine("10.0.0.2")
+	appendLine(t, path, line[:20])
+	time.Sleep(3 * pollInterval / 2)
+	appendLine(t, path, line[20:])
+
+	select {
+	case entry := <-reported:
+		for entry.Source == "10.0.0.1" {
+			entry = <-reported
+		}
+		if entry.Source != "10.0.0.2" {
+			t.Fatalf("expected the completed line to be reported, got %+v", entry)
+		}
+	case <-time.After(5 * pollInterval):
+		t.Fatalf("expected the completed line to be reported")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendLine(t, path, "")
+
+	_, reported := newTestWatcher(t, path)
+	waitForSource(t, path, reported, "10.0.0.1")
+
+	// Files replacing the rotated file are read from the start
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	appendLine(t, path, failedLine("10.0.0.2"))
+
+	deadline := time.After(5 * pollInterval)
+	for {
+		select {
+		case entry := <-reported:
+			if entry.Source == "10.0.0.1" {
+				continue
+			}
+			if entry.Source != "10.0.0.2" {
+				t.Fatalf("expected the entry of the new file, got %+v", entry)
+			}
+		case <-deadline:
+			t.Fatalf("expected the entry of the new file to be reported")
+		}
+		break
+	}
+
+	// Truncated files are read from the start as well, once the truncation was noticed
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(3 * pollInterval / 2)
+	appendLine(t, path, failedLine("10.0.0.3"))
+
+	select {
+	case entry := <-reported:
+		if entry.Source != "10.0.0.3" {
+			t.Fatalf("expected the entry of the truncated file, got %+v", entry)
+		}
+	case <-time.After(5 * pollInterval):
+		t.Fatalf("expected the entry of the truncated file to be reported")
+	}
+}